@@ -0,0 +1,339 @@
+// Copyright © 2019 Ispirata Srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package astartetest
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/astarte-platform/astartectl/client"
+	"github.com/astarte-platform/astartectl/common"
+	"github.com/iancoleman/orderedmap"
+)
+
+func (r *Realm) serveAppEngine(w http.ResponseWriter, req *http.Request, tokens []string) {
+	if len(tokens) == 1 && tokens[0] == "devices" && req.Method == http.MethodGet {
+		deviceIDs := []string{}
+		for deviceID := range r.devices {
+			deviceIDs = append(deviceIDs, deviceID)
+		}
+		sort.Strings(deviceIDs)
+		writeData(w, http.StatusOK, deviceIDs)
+		return
+	}
+	if len(tokens) == 2 && tokens[0] == "stats" && tokens[1] == "devices" && req.Method == http.MethodGet {
+		if r.server.DisableDevicesStats {
+			writeError(w, http.StatusNotFound, "Not found")
+			return
+		}
+		stats := client.DevicesStats{TotalDevices: int64(len(r.devices))}
+		for _, device := range r.devices {
+			if device.details.Connected {
+				stats.ConnectedDevices++
+			}
+		}
+		writeData(w, http.StatusOK, stats)
+		return
+	}
+	if len(tokens) < 2 {
+		writeError(w, http.StatusNotFound, "Not found")
+		return
+	}
+
+	var device *Device
+	switch tokens[0] {
+	case "devices":
+		device = r.devices[tokens[1]]
+	case "devices-by-alias":
+		device = r.deviceByAlias(tokens[1])
+	default:
+		writeError(w, http.StatusNotFound, "Not found")
+		return
+	}
+	if device == nil {
+		writeError(w, http.StatusNotFound, "Device not found")
+		return
+	}
+
+	tokens = tokens[2:]
+	switch {
+	case len(tokens) == 0 && req.Method == http.MethodGet:
+		writeData(w, http.StatusOK, device.details)
+
+	case len(tokens) == 0 && req.Method == http.MethodPatch:
+		var patch struct {
+			Aliases map[string]*string `json:"aliases"`
+		}
+		if err := readData(req, &patch); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		for tag, alias := range patch.Aliases {
+			if alias == nil {
+				delete(device.details.Aliases, tag)
+				continue
+			}
+			if owner := r.deviceByAlias(*alias); owner != nil && owner != device {
+				writeError(w, http.StatusConflict, "Alias already in use")
+				return
+			}
+			device.details.Aliases[tag] = *alias
+		}
+		writeData(w, http.StatusOK, device.details)
+
+	case len(tokens) == 1 && tokens[0] == "interfaces" && req.Method == http.MethodGet:
+		interfaceNames := []string{}
+		for interfaceName := range device.details.Introspection {
+			interfaceNames = append(interfaceNames, interfaceName)
+		}
+		sort.Strings(interfaceNames)
+		writeData(w, http.StatusOK, interfaceNames)
+
+	case len(tokens) > 1 && tokens[0] == "interfaces" && req.Method == http.MethodGet:
+		r.serveInterfaceData(w, req, device, tokens[1], tokens[2:])
+
+	default:
+		writeError(w, http.StatusNotFound, "Not found")
+	}
+}
+
+func (r *Realm) deviceByAlias(alias string) *Device {
+	for _, device := range r.devices {
+		for _, deviceAlias := range device.details.Aliases {
+			if deviceAlias == alias {
+				return device
+			}
+		}
+	}
+	return nil
+}
+
+func (r *Realm) serveInterfaceData(w http.ResponseWriter, req *http.Request, device *Device, interfaceName string,
+	pathTokens []string) {
+	introspection, ok := device.details.Introspection[interfaceName]
+	if !ok {
+		writeError(w, http.StatusNotFound, "Interface not found in device introspection")
+		return
+	}
+	astarteInterface, ok := r.interfaces[interfaceName][introspection.Major]
+	if !ok || len(astarteInterface.Mappings) == 0 {
+		writeError(w, http.StatusNotFound, "Interface not found")
+		return
+	}
+
+	interfacePath := ""
+	if len(pathTokens) > 0 {
+		interfacePath = "/" + strings.Join(pathTokens, "/")
+	}
+	endpointTokens := len(strings.Split(strings.Trim(astarteInterface.Mappings[0].Endpoint, "/"), "/"))
+
+	switch {
+	case astarteInterface.Type == common.PropertiesType:
+		properties := device.properties[interfaceName]
+		if value, ok := properties[interfacePath]; ok {
+			writeData(w, http.StatusOK, value)
+			return
+		}
+		snapshot := orderedmap.New()
+		for _, p := range sortedKeys(properties, interfacePath) {
+			setNested(snapshot, strings.TrimPrefix(p, interfacePath), properties[p])
+		}
+		writeData(w, http.StatusOK, snapshot)
+
+	case astarteInterface.Aggregation == common.ObjectAggregation:
+		aggregates := device.aggregates[interfaceName]
+		if len(pathTokens) == endpointTokens-1 {
+			samples := aggregates[interfacePath]
+			timestamps := make([]time.Time, len(samples))
+			for i, sample := range samples {
+				timestamps[i] = sample.Timestamp
+			}
+			indexes, err := selectSamples(timestamps, req.URL.Query())
+			if err != nil {
+				writeError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			values := []*orderedmap.OrderedMap{}
+			for _, i := range indexes {
+				values = append(values, aggregateValue(samples[i].Values, samples[i].Timestamp))
+			}
+			writeData(w, http.StatusOK, values)
+			return
+		}
+		snapshot := orderedmap.New()
+		for _, p := range sortedKeys(aggregates, interfacePath) {
+			last := aggregates[p][len(aggregates[p])-1]
+			setNested(snapshot, strings.TrimPrefix(p, interfacePath), aggregateValue(last.Values, last.Timestamp))
+		}
+		writeData(w, http.StatusOK, snapshot)
+
+	default:
+		datastreams := device.datastreams[interfaceName]
+		if len(pathTokens) == endpointTokens {
+			samples := datastreams[interfacePath]
+			timestamps := make([]time.Time, len(samples))
+			for i, sample := range samples {
+				timestamps[i] = sample.Timestamp
+			}
+			indexes, err := selectSamples(timestamps, req.URL.Query())
+			if err != nil {
+				writeError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			values := []interface{}{}
+			for _, i := range indexes {
+				values = append(values, samples[i])
+			}
+			writeData(w, http.StatusOK, values)
+			return
+		}
+		snapshot := orderedmap.New()
+		for _, p := range sortedKeys(datastreams, interfacePath) {
+			setNested(snapshot, strings.TrimPrefix(p, interfacePath), datastreams[p][len(datastreams[p])-1])
+		}
+		writeData(w, http.StatusOK, snapshot)
+	}
+}
+
+// selectSamples applies the query parameters of a datastream query to samples with the given ascending timestamps,
+// returning the indexes of the selected samples in the order they should be returned
+func selectSamples(timestamps []time.Time, query url.Values) ([]int, error) {
+	parseTime := func(name string) (time.Time, bool, error) {
+		value := query.Get(name)
+		if value == "" {
+			return time.Time{}, false, nil
+		}
+		t, err := time.Parse(time.RFC3339Nano, value)
+		if err != nil {
+			return time.Time{}, false, fmt.Errorf("Invalid %s: %s", name, err)
+		}
+		return t, true, nil
+	}
+	parseInt := func(name string) (int, bool, error) {
+		value := query.Get(name)
+		if value == "" {
+			return 0, false, nil
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return 0, false, fmt.Errorf("Invalid %s: %s", name, value)
+		}
+		return n, true, nil
+	}
+
+	since, hasSince, err := parseTime("since")
+	if err != nil {
+		return nil, err
+	}
+	sinceAfter, hasSinceAfter, err := parseTime("since_after")
+	if err != nil {
+		return nil, err
+	}
+	to, hasTo, err := parseTime("to")
+	if err != nil {
+		return nil, err
+	}
+	limit, hasLimit, err := parseInt("limit")
+	if err != nil {
+		return nil, err
+	}
+	pageSize, hasPageSize, err := parseInt("page_size")
+	if err != nil {
+		return nil, err
+	}
+
+	indexes := []int{}
+	for i, t := range timestamps {
+		if (hasSince && t.Before(since)) || (hasSinceAfter && !t.After(sinceAfter)) || (hasTo && !t.Before(to)) {
+			continue
+		}
+		indexes = append(indexes, i)
+	}
+
+	switch {
+	case hasLimit:
+		// The newest samples are returned, starting from the most recent one
+		if len(indexes) > limit {
+			indexes = indexes[len(indexes)-limit:]
+		}
+		for i, j := 0, len(indexes)-1; i < j; i, j = i+1, j-1 {
+			indexes[i], indexes[j] = indexes[j], indexes[i]
+		}
+	case hasPageSize && len(indexes) > pageSize:
+		indexes = indexes[:pageSize]
+	}
+
+	return indexes, nil
+}
+
+// sortedKeys returns the sorted paths of values which are under prefix
+func sortedKeys(values interface{}, prefix string) []string {
+	keys := []string{}
+	add := func(p string) {
+		if strings.HasPrefix(p, prefix+"/") {
+			keys = append(keys, p)
+		}
+	}
+	switch v := values.(type) {
+	case map[string]interface{}:
+		for p := range v {
+			add(p)
+		}
+	case map[string][]client.DatastreamValue:
+		for p, samples := range v {
+			if len(samples) > 0 {
+				add(p)
+			}
+		}
+	case map[string][]client.DatastreamAggregateValue:
+		for p, samples := range v {
+			if len(samples) > 0 {
+				add(p)
+			}
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// setNested sets value in m at the nested position identified by relativePath, e.g. "/a/b"
+func setNested(m *orderedmap.OrderedMap, relativePath string, value interface{}) {
+	pathTokens := strings.Split(strings.Trim(relativePath, "/"), "/")
+	for _, token := range pathTokens[:len(pathTokens)-1] {
+		child, ok := m.Get(token)
+		childMap, isMap := child.(*orderedmap.OrderedMap)
+		if !ok || !isMap {
+			childMap = orderedmap.New()
+			m.Set(token, childMap)
+		}
+		m = childMap
+	}
+	m.Set(pathTokens[len(pathTokens)-1], value)
+}
+
+func aggregateValue(values orderedmap.OrderedMap, timestamp time.Time) *orderedmap.OrderedMap {
+	value := orderedmap.New()
+	for _, key := range values.Keys() {
+		v, _ := values.Get(key)
+		value.Set(key, v)
+	}
+	value.Set("timestamp", timestamp)
+	return value
+}
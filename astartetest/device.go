@@ -0,0 +1,150 @@
+// Copyright © 2019 Ispirata Srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package astartetest
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/astarte-platform/astartectl/client"
+	"github.com/iancoleman/orderedmap"
+)
+
+// Device is a device of a Realm. Its methods can be used to seed and inspect its state.
+type Device struct {
+	realm             *Realm
+	details           client.DeviceDetails
+	credentialsSecret string
+	properties        map[string]map[string]interface{}
+	datastreams       map[string]map[string][]client.DatastreamValue
+	aggregates        map[string]map[string][]client.DatastreamAggregateValue
+}
+
+func newDevice(r *Realm, deviceID string) *Device {
+	return &Device{
+		realm: r,
+		details: client.DeviceDetails{
+			DeviceID:          deviceID,
+			FirstRegistration: time.Now().UTC(),
+			Introspection:     map[string]client.DeviceInterfaceIntrospection{},
+			Aliases:           map[string]string{},
+		},
+		properties:  map[string]map[string]interface{}{},
+		datastreams: map[string]map[string][]client.DatastreamValue{},
+		aggregates:  map[string]map[string][]client.DatastreamAggregateValue{},
+	}
+}
+
+// Details returns a copy of the DeviceDetails of the Device, as returned by AppEngine
+func (d *Device) Details() client.DeviceDetails {
+	d.realm.server.mu.Lock()
+	defer d.realm.server.mu.Unlock()
+	details := d.details
+	details.Introspection = map[string]client.DeviceInterfaceIntrospection{}
+	for name, introspection := range d.details.Introspection {
+		details.Introspection[name] = introspection
+	}
+	details.Aliases = map[string]string{}
+	for tag, alias := range d.details.Aliases {
+		details.Aliases[tag] = alias
+	}
+	return details
+}
+
+// CredentialsSecret returns the credentials secret of the Device, or an empty string if it has not been
+// registered through Pairing or it has been unregistered
+func (d *Device) CredentialsSecret() string {
+	d.realm.server.mu.Lock()
+	defer d.realm.server.mu.Unlock()
+	return d.credentialsSecret
+}
+
+// EditDetails calls edit on the DeviceDetails of the Device, allowing to seed connection status and stats
+func (d *Device) EditDetails(edit func(*client.DeviceDetails)) *Device {
+	d.realm.server.mu.Lock()
+	defer d.realm.server.mu.Unlock()
+	edit(&d.details)
+	return d
+}
+
+// SetIntrospection adds an interface to the introspection of the Device
+func (d *Device) SetIntrospection(interfaceName string, major int, minor int) *Device {
+	d.realm.server.mu.Lock()
+	defer d.realm.server.mu.Unlock()
+	d.details.Introspection[interfaceName] = client.DeviceInterfaceIntrospection{Major: major, Minor: minor}
+	return d
+}
+
+// AddAlias sets the alias of the Device for tag
+func (d *Device) AddAlias(tag string, alias string) *Device {
+	d.realm.server.mu.Lock()
+	defer d.realm.server.mu.Unlock()
+	d.details.Aliases[tag] = alias
+	return d
+}
+
+// SetProperty sets the value of a property of the Device
+func (d *Device) SetProperty(interfaceName string, interfacePath string, value interface{}) *Device {
+	d.realm.server.mu.Lock()
+	defer d.realm.server.mu.Unlock()
+	if _, ok := d.properties[interfaceName]; !ok {
+		d.properties[interfaceName] = map[string]interface{}{}
+	}
+	d.properties[interfaceName][interfacePath] = value
+	return d
+}
+
+// AppendDatastream adds a sample to an individual datastream of the Device
+func (d *Device) AppendDatastream(interfaceName string, interfacePath string, value interface{}, timestamp time.Time) *Device {
+	d.realm.server.mu.Lock()
+	defer d.realm.server.mu.Unlock()
+	if _, ok := d.datastreams[interfaceName]; !ok {
+		d.datastreams[interfaceName] = map[string][]client.DatastreamValue{}
+	}
+	samples := append(d.datastreams[interfaceName][interfacePath],
+		client.DatastreamValue{Value: value, Timestamp: timestamp.UTC(), ReceptionTimestamp: timestamp.UTC()})
+	sort.SliceStable(samples, func(i, j int) bool { return samples[i].Timestamp.Before(samples[j].Timestamp) })
+	d.datastreams[interfaceName][interfacePath] = samples
+	return d
+}
+
+// AppendAggregateDatastream adds a sample to an object aggregated datastream of the Device. interfacePath is
+// the path of the object, i.e. "/" for non-parametric interfaces.
+func (d *Device) AppendAggregateDatastream(interfaceName string, interfacePath string, values map[string]interface{},
+	timestamp time.Time) *Device {
+	d.realm.server.mu.Lock()
+	defer d.realm.server.mu.Unlock()
+	if _, ok := d.aggregates[interfaceName]; !ok {
+		d.aggregates[interfaceName] = map[string][]client.DatastreamAggregateValue{}
+	}
+
+	keys := []string{}
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	orderedValues := orderedmap.New()
+	for _, key := range keys {
+		orderedValues.Set(key, values[key])
+	}
+
+	interfacePath = strings.TrimSuffix(interfacePath, "/")
+	samples := append(d.aggregates[interfaceName][interfacePath],
+		client.DatastreamAggregateValue{Values: *orderedValues, Timestamp: timestamp.UTC()})
+	sort.SliceStable(samples, func(i, j int) bool { return samples[i].Timestamp.Before(samples[j].Timestamp) })
+	d.aggregates[interfaceName][interfacePath] = samples
+	return d
+}
@@ -0,0 +1,339 @@
+// Copyright © 2019 Ispirata Srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package astartetest
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/astarte-platform/astartectl/client"
+	"github.com/astarte-platform/astartectl/common"
+	"github.com/astarte-platform/astartectl/utils"
+)
+
+// Realm is a realm of a Server. Its methods can be used to seed and inspect its state.
+type Realm struct {
+	server     *Server
+	details    client.RealmDetails
+	privateKey []byte
+	interfaces map[string]map[int]common.AstarteInterface
+	triggers   map[string]map[string]interface{}
+	devices    map[string]*Device
+}
+
+func newRealm(s *Server, details client.RealmDetails) *Realm {
+	return &Realm{
+		server:     s,
+		details:    details,
+		interfaces: map[string]map[int]common.AstarteInterface{},
+		triggers:   map[string]map[string]interface{}{},
+		devices:    map[string]*Device{},
+	}
+}
+
+// Name returns the name of the Realm
+func (r *Realm) Name() string {
+	return r.details.Name
+}
+
+// PrivateKey returns the PEM encoded private key of the Realm. Returns nil if the Realm has been created
+// through the Housekeeping API, as only its public key is known.
+func (r *Realm) PrivateKey() []byte {
+	return r.privateKey
+}
+
+// Token returns an all-access token for astarteService in the Realm. It panics if the private key of the
+// Realm is not known.
+func (r *Realm) Token(astarteService utils.AstarteService) string {
+	if r.privateKey == nil {
+		panic("astartetest: the private key of realm " + r.details.Name + " is not known")
+	}
+	return mustGenerateToken(r.privateKey, astarteService)
+}
+
+// AddInterface installs astarteInterface in the Realm, replacing any interface with the same name and major version
+func (r *Realm) AddInterface(astarteInterface common.AstarteInterface) {
+	r.server.mu.Lock()
+	defer r.server.mu.Unlock()
+	r.addInterface(astarteInterface)
+}
+
+// Interface returns the given major version of an interface installed in the Realm
+func (r *Realm) Interface(name string, major int) (common.AstarteInterface, bool) {
+	r.server.mu.Lock()
+	defer r.server.mu.Unlock()
+	astarteInterface, ok := r.interfaces[name][major]
+	return astarteInterface, ok
+}
+
+// AddTrigger installs trigger in the Realm. The trigger is identified by its "name" key.
+func (r *Realm) AddTrigger(trigger map[string]interface{}) {
+	r.server.mu.Lock()
+	defer r.server.mu.Unlock()
+	r.triggers[triggerName(trigger)] = trigger
+}
+
+// Trigger returns a trigger installed in the Realm
+func (r *Realm) Trigger(name string) (map[string]interface{}, bool) {
+	r.server.mu.Lock()
+	defer r.server.mu.Unlock()
+	trigger, ok := r.triggers[name]
+	return trigger, ok
+}
+
+// AddDevice adds a registered Device to the Realm. If the Device exists, it is returned as is.
+func (r *Realm) AddDevice(deviceID string) *Device {
+	r.server.mu.Lock()
+	defer r.server.mu.Unlock()
+	return r.addDevice(deviceID)
+}
+
+// Device returns the Device with ID deviceID, or nil if it does not exist
+func (r *Realm) Device(deviceID string) *Device {
+	r.server.mu.Lock()
+	defer r.server.mu.Unlock()
+	return r.devices[deviceID]
+}
+
+func (r *Realm) addInterface(astarteInterface common.AstarteInterface) {
+	if _, ok := r.interfaces[astarteInterface.Name]; !ok {
+		r.interfaces[astarteInterface.Name] = map[int]common.AstarteInterface{}
+	}
+	r.interfaces[astarteInterface.Name][astarteInterface.MajorVersion] = astarteInterface
+}
+
+func (r *Realm) addDevice(deviceID string) *Device {
+	if device, ok := r.devices[deviceID]; ok {
+		return device
+	}
+	device := newDevice(r, deviceID)
+	r.devices[deviceID] = device
+	return device
+}
+
+func triggerName(trigger map[string]interface{}) string {
+	name, _ := trigger["name"].(string)
+	return name
+}
+
+func (r *Realm) serveRealmManagement(w http.ResponseWriter, req *http.Request, tokens []string) {
+	if len(tokens) == 0 {
+		writeError(w, http.StatusNotFound, "Not found")
+		return
+	}
+
+	switch tokens[0] {
+	case "interfaces":
+		r.serveInterfaces(w, req, tokens[1:])
+	case "triggers":
+		r.serveTriggers(w, req, tokens[1:])
+	default:
+		writeError(w, http.StatusNotFound, "Not found")
+	}
+}
+
+func (r *Realm) serveInterfaces(w http.ResponseWriter, req *http.Request, tokens []string) {
+	switch {
+	case len(tokens) == 0 && req.Method == http.MethodGet:
+		names := []string{}
+		for name := range r.interfaces {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		writeData(w, http.StatusOK, names)
+
+	case len(tokens) == 0 && req.Method == http.MethodPost:
+		var astarteInterface common.AstarteInterface
+		if err := readData(req, &astarteInterface); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if astarteInterface.Name == "" || len(astarteInterface.Mappings) == 0 {
+			writeError(w, http.StatusUnprocessableEntity, "Invalid interface")
+			return
+		}
+		if _, ok := r.interfaces[astarteInterface.Name][astarteInterface.MajorVersion]; ok {
+			writeError(w, http.StatusConflict, "Interface already exists")
+			return
+		}
+		r.addInterface(astarteInterface)
+		writeData(w, http.StatusCreated, astarteInterface)
+
+	case len(tokens) == 1 && req.Method == http.MethodGet:
+		versions, ok := r.interfaces[tokens[0]]
+		if !ok {
+			writeError(w, http.StatusNotFound, "Interface not found")
+			return
+		}
+		majors := []int{}
+		for major := range versions {
+			majors = append(majors, major)
+		}
+		sort.Ints(majors)
+		writeData(w, http.StatusOK, majors)
+
+	case len(tokens) == 2:
+		major, err := strconv.Atoi(tokens[1])
+		if err != nil {
+			writeError(w, http.StatusNotFound, "Interface not found")
+			return
+		}
+		existingInterface, ok := r.interfaces[tokens[0]][major]
+		if !ok {
+			writeError(w, http.StatusNotFound, "Interface not found")
+			return
+		}
+
+		switch req.Method {
+		case http.MethodGet:
+			writeData(w, http.StatusOK, existingInterface)
+		case http.MethodPut:
+			var astarteInterface common.AstarteInterface
+			if err := readData(req, &astarteInterface); err != nil {
+				writeError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			if astarteInterface.Name != existingInterface.Name || astarteInterface.MajorVersion != major {
+				writeError(w, http.StatusConflict, "Interface name and major version do not match")
+				return
+			}
+			if astarteInterface.MinorVersion <= existingInterface.MinorVersion {
+				writeError(w, http.StatusConflict, "Interface minor version was not increased")
+				return
+			}
+			r.addInterface(astarteInterface)
+			w.WriteHeader(http.StatusNoContent)
+		case http.MethodDelete:
+			if major != 0 {
+				writeError(w, http.StatusForbidden, "Only draft interfaces can be deleted")
+				return
+			}
+			delete(r.interfaces[tokens[0]], major)
+			if len(r.interfaces[tokens[0]]) == 0 {
+				delete(r.interfaces, tokens[0])
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		}
+
+	default:
+		writeError(w, http.StatusNotFound, "Not found")
+	}
+}
+
+func (r *Realm) serveTriggers(w http.ResponseWriter, req *http.Request, tokens []string) {
+	switch {
+	case len(tokens) == 0 && req.Method == http.MethodGet:
+		names := []string{}
+		for name := range r.triggers {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		writeData(w, http.StatusOK, names)
+
+	case len(tokens) == 0 && req.Method == http.MethodPost:
+		trigger := map[string]interface{}{}
+		if err := readData(req, &trigger); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		name := triggerName(trigger)
+		if name == "" {
+			writeError(w, http.StatusUnprocessableEntity, "name can't be blank")
+			return
+		}
+		if _, ok := r.triggers[name]; ok {
+			writeError(w, http.StatusConflict, "Trigger already exists")
+			return
+		}
+		r.triggers[name] = trigger
+		writeData(w, http.StatusCreated, trigger)
+
+	case len(tokens) == 1:
+		trigger, ok := r.triggers[tokens[0]]
+		if !ok {
+			writeError(w, http.StatusNotFound, "Trigger not found")
+			return
+		}
+		switch req.Method {
+		case http.MethodGet:
+			writeData(w, http.StatusOK, trigger)
+		case http.MethodDelete:
+			delete(r.triggers, tokens[0])
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		}
+
+	default:
+		writeError(w, http.StatusNotFound, "Not found")
+	}
+}
+
+func (r *Realm) servePairing(w http.ResponseWriter, req *http.Request, tokens []string) {
+	if len(tokens) < 2 || tokens[0] != "agent" || tokens[1] != "devices" || len(tokens) > 3 {
+		writeError(w, http.StatusNotFound, "Not found")
+		return
+	}
+
+	switch {
+	case len(tokens) == 2 && req.Method == http.MethodPost:
+		var registration struct {
+			HwID                 string                                         `json:"hw_id"`
+			InitialIntrospection map[string]client.DeviceInterfaceIntrospection `json:"initial_introspection"`
+		}
+		if err := readData(req, &registration); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if !utils.IsValidAstarteDeviceID(registration.HwID) {
+			writeError(w, http.StatusUnprocessableEntity, "hw_id is not a valid Astarte Device ID")
+			return
+		}
+		if device, ok := r.devices[registration.HwID]; ok && device.credentialsSecret != "" {
+			writeError(w, http.StatusUnprocessableEntity, "Device already registered")
+			return
+		}
+
+		device := r.addDevice(registration.HwID)
+		for interfaceName, introspection := range registration.InitialIntrospection {
+			device.details.Introspection[interfaceName] = introspection
+		}
+		device.credentialsSecret = newCredentialsSecret()
+		writeData(w, http.StatusCreated, map[string]string{"credentials_secret": device.credentialsSecret})
+
+	case len(tokens) == 3 && req.Method == http.MethodDelete:
+		device, ok := r.devices[tokens[2]]
+		if !ok {
+			writeError(w, http.StatusNotFound, "Device not found")
+			return
+		}
+		device.credentialsSecret = ""
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	}
+}
+
+func newCredentialsSecret() string {
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	return base64.StdEncoding.EncodeToString(secret)
+}
@@ -0,0 +1,321 @@
+// Copyright © 2019 Ispirata Srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package astartetest provides an in-memory implementation of Astarte's AppEngine, Realm Management,
+// Housekeeping and Pairing REST APIs, to test code built on top of the client package without a running
+// Astarte instance.
+//
+// A Server is seeded through its Realm and Device handles, and checks the JWT of each call against the
+// Housekeeping key or the key of the realm, just like Astarte does:
+//
+//	server, err := astartetest.NewServer()
+//	if err != nil {
+//		t.Fatal(err)
+//	}
+//	defer server.Close()
+//
+//	realm := server.AddRealm("test")
+//	realm.AddDevice("2TBn-jNESuuHamE2Zo1anA").SetIntrospection("com.example.Interface", 1, 0)
+//
+//	astarteAPIClient, _ := server.Client()
+//	devices, err := astarteAPIClient.AppEngine.ListDevices("test", realm.Token(utils.AppEngine))
+package astartetest
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/astarte-platform/astartectl/client"
+	"github.com/astarte-platform/astartectl/utils"
+	"github.com/dgrijalva/jwt-go"
+)
+
+// tokenTTL is the lifetime, in seconds, of tokens minted by the Server's helpers
+const tokenTTL = 300
+
+// Server is an in-memory Astarte instance, serving its REST APIs over HTTP
+type Server struct {
+	// SkipAuthorization disables JWT checks when set, accepting all calls
+	SkipAuthorization bool
+	// DisableDevicesStats makes the devices stats endpoint unavailable, as in older Astarte versions
+	DisableDevicesStats bool
+
+	mu                     sync.Mutex
+	httpServer             *httptest.Server
+	housekeepingPrivateKey []byte
+	housekeepingPublicKey  []byte
+	realms                 map[string]*Realm
+}
+
+// NewServer starts a new Server with no realms and a freshly generated Housekeeping keypair.
+// The Server must be closed with Close once done.
+func NewServer() (*Server, error) {
+	privateKey, publicKey, err := GenerateKeyPair()
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		housekeepingPrivateKey: privateKey,
+		housekeepingPublicKey:  publicKey,
+		realms:                 map[string]*Realm{},
+	}
+	s.httpServer = httptest.NewServer(s)
+	return s, nil
+}
+
+// Close shuts the Server down
+func (s *Server) Close() {
+	s.httpServer.Close()
+}
+
+// URL returns the base URL of the Server. APIs are served with the standard URL hierarchy, e.g.
+// <url>/appengine or <url>/housekeeping.
+func (s *Server) URL() string {
+	return s.httpServer.URL
+}
+
+// Client returns an Astarte API client pointing to the Server
+func (s *Server) Client() (*client.Client, error) {
+	return client.NewClient(s.URL(), s.httpServer.Client())
+}
+
+// HousekeepingPrivateKey returns the PEM encoded Housekeeping private key
+func (s *Server) HousekeepingPrivateKey() []byte {
+	return s.housekeepingPrivateKey
+}
+
+// HousekeepingToken returns an all-access Housekeeping token
+func (s *Server) HousekeepingToken() string {
+	return mustGenerateToken(s.housekeepingPrivateKey, utils.Housekeeping)
+}
+
+// AddRealm creates a realm with a freshly generated keypair, whose private key can be retrieved through
+// the returned Realm. If a realm with the same name exists, it is returned as is.
+func (s *Server) AddRealm(name string) *Realm {
+	privateKey, publicKey, err := GenerateKeyPair()
+	if err != nil {
+		panic(fmt.Sprintf("astartetest: could not generate a keypair: %v", err))
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if realm, ok := s.realms[name]; ok {
+		return realm
+	}
+	realm := newRealm(s, client.RealmDetails{Name: name, JwtPublicKeyPEM: string(publicKey)})
+	realm.privateKey = privateKey
+	s.realms[name] = realm
+	return realm
+}
+
+// Realm returns the realm named name, or nil if it does not exist
+func (s *Server) Realm(name string) *Realm {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.realms[name]
+}
+
+// ServeHTTP implements http.Handler
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	tokens := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(tokens) < 3 || tokens[1] != "v1" {
+		writeError(w, http.StatusNotFound, "Not found")
+		return
+	}
+
+	var astarteService utils.AstarteService
+	switch tokens[0] {
+	case "housekeeping":
+		astarteService = utils.Housekeeping
+	case "realmmanagement":
+		astarteService = utils.RealmManagement
+	case "pairing":
+		astarteService = utils.Pairing
+	case "appengine":
+		astarteService = utils.AppEngine
+	default:
+		writeError(w, http.StatusNotFound, "Not found")
+		return
+	}
+	apiPath := "/" + strings.Join(tokens[1:], "/")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if astarteService == utils.Housekeeping {
+		if status, err := s.authorize(astarteService, s.housekeepingPublicKey, r.Method, apiPath, r); err != nil {
+			writeError(w, status, err.Error())
+			return
+		}
+		s.serveHousekeeping(w, r, tokens[2:])
+		return
+	}
+
+	realm, ok := s.realms[tokens[2]]
+	if !ok {
+		writeError(w, http.StatusNotFound, "Realm not found")
+		return
+	}
+	if status, err := s.authorize(astarteService, []byte(realm.details.JwtPublicKeyPEM), r.Method, apiPath, r); err != nil {
+		writeError(w, status, err.Error())
+		return
+	}
+
+	switch astarteService {
+	case utils.RealmManagement:
+		realm.serveRealmManagement(w, r, tokens[3:])
+	case utils.Pairing:
+		realm.servePairing(w, r, tokens[3:])
+	case utils.AppEngine:
+		realm.serveAppEngine(w, r, tokens[3:])
+	}
+}
+
+// authorize checks the token of the request against publicKeyPEM, and its authorization claims against the call.
+// It returns the HTTP status to reply with when the call is not authorized.
+func (s *Server) authorize(astarteService utils.AstarteService, publicKeyPEM []byte, method string, apiPath string,
+	r *http.Request) (int, error) {
+	if s.SkipAuthorization {
+		return 0, nil
+	}
+
+	authorizationHeader := r.Header.Get("Authorization")
+	if !strings.HasPrefix(authorizationHeader, "Bearer ") {
+		return http.StatusUnauthorized, errors.New("Missing token")
+	}
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(strings.TrimPrefix(authorizationHeader, "Bearer "), claims,
+		func(token *jwt.Token) (interface{}, error) {
+			if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
+				return nil, fmt.Errorf("Unsupported signing method %v", token.Header["alg"])
+			}
+			return jwt.ParseRSAPublicKeyFromPEM(publicKeyPEM)
+		})
+	if err != nil {
+		return http.StatusUnauthorized, fmt.Errorf("Invalid token: %s", err)
+	}
+
+	authorizationClaims := utils.GetAstarteJWTAuthorizationClaims(claims)[astarteService]
+	if _, ok, err := utils.FindAuthorizingAstarteClaim(astarteService, authorizationClaims, method, apiPath); err != nil || !ok {
+		return http.StatusForbidden, errors.New("Forbidden")
+	}
+
+	return 0, nil
+}
+
+func (s *Server) serveHousekeeping(w http.ResponseWriter, r *http.Request, tokens []string) {
+	if tokens[0] != "realms" || len(tokens) > 2 {
+		writeError(w, http.StatusNotFound, "Not found")
+		return
+	}
+
+	switch {
+	case len(tokens) == 1 && r.Method == http.MethodGet:
+		realmNames := []string{}
+		for name := range s.realms {
+			realmNames = append(realmNames, name)
+		}
+		sort.Strings(realmNames)
+		writeData(w, http.StatusOK, realmNames)
+
+	case len(tokens) == 1 && r.Method == http.MethodPost:
+		var realmDetails client.RealmDetails
+		if err := readData(r, &realmDetails); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if realmDetails.Name == "" {
+			writeError(w, http.StatusUnprocessableEntity, "realm_name can't be blank")
+			return
+		}
+		if _, err := jwt.ParseRSAPublicKeyFromPEM([]byte(realmDetails.JwtPublicKeyPEM)); err != nil {
+			writeError(w, http.StatusUnprocessableEntity, "jwt_public_key_pem is not a valid PEM public key")
+			return
+		}
+		if _, ok := s.realms[realmDetails.Name]; ok {
+			writeError(w, http.StatusConflict, "Realm already exists")
+			return
+		}
+		s.realms[realmDetails.Name] = newRealm(s, realmDetails)
+		writeData(w, http.StatusCreated, realmDetails)
+
+	case len(tokens) == 2 && r.Method == http.MethodGet:
+		realm, ok := s.realms[tokens[1]]
+		if !ok {
+			writeError(w, http.StatusNotFound, "Realm not found")
+			return
+		}
+		writeData(w, http.StatusOK, realm.details)
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	}
+}
+
+// GenerateKeyPair generates an RSA keypair suitable for signing Astarte tokens, and returns both keys PEM encoded
+func GenerateKeyPair() (privateKeyPEM []byte, publicKeyPEM []byte, err error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, nil, err
+	}
+	publicKeyBytes, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	privateKeyPEM = pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	publicKeyPEM = pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicKeyBytes})
+	return privateKeyPEM, publicKeyPEM, nil
+}
+
+func mustGenerateToken(privateKeyPEM []byte, astarteService utils.AstarteService) string {
+	token, err := utils.GenerateAstarteJWTFromPEMKey(privateKeyPEM, astarteService, nil, tokenTTL)
+	if err != nil {
+		panic(fmt.Sprintf("astartetest: could not generate a token: %v", err))
+	}
+	return token
+}
+
+func readData(r *http.Request, data interface{}) error {
+	requestBody := struct {
+		Data interface{} `json:"data"`
+	}{Data: data}
+	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
+		return fmt.Errorf("Invalid request body: %s", err)
+	}
+	return nil
+}
+
+func writeData(w http.ResponseWriter, status int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{"data": data})
+}
+
+func writeError(w http.ResponseWriter, status int, detail string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{"errors": map[string]string{"detail": detail}})
+}
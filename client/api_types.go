@@ -104,6 +104,12 @@ type DeviceDetails struct {
 	Aliases                  map[string]string                       `json:"aliases"`
 }
 
+// DevicesStats maps to the JSON object returned by a Devices Stats call to AppEngine API
+type DevicesStats struct {
+	TotalDevices     int64 `json:"total_devices"`
+	ConnectedDevices int64 `json:"connected_devices"`
+}
+
 // DatastreamValue represent one single Datastream Value
 type DatastreamValue struct {
 	Value              interface{} `json:"value"`
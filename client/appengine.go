@@ -96,6 +96,25 @@ func (s *AppEngineService) ListDevices(realm string, token string) ([]string, er
 	return responseBody.Data, nil
 }
 
+// GetDevicesStats returns the number of total and connected Devices in the Realm
+func (s *AppEngineService) GetDevicesStats(realm string, token string) (DevicesStats, error) {
+	callURL, _ := url.Parse(s.appEngineURL.String())
+	callURL.Path = path.Join(callURL.Path, fmt.Sprintf("/v1/%s/stats/devices", realm))
+	decoder, err := s.client.genericJSONDataAPIGET(callURL.String(), token, 200)
+	if err != nil {
+		return DevicesStats{}, err
+	}
+	var responseBody struct {
+		Data DevicesStats `json:"data"`
+	}
+	err = decoder.Decode(&responseBody)
+	if err != nil {
+		return DevicesStats{}, err
+	}
+
+	return responseBody.Data, nil
+}
+
 // GetDevice returns the DeviceDetails of a single Device in the Realm
 func (s *AppEngineService) GetDevice(realm string, deviceIdentifier string, deviceIdentifierType DeviceIdentifierType, token string) (DeviceDetails, error) {
 	resolvedDeviceIdentifierType := resolveDeviceIdentifierType(deviceIdentifier, deviceIdentifierType)
@@ -356,7 +375,7 @@ func (s *AppEngineService) GetDatastreamSnapshot(realm string, deviceIdentifier
 // If limit is <= 0, it returns all existing datastreams. Consider using a GetDatastreamsPaginator in that case.
 func (s *AppEngineService) GetLastDatastreams(realm string, deviceIdentifier string, deviceIdentifierType DeviceIdentifierType, interfaceName string, interfacePath string, limit int, token string) ([]DatastreamValue, error) {
 	resolvedDeviceIdentifierType := resolveDeviceIdentifierType(deviceIdentifier, deviceIdentifierType)
-	return s.getDatastreamInternal(realm, devicePath(deviceIdentifier, resolvedDeviceIdentifierType), interfaceName, interfacePath, invalidTime, invalidTime, limit, DescendingOrder, token)
+	return s.getDatastreamInternal(realm, devicePath(deviceIdentifier, resolvedDeviceIdentifierType), interfaceName, interfacePath, invalidTime, time.Now(), limit, DescendingOrder, token)
 }
 
 // GetDatastreamsPaginator returns a Paginator for all the values on a path for a Datastream interface.
@@ -520,7 +539,7 @@ func (s *AppEngineService) getDatastreamInternal(realm string, devicePath string
 				return append(resultSet, page...), nil
 			} else if totalSize > limit {
 				missingSamples := limit - len(resultSet)
-				return append(resultSet, page[0:missingSamples-1]...), nil
+				return append(resultSet, page[0:missingSamples]...), nil
 			}
 		}
 
@@ -17,7 +17,6 @@ package client
 import (
 	"bytes"
 	"encoding/json"
-	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
@@ -126,18 +125,29 @@ func NewClientWithIndividualURLs(rawAppEngineURL string, rawHousekeepingURL stri
 	return c, nil
 }
 
-func errorFromJSONErrors(responseBody io.Reader) error {
+// APIError is returned when Astarte replies to a request with an unexpected status code
+type APIError struct {
+	// StatusCode is the HTTP status code of the response
+	StatusCode int
+	message    string
+}
+
+func (e *APIError) Error() string {
+	return e.message
+}
+
+func errorFromJSONErrors(resp *http.Response) error {
 	var errorBody struct {
 		Errors map[string]interface{} `json:"errors"`
 	}
 
-	err := json.NewDecoder(responseBody).Decode(&errorBody)
+	err := json.NewDecoder(resp.Body).Decode(&errorBody)
 	if err != nil {
-		return err
+		return &APIError{StatusCode: resp.StatusCode, message: err.Error()}
 	}
 
 	errJSON, _ := json.MarshalIndent(&errorBody, "", "  ")
-	return fmt.Errorf("%s", errJSON)
+	return &APIError{StatusCode: resp.StatusCode, message: string(errJSON)}
 }
 
 func (c *Client) genericJSONDataAPIGET(urlString string, authorizationToken string, expectedReturnCode int) (*json.Decoder, error) {
@@ -155,7 +165,7 @@ func (c *Client) genericJSONDataAPIGET(urlString string, authorizationToken stri
 	}
 
 	if resp.StatusCode != expectedReturnCode {
-		return nil, errorFromJSONErrors(resp.Body)
+		return nil, errorFromJSONErrors(resp)
 	}
 
 	return json.NewDecoder(resp.Body), nil
@@ -270,7 +280,7 @@ func (c *Client) genericJSONDataAPIWriteWithContentType(httpVerb string, urlStri
 	}
 
 	if resp.StatusCode != expectedReturnCode {
-		return nil, errorFromJSONErrors(resp.Body)
+		return nil, errorFromJSONErrors(resp)
 	}
 
 	return json.NewDecoder(resp.Body), nil
@@ -290,7 +300,7 @@ func (c *Client) genericJSONDataAPIDelete(urlString string, authorizationToken s
 	}
 
 	if resp.StatusCode != expectedReturnCode {
-		return errorFromJSONErrors(resp.Body)
+		return errorFromJSONErrors(resp)
 	}
 
 	// When calling this function, we're discarding the response, but there might indeed have been
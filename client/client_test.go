@@ -0,0 +1,463 @@
+// Copyright © 2019 Ispirata Srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client_test
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/astarte-platform/astartectl/astartetest"
+	"github.com/astarte-platform/astartectl/client"
+	"github.com/astarte-platform/astartectl/common"
+	"github.com/astarte-platform/astartectl/utils"
+)
+
+const (
+	testRealm    = "test"
+	testDeviceID = "2TBn-jNESuuHamE2Zo1anA"
+)
+
+var (
+	testPropertiesInterface = common.AstarteInterface{
+		Name:         "org.example.Settings",
+		MajorVersion: 1,
+		Type:         common.PropertiesType,
+		Ownership:    common.ServerOwnership,
+		Mappings:     []common.AstarteInterfaceMapping{{Endpoint: "/%{group}/enabled", Type: "boolean"}},
+	}
+	testDatastreamInterface = common.AstarteInterface{
+		Name:         "org.example.Temperature",
+		MajorVersion: 1,
+		Type:         common.DatastreamType,
+		Ownership:    common.DeviceOwnership,
+		Mappings:     []common.AstarteInterfaceMapping{{Endpoint: "/%{sensor}/value", Type: "double"}},
+	}
+	testAggregateInterface = common.AstarteInterface{
+		Name:         "org.example.Position",
+		MajorVersion: 0,
+		MinorVersion: 1,
+		Type:         common.DatastreamType,
+		Ownership:    common.DeviceOwnership,
+		Aggregation:  common.ObjectAggregation,
+		Mappings: []common.AstarteInterfaceMapping{
+			{Endpoint: "/latitude", Type: "double"},
+			{Endpoint: "/longitude", Type: "double"},
+		},
+	}
+	testParametricAggregateInterface = common.AstarteInterface{
+		Name:         "org.example.Readings",
+		MajorVersion: 1,
+		Type:         common.DatastreamType,
+		Ownership:    common.DeviceOwnership,
+		Aggregation:  common.ObjectAggregation,
+		Mappings: []common.AstarteInterfaceMapping{
+			{Endpoint: "/%{sensor}/min", Type: "double"},
+			{Endpoint: "/%{sensor}/max", Type: "double"},
+		},
+	}
+)
+
+func newTestServer(t *testing.T) (*astartetest.Server, *astartetest.Realm, *client.Client) {
+	server, err := astartetest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	astarteAPIClient, err := server.Client()
+	if err != nil {
+		server.Close()
+		t.Fatal(err)
+	}
+	return server, server.AddRealm(testRealm), astarteAPIClient
+}
+
+func TestHousekeeping(t *testing.T) {
+	server, _, astarteAPIClient := newTestServer(t)
+	defer server.Close()
+	token := server.HousekeepingToken()
+
+	_, publicKey, err := astartetest.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := astarteAPIClient.Housekeeping.CreateRealmWithReplicationFactor("another", string(publicKey), 3, token); err != nil {
+		t.Fatal(err)
+	}
+	err = astarteAPIClient.Housekeeping.CreateRealm("another", string(publicKey), token)
+	if apiErr, ok := err.(*client.APIError); !ok || apiErr.StatusCode != http.StatusConflict {
+		t.Errorf("creating a duplicate realm did not fail with a conflict: %v", err)
+	}
+
+	realms, err := astarteAPIClient.Housekeeping.ListRealms(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(realms, []string{"another", testRealm}) {
+		t.Errorf("unexpected realms: %v", realms)
+	}
+
+	realmDetails, err := astarteAPIClient.Housekeeping.GetRealm("another", token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if realmDetails.ReplicationClass != client.SimpleStrategy || realmDetails.ReplicationFactor != 3 ||
+		realmDetails.JwtPublicKeyPEM != string(publicKey) {
+		t.Errorf("unexpected realm details: %+v", realmDetails)
+	}
+}
+
+func TestAuthorization(t *testing.T) {
+	server, realm, astarteAPIClient := newTestServer(t)
+	defer server.Close()
+
+	if _, err := astarteAPIClient.Housekeeping.ListRealms(realm.Token(utils.Housekeeping)); err == nil {
+		t.Error("a realm token was accepted by Housekeeping")
+	}
+	if _, err := astarteAPIClient.AppEngine.ListDevices(testRealm, realm.Token(utils.RealmManagement)); err == nil {
+		t.Error("a Realm Management token was accepted by AppEngine")
+	}
+
+	privateKey, _, err := astartetest.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := utils.GenerateAstarteJWTFromPEMKey(privateKey, utils.AppEngine, nil, 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := astarteAPIClient.AppEngine.ListDevices(testRealm, token); err == nil {
+		t.Error("a token signed with an unknown key was accepted")
+	}
+
+	token, err = utils.GenerateAstarteJWTFromPEMKey(realm.PrivateKey(), utils.AppEngine, []string{"GET::devices"}, 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := astarteAPIClient.AppEngine.ListDevices(testRealm, token); err != nil {
+		t.Errorf("a token with a matching claim was rejected: %v", err)
+	}
+	if _, err := astarteAPIClient.AppEngine.GetDevice(testRealm, testDeviceID, client.AstarteDeviceID, token); err == nil {
+		t.Error("a token without a matching claim was accepted")
+	}
+
+	server.SkipAuthorization = true
+	if _, err := astarteAPIClient.Housekeeping.ListRealms(""); err != nil {
+		t.Errorf("authorization was not skipped: %v", err)
+	}
+}
+
+func TestRealmManagement(t *testing.T) {
+	server, realm, astarteAPIClient := newTestServer(t)
+	defer server.Close()
+	token := realm.Token(utils.RealmManagement)
+
+	if err := astarteAPIClient.RealmManagement.InstallInterface(testRealm, testAggregateInterface, token); err != nil {
+		t.Fatal(err)
+	}
+	if err := astarteAPIClient.RealmManagement.InstallInterface(testRealm, testAggregateInterface, token); err == nil {
+		t.Error("installing a duplicate interface succeeded")
+	}
+	realm.AddInterface(testDatastreamInterface)
+
+	interfaces, err := astarteAPIClient.RealmManagement.ListInterfaces(testRealm, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(interfaces, []string{testAggregateInterface.Name, testDatastreamInterface.Name}) {
+		t.Errorf("unexpected interfaces: %v", interfaces)
+	}
+	majors, err := astarteAPIClient.RealmManagement.ListInterfaceMajorVersions(testRealm, testAggregateInterface.Name, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(majors, []int{0}) {
+		t.Errorf("unexpected major versions: %v", majors)
+	}
+
+	updatedInterface := testAggregateInterface
+	updatedInterface.MinorVersion = 2
+	if err := astarteAPIClient.RealmManagement.UpdateInterface(testRealm, updatedInterface.Name, 0, updatedInterface, token); err != nil {
+		t.Fatal(err)
+	}
+	if err := astarteAPIClient.RealmManagement.UpdateInterface(testRealm, updatedInterface.Name, 0, updatedInterface, token); err == nil {
+		t.Error("updating an interface without increasing its minor version succeeded")
+	}
+	astarteInterface, err := astarteAPIClient.RealmManagement.GetInterface(testRealm, updatedInterface.Name, 0, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(astarteInterface, updatedInterface) {
+		t.Errorf("unexpected interface: %+v", astarteInterface)
+	}
+
+	if err := astarteAPIClient.RealmManagement.DeleteInterface(testRealm, testDatastreamInterface.Name, 1, token); err == nil {
+		t.Error("deleting a non-draft interface succeeded")
+	}
+	if err := astarteAPIClient.RealmManagement.DeleteInterface(testRealm, updatedInterface.Name, 0, token); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := realm.Interface(updatedInterface.Name, 0); ok {
+		t.Error("deleted interface is still installed")
+	}
+
+	trigger := map[string]interface{}{
+		"name":   "connections",
+		"action": map[string]interface{}{"http_post_url": "https://example.com/hook"},
+		"simple_triggers": []interface{}{
+			map[string]interface{}{"type": "device_trigger", "on": "device_connected"},
+		},
+	}
+	if err := astarteAPIClient.RealmManagement.InstallTrigger(testRealm, trigger, token); err != nil {
+		t.Fatal(err)
+	}
+	triggers, err := astarteAPIClient.RealmManagement.ListTriggers(testRealm, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(triggers, []string{"connections"}) {
+		t.Errorf("unexpected triggers: %v", triggers)
+	}
+	installedTrigger, err := astarteAPIClient.RealmManagement.GetTrigger(testRealm, "connections", token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(installedTrigger, trigger) {
+		t.Errorf("unexpected trigger: %v", installedTrigger)
+	}
+	if err := astarteAPIClient.RealmManagement.DeleteTrigger(testRealm, "connections", token); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := astarteAPIClient.RealmManagement.GetTrigger(testRealm, "connections", token); err == nil {
+		t.Error("deleted trigger still exists")
+	}
+}
+
+func TestPairing(t *testing.T) {
+	server, realm, astarteAPIClient := newTestServer(t)
+	defer server.Close()
+	token := realm.Token(utils.Pairing)
+
+	if _, err := astarteAPIClient.Pairing.RegisterDevice(testRealm, "not a device id", token); err == nil {
+		t.Error("registering an invalid device ID succeeded")
+	}
+	credentialsSecret, err := astarteAPIClient.Pairing.RegisterDevice(testRealm, testDeviceID, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if credentialsSecret == "" || realm.Device(testDeviceID).CredentialsSecret() != credentialsSecret {
+		t.Errorf("unexpected credentials secret: %v", credentialsSecret)
+	}
+	if _, err := astarteAPIClient.Pairing.RegisterDevice(testRealm, testDeviceID, token); err == nil {
+		t.Error("registering a registered device succeeded")
+	}
+
+	if err := astarteAPIClient.Pairing.UnregisterDevice(testRealm, testDeviceID, token); err != nil {
+		t.Fatal(err)
+	}
+	if realm.Device(testDeviceID).CredentialsSecret() != "" {
+		t.Error("unregistered device still has a credentials secret")
+	}
+	if _, err := astarteAPIClient.Pairing.RegisterDevice(testRealm, testDeviceID, token); err != nil {
+		t.Errorf("registering an unregistered device failed: %v", err)
+	}
+
+	introspection := map[string]client.DeviceInterfaceIntrospection{"org.example.Config": {Major: 1, Minor: 2}}
+	if _, err := astarteAPIClient.Pairing.RegisterDeviceWithInitialIntrospection(testRealm, "f0VMRgIBAQAAAAAAAAAAAA",
+		introspection, token); err != nil {
+		t.Fatal(err)
+	}
+	if details := realm.Device("f0VMRgIBAQAAAAAAAAAAAA").Details(); !reflect.DeepEqual(details.Introspection, introspection) {
+		t.Errorf("unexpected introspection: %v", details.Introspection)
+	}
+}
+
+func TestAppEngineDevices(t *testing.T) {
+	server, realm, astarteAPIClient := newTestServer(t)
+	defer server.Close()
+	token := realm.Token(utils.AppEngine)
+
+	realm.AddDevice(testDeviceID).
+		SetIntrospection(testDatastreamInterface.Name, 1, 0).
+		SetIntrospection(testPropertiesInterface.Name, 1, 2).
+		AddAlias("name", "thermostat")
+	realm.AddDevice("f0VMRgIBAQAAAAAAAAAAAA")
+
+	devices, err := astarteAPIClient.AppEngine.ListDevices(testRealm, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(devices, []string{testDeviceID, "f0VMRgIBAQAAAAAAAAAAAA"}) {
+		t.Errorf("unexpected devices: %v", devices)
+	}
+
+	deviceDetails, err := astarteAPIClient.AppEngine.GetDevice(testRealm, "thermostat", client.AutodiscoverDeviceIdentifier, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deviceDetails.DeviceID != testDeviceID ||
+		deviceDetails.Introspection[testPropertiesInterface.Name] != (client.DeviceInterfaceIntrospection{Major: 1, Minor: 2}) {
+		t.Errorf("unexpected device details: %+v", deviceDetails)
+	}
+
+	deviceInterfaces, err := astarteAPIClient.AppEngine.ListDeviceInterfaces(testRealm, testDeviceID, client.AstarteDeviceID, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(deviceInterfaces, []string{testPropertiesInterface.Name, testDatastreamInterface.Name}) {
+		t.Errorf("unexpected device interfaces: %v", deviceInterfaces)
+	}
+
+	if err := astarteAPIClient.AppEngine.AddDeviceAlias(testRealm, testDeviceID, "serial", "SN-42", token); err != nil {
+		t.Fatal(err)
+	}
+	if err := astarteAPIClient.AppEngine.AddDeviceAlias(testRealm, "f0VMRgIBAQAAAAAAAAAAAA", "name", "thermostat", token); err == nil {
+		t.Error("adding an alias in use succeeded")
+	}
+	if err := astarteAPIClient.AppEngine.DeleteDeviceAlias(testRealm, testDeviceID, "name", token); err != nil {
+		t.Fatal(err)
+	}
+	aliases, err := astarteAPIClient.AppEngine.ListDeviceAliases(testRealm, testDeviceID, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(aliases, map[string]string{"serial": "SN-42"}) {
+		t.Errorf("unexpected aliases: %v", aliases)
+	}
+	deviceID, err := astarteAPIClient.AppEngine.GetDeviceIDFromDeviceIdentifier(testRealm, "SN-42", client.AutodiscoverDeviceIdentifier, token)
+	if err != nil || deviceID != testDeviceID {
+		t.Errorf("unexpected device ID: %v %v", deviceID, err)
+	}
+}
+
+func TestAppEngineData(t *testing.T) {
+	server, realm, astarteAPIClient := newTestServer(t)
+	defer server.Close()
+	token := realm.Token(utils.AppEngine)
+
+	realm.AddInterface(testPropertiesInterface)
+	realm.AddInterface(testDatastreamInterface)
+	realm.AddInterface(testAggregateInterface)
+	realm.AddInterface(testParametricAggregateInterface)
+
+	start := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	device := realm.AddDevice(testDeviceID).
+		SetIntrospection(testPropertiesInterface.Name, 1, 0).
+		SetIntrospection(testDatastreamInterface.Name, 1, 0).
+		SetIntrospection(testAggregateInterface.Name, 0, 1).
+		SetIntrospection(testParametricAggregateInterface.Name, 1, 0).
+		SetProperty(testPropertiesInterface.Name, "/lights/enabled", true).
+		SetProperty(testPropertiesInterface.Name, "/heating/enabled", false)
+	for i := 0; i < 5; i++ {
+		device.AppendDatastream(testDatastreamInterface.Name, "/indoor/value", float64(20+i), start.Add(time.Duration(i)*time.Minute))
+	}
+	device.AppendDatastream(testDatastreamInterface.Name, "/outdoor/value", 3.5, start)
+	for i := 0; i < 3; i++ {
+		device.AppendAggregateDatastream(testAggregateInterface.Name, "/",
+			map[string]interface{}{"latitude": 45.0 + float64(i), "longitude": 9.0}, start.Add(time.Duration(i)*time.Minute))
+	}
+	device.AppendAggregateDatastream(testParametricAggregateInterface.Name, "/boiler",
+		map[string]interface{}{"min": 40.0, "max": 70.0}, start)
+
+	properties, err := astarteAPIClient.AppEngine.GetProperties(testRealm, testDeviceID, client.AstarteDeviceID,
+		testPropertiesInterface.Name, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(properties, map[string]interface{}{"/lights/enabled": true, "/heating/enabled": false}) {
+		t.Errorf("unexpected properties: %v", properties)
+	}
+
+	snapshot, err := astarteAPIClient.AppEngine.GetDatastreamSnapshot(testRealm, testDeviceID, client.AstarteDeviceID,
+		testDatastreamInterface.Name, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshot) != 2 || snapshot["/indoor/value"].Value != 24.0 || snapshot["/outdoor/value"].Value != 3.5 {
+		t.Errorf("unexpected snapshot: %v", snapshot)
+	}
+
+	lastValues, err := astarteAPIClient.AppEngine.GetLastDatastreams(testRealm, testDeviceID, client.AstarteDeviceID,
+		testDatastreamInterface.Name, "/indoor/value", 2, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lastValues) != 2 || lastValues[0].Value != 24.0 || lastValues[1].Value != 23.0 {
+		t.Errorf("unexpected last values: %v", lastValues)
+	}
+
+	paginator := astarteAPIClient.AppEngine.GetDatastreamsTimeWindowPaginator(testRealm, testDeviceID, client.AstarteDeviceID,
+		testDatastreamInterface.Name, "/indoor/value", start.Add(time.Minute), start.Add(4*time.Minute), client.AscendingOrder, token)
+	values := []interface{}{}
+	for paginator.HasNextPage() {
+		page, err := paginator.GetNextPage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, value := range page {
+			values = append(values, value.Value)
+		}
+	}
+	if !reflect.DeepEqual(values, []interface{}{21.0, 22.0, 23.0}) {
+		t.Errorf("unexpected time window values: %v", values)
+	}
+
+	paginator = astarteAPIClient.AppEngine.GetDatastreamsPaginator(testRealm, testDeviceID, client.AstarteDeviceID,
+		testDatastreamInterface.Name, "/indoor/value", client.DescendingOrder, token)
+	page, err := paginator.GetNextPage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page) != 5 || page[0].Value != 24.0 || paginator.HasNextPage() {
+		t.Errorf("unexpected page: %v", page)
+	}
+
+	aggregateSnapshot, err := astarteAPIClient.AppEngine.GetAggregateDatastreamSnapshot(testRealm, testDeviceID, client.AstarteDeviceID,
+		testAggregateInterface.Name, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latitude, _ := aggregateSnapshot.Values.Get("latitude"); latitude != 47.0 || !aggregateSnapshot.Timestamp.Equal(start.Add(2*time.Minute)) {
+		t.Errorf("unexpected aggregate snapshot: %v", aggregateSnapshot)
+	}
+
+	lastAggregates, err := astarteAPIClient.AppEngine.GetLastAggregateDatastreams(testRealm, testDeviceID, client.AstarteDeviceID,
+		testAggregateInterface.Name, "", token, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lastAggregates) != 2 {
+		t.Errorf("unexpected last aggregates: %v", lastAggregates)
+	}
+
+	aggregates, err := astarteAPIClient.AppEngine.GetAggregateDatastreamsTimeWindow(testRealm, testDeviceID, client.AstarteDeviceID,
+		testAggregateInterface.Name, "", token, start, start.Add(2*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(aggregates) != 2 || !aggregates[0].Timestamp.Equal(start) {
+		t.Errorf("unexpected aggregates: %v", aggregates)
+	}
+
+	parametricSnapshot, err := astarteAPIClient.AppEngine.GetAggregateParametricDatastreamSnapshot(testRealm, testDeviceID,
+		client.AstarteDeviceID, testParametricAggregateInterface.Name, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	boilerSnapshot := parametricSnapshot["/boiler"]
+	if maxValue, _ := boilerSnapshot.Values.Get("max"); len(parametricSnapshot) != 1 || maxValue != 70.0 {
+		t.Errorf("unexpected parametric snapshot: %v", parametricSnapshot)
+	}
+}
@@ -26,17 +26,32 @@ type PairingService struct {
 	pairingURL *url.URL
 }
 
+// URL returns the base URL of the Pairing API, which Devices use to obtain their credentials
+func (s *PairingService) URL() string {
+	return s.pairingURL.String()
+}
+
 // RegisterDevice registers a new device into the Realm.
 // Returns the Credential Secret of the Device when successful.
-// TODO: add support for initial_introspection
 func (s *PairingService) RegisterDevice(realm string, deviceID string, token string) (string, error) {
+	return s.RegisterDeviceWithInitialIntrospection(realm, deviceID, nil, token)
+}
+
+// RegisterDeviceWithInitialIntrospection registers a new device into the Realm, declaring the interfaces it
+// will expose before it connects for the first time. This allows server owned data to be sent to the Device
+// ahead of its first connection.
+// Returns the Credential Secret of the Device when successful.
+func (s *PairingService) RegisterDeviceWithInitialIntrospection(realm string, deviceID string,
+	initialIntrospection map[string]DeviceInterfaceIntrospection, token string) (string, error) {
 	callURL, _ := url.Parse(s.pairingURL.String())
 	callURL.Path = path.Join(callURL.Path, fmt.Sprintf("/v1/%s/agent/devices", realm))
 
 	var requestBody struct {
-		HwID string `json:"hw_id"`
+		HwID                 string                                  `json:"hw_id"`
+		InitialIntrospection map[string]DeviceInterfaceIntrospection `json:"initial_introspection,omitempty"`
 	}
 	requestBody.HwID = deviceID
+	requestBody.InitialIntrospection = initialIntrospection
 
 	decoder, err := s.client.genericJSONDataAPIPostWithResponse(callURL.String(), requestBody, token, 201)
 	if err != nil {
@@ -0,0 +1,191 @@
+// Copyright © 2019 Ispirata Srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// TraceRequests logs method, URL, status and latency of each call
+	TraceRequests = 1
+	// TraceHeaders additionally logs request and response headers
+	TraceHeaders = 6
+	// TraceBodies additionally logs request and response bodies, truncated to maxTracedBodyLength
+	TraceBodies = 8
+	// TraceFullBodies logs request and response bodies without truncating them
+	TraceFullBodies = 9
+
+	maxTracedBodyLength = 1024
+	redactedToken       = "<redacted>"
+)
+
+// redactedBodyField matches secrets in JSON bodies, such as the credentials secret returned when registering a device
+var redactedBodyField = regexp.MustCompile(`("credentials_secret"\s*:\s*)"(\\.|[^"\\])*"`)
+
+// TracingTransport is an http.RoundTripper which logs the calls it performs, to debug interactions with Astarte.
+// Bearer tokens and credentials secrets are never logged.
+type TracingTransport struct {
+	// Transport performs the actual calls. When nil, http.DefaultTransport is used.
+	Transport http.RoundTripper
+	// Out is where the trace is written
+	Out io.Writer
+	// Verbosity is the trace level, from 0 (no trace) to TraceFullBodies
+	Verbosity int
+	// PrintCurl prints each call as an equivalent curl command. The token is referenced as $ASTARTE_TOKEN.
+	PrintCurl bool
+}
+
+// NewTracingHTTPClient returns an http.Client with the default timeout, which traces calls through a
+// TracingTransport writing to out
+func NewTracingHTTPClient(out io.Writer, verbosity int, printCurl bool) *http.Client {
+	return &http.Client{
+		Timeout:   time.Second * 30,
+		Transport: &TracingTransport{Out: out, Verbosity: verbosity, PrintCurl: printCurl},
+	}
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *TracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	transport := t.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+
+	var requestBody []byte
+	if req.Body != nil && (t.PrintCurl || t.Verbosity >= TraceBodies) {
+		var err error
+		requestBody, err = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(requestBody))
+	}
+
+	if t.PrintCurl {
+		fmt.Fprintln(t.Out, curlCommand(req, requestBody))
+	}
+	if t.Verbosity >= TraceHeaders {
+		fmt.Fprintf(t.Out, "Request headers:\n%s", formatHeaders(req.Header))
+	}
+	if t.Verbosity >= TraceBodies && len(requestBody) > 0 {
+		fmt.Fprintf(t.Out, "Request body: %s\n", t.formatBody(requestBody))
+	}
+
+	start := time.Now()
+	resp, err := transport.RoundTrip(req)
+	latency := time.Since(start)
+	if err != nil {
+		if t.Verbosity >= TraceRequests {
+			fmt.Fprintf(t.Out, "%s %s failed in %v: %v\n", req.Method, req.URL, latency.Round(time.Millisecond), err)
+		}
+		return nil, err
+	}
+
+	if t.Verbosity >= TraceRequests {
+		fmt.Fprintf(t.Out, "%s %s %s in %v\n", req.Method, req.URL, resp.Status, latency.Round(time.Millisecond))
+	}
+	if t.Verbosity >= TraceHeaders {
+		fmt.Fprintf(t.Out, "Response headers:\n%s", formatHeaders(resp.Header))
+	}
+	if t.Verbosity >= TraceBodies {
+		responseBody, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		resp.Body = ioutil.NopCloser(bytes.NewReader(responseBody))
+		if len(responseBody) > 0 {
+			fmt.Fprintf(t.Out, "Response body: %s\n", t.formatBody(responseBody))
+		}
+	}
+
+	return resp, nil
+}
+
+// formatBody redacts secrets in body, and truncates it according to the verbosity
+func (t *TracingTransport) formatBody(body []byte) string {
+	body = redactedBodyField.ReplaceAll(body, []byte(`$1"`+redactedToken+`"`))
+	if t.Verbosity < TraceFullBodies && len(body) > maxTracedBodyLength {
+		return fmt.Sprintf("%s... (%d more bytes)", body[:maxTracedBodyLength], len(body)-maxTracedBodyLength)
+	}
+	return string(bytes.TrimSpace(body))
+}
+
+func formatHeaders(headers http.Header) string {
+	names := []string{}
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		for _, value := range headers[name] {
+			fmt.Fprintf(&b, "    %s: %s\n", name, redactHeader(name, value))
+		}
+	}
+	return b.String()
+}
+
+func redactHeader(name string, value string) string {
+	if !strings.EqualFold(name, "Authorization") {
+		return value
+	}
+	if strings.HasPrefix(value, "Bearer ") {
+		return "Bearer " + redactedToken
+	}
+	return redactedToken
+}
+
+// curlCommand returns a curl command line equivalent to req, referencing the token as $ASTARTE_TOKEN
+func curlCommand(req *http.Request, body []byte) string {
+	command := []string{"curl", "-X", req.Method}
+
+	names := []string{}
+	for name := range req.Header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, value := range req.Header[name] {
+			if strings.EqualFold(name, "Authorization") {
+				// Double quotes let the shell expand the variable
+				command = append(command, "-H", `"Authorization: Bearer $ASTARTE_TOKEN"`)
+				continue
+			}
+			command = append(command, "-H", shellQuote(name+": "+value))
+		}
+	}
+	if len(body) > 0 {
+		command = append(command, "--data", shellQuote(string(bytes.TrimSpace(body))))
+	}
+	command = append(command, shellQuote(req.URL.String()))
+
+	return strings.Join(command, " ")
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
@@ -0,0 +1,64 @@
+// Copyright © 2019 Ispirata Srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/astarte-platform/astartectl/astartetest"
+	"github.com/astarte-platform/astartectl/client"
+	"github.com/astarte-platform/astartectl/utils"
+)
+
+func TestTracingTransport(t *testing.T) {
+	server, err := astartetest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	realm := server.AddRealm(testRealm)
+	token := realm.Token(utils.Pairing)
+
+	var trace bytes.Buffer
+	astarteAPIClient, err := client.NewClient(server.URL(), client.NewTracingHTTPClient(&trace, client.TraceBodies, true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := astarteAPIClient.Pairing.RegisterDevice(testRealm, testDeviceID, token); err != nil {
+		t.Fatal(err)
+	}
+
+	out := trace.String()
+	if strings.Contains(out, token) {
+		t.Errorf("token leaked in trace: %s", out)
+	}
+	if secret := realm.Device(testDeviceID).CredentialsSecret(); strings.Contains(out, secret) {
+		t.Errorf("credentials secret leaked in trace: %s", out)
+	}
+	for _, expected := range []string{
+		"POST " + server.URL() + "/pairing/v1/test/agent/devices 201 Created in",
+		"Authorization: Bearer <redacted>",
+		`Request body: {"data":{"hw_id":"` + testDeviceID + `"}}`,
+		`Response body: {"data":{"credentials_secret":"<redacted>"}}`,
+		`curl -X POST -H 'Accept: application/json' -H "Authorization: Bearer $ASTARTE_TOKEN"`,
+		`--data '{"data":{"hw_id":"` + testDeviceID + `"}}' '` + server.URL() + `/pairing/v1/test/agent/devices'`,
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("trace does not contain %q: %s", expected, out)
+		}
+	}
+}
@@ -19,6 +19,7 @@ import (
 	"fmt"
 
 	"github.com/astarte-platform/astartectl/client"
+	"github.com/astarte-platform/astartectl/cmd/config"
 
 	"github.com/astarte-platform/astartectl/utils"
 	"github.com/spf13/cobra"
@@ -59,13 +60,13 @@ func appEnginePersistentPreRunE(cmd *cobra.Command, args []string) error {
 	if appEngineURLOverride != "" {
 		// Use explicit appengine-url
 		var err error
-		astarteAPIClient, err = client.NewClientWithIndividualURLs(appEngineURLOverride, "", "", realmManagementURLOverride, nil)
+		astarteAPIClient, err = client.NewClientWithIndividualURLs(appEngineURLOverride, "", "", realmManagementURLOverride, config.HTTPClient())
 		if err != nil {
 			return err
 		}
 	} else if astarteURL != "" {
 		var err error
-		astarteAPIClient, err = client.NewClient(astarteURL, nil)
+		astarteAPIClient, err = client.NewClient(astarteURL, config.HTTPClient())
 		if err != nil {
 			return err
 		}
@@ -75,7 +76,10 @@ func appEnginePersistentPreRunE(cmd *cobra.Command, args []string) error {
 
 	viper.BindPFlag("realm.key", cmd.Flags().Lookup("realm-key"))
 	appEngineKey := viper.GetString("realm.key")
-	explicitToken := viper.GetString("token")
+	explicitToken, err := config.GetExplicitToken()
+	if err != nil {
+		return err
+	}
 	if appEngineKey == "" && explicitToken == "" {
 		return errors.New("realm-key or token is required")
 	}
@@ -88,11 +92,11 @@ func appEnginePersistentPreRunE(cmd *cobra.Command, args []string) error {
 
 	if explicitToken == "" {
 		var err error
-		appEngineJwt, err = generateAppEngineJWT(appEngineKey)
+		appEngineJwt, err = generateAppEngineJWT(appEngineKey, cmd, args)
 		if err != nil {
 			return err
 		}
-		realmManagementJwt, err = generateRealmManagementJWT(appEngineKey)
+		realmManagementJwt, err = generateRealmManagementJWT(appEngineKey, cmd, args)
 		if err != nil {
 			return err
 		}
@@ -104,12 +108,51 @@ func appEnginePersistentPreRunE(cmd *cobra.Command, args []string) error {
 	return nil
 }
 
-func generateAppEngineJWT(privateKey string) (jwtString string, err error) {
-	return utils.GenerateAstarteJWTFromKeyFile(privateKey, utils.AppEngine, nil, 300)
+// refreshJWTs obtains new tokens, running the token command again or minting them from the realm key.
+// Long running commands call it periodically, as tokens expire.
+func refreshJWTs(cmd *cobra.Command, args []string) error {
+	explicitToken, err := config.GetExplicitToken()
+	if err != nil {
+		return err
+	}
+	if explicitToken != "" {
+		appEngineJwt = explicitToken
+		realmManagementJwt = explicitToken
+		return nil
+	}
+
+	appEngineKey := viper.GetString("realm.key")
+	appEngineJwt, err = generateAppEngineJWT(appEngineKey, cmd, args)
+	if err != nil {
+		return err
+	}
+	realmManagementJwt, err = generateRealmManagementJWT(appEngineKey, cmd, args)
+	return err
+}
+
+func generateAppEngineJWT(privateKey string, cmd *cobra.Command, args []string) (jwtString string, err error) {
+	if !viper.GetBool("least-privilege-tokens") {
+		return utils.GenerateAstarteJWTFromKeyFile(privateKey, utils.AppEngine, nil, 300)
+	}
+
+	claims := utils.ExpandAuthorizationClaims(cmd.Annotations, utils.AppEngine, args)
+	if len(claims) == 0 {
+		return "", fmt.Errorf("%s does not declare the AppEngine claims it needs, and cannot be used with least-privilege-tokens", cmd.CommandPath())
+	}
+	return utils.GenerateAstarteJWTFromKeyFile(privateKey, utils.AppEngine, claims, utils.LeastPrivilegeTokenTTL)
 }
 
-func generateRealmManagementJWT(privateKey string) (jwtString string, err error) {
-	return utils.GenerateAstarteJWTFromKeyFile(privateKey, utils.RealmManagement, nil, 300)
+func generateRealmManagementJWT(privateKey string, cmd *cobra.Command, args []string) (jwtString string, err error) {
+	if !viper.GetBool("least-privilege-tokens") {
+		return utils.GenerateAstarteJWTFromKeyFile(privateKey, utils.RealmManagement, nil, 300)
+	}
+
+	// Realm Management is not needed by every command: when no claims are declared, no token is minted at all.
+	claims := utils.ExpandAuthorizationClaims(cmd.Annotations, utils.RealmManagement, args)
+	if len(claims) == 0 {
+		return "", nil
+	}
+	return utils.GenerateAstarteJWTFromKeyFile(privateKey, utils.RealmManagement, claims, utils.LeastPrivilegeTokenTTL)
 }
 
 func deviceIdentifierTypeFromFlags(deviceIdentifier string, forceDeviceIdentifier string) (client.DeviceIdentifierType, error) {
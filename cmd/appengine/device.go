@@ -15,7 +15,6 @@
 package appengine
 
 import (
-	"encoding/json"
 	"fmt"
 	"os"
 	"strings"
@@ -24,9 +23,9 @@ import (
 
 	"code.cloudfoundry.org/bytefmt"
 	"github.com/astarte-platform/astartectl/client"
+	"github.com/astarte-platform/astartectl/cmd/output"
 	"github.com/astarte-platform/astartectl/common"
 	"github.com/astarte-platform/astartectl/utils"
-	"github.com/jedib0t/go-pretty/table"
 
 	"github.com/araddon/dateparse"
 
@@ -48,6 +47,9 @@ var devicesListCmd = &cobra.Command{
 	Example: `  astartectl appengine devices list`,
 	RunE:    devicesListF,
 	Aliases: []string{"ls"},
+	Annotations: map[string]string{
+		utils.AuthorizationClaimsAnnotation(utils.AppEngine): "GET::devices",
+	},
 }
 
 var devicesShowCmd = &cobra.Command{
@@ -60,6 +62,9 @@ this is automatically determined - however, you can tweak this behavior by using
 	Example: `  astartectl appengine devices show 2TBn-jNESuuHamE2Zo1anA`,
 	Args:    cobra.ExactArgs(1),
 	RunE:    devicesShowF,
+	Annotations: map[string]string{
+		utils.AuthorizationClaimsAnnotation(utils.AppEngine): "GET::(devices|devices-by-alias)/$1",
+	},
 }
 
 var devicesDataSnapshotCmd = &cobra.Command{
@@ -75,6 +80,10 @@ this is automatically determined - however, you can tweak this behavior by using
 	Example: `  astartectl appengine devices data-snapshot 2TBn-jNESuuHamE2Zo1anA`,
 	Args:    cobra.RangeArgs(1, 2),
 	RunE:    devicesDataSnapshotF,
+	Annotations: map[string]string{
+		utils.AuthorizationClaimsAnnotation(utils.AppEngine):       "GET::(devices|devices-by-alias)/$1\nGET::(devices|devices-by-alias)/$1/interfaces/$2",
+		utils.AuthorizationClaimsAnnotation(utils.RealmManagement): "GET::interfaces/$2/[0-9]+",
+	},
 }
 
 var devicesGetSamplesCmd = &cobra.Command{
@@ -91,17 +100,10 @@ this is automatically determined - however, you can tweak this behavior by using
 	Example: `  astartectl appengine devices get-samples 2TBn-jNESuuHamE2Zo1anA com.my.interface /my/path`,
 	Args:    cobra.ExactArgs(3),
 	RunE:    devicesGetSamplesF,
-}
-
-var supportedOutputTypes = []string{"default", "csv", "json"}
-
-func isASupportedOutputType(outputType string) bool {
-	for _, s := range supportedOutputTypes {
-		if s == outputType {
-			return true
-		}
-	}
-	return false
+	Annotations: map[string]string{
+		utils.AuthorizationClaimsAnnotation(utils.AppEngine):       "GET::(devices|devices-by-alias)/$1\nGET::(devices|devices-by-alias)/$1/interfaces/$2(${3})?",
+		utils.AuthorizationClaimsAnnotation(utils.RealmManagement): "GET::interfaces/$2/[0-9]+",
+	},
 }
 
 func init() {
@@ -111,17 +113,20 @@ func init() {
 	devicesGetSamplesCmd.Flags().Bool("ascending", false, "When set, returns samples in ascending order rather than descending.")
 	devicesGetSamplesCmd.Flags().String("since", "", "When set, returns only samples newer than the provided date.")
 	devicesGetSamplesCmd.Flags().String("to", "", "When set, returns only samples older than the provided date.")
-	devicesGetSamplesCmd.Flags().StringP("output", "o", "default", "The type of output (default,csv,json)")
+	output.AddFlag(devicesGetSamplesCmd)
 	devicesGetSamplesCmd.Flags().String("force-id-type", "", "When set, rather than autodetecting, it forces the device ID to be evaluated as a (device-id,alias).")
 	devicesGetSamplesCmd.Flags().Bool("aggregate", false, "When set, if Realm Management checks are disabled, it forces resolution of the interface as an aggregate datastream.")
 	devicesGetSamplesCmd.Flags().Bool("skip-realm-management-checks", false, "When set, it skips any consistency checks on Realm Management before performing the Query. This might lead to unexpected errors.")
 
-	devicesDataSnapshotCmd.Flags().StringP("output", "o", "default", "The type of output (default,csv,json)")
+	output.AddFlag(devicesDataSnapshotCmd)
 	devicesDataSnapshotCmd.Flags().String("force-id-type", "", "When set, rather than autodetecting, it forces the device ID to be evaluated as a (device-id,alias).")
 	devicesDataSnapshotCmd.Flags().Bool("skip-realm-management-checks", false, "When set, it skips any consistency checks on Realm Management before performing the Query. This might lead to unexpected errors. This has effect only if data-snapshot is invoked for a specific interface.")
 	devicesDataSnapshotCmd.Flags().String("interface-type", "", "When set, if Realm Management checks are disabled, it forces resolution of the interface as the specified type. Valid options are: properties, individual-datastream, aggregate-datastream, individual-parametric-datastream, aggregate-parametric-datastream.")
 
 	devicesShowCmd.Flags().String("force-id-type", "", "When set, rather than autodetecting, it forces the device ID to be evaluated as a (device-id,alias).")
+	output.AddFlag(devicesShowCmd)
+
+	output.AddFlag(devicesListCmd)
 
 	devicesCmd.AddCommand(
 		devicesListCmd,
@@ -132,14 +137,22 @@ func init() {
 }
 
 func devicesListF(command *cobra.Command, args []string) error {
+	outputFormat, err := output.FormatFromFlags(command)
+	if err != nil {
+		return err
+	}
+
 	devices, err := astarteAPIClient.AppEngine.ListDevices(realm, appEngineJwt)
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
 
-	fmt.Println(devices)
-	return nil
+	t := output.NewTable("Device ID")
+	for _, device := range devices {
+		t.AppendRow(device)
+	}
+	return output.Print(os.Stdout, outputFormat, devices, t)
 }
 
 func prettyPrintDeviceDetails(deviceDetails client.DeviceDetails) {
@@ -173,6 +186,10 @@ func prettyPrintDeviceDetails(deviceDetails client.DeviceDetails) {
 
 func devicesShowF(command *cobra.Command, args []string) error {
 	deviceID := args[0]
+	outputFormat, err := output.FormatFromFlags(command)
+	if err != nil {
+		return err
+	}
 	forceIDType, err := command.Flags().GetString("force-id-type")
 	if err != nil {
 		return err
@@ -188,23 +205,11 @@ func devicesShowF(command *cobra.Command, args []string) error {
 		os.Exit(1)
 	}
 
-	prettyPrintDeviceDetails(deviceDetails)
-	return nil
-}
-
-func tableWriterForOutputType(outputType string) table.Writer {
-	t := table.NewWriter()
-	switch outputType {
-	case "default":
-		t.SetOutputMirror(os.Stdout)
-		t.SetStyle(table.StyleLight)
-	case "csv":
-		t.SetOutputMirror(os.Stdout)
-	case "json":
-	default:
+	if outputFormat.IsHumanReadable() {
+		prettyPrintDeviceDetails(deviceDetails)
 		return nil
 	}
-	return t
+	return output.Print(os.Stdout, outputFormat, deviceDetails, nil)
 }
 
 func devicesDataSnapshotF(command *cobra.Command, args []string) error {
@@ -236,19 +241,13 @@ func devicesDataSnapshotF(command *cobra.Command, args []string) error {
 		return fmt.Errorf("When using --skip-realm-management-checks, --interface-type should always be specified")
 	}
 
-	outputType, err := command.Flags().GetString("output")
+	outputFormat, err := output.FormatFromFlags(command)
 	if err != nil {
 		return err
 	}
-	if !isASupportedOutputType(outputType) {
-		return fmt.Errorf("%v is not a supported output type. Supported output types are %v", outputType, supportedOutputTypes)
-	}
 
 	// Go with the table header
-	t := tableWriterForOutputType(outputType)
-	if snapshotInterface == "" {
-		t.AppendHeader(table.Row{"Interface", "Path", "Value", "Ownership", "Timestamp (Datastream only)"})
-	}
+	t := output.NewTable("Interface", "Path", "Value", "Ownership", "Timestamp (Datastream only)")
 	jsonOutput := make(map[string]interface{})
 
 	if snapshotInterface != "" {
@@ -318,7 +317,7 @@ func devicesDataSnapshotF(command *cobra.Command, args []string) error {
 
 		switch interfaceType {
 		case common.DatastreamType:
-			t.AppendHeader(table.Row{"Interface", "Path", "Value", "Timestamp"})
+			t = output.NewTable("Interface", "Path", "Value", "Timestamp")
 			if interfaceAggregation == common.ObjectAggregation {
 				if isParametricInterface {
 					val, err := astarteAPIClient.AppEngine.GetAggregateParametricDatastreamSnapshot(realm, deviceID, deviceIdentifierType, snapshotInterface, appEngineJwt)
@@ -326,12 +325,12 @@ func devicesDataSnapshotF(command *cobra.Command, args []string) error {
 						return err
 					}
 					for path, aggregate := range val {
-						if outputType == "json" {
+						if !outputFormat.IsTabular() {
 							jsonOutput[snapshotInterface] = val
 						} else {
 							for _, k := range aggregate.Values.Keys() {
 								v, _ := aggregate.Values.Get(k)
-								t.AppendRow([]interface{}{snapshotInterface, fmt.Sprintf("%s/%s", path, k), v, timestampForOutput(aggregate.Timestamp, outputType)})
+								t.AppendRow(snapshotInterface, fmt.Sprintf("%s/%s", path, k), v, outputFormat.Timestamp(aggregate.Timestamp))
 							}
 						}
 					}
@@ -340,12 +339,12 @@ func devicesDataSnapshotF(command *cobra.Command, args []string) error {
 					if err != nil {
 						return err
 					}
-					if outputType == "json" {
+					if !outputFormat.IsTabular() {
 						jsonOutput[snapshotInterface] = val
 					} else {
 						for _, k := range val.Values.Keys() {
 							v, _ := val.Values.Get(k)
-							t.AppendRow([]interface{}{snapshotInterface, fmt.Sprintf("/%s", k), v, timestampForOutput(val.Timestamp, outputType)})
+							t.AppendRow(snapshotInterface, fmt.Sprintf("/%s", k), v, outputFormat.Timestamp(val.Timestamp))
 						}
 					}
 				}
@@ -357,12 +356,12 @@ func devicesDataSnapshotF(command *cobra.Command, args []string) error {
 				jsonRepresentation := make(map[string]interface{})
 				for k, v := range val {
 					jsonRepresentation[k] = v
-					t.AppendRow([]interface{}{snapshotInterface, k, v.Value, timestampForOutput(v.Timestamp, outputType)})
+					t.AppendRow(snapshotInterface, k, v.Value, outputFormat.Timestamp(v.Timestamp))
 				}
 				jsonOutput[snapshotInterface] = jsonRepresentation
 			}
 		case common.PropertiesType:
-			t.AppendHeader(table.Row{"Interface", "Path", "Value"})
+			t = output.NewTable("Interface", "Path", "Value")
 			val, err := astarteAPIClient.AppEngine.GetProperties(realm, deviceID, deviceIdentifierType, snapshotInterface, appEngineJwt)
 			if err != nil {
 				return err
@@ -370,7 +369,7 @@ func devicesDataSnapshotF(command *cobra.Command, args []string) error {
 			jsonRepresentation := make(map[string]interface{})
 			for k, v := range val {
 				jsonRepresentation[k] = v
-				t.AppendRow([]interface{}{snapshotInterface, k, v})
+				t.AppendRow(snapshotInterface, k, v)
 			}
 			jsonOutput[snapshotInterface] = jsonRepresentation
 		}
@@ -398,13 +397,13 @@ func devicesDataSnapshotF(command *cobra.Command, args []string) error {
 							return err
 						}
 						for path, aggregate := range val {
-							if outputType == "json" {
+							if !outputFormat.IsTabular() {
 								jsonOutput[astarteInterface] = val
 							} else {
 								for _, k := range aggregate.Values.Keys() {
 									v, _ := aggregate.Values.Get(k)
-									t.AppendRow([]interface{}{astarteInterface, fmt.Sprintf("%s/%s", path, k), v, interfaceDescription.Ownership.String(),
-										timestampForOutput(aggregate.Timestamp, outputType)})
+									t.AppendRow(astarteInterface, fmt.Sprintf("%s/%s", path, k), v, interfaceDescription.Ownership.String(),
+										outputFormat.Timestamp(aggregate.Timestamp))
 								}
 							}
 						}
@@ -413,13 +412,13 @@ func devicesDataSnapshotF(command *cobra.Command, args []string) error {
 						if err != nil {
 							return err
 						}
-						if outputType == "json" {
+						if !outputFormat.IsTabular() {
 							jsonOutput[astarteInterface] = val
 						} else {
 							for _, k := range val.Values.Keys() {
 								v, _ := val.Values.Get(k)
-								t.AppendRow([]interface{}{astarteInterface, fmt.Sprintf("/%s", k), v, interfaceDescription.Ownership.String(),
-									timestampForOutput(val.Timestamp, outputType)})
+								t.AppendRow(astarteInterface, fmt.Sprintf("/%s", k), v, interfaceDescription.Ownership.String(),
+									outputFormat.Timestamp(val.Timestamp))
 							}
 						}
 					}
@@ -431,8 +430,8 @@ func devicesDataSnapshotF(command *cobra.Command, args []string) error {
 					jsonRepresentation := make(map[string]interface{})
 					for k, v := range val {
 						jsonRepresentation[k] = v
-						t.AppendRow([]interface{}{astarteInterface, k, v.Value, interfaceDescription.Ownership.String(),
-							timestampForOutput(v.Timestamp, outputType)})
+						t.AppendRow(astarteInterface, k, v.Value, interfaceDescription.Ownership.String(),
+							outputFormat.Timestamp(v.Timestamp))
 					}
 					jsonOutput[astarteInterface] = jsonRepresentation
 				}
@@ -444,7 +443,7 @@ func devicesDataSnapshotF(command *cobra.Command, args []string) error {
 				jsonRepresentation := make(map[string]interface{})
 				for k, v := range val {
 					jsonRepresentation[k] = v
-					t.AppendRow([]interface{}{astarteInterface, k, v, interfaceDescription.Ownership.String(), ""})
+					t.AppendRow(astarteInterface, k, v, interfaceDescription.Ownership.String(), "")
 				}
 				jsonOutput[astarteInterface] = jsonRepresentation
 			}
@@ -452,9 +451,7 @@ func devicesDataSnapshotF(command *cobra.Command, args []string) error {
 	}
 
 	// Done
-	renderOutput(t, jsonOutput, outputType)
-
-	return nil
+	return output.Print(os.Stdout, outputFormat, jsonOutput, t)
 }
 
 func devicesGetSamplesF(command *cobra.Command, args []string) error {
@@ -511,13 +508,10 @@ func devicesGetSamplesF(command *cobra.Command, args []string) error {
 			return err
 		}
 	}
-	outputType, err := command.Flags().GetString("output")
+	outputFormat, err := output.FormatFromFlags(command)
 	if err != nil {
 		return err
 	}
-	if !isASupportedOutputType(outputType) {
-		return fmt.Errorf("%v is not a supported output type. Supported output types are %v", outputType, supportedOutputTypes)
-	}
 
 	var isAggregate bool
 	if !skipRealmManagementChecks {
@@ -573,10 +567,9 @@ func devicesGetSamplesF(command *cobra.Command, args []string) error {
 	}
 
 	// We are good to go.
-	t := tableWriterForOutputType(outputType)
 	if !isAggregate {
 		// Go with the table header
-		t.AppendHeader(table.Row{"Timestamp", "Value"})
+		t := output.NewTable("Timestamp", "Value")
 		printedValues := 0
 		jsonOutput := []client.DatastreamValue{}
 		datastreamPaginator := astarteAPIClient.AppEngine.GetDatastreamsTimeWindowPaginator(realm, deviceID,
@@ -588,22 +581,21 @@ func devicesGetSamplesF(command *cobra.Command, args []string) error {
 				os.Exit(1)
 			}
 
-			if outputType == "json" {
+			if !outputFormat.IsTabular() {
 				jsonOutput = append(jsonOutput, page...)
 			} else {
 				for _, v := range page {
-					t.AppendRow([]interface{}{timestampForOutput(v.Timestamp, outputType), v.Value})
+					t.AppendRow(outputFormat.Timestamp(v.Timestamp), v.Value)
 					printedValues++
 					if printedValues >= limit && limit > 0 {
-						renderOutput(t, jsonOutput, outputType)
-						return nil
+						return output.Print(os.Stdout, outputFormat, jsonOutput, t)
 					}
 				}
 			}
 		}
-		renderOutput(t, jsonOutput, outputType)
+		return output.Print(os.Stdout, outputFormat, jsonOutput, t)
 	} else {
-		headerRow := table.Row{"Timestamp"}
+		t := output.NewTable("Timestamp")
 		headerPrinted := false
 
 		jsonOutput := []client.DatastreamAggregateValue{}
@@ -617,59 +609,29 @@ func devicesGetSamplesF(command *cobra.Command, args []string) error {
 				os.Exit(1)
 			}
 
-			if outputType == "json" {
+			if !outputFormat.IsTabular() {
 				jsonOutput = append(jsonOutput, page...)
 			} else {
 				for _, v := range page {
 					// Iterate the aggregate
 					line := []interface{}{}
-					line = append(line, timestampForOutput(v.Timestamp, outputType))
+					line = append(line, outputFormat.Timestamp(v.Timestamp))
 					for _, path := range v.Values.Keys() {
 						value, _ := v.Values.Get(path)
 						if !headerPrinted {
-							headerRow = append(headerRow, fmt.Sprintf("%s/%s", interfacePath, path))
+							t.Columns = append(t.Columns, output.Column{Name: fmt.Sprintf("%s/%s", interfacePath, path)})
 						}
 						line = append(line, value)
 					}
-					if !headerPrinted {
-						t.AppendHeader(headerRow)
-						headerPrinted = true
-					}
-					t.AppendRow(line)
+					headerPrinted = true
+					t.AppendRow(line...)
 					printedValues++
 					if printedValues >= limit && limit > 0 {
-						renderOutput(t, jsonOutput, outputType)
-						return nil
+						return output.Print(os.Stdout, outputFormat, jsonOutput, t)
 					}
 				}
 			}
 		}
-		renderOutput(t, jsonOutput, outputType)
-	}
-
-	return nil
-}
-
-func timestampForOutput(timestamp time.Time, outputType string) string {
-	switch outputType {
-	case "default":
-		return timestamp.String()
-	case "csv":
-		return timestamp.Format(time.RFC3339Nano)
-	case "json":
-	}
-
-	return ""
-}
-
-func renderOutput(t table.Writer, jsonOutput interface{}, outputType string) {
-	switch outputType {
-	case "default":
-		t.Render()
-	case "csv":
-		t.RenderCSV()
-	case "json":
-		respJSON, _ := json.MarshalIndent(jsonOutput, "", "  ")
-		fmt.Println(string(respJSON))
+		return output.Print(os.Stdout, outputFormat, jsonOutput, t)
 	}
 }
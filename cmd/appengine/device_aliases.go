@@ -17,8 +17,10 @@ package appengine
 import (
 	"fmt"
 	"os"
+	"sort"
 	"strings"
 
+	"github.com/astarte-platform/astartectl/cmd/output"
 	"github.com/astarte-platform/astartectl/utils"
 	"github.com/spf13/cobra"
 )
@@ -39,6 +41,9 @@ var aliasesListCmd = &cobra.Command{
 	Args:    cobra.ExactArgs(1),
 	RunE:    aliasesListF,
 	Aliases: []string{"ls"},
+	Annotations: map[string]string{
+		utils.AuthorizationClaimsAnnotation(utils.AppEngine): "GET::devices/$1",
+	},
 }
 
 var aliasesAddCmd = &cobra.Command{
@@ -48,6 +53,9 @@ var aliasesAddCmd = &cobra.Command{
 	Example: `  astartectl appengine devices aliases add 2TBn-jNESuuHamE2Zo1anA my-alias-tag=device12345`,
 	Args:    cobra.ExactArgs(2),
 	RunE:    aliasesAddF,
+	Annotations: map[string]string{
+		utils.AuthorizationClaimsAnnotation(utils.AppEngine): "PATCH::devices/$1",
+	},
 }
 
 var aliasesRemoveCmd = &cobra.Command{
@@ -58,11 +66,16 @@ var aliasesRemoveCmd = &cobra.Command{
 	Args:    cobra.ExactArgs(2),
 	RunE:    aliasesRemoveF,
 	Aliases: []string{"rm"},
+	Annotations: map[string]string{
+		utils.AuthorizationClaimsAnnotation(utils.AppEngine): "PATCH::devices/$1",
+	},
 }
 
 func init() {
 	devicesCmd.AddCommand(aliasesCmd)
 
+	output.AddFlag(aliasesListCmd)
+
 	aliasesCmd.AddCommand(
 		aliasesListCmd,
 		aliasesAddCmd,
@@ -76,14 +89,26 @@ func aliasesListF(command *cobra.Command, args []string) error {
 		fmt.Printf("%s is not a valid Astarte Device ID\n", deviceID)
 		os.Exit(1)
 	}
+	outputFormat, err := output.FormatFromFlags(command)
+	if err != nil {
+		return err
+	}
 	aliases, err := astarteAPIClient.AppEngine.ListDeviceAliases(realm, deviceID, appEngineJwt)
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
 
-	fmt.Printf("%v\n", aliases)
-	return nil
+	aliasTags := []string{}
+	for aliasTag := range aliases {
+		aliasTags = append(aliasTags, aliasTag)
+	}
+	sort.Strings(aliasTags)
+	t := output.NewTable("Tag", "Alias")
+	for _, aliasTag := range aliasTags {
+		t.AppendRow(aliasTag, aliases[aliasTag])
+	}
+	return output.Print(os.Stdout, outputFormat, aliases, t)
 }
 
 func aliasesAddF(command *cobra.Command, args []string) error {
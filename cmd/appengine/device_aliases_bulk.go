@@ -0,0 +1,385 @@
+// Copyright © 2019 Ispirata Srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package appengine
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/astarte-platform/astartectl/client"
+	"github.com/astarte-platform/astartectl/cmd/output"
+	"github.com/astarte-platform/astartectl/utils"
+	"github.com/spf13/cobra"
+)
+
+var aliasesImportCmd = &cobra.Command{
+	Use:   "import <file>",
+	Short: "Assign aliases to devices in bulk",
+	Long: `Assign aliases to devices from a CSV or JSON mapping file, and print the result of each row.
+
+CSV files have a header with device_id, tag and alias columns. JSON files hold an array of objects with
+device_id, tag and alias keys. The output of aliases export with -o csv or -o json can be imported as is.
+An empty alias removes the tag from the device.
+
+Rows assigning an alias which is already taken by another device, or which is assigned to more than one
+device in the file, are reported as conflicts and skipped. Rows whose alias cannot be looked up fail.
+With --dry-run, rows are checked but no alias is changed.`,
+	Example: `  astartectl appengine devices aliases import serials.csv
+  astartectl appengine devices aliases import customers.json --dry-run`,
+	Args: cobra.ExactArgs(1),
+	RunE: aliasesImportF,
+	Annotations: map[string]string{
+		utils.AuthorizationClaimsAnnotation(utils.AppEngine): "GET::devices/[^/]+\nGET::devices-by-alias/[^/]+\nPATCH::devices/[^/]+",
+	},
+}
+
+var aliasesExportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Export the aliases of all devices",
+	Long: `Export the aliases of all devices in the realm, one row per alias. With -o csv or -o json, the result
+can be imported with aliases import.`,
+	Example: `  astartectl appengine devices aliases export -o csv > aliases.csv`,
+	Args:    cobra.NoArgs,
+	RunE:    aliasesExportF,
+	Annotations: map[string]string{
+		utils.AuthorizationClaimsAnnotation(utils.AppEngine): "GET::devices\nGET::devices/[^/]+",
+	},
+}
+
+// aliasRow is a single row of an alias mapping file
+type aliasRow struct {
+	DeviceID string `json:"device_id"`
+	Tag      string `json:"tag"`
+	Alias    string `json:"alias"`
+}
+
+// aliasRowResult is the outcome of importing an aliasRow
+type aliasRowResult struct {
+	Row      int    `json:"row"`
+	DeviceID string `json:"device_id"`
+	Tag      string `json:"tag"`
+	Alias    string `json:"alias"`
+	Result   string `json:"result"`
+	Details  string `json:"details,omitempty"`
+}
+
+// Results of an aliasRow import
+const (
+	aliasAdded     = "added"
+	aliasReplaced  = "replaced"
+	aliasRemoved   = "removed"
+	aliasUnchanged = "unchanged"
+	aliasConflict  = "conflict"
+	aliasInvalid   = "invalid"
+	aliasFailed    = "failed"
+)
+
+func init() {
+	aliasesImportCmd.Flags().Bool("dry-run", false, "Check rows and report what would be done, without changing any alias")
+	aliasesImportCmd.Flags().Int("concurrency", 8, "Number of devices updated concurrently")
+	aliasesImportCmd.Flags().String("format", "", "Format of the mapping file (csv, json). Defaults to the file extension.")
+	output.AddFlag(aliasesImportCmd)
+
+	aliasesExportCmd.Flags().Int("concurrency", 8, "Number of devices queried concurrently")
+	output.AddFlag(aliasesExportCmd)
+
+	aliasesCmd.AddCommand(aliasesImportCmd, aliasesExportCmd)
+}
+
+func aliasesImportF(command *cobra.Command, args []string) error {
+	dryRun, err := command.Flags().GetBool("dry-run")
+	if err != nil {
+		return err
+	}
+	concurrency, err := command.Flags().GetInt("concurrency")
+	if err != nil {
+		return err
+	}
+	if concurrency < 1 {
+		return errors.New("concurrency must be at least 1")
+	}
+	format, err := command.Flags().GetString("format")
+	if err != nil {
+		return err
+	}
+	outputFormat, err := output.FormatFromFlags(command)
+	if err != nil {
+		return err
+	}
+
+	rows, err := readAliasRows(args[0], format)
+	if err != nil {
+		return err
+	}
+
+	results := make([]aliasRowResult, len(rows))
+	rowsByDevice := map[string][]int{}
+	for i, row := range rows {
+		results[i] = aliasRowResult{Row: i + 1, DeviceID: row.DeviceID, Tag: row.Tag, Alias: row.Alias}
+		switch {
+		case !utils.IsValidAstarteDeviceID(row.DeviceID):
+			results[i].Result = aliasInvalid
+			results[i].Details = "not a valid Astarte Device ID"
+		case row.Tag == "":
+			results[i].Result = aliasInvalid
+			results[i].Details = "empty tag"
+		default:
+			rowsByDevice[row.DeviceID] = append(rowsByDevice[row.DeviceID], i)
+		}
+	}
+	markInFileAliasConflicts(rows, results)
+
+	// Rows of the same device are applied sequentially, devices are handled concurrently
+	deviceIDs := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for deviceID := range deviceIDs {
+				importDeviceAliases(deviceID, rows, rowsByDevice[deviceID], results, dryRun)
+			}
+		}()
+	}
+	for deviceID := range rowsByDevice {
+		deviceIDs <- deviceID
+	}
+	close(deviceIDs)
+	wg.Wait()
+
+	t := output.NewTable("Row", "Device ID", "Tag", "Alias", "Result", "Details")
+	failures := 0
+	for _, result := range results {
+		t.AppendRow(result.Row, result.DeviceID, result.Tag, result.Alias, result.Result, result.Details)
+		switch result.Result {
+		case aliasConflict, aliasInvalid, aliasFailed:
+			failures++
+		}
+	}
+	if err := output.Print(os.Stdout, outputFormat, results, t); err != nil {
+		return err
+	}
+
+	if failures > 0 {
+		fmt.Fprintf(os.Stderr, "%d of %d rows could not be imported\n", failures, len(results))
+		os.Exit(1)
+	}
+	return nil
+}
+
+// markInFileAliasConflicts marks as conflicting the rows assigning the same alias to different devices
+func markInFileAliasConflicts(rows []aliasRow, results []aliasRowResult) {
+	devicesByAlias := map[string]map[string]bool{}
+	for i, row := range rows {
+		if row.Alias == "" || results[i].Result != "" {
+			continue
+		}
+		if devicesByAlias[row.Alias] == nil {
+			devicesByAlias[row.Alias] = map[string]bool{}
+		}
+		devicesByAlias[row.Alias][row.DeviceID] = true
+	}
+
+	for i, row := range rows {
+		if row.Alias != "" && results[i].Result == "" && len(devicesByAlias[row.Alias]) > 1 {
+			results[i].Result = aliasConflict
+			results[i].Details = "alias assigned to more than one device in the file"
+		}
+	}
+}
+
+func importDeviceAliases(deviceID string, rows []aliasRow, rowIndexes []int, results []aliasRowResult, dryRun bool) {
+	setResult := func(i int, result string, details string) {
+		if dryRun && (result == aliasAdded || result == aliasReplaced || result == aliasRemoved) {
+			details = "dry run, would be " + result
+			result = aliasUnchanged
+		}
+		results[i].Result = result
+		results[i].Details = details
+	}
+
+	aliases, err := astarteAPIClient.AppEngine.ListDeviceAliases(realm, deviceID, appEngineJwt)
+	if err != nil {
+		for _, i := range rowIndexes {
+			if results[i].Result == "" {
+				setResult(i, aliasFailed, err.Error())
+			}
+		}
+		return
+	}
+	if aliases == nil {
+		aliases = map[string]string{}
+	}
+
+	for _, i := range rowIndexes {
+		if results[i].Result != "" {
+			continue
+		}
+		row := rows[i]
+		currentAlias, hasTag := aliases[row.Tag]
+
+		if row.Alias == "" {
+			if !hasTag {
+				setResult(i, aliasUnchanged, "tag not set")
+				continue
+			}
+			if !dryRun {
+				if err := astarteAPIClient.AppEngine.DeleteDeviceAlias(realm, deviceID, row.Tag, appEngineJwt); err != nil {
+					setResult(i, aliasFailed, err.Error())
+					continue
+				}
+			}
+			delete(aliases, row.Tag)
+			setResult(i, aliasRemoved, fmt.Sprintf("was %s", currentAlias))
+			continue
+		}
+
+		if hasTag && currentAlias == row.Alias {
+			setResult(i, aliasUnchanged, "")
+			continue
+		}
+		// Only a missing device means the alias is not taken
+		owner, err := astarteAPIClient.AppEngine.GetDevice(realm, row.Alias, client.AstarteDeviceAlias, appEngineJwt)
+		if err != nil {
+			if apiErr, ok := err.(*client.APIError); !ok || apiErr.StatusCode != http.StatusNotFound {
+				setResult(i, aliasFailed, fmt.Sprintf("could not check whether the alias is taken: %s", err))
+				continue
+			}
+		} else if owner.DeviceID != deviceID {
+			setResult(i, aliasConflict, fmt.Sprintf("alias already taken by %s", owner.DeviceID))
+			continue
+		}
+
+		if !dryRun {
+			if err := astarteAPIClient.AppEngine.AddDeviceAlias(realm, deviceID, row.Tag, row.Alias, appEngineJwt); err != nil {
+				setResult(i, aliasFailed, err.Error())
+				continue
+			}
+		}
+		aliases[row.Tag] = row.Alias
+		if hasTag {
+			setResult(i, aliasReplaced, fmt.Sprintf("was %s", currentAlias))
+		} else {
+			setResult(i, aliasAdded, "")
+		}
+	}
+}
+
+func readAliasRows(file string, format string) ([]aliasRow, error) {
+	if format == "" {
+		format = strings.TrimPrefix(strings.ToLower(filepath.Ext(file)), ".")
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	switch format {
+	case "json":
+		rows := []aliasRow{}
+		if err := json.NewDecoder(f).Decode(&rows); err != nil {
+			return nil, fmt.Errorf("Could not parse %s: %s", file, err)
+		}
+		return rows, nil
+	case "csv":
+		return readAliasRowsCSV(f, file)
+	}
+	return nil, fmt.Errorf("Unsupported mapping file format %q. Supported formats are csv and json", format)
+}
+
+func readAliasRowsCSV(r io.Reader, file string) ([]aliasRow, error) {
+	records, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse %s: %s", file, err)
+	}
+	if len(records) == 0 {
+		return []aliasRow{}, nil
+	}
+
+	// Headers are matched loosely, so that the table headers of aliases export are accepted too
+	columns := map[string]int{}
+	for i, header := range records[0] {
+		columns[strings.Replace(strings.ToLower(strings.TrimSpace(header)), " ", "_", -1)] = i
+	}
+	for _, column := range []string{"device_id", "tag", "alias"} {
+		if _, ok := columns[column]; !ok {
+			return nil, fmt.Errorf("%s has no %s column", file, column)
+		}
+	}
+
+	rows := []aliasRow{}
+	for _, record := range records[1:] {
+		rows = append(rows, aliasRow{
+			DeviceID: strings.TrimSpace(record[columns["device_id"]]),
+			Tag:      strings.TrimSpace(record[columns["tag"]]),
+			Alias:    strings.TrimSpace(record[columns["alias"]]),
+		})
+	}
+	return rows, nil
+}
+
+func aliasesExportF(command *cobra.Command, args []string) error {
+	concurrency, err := command.Flags().GetInt("concurrency")
+	if err != nil {
+		return err
+	}
+	if concurrency < 1 {
+		return errors.New("concurrency must be at least 1")
+	}
+	outputFormat, err := output.FormatFromFlags(command)
+	if err != nil {
+		return err
+	}
+
+	devices, err := astarteAPIClient.AppEngine.ListDevices(realm, appEngineJwt)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	// An incomplete export would silently lose aliases
+	devicesDetails, failedDevices := getDevicesDetails(devices, concurrency)
+	if failedDevices > 0 {
+		os.Exit(1)
+	}
+
+	rows := []aliasRow{}
+	for _, deviceDetails := range devicesDetails {
+		for tag, alias := range deviceDetails.Aliases {
+			rows = append(rows, aliasRow{DeviceID: deviceDetails.DeviceID, Tag: tag, Alias: alias})
+		}
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		if rows[i].DeviceID != rows[j].DeviceID {
+			return rows[i].DeviceID < rows[j].DeviceID
+		}
+		return rows[i].Tag < rows[j].Tag
+	})
+
+	t := output.NewTable("Device ID", "Tag", "Alias")
+	for _, row := range rows {
+		t.AppendRow(row.DeviceID, row.Tag, row.Alias)
+	}
+	return output.Print(os.Stdout, outputFormat, rows, t)
+}
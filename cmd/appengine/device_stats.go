@@ -0,0 +1,315 @@
+// Copyright © 2019 Ispirata Srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package appengine
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/bytefmt"
+	"github.com/astarte-platform/astartectl/client"
+	"github.com/astarte-platform/astartectl/cmd/output"
+	"github.com/astarte-platform/astartectl/utils"
+	"github.com/spf13/cobra"
+)
+
+var devicesStatsCmd = &cobra.Command{
+	Use:   "stats",
+	Short: "Show connectivity and traffic statistics of the realm's devices",
+	Long: `Show how many devices of the realm are connected, how many have never connected, how long ago
+disconnected devices were last seen, and which devices sent the most messages and data.
+
+Total and connected devices are read from the realm's device stats endpoint when Astarte provides it.
+All other statistics are computed from the details of each device, which are retrieved concurrently.
+Devices whose details cannot be retrieved are reported on stderr and left out. --counts-only skips this
+step, which might take a while on large realms.
+
+With csv output, the statistics of each device are printed instead.`,
+	Example: `  astartectl appengine devices stats
+  astartectl appengine devices stats --top 20 --concurrency 32
+  astartectl appengine devices stats -o json`,
+	Args: cobra.NoArgs,
+	RunE: devicesStatsF,
+	Annotations: map[string]string{
+		utils.AuthorizationClaimsAnnotation(utils.AppEngine): "GET::stats/devices\nGET::devices\nGET::devices/[^/]+",
+	},
+}
+
+// lastSeenBuckets are the upper bounds of the last seen histogram buckets
+var lastSeenBuckets = []struct {
+	label string
+	age   time.Duration
+}{
+	{"< 1 hour", time.Hour},
+	{"< 1 day", 24 * time.Hour},
+	{"< 1 week", 7 * 24 * time.Hour},
+	{"< 30 days", 30 * 24 * time.Hour},
+}
+
+type lastSeenBucket struct {
+	LastSeen string `json:"last_seen"`
+	Devices  int    `json:"devices"`
+}
+
+type deviceTraffic struct {
+	DeviceID              string `json:"device_id"`
+	TotalReceivedMessages int64  `json:"total_received_msgs"`
+	TotalReceivedBytes    uint64 `json:"total_received_bytes"`
+}
+
+type devicesStats struct {
+	TotalDevices          int64            `json:"total_devices"`
+	ConnectedDevices      int64            `json:"connected_devices"`
+	NeverConnectedDevices *int             `json:"never_connected_devices,omitempty"`
+	LastSeenHistogram     []lastSeenBucket `json:"last_seen_histogram,omitempty"`
+	TopByMessages         []deviceTraffic  `json:"top_by_messages,omitempty"`
+	TopByBytes            []deviceTraffic  `json:"top_by_bytes,omitempty"`
+	FailedDevices         int              `json:"failed_devices,omitempty"`
+}
+
+func init() {
+	devicesStatsCmd.Flags().Int("top", 10, "Number of devices to show in the top talkers tables")
+	devicesStatsCmd.Flags().Int("concurrency", 10, "Number of device details to retrieve concurrently")
+	devicesStatsCmd.Flags().Bool("counts-only", false, "Only show total and connected devices, without retrieving the details of each device")
+	output.AddFlag(devicesStatsCmd)
+
+	devicesCmd.AddCommand(devicesStatsCmd)
+}
+
+func devicesStatsF(command *cobra.Command, args []string) error {
+	outputFormat, err := output.FormatFromFlags(command)
+	if err != nil {
+		return err
+	}
+	top, err := command.Flags().GetInt("top")
+	if err != nil {
+		return err
+	}
+	if top < 0 {
+		return errors.New("top must not be negative")
+	}
+	concurrency, err := command.Flags().GetInt("concurrency")
+	if err != nil {
+		return err
+	}
+	if concurrency < 1 {
+		return errors.New("concurrency must be at least 1")
+	}
+	countsOnly, err := command.Flags().GetBool("counts-only")
+	if err != nil {
+		return err
+	}
+
+	realmStats, statsErr := astarteAPIClient.AppEngine.GetDevicesStats(realm, appEngineJwt)
+	if countsOnly {
+		if statsErr != nil {
+			fmt.Printf("Device stats are not available in this realm: %s\n", statsErr)
+			os.Exit(1)
+		}
+		return printDevicesStats(outputFormat, devicesStats{
+			TotalDevices:     realmStats.TotalDevices,
+			ConnectedDevices: realmStats.ConnectedDevices,
+		}, nil)
+	}
+
+	devices, err := astarteAPIClient.AppEngine.ListDevices(realm, appEngineJwt)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	devicesDetails, failedDevices := getDevicesDetails(devices, concurrency)
+	if failedDevices > 0 {
+		fmt.Fprintf(os.Stderr, "Could not retrieve %d of %d devices, statistics are computed from the remaining ones.\n",
+			failedDevices, len(devices))
+		if len(devicesDetails) == 0 {
+			os.Exit(1)
+		}
+	}
+
+	stats := computeDevicesStats(devicesDetails, top, time.Now())
+	stats.TotalDevices = int64(len(devices))
+	stats.FailedDevices = failedDevices
+	if statsErr == nil {
+		// The stats endpoint is authoritative, as it is not affected by devices changing while scanning the realm
+		stats.TotalDevices = realmStats.TotalDevices
+		stats.ConnectedDevices = realmStats.ConnectedDevices
+	}
+	return printDevicesStats(outputFormat, stats, devicesDetails)
+}
+
+// getDevicesDetails retrieves the details of devices using concurrency parallel calls. Devices which cannot be retrieved
+// are reported on stderr and skipped, and their number is returned.
+func getDevicesDetails(devices []string, concurrency int) ([]client.DeviceDetails, int) {
+	devicesDetails := make([]client.DeviceDetails, len(devices))
+	errs := make([]error, len(devices))
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range indexes {
+				devicesDetails[index], errs[index] = astarteAPIClient.AppEngine.GetDevice(realm, devices[index],
+					client.AstarteDeviceID, appEngineJwt)
+			}
+		}()
+	}
+	for i := range devices {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+
+	retrieved := []client.DeviceDetails{}
+	failed := 0
+	for i, err := range errs {
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not retrieve device %s: %s\n", devices[i], err)
+			failed++
+			continue
+		}
+		retrieved = append(retrieved, devicesDetails[i])
+	}
+	return retrieved, failed
+}
+
+func computeDevicesStats(devicesDetails []client.DeviceDetails, top int, now time.Time) devicesStats {
+	stats := devicesStats{TotalDevices: int64(len(devicesDetails))}
+	neverConnected := 0
+	histogram := make([]lastSeenBucket, len(lastSeenBuckets)+1)
+	for i, bucket := range lastSeenBuckets {
+		histogram[i].LastSeen = bucket.label
+	}
+	histogram[len(lastSeenBuckets)].LastSeen = ">= 30 days"
+
+	for _, deviceDetails := range devicesDetails {
+		switch {
+		case deviceDetails.Connected:
+			stats.ConnectedDevices++
+		case deviceDetails.LastConnection.IsZero():
+			neverConnected++
+		default:
+			lastSeen := deviceDetails.LastDisconnection
+			if lastSeen.Before(deviceDetails.LastConnection) {
+				lastSeen = deviceDetails.LastConnection
+			}
+			bucket := len(lastSeenBuckets)
+			for i, b := range lastSeenBuckets {
+				if now.Sub(lastSeen) < b.age {
+					bucket = i
+					break
+				}
+			}
+			histogram[bucket].Devices++
+		}
+	}
+	stats.NeverConnectedDevices = &neverConnected
+	stats.LastSeenHistogram = histogram
+
+	traffic := make([]deviceTraffic, len(devicesDetails))
+	for i, deviceDetails := range devicesDetails {
+		traffic[i] = deviceTraffic{
+			DeviceID:              deviceDetails.DeviceID,
+			TotalReceivedMessages: deviceDetails.TotalReceivedMessages,
+			TotalReceivedBytes:    deviceDetails.TotalReceivedBytes,
+		}
+	}
+	stats.TopByMessages = topTalkers(traffic, top, func(a, b deviceTraffic) bool {
+		return a.TotalReceivedMessages > b.TotalReceivedMessages
+	})
+	stats.TopByBytes = topTalkers(traffic, top, func(a, b deviceTraffic) bool {
+		return a.TotalReceivedBytes > b.TotalReceivedBytes
+	})
+
+	return stats
+}
+
+func topTalkers(traffic []deviceTraffic, top int, greater func(a, b deviceTraffic) bool) []deviceTraffic {
+	sorted := make([]deviceTraffic, len(traffic))
+	copy(sorted, traffic)
+	sort.SliceStable(sorted, func(i, j int) bool { return greater(sorted[i], sorted[j]) })
+	if len(sorted) > top {
+		sorted = sorted[:top]
+	}
+	return sorted
+}
+
+func printDevicesStats(outputFormat output.Format, stats devicesStats, devicesDetails []client.DeviceDetails) error {
+	if outputFormat.Type == output.CSVOutput && devicesDetails != nil {
+		t := output.NewTable("Device ID", "Connected", "Last Connection", "Last Disconnection", "Received Messages", "Received Bytes")
+		for _, deviceDetails := range devicesDetails {
+			t.AppendRow(deviceDetails.DeviceID, deviceDetails.Connected, outputFormat.Timestamp(deviceDetails.LastConnection),
+				outputFormat.Timestamp(deviceDetails.LastDisconnection), deviceDetails.TotalReceivedMessages,
+				deviceDetails.TotalReceivedBytes)
+		}
+		return output.Print(os.Stdout, outputFormat, devicesDetails, t)
+	}
+	if !outputFormat.IsHumanReadable() {
+		return output.Print(os.Stdout, outputFormat, stats, nil)
+	}
+
+	summary := map[string]interface{}{
+		"Total Devices":     stats.TotalDevices,
+		"Connected Devices": stats.ConnectedDevices,
+	}
+	keys := []string{"Total Devices", "Connected Devices"}
+	if stats.NeverConnectedDevices != nil {
+		summary["Never Connected Devices"] = *stats.NeverConnectedDevices
+		keys = append(keys, "Never Connected Devices")
+	}
+	if stats.FailedDevices > 0 {
+		summary["Devices Not Retrieved"] = stats.FailedDevices
+		keys = append(keys, "Devices Not Retrieved")
+	}
+	if err := output.Print(os.Stdout, outputFormat, summary, output.NewKeyValueTable(keys, summary)); err != nil {
+		return err
+	}
+	if stats.LastSeenHistogram == nil {
+		return nil
+	}
+
+	fmt.Println()
+	fmt.Println("Disconnected devices by last seen:")
+	t := output.NewTable("Last Seen", "Devices")
+	for _, bucket := range stats.LastSeenHistogram {
+		t.AppendRow(bucket.LastSeen, bucket.Devices)
+	}
+	if err := output.Print(os.Stdout, outputFormat, stats.LastSeenHistogram, t); err != nil {
+		return err
+	}
+
+	for _, topTable := range []struct {
+		title   string
+		traffic []deviceTraffic
+	}{
+		{"Top devices by received messages:", stats.TopByMessages},
+		{"Top devices by received data:", stats.TopByBytes},
+	} {
+		fmt.Println()
+		fmt.Println(topTable.title)
+		t := output.NewTable("Device ID", "Received Messages", "Data Received")
+		for _, traffic := range topTable.traffic {
+			t.AppendRow(traffic.DeviceID, traffic.TotalReceivedMessages, bytefmt.ByteSize(traffic.TotalReceivedBytes))
+		}
+		if err := output.Print(os.Stdout, outputFormat, topTable.traffic, t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
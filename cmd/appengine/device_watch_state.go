@@ -0,0 +1,420 @@
+// Copyright © 2019 Ispirata Srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package appengine
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"reflect"
+	"runtime"
+	"sort"
+	"time"
+
+	"github.com/astarte-platform/astartectl/client"
+	"github.com/astarte-platform/astartectl/cmd/output"
+	"github.com/astarte-platform/astartectl/common"
+	"github.com/astarte-platform/astartectl/utils"
+	"github.com/spf13/cobra"
+)
+
+var devicesWatchStateCmd = &cobra.Command{
+	Use:   "watch-state [<device_id_or_alias>]",
+	Short: "Watch devices for state changes",
+	Long: `Watch a device, or all devices of the realm with --all, and print an event whenever a device connects,
+disconnects, changes its introspection or one of its properties changes.
+
+State is polled through AppEngine every --interval, hence this works even when Channels are not available,
+but changes lasting less than the interval might be missed. The first poll only records the initial state.
+
+Events are printed as a table, or as one JSON document per line with --output ndjson. With --exec, a command
+is run for each event, receiving the event as JSON on its standard input and its type and device ID in the
+ASTARTECTL_EVENT_TYPE and ASTARTECTL_EVENT_DEVICE_ID environment variables.
+
+Event types are connected, disconnected, interface_added, interface_removed, interface_version_changed,
+property_set, property_changed and property_unset. With --all, device_added and device_removed are also
+emitted when devices appear in or disappear from the realm.`,
+	Example: `  astartectl appengine devices watch-state 2TBn-jNESuuHamE2Zo1anA
+  astartectl appengine devices watch-state --all --interval 1m -o ndjson
+  astartectl appengine devices watch-state --all --exec 'notify-send "$ASTARTECTL_EVENT_DEVICE_ID $ASTARTECTL_EVENT_TYPE"'`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: devicesWatchStateF,
+	Annotations: map[string]string{
+		utils.AuthorizationClaimsAnnotation(utils.AppEngine):       "GET::devices\nGET::(devices|devices-by-alias)/$1\nGET::(devices|devices-by-alias)/$1/interfaces/.+",
+		utils.AuthorizationClaimsAnnotation(utils.RealmManagement): "GET::interfaces/.+/[0-9]+",
+	},
+}
+
+// Types of the events emitted by watch-state
+const (
+	deviceAddedEvent             = "device_added"
+	deviceRemovedEvent           = "device_removed"
+	connectedEvent               = "connected"
+	disconnectedEvent            = "disconnected"
+	interfaceAddedEvent          = "interface_added"
+	interfaceRemovedEvent        = "interface_removed"
+	interfaceVersionChangedEvent = "interface_version_changed"
+	propertySetEvent             = "property_set"
+	propertyChangedEvent         = "property_changed"
+	propertyUnsetEvent           = "property_unset"
+)
+
+// deviceState is the state of a device observed by a single poll
+type deviceState struct {
+	details client.DeviceDetails
+	// properties maps interface names to their properties, by path
+	properties map[string]map[string]interface{}
+}
+
+// stateChangeEvent is a change between two successive states of a device
+type stateChangeEvent struct {
+	Timestamp time.Time   `json:"timestamp"`
+	DeviceID  string      `json:"device_id"`
+	Type      string      `json:"type"`
+	Interface string      `json:"interface,omitempty"`
+	Path      string      `json:"path,omitempty"`
+	OldValue  interface{} `json:"old_value"`
+	NewValue  interface{} `json:"new_value"`
+}
+
+func init() {
+	devicesWatchStateCmd.Flags().Bool("all", false, "Watch all devices of the realm, including the ones added while watching")
+	devicesWatchStateCmd.Flags().Duration("interval", 10*time.Second, "Interval between two polls")
+	devicesWatchStateCmd.Flags().Bool("skip-properties", false, "Only watch connection status and introspection, without polling properties")
+	devicesWatchStateCmd.Flags().String("exec", "", "Command to run for each event. It is run through the shell.")
+	devicesWatchStateCmd.Flags().String("force-id-type", "", "When set, rather than autodetecting, it forces the device ID to be evaluated as a (device-id,alias).")
+	output.AddFlag(devicesWatchStateCmd)
+
+	devicesCmd.AddCommand(devicesWatchStateCmd)
+}
+
+func devicesWatchStateF(command *cobra.Command, args []string) error {
+	watchAll, err := command.Flags().GetBool("all")
+	if err != nil {
+		return err
+	}
+	if watchAll == (len(args) == 1) {
+		return errors.New("Either a device or --all has to be specified")
+	}
+	interval, err := command.Flags().GetDuration("interval")
+	if err != nil {
+		return err
+	}
+	if interval <= 0 {
+		return errors.New("interval must be positive")
+	}
+	skipProperties, err := command.Flags().GetBool("skip-properties")
+	if err != nil {
+		return err
+	}
+	hook, err := command.Flags().GetString("exec")
+	if err != nil {
+		return err
+	}
+	outputFormat, err := output.FormatFromFlags(command)
+	if err != nil {
+		return err
+	}
+	if outputFormat.Type != output.TableOutput && outputFormat.Type != output.NDJSONOutput {
+		return errors.New("watch-state supports only table and ndjson output")
+	}
+
+	deviceIDs := []string{}
+	claimsArgs := args
+	if !watchAll {
+		deviceID, err := resolveWatchedDevice(command, args)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		deviceIDs = append(deviceIDs, deviceID)
+		claimsArgs = []string{deviceID}
+	}
+
+	watcher := &stateWatcher{
+		skipProperties: skipProperties,
+		interfaceTypes: map[string]common.AstarteInterfaceType{},
+	}
+	if outputFormat.Type == output.TableOutput {
+		fmt.Printf("%-25s  %-22s  %-25s  %s\n", "TIMESTAMP", "DEVICE ID", "EVENT", "DETAILS")
+	}
+
+	emit := func(event stateChangeEvent) {
+		printStateChangeEvent(outputFormat, event)
+		if hook != "" {
+			runStateChangeHook(hook, event)
+		}
+	}
+	states := map[string]deviceState{}
+	for firstPoll := true; ; firstPoll = false {
+		// Tokens obtained before the first poll are still valid
+		if !firstPoll {
+			if err := refreshJWTs(command, claimsArgs); err != nil {
+				fmt.Fprintf(os.Stderr, "Could not refresh tokens: %s\n", err)
+			}
+		}
+		if watchAll {
+			// On errors, the devices of the previous poll are polled again
+			listedDeviceIDs, err := astarteAPIClient.AppEngine.ListDevices(realm, appEngineJwt)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Could not list devices: %s\n", err)
+			} else {
+				if !firstPoll {
+					for _, event := range diffDeviceIDs(deviceIDs, listedDeviceIDs, time.Now().UTC()) {
+						if event.Type == deviceRemovedEvent {
+							delete(states, event.DeviceID)
+						}
+						emit(event)
+					}
+				}
+				deviceIDs = listedDeviceIDs
+			}
+		}
+
+		for _, deviceID := range deviceIDs {
+			state, err := watcher.poll(deviceID)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Could not poll device %s: %s\n", deviceID, err)
+				continue
+			}
+			if previousState, ok := states[deviceID]; ok {
+				for _, event := range diffDeviceStates(deviceID, previousState, state, time.Now().UTC()) {
+					emit(event)
+				}
+			}
+			states[deviceID] = state
+		}
+
+		time.Sleep(interval)
+	}
+}
+
+// resolveWatchedDevice returns the ID of the device given as argument. Devices are polled by ID, hence when an alias
+// is given, tokens are minted again with the claims expanded from the device ID.
+func resolveWatchedDevice(command *cobra.Command, args []string) (string, error) {
+	forceIDType, err := command.Flags().GetString("force-id-type")
+	if err != nil {
+		return "", err
+	}
+	deviceIdentifierType, err := deviceIdentifierTypeFromFlags(args[0], forceIDType)
+	if err != nil {
+		return "", err
+	}
+	deviceID, err := astarteAPIClient.AppEngine.GetDeviceIDFromDeviceIdentifier(realm, args[0], deviceIdentifierType, appEngineJwt)
+	if err != nil {
+		return "", err
+	}
+	if deviceID != args[0] {
+		if err := refreshJWTs(command, []string{deviceID}); err != nil {
+			return "", err
+		}
+	}
+	return deviceID, nil
+}
+
+// stateWatcher polls the state of devices, caching the type of the interfaces it encounters
+type stateWatcher struct {
+	skipProperties bool
+	interfaceTypes map[string]common.AstarteInterfaceType
+}
+
+func (w *stateWatcher) poll(deviceID string) (deviceState, error) {
+	deviceDetails, err := astarteAPIClient.AppEngine.GetDevice(realm, deviceID, client.AstarteDeviceID, appEngineJwt)
+	if err != nil {
+		return deviceState{}, err
+	}
+	state := deviceState{details: deviceDetails, properties: map[string]map[string]interface{}{}}
+	if w.skipProperties {
+		return state, nil
+	}
+
+	for interfaceName, introspection := range deviceDetails.Introspection {
+		interfaceKey := fmt.Sprintf("%s/%d", interfaceName, introspection.Major)
+		interfaceType, ok := w.interfaceTypes[interfaceKey]
+		if !ok {
+			astarteInterface, err := astarteAPIClient.RealmManagement.GetInterface(realm, interfaceName, introspection.Major, realmManagementJwt)
+			if err != nil {
+				return deviceState{}, err
+			}
+			interfaceType = astarteInterface.Type
+			w.interfaceTypes[interfaceKey] = interfaceType
+		}
+		if interfaceType != common.PropertiesType {
+			continue
+		}
+
+		properties, err := astarteAPIClient.AppEngine.GetProperties(realm, deviceID, client.AstarteDeviceID, interfaceName, appEngineJwt)
+		if err != nil {
+			return deviceState{}, err
+		}
+		state.properties[interfaceName] = properties
+	}
+
+	return state, nil
+}
+
+// diffDeviceIDs returns the events for the devices added and removed between two listings of the realm, sorted by
+// device ID
+func diffDeviceIDs(oldDeviceIDs []string, newDeviceIDs []string, timestamp time.Time) []stateChangeEvent {
+	oldSet, newSet := map[string]bool{}, map[string]bool{}
+	for _, deviceID := range oldDeviceIDs {
+		oldSet[deviceID] = true
+	}
+	for _, deviceID := range newDeviceIDs {
+		newSet[deviceID] = true
+	}
+
+	events := []stateChangeEvent{}
+	for _, deviceID := range sortedKeys(oldSet, newSet) {
+		event := stateChangeEvent{Timestamp: timestamp, DeviceID: deviceID}
+		switch {
+		case !oldSet[deviceID]:
+			event.Type = deviceAddedEvent
+		case !newSet[deviceID]:
+			event.Type = deviceRemovedEvent
+		default:
+			continue
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+// diffDeviceStates returns the events turning oldState into newState, in a stable order
+func diffDeviceStates(deviceID string, oldState deviceState, newState deviceState, timestamp time.Time) []stateChangeEvent {
+	events := []stateChangeEvent{}
+	newEvent := func(eventType string) stateChangeEvent {
+		return stateChangeEvent{Timestamp: timestamp, DeviceID: deviceID, Type: eventType}
+	}
+
+	if !oldState.details.Connected && newState.details.Connected {
+		events = append(events, newEvent(connectedEvent))
+	}
+
+	interfaceNames := sortedKeys(oldState.details.Introspection, newState.details.Introspection)
+	for _, interfaceName := range interfaceNames {
+		oldIntrospection, wasPresent := oldState.details.Introspection[interfaceName]
+		newIntrospection, isPresent := newState.details.Introspection[interfaceName]
+		event := newEvent("")
+		event.Interface = interfaceName
+		switch {
+		case !wasPresent:
+			event.Type = interfaceAddedEvent
+			event.NewValue = fmt.Sprintf("%d.%d", newIntrospection.Major, newIntrospection.Minor)
+		case !isPresent:
+			event.Type = interfaceRemovedEvent
+			event.OldValue = fmt.Sprintf("%d.%d", oldIntrospection.Major, oldIntrospection.Minor)
+		case oldIntrospection != newIntrospection:
+			event.Type = interfaceVersionChangedEvent
+			event.OldValue = fmt.Sprintf("%d.%d", oldIntrospection.Major, oldIntrospection.Minor)
+			event.NewValue = fmt.Sprintf("%d.%d", newIntrospection.Major, newIntrospection.Minor)
+		default:
+			continue
+		}
+		events = append(events, event)
+	}
+
+	for _, interfaceName := range sortedKeys(oldState.properties, newState.properties) {
+		oldProperties, newProperties := oldState.properties[interfaceName], newState.properties[interfaceName]
+		// Properties of interfaces leaving or entering the introspection are not reported as unset or set
+		if oldProperties == nil || newProperties == nil {
+			continue
+		}
+		for _, path := range sortedKeys(oldProperties, newProperties) {
+			oldValue, wasSet := oldProperties[path]
+			newValue, isSet := newProperties[path]
+			event := newEvent("")
+			event.Interface = interfaceName
+			event.Path = path
+			event.OldValue = oldValue
+			event.NewValue = newValue
+			switch {
+			case !wasSet:
+				event.Type = propertySetEvent
+			case !isSet:
+				event.Type = propertyUnsetEvent
+			case !reflect.DeepEqual(oldValue, newValue):
+				event.Type = propertyChangedEvent
+			default:
+				continue
+			}
+			events = append(events, event)
+		}
+	}
+
+	if oldState.details.Connected && !newState.details.Connected {
+		events = append(events, newEvent(disconnectedEvent))
+	}
+
+	return events
+}
+
+// sortedKeys returns the sorted union of the keys of two maps with string keys
+func sortedKeys(maps ...interface{}) []string {
+	keySet := map[string]bool{}
+	for _, m := range maps {
+		for _, key := range reflect.ValueOf(m).MapKeys() {
+			keySet[key.String()] = true
+		}
+	}
+	keys := []string{}
+	for key := range keySet {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func printStateChangeEvent(outputFormat output.Format, event stateChangeEvent) {
+	if outputFormat.Type == output.NDJSONOutput {
+		output.Print(os.Stdout, outputFormat, []stateChangeEvent{event}, nil)
+		return
+	}
+
+	details := event.Interface
+	if event.Path != "" {
+		details += event.Path
+	}
+	switch {
+	case event.OldValue != nil && event.NewValue != nil:
+		details += fmt.Sprintf(": %v -> %v", event.OldValue, event.NewValue)
+	case event.NewValue != nil:
+		details += fmt.Sprintf(": %v", event.NewValue)
+	case event.OldValue != nil:
+		details += fmt.Sprintf(": was %v", event.OldValue)
+	}
+	fmt.Printf("%-25s  %-22s  %-25s  %s\n", event.Timestamp.Local().Format(time.RFC3339), event.DeviceID, event.Type, details)
+}
+
+func runStateChangeHook(hook string, event stateChangeEvent) {
+	eventJSON, _ := json.Marshal(event)
+
+	var c *exec.Cmd
+	if runtime.GOOS == "windows" {
+		c = exec.Command("cmd", "/C", hook)
+	} else {
+		c = exec.Command("sh", "-c", hook)
+	}
+	c.Env = append(os.Environ(), "ASTARTECTL_EVENT_TYPE="+event.Type, "ASTARTECTL_EVENT_DEVICE_ID="+event.DeviceID)
+	c.Stdin = bytes.NewReader(eventJSON)
+	c.Stdout = os.Stdout
+	c.Stderr = os.Stderr
+	if err := c.Run(); err != nil {
+		fmt.Fprintf(os.Stderr, "Hook failed for %s event of device %s: %s\n", event.Type, event.DeviceID, err)
+	}
+}
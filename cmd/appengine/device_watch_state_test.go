@@ -0,0 +1,152 @@
+package appengine
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/astarte-platform/astartectl/astartetest"
+	"github.com/astarte-platform/astartectl/client"
+	"github.com/astarte-platform/astartectl/common"
+	"github.com/spf13/viper"
+)
+
+func TestDiffDeviceStates(t *testing.T) {
+	timestamp := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	oldState := deviceState{
+		details: client.DeviceDetails{
+			Connected: true,
+			Introspection: map[string]client.DeviceInterfaceIntrospection{
+				"org.example.Settings": {Major: 1, Minor: 0},
+				"org.example.Legacy":   {Major: 0, Minor: 3},
+			},
+		},
+		properties: map[string]map[string]interface{}{
+			"org.example.Settings": {"/lights/enabled": true, "/heating/enabled": true},
+		},
+	}
+	newState := deviceState{
+		details: client.DeviceDetails{
+			Connected: false,
+			Introspection: map[string]client.DeviceInterfaceIntrospection{
+				"org.example.Settings": {Major: 1, Minor: 1},
+				"org.example.Position": {Major: 1, Minor: 0},
+			},
+		},
+		properties: map[string]map[string]interface{}{
+			"org.example.Settings": {"/lights/enabled": false, "/fan/enabled": true},
+		},
+	}
+
+	events := diffDeviceStates("2TBn-jNESuuHamE2Zo1anA", oldState, newState, timestamp)
+	eventTypes := []string{}
+	for _, event := range events {
+		if event.DeviceID != "2TBn-jNESuuHamE2Zo1anA" || !event.Timestamp.Equal(timestamp) {
+			t.Errorf("unexpected event: %+v", event)
+		}
+		eventTypes = append(eventTypes, event.Type+" "+event.Interface+event.Path)
+	}
+	expectedEventTypes := []string{
+		"interface_removed org.example.Legacy",
+		"interface_added org.example.Position",
+		"interface_version_changed org.example.Settings",
+		"property_set org.example.Settings/fan/enabled",
+		"property_unset org.example.Settings/heating/enabled",
+		"property_changed org.example.Settings/lights/enabled",
+		"disconnected ",
+	}
+	if !reflect.DeepEqual(eventTypes, expectedEventTypes) {
+		t.Errorf("unexpected events: %v", eventTypes)
+	}
+	if events[5].OldValue != true || events[5].NewValue != false {
+		t.Errorf("unexpected property change: %+v", events[5])
+	}
+
+	if events := diffDeviceStates("2TBn-jNESuuHamE2Zo1anA", newState, newState, timestamp); len(events) != 0 {
+		t.Errorf("unexpected events between equal states: %v", events)
+	}
+}
+
+func TestDiffDeviceIDs(t *testing.T) {
+	timestamp := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	events := diffDeviceIDs([]string{"c", "a", "b"}, []string{"b", "d", "a"}, timestamp)
+	eventTypes := []string{}
+	for _, event := range events {
+		eventTypes = append(eventTypes, event.Type+" "+event.DeviceID)
+	}
+	if !reflect.DeepEqual(eventTypes, []string{"device_removed c", "device_added d"}) {
+		t.Errorf("unexpected events: %v", eventTypes)
+	}
+	if events := diffDeviceIDs([]string{"a"}, []string{"a"}, timestamp); len(events) != 0 {
+		t.Errorf("unexpected events between equal listings: %v", events)
+	}
+}
+
+func TestWatchStateAliasLeastPrivilege(t *testing.T) {
+	server, err := astartetest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	testRealm := server.AddRealm("test")
+	testRealm.AddInterface(common.AstarteInterface{
+		Name:         "org.example.Settings",
+		MajorVersion: 1,
+		Type:         common.PropertiesType,
+		Ownership:    common.ServerOwnership,
+		Mappings:     []common.AstarteInterfaceMapping{{Endpoint: "/threshold", Type: "double"}},
+	})
+	const deviceID = "2TBn-jNESuuHamE2Zo1anA"
+	testRealm.AddDevice(deviceID).
+		AddAlias("name", "boiler").
+		SetIntrospection("org.example.Settings", 1, 0).
+		SetProperty("org.example.Settings", "/threshold", 21.5)
+
+	dir, err := ioutil.TempDir("", "astartectl-watch-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	keyFile := filepath.Join(dir, "realm.pem")
+	if err := ioutil.WriteFile(keyFile, testRealm.PrivateKey(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	viper.Set("realm.key", keyFile)
+	viper.Set("least-privilege-tokens", true)
+	defer viper.Set("realm.key", "")
+	defer viper.Set("least-privilege-tokens", false)
+	previousClient, previousRealm := astarteAPIClient, realm
+	defer func() { astarteAPIClient, realm = previousClient, previousRealm }()
+	if astarteAPIClient, err = client.NewClient(server.URL(), nil); err != nil {
+		t.Fatal(err)
+	}
+	realm = "test"
+
+	// Tokens are first minted from the arguments, as the persistent pre-run does
+	args := []string{"boiler"}
+	if err := refreshJWTs(devicesWatchStateCmd, args); err != nil {
+		t.Fatal(err)
+	}
+	watcher := &stateWatcher{interfaceTypes: map[string]common.AstarteInterfaceType{}}
+	if _, err := watcher.poll(deviceID); err == nil {
+		t.Error("expected tokens minted for the alias not to authorize polling by device ID")
+	}
+
+	resolvedID, err := resolveWatchedDevice(devicesWatchStateCmd, args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resolvedID != deviceID {
+		t.Errorf("unexpected device ID %s", resolvedID)
+	}
+	state, err := watcher.poll(resolvedID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if threshold := state.properties["org.example.Settings"]["/threshold"]; threshold != 21.5 {
+		t.Errorf("unexpected properties %v", state.properties)
+	}
+}
@@ -0,0 +1,413 @@
+// Copyright © 2019 Ispirata Srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/astarte-platform/astartectl/cmd/cluster/deployment"
+	"gopkg.in/yaml.v2"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// nodeCapacity holds the resources of a node which can be requested by new pods
+type nodeCapacity struct {
+	Name              string
+	AllocatableCPU    int64
+	AllocatableMemory int64
+	// FreeCPU and FreeMemory are what is left of the allocatable resources once the requests of the pods
+	// running on the node are subtracted
+	FreeCPU    int64
+	FreeMemory int64
+}
+
+// clusterCapacity models the resources the scheduler can still hand out in a cluster
+type clusterCapacity struct {
+	Nodes []nodeCapacity
+	// UnschedulableNodes maps the nodes new pods cannot land on to the reason why
+	UnschedulableNodes map[string]string
+}
+
+// podRequest holds the resources requested by a pod of an Astarte component
+type podRequest struct {
+	Component string
+	CPU       int64
+	Memory    int64
+}
+
+// astarteComponentPods lists where the settings of each Astarte component live in the spec of an Astarte
+// resource. Astarte components without explicit resources share the ones in components.resources.
+var astarteComponentPods = []struct {
+	name   string
+	path   []string
+	shared bool
+}{
+	{"cassandra", []string{"cassandra"}, false},
+	{"rabbitmq", []string{"rabbitmq"}, false},
+	{"vernemq", []string{"vernemq"}, false},
+	{"cfssl", []string{"cfssl"}, false},
+	{"housekeeping-api", []string{"components", "housekeeping", "api"}, true},
+	{"housekeeping-backend", []string{"components", "housekeeping", "backend"}, true},
+	{"realm-management-api", []string{"components", "realmManagement", "api"}, true},
+	{"realm-management-backend", []string{"components", "realmManagement", "backend"}, true},
+	{"pairing-api", []string{"components", "pairing", "api"}, true},
+	{"pairing-backend", []string{"components", "pairing", "backend"}, true},
+	{"data-updater-plant", []string{"components", "dataUpdaterPlant"}, true},
+	{"appengine-api", []string{"components", "appengineApi"}, true},
+	{"trigger-engine", []string{"components", "triggerEngine"}, true},
+	{"dashboard", []string{"components", "dashboard"}, true},
+}
+
+// getClusterCapacity computes the capacity of the current cluster. Pods for which ignorePod returns true are
+// considered gone, e.g. the ones of an instance which is being changed. ignorePod can be nil.
+func getClusterCapacity(ignorePod func(corev1.Pod) bool) (*clusterCapacity, error) {
+	nodes, err := kubernetesClient.CoreV1().Nodes().List(metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	pods, err := kubernetesClient.CoreV1().Pods("").List(metav1.ListOptions{
+		FieldSelector: "status.phase!=Succeeded,status.phase!=Failed",
+	})
+	if err != nil {
+		return nil, err
+	}
+	return newClusterCapacity(nodes.Items, pods.Items, ignorePod)
+}
+
+// astarteInstancePods matches the pods of the Astarte instance name, which Astarte Operator names after it
+func astarteInstancePods(name string, namespace string) func(corev1.Pod) bool {
+	return func(pod corev1.Pod) bool {
+		return pod.Namespace == namespace && strings.HasPrefix(pod.Name, name+"-")
+	}
+}
+
+// newClusterCapacity computes the capacity of a cluster made of nodes, where pods are running
+func newClusterCapacity(nodes []corev1.Node, pods []corev1.Pod, ignorePod func(corev1.Pod) bool) (*clusterCapacity, error) {
+	capacity := &clusterCapacity{UnschedulableNodes: map[string]string{}}
+	indexes := map[string]int{}
+	for _, node := range nodes {
+		if reason := nodeUnschedulableReason(node); reason != "" {
+			capacity.UnschedulableNodes[node.Name] = reason
+			continue
+		}
+		allocatableCPU := node.Status.Allocatable.Cpu().ScaledValue(resource.Milli)
+		if allocatableCPU <= 0 {
+			return nil, fmt.Errorf("Could not retrieve allocatable CPU for node %s", node.Name)
+		}
+		// Get Int64 directly, as the value is always returned in bytes.
+		allocatableMemory, ok := node.Status.Allocatable.Memory().AsInt64()
+		if !ok {
+			return nil, fmt.Errorf("Could not retrieve allocatable Memory for node %s", node.Name)
+		}
+		indexes[node.Name] = len(capacity.Nodes)
+		capacity.Nodes = append(capacity.Nodes, nodeCapacity{
+			Name:              node.Name,
+			AllocatableCPU:    allocatableCPU,
+			AllocatableMemory: allocatableMemory,
+			FreeCPU:           allocatableCPU,
+			FreeMemory:        allocatableMemory,
+		})
+	}
+
+	for _, pod := range pods {
+		i, ok := indexes[pod.Spec.NodeName]
+		if !ok || (ignorePod != nil && ignorePod(pod)) {
+			continue
+		}
+		cpu, memory := podRequests(pod)
+		capacity.Nodes[i].FreeCPU -= cpu
+		capacity.Nodes[i].FreeMemory -= memory
+	}
+	return capacity, nil
+}
+
+// nodeUnschedulableReason returns why pods of Astarte cannot be scheduled on node, or an empty string if they can
+func nodeUnschedulableReason(node corev1.Node) string {
+	if node.Spec.Unschedulable {
+		return "cordoned"
+	}
+	for _, condition := range node.Status.Conditions {
+		if condition.Type == corev1.NodeReady && condition.Status != corev1.ConditionTrue {
+			return "not ready"
+		}
+	}
+	// Astarte pods have no tolerations
+	for _, taint := range node.Spec.Taints {
+		if taint.Effect == corev1.TaintEffectNoSchedule || taint.Effect == corev1.TaintEffectNoExecute {
+			return fmt.Sprintf("tainted with %s", taint.Key)
+		}
+	}
+	return ""
+}
+
+// podRequests returns the CPU, in millicores, and memory requested by pod, as the scheduler accounts them: init
+// containers run one at a time before the other containers
+func podRequests(pod corev1.Pod) (int64, int64) {
+	var cpu, memory int64
+	for _, container := range pod.Spec.Containers {
+		cpu += container.Resources.Requests.Cpu().ScaledValue(resource.Milli)
+		memory += container.Resources.Requests.Memory().Value()
+	}
+	for _, container := range pod.Spec.InitContainers {
+		if initCPU := container.Resources.Requests.Cpu().ScaledValue(resource.Milli); initCPU > cpu {
+			cpu = initCPU
+		}
+		if initMemory := container.Resources.Requests.Memory().Value(); initMemory > memory {
+			memory = initMemory
+		}
+	}
+	return cpu, memory
+}
+
+// requirements sums the free resources of the cluster, to be checked against the requirements of profiles
+func (c *clusterCapacity) requirements() deployment.AstarteProfileRequirements {
+	requirements := deployment.AstarteProfileRequirements{MinNodes: len(c.Nodes), MaxNodes: len(c.Nodes)}
+	for _, node := range c.Nodes {
+		if node.FreeCPU > 0 {
+			requirements.CPUAllocation += node.FreeCPU
+		}
+		if node.FreeMemory > 0 {
+			requirements.MemoryAllocation += node.FreeMemory
+		}
+	}
+	return requirements
+}
+
+// profileIncompatibilityReasons explains why profile cannot be deployed with version on the cluster. Besides the
+// requirements of the profile, the pods of its default spec must fit on the nodes one by one.
+func (c *clusterCapacity) profileIncompatibilityReasons(profile deployment.AstarteClusterProfile, version *semver.Version) []string {
+	reasons := profile.IncompatibilityReasons(version, c.requirements())
+	pods, err := profilePodRequests(profile)
+	if err != nil {
+		return append(reasons, err.Error())
+	}
+	return append(reasons, c.placePods(pods)...)
+}
+
+// placePods bin-packs pods on the nodes of the cluster, and explains which pods could not be placed. Like the
+// scheduler does by default, each pod goes to the node which would be left with the most free resources.
+func (c *clusterCapacity) placePods(pods []podRequest) []string {
+	if len(c.Nodes) == 0 {
+		reason := "the cluster has no schedulable nodes"
+		if len(c.UnschedulableNodes) > 0 {
+			reason += ": " + c.unschedulableNodesSummary()
+		}
+		return []string{reason}
+	}
+
+	nodes := append([]nodeCapacity{}, c.Nodes...)
+	sorted := append([]podRequest{}, pods...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].CPU != sorted[j].CPU {
+			return sorted[i].CPU > sorted[j].CPU
+		}
+		return sorted[i].Memory > sorted[j].Memory
+	})
+
+	unplaced := map[string]int{}
+	total := map[string]int{}
+	requests := map[string]podRequest{}
+	components := []string{}
+	for _, pod := range sorted {
+		if _, ok := total[pod.Component]; !ok {
+			components = append(components, pod.Component)
+		}
+		total[pod.Component]++
+		requests[pod.Component] = pod
+
+		best := -1
+		var bestScore float64
+		for i, node := range nodes {
+			if node.FreeCPU < pod.CPU || node.FreeMemory < pod.Memory {
+				continue
+			}
+			score := float64(node.FreeCPU-pod.CPU)/float64(node.AllocatableCPU) +
+				float64(node.FreeMemory-pod.Memory)/float64(node.AllocatableMemory)
+			if best < 0 || score > bestScore {
+				best, bestScore = i, score
+			}
+		}
+		if best < 0 {
+			unplaced[pod.Component]++
+			continue
+		}
+		nodes[best].FreeCPU -= pod.CPU
+		nodes[best].FreeMemory -= pod.Memory
+	}
+
+	reasons := []string{}
+	for _, component := range components {
+		if unplaced[component] == 0 {
+			continue
+		}
+		pod := requests[component]
+		closest := closestFit(nodes, pod)
+		reasons = append(reasons, fmt.Sprintf("%d of %d %s pods (%dm CPU, %s memory each) do not fit on any node, "+
+			"the closest fit is %s with %dm CPU and %s memory free", unplaced[component], total[component],
+			component, pod.CPU, memoryQuantity(pod.Memory), closest.Name, maxInt64(closest.FreeCPU, 0),
+			memoryQuantity(maxInt64(closest.FreeMemory, 0))))
+	}
+	return reasons
+}
+
+// closestFit returns the node which comes closest to holding pod, i.e. the one whose scarcest free resource covers
+// the largest share of what pod requests
+func closestFit(nodes []nodeCapacity, pod podRequest) nodeCapacity {
+	share := func(free int64, requested int64) float64 {
+		if requested <= 0 {
+			return 1
+		}
+		return float64(free) / float64(requested)
+	}
+	closest := nodes[0]
+	var closestScore float64 = -1
+	for _, node := range nodes {
+		score := share(node.FreeCPU, pod.CPU)
+		if memoryShare := share(node.FreeMemory, pod.Memory); memoryShare < score {
+			score = memoryShare
+		}
+		if score > closestScore {
+			closest, closestScore = node, score
+		}
+	}
+	return closest
+}
+
+// unschedulableNodesSummary describes the nodes pods cannot be scheduled on
+func (c *clusterCapacity) unschedulableNodesSummary() string {
+	descriptions := []string{}
+	for name, reason := range c.UnschedulableNodes {
+		descriptions = append(descriptions, fmt.Sprintf("%s is %s", name, reason))
+	}
+	sort.Strings(descriptions)
+	return strings.Join(descriptions, ", ")
+}
+
+// profilePodRequests returns the requests of the pods deployed by profile with its default spec
+func profilePodRequests(profile deployment.AstarteClusterProfile) ([]podRequest, error) {
+	content, err := yaml.Marshal(profile.DefaultSpec)
+	if err != nil {
+		return nil, err
+	}
+	spec := map[string]interface{}{}
+	if err := yaml.Unmarshal(content, &spec); err != nil {
+		return nil, err
+	}
+	return specPodRequests(spec)
+}
+
+// specPodRequests returns the requests of the pods deployed by the spec of an Astarte resource. Astarte Operator
+// splits components.resources among the Astarte components without explicit resources: it is approximated here
+// with an even split.
+func specPodRequests(spec map[string]interface{}) ([]podRequest, error) {
+	type componentPods struct {
+		name     string
+		replicas int
+		cpu      int64
+		memory   int64
+		shared   bool
+	}
+	deployed := []componentPods{}
+	sharedComponents := 0
+	for _, component := range astarteComponentPods {
+		settings := lookupSpecPath(spec, component.path)
+		if deploy, ok := lookupSpecPath(settings, []string{"deploy"}).(bool); ok && !deploy {
+			continue
+		}
+		pods := componentPods{name: component.name, replicas: 1}
+		if replicas, ok := lookupSpecPath(settings, []string{"replicas"}).(int); ok && replicas > 0 {
+			pods.replicas = replicas
+		}
+		cpu, memory, err := parseRequests(lookupSpecPath(settings, []string{"resources", "requests"}))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid resources for %s: %s", component.name, err)
+		}
+		pods.cpu, pods.memory = cpu, memory
+		if component.shared && cpu == 0 && memory == 0 {
+			pods.shared = true
+			sharedComponents++
+		}
+		deployed = append(deployed, pods)
+	}
+
+	sharedCPU, sharedMemory, err := parseRequests(lookupSpecPath(spec, []string{"components", "resources", "requests"}))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid resources for components: %s", err)
+	}
+
+	requests := []podRequest{}
+	for _, pods := range deployed {
+		if pods.shared {
+			pods.cpu = sharedCPU / int64(sharedComponents)
+			pods.memory = sharedMemory / int64(sharedComponents)
+		}
+		for i := 0; i < pods.replicas; i++ {
+			requests = append(requests, podRequest{Component: pods.name, CPU: pods.cpu, Memory: pods.memory})
+		}
+	}
+	return requests, nil
+}
+
+// lookupSpecPath returns the value at path in a spec decoded from YAML, or nil if there is none
+func lookupSpecPath(spec interface{}, path []string) interface{} {
+	current := spec
+	for _, key := range path {
+		switch m := current.(type) {
+		case map[string]interface{}:
+			current = m[key]
+		case map[interface{}]interface{}:
+			current = m[key]
+		default:
+			return nil
+		}
+	}
+	return current
+}
+
+// parseRequests parses the cpu and memory of resource requests. Missing or empty values are zero.
+func parseRequests(requests interface{}) (int64, int64, error) {
+	parse := func(key string) (resource.Quantity, error) {
+		value := lookupSpecPath(requests, []string{key})
+		if value == nil || fmt.Sprintf("%v", value) == "" {
+			return resource.Quantity{}, nil
+		}
+		quantity, err := resource.ParseQuantity(fmt.Sprintf("%v", value))
+		if err != nil {
+			return quantity, fmt.Errorf("invalid %s %v", key, value)
+		}
+		return quantity, nil
+	}
+	cpu, err := parse("cpu")
+	if err != nil {
+		return 0, 0, err
+	}
+	memory, err := parse("memory")
+	if err != nil {
+		return 0, 0, err
+	}
+	return cpu.ScaledValue(resource.Milli), memory.Value(), nil
+}
+
+func maxInt64(a int64, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,183 @@
+package cluster
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/astarte-platform/astartectl/cmd/cluster/deployment"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func testNode(name string, cpu string, memory string) corev1.Node {
+	return corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Status: corev1.NodeStatus{
+			Allocatable: corev1.ResourceList{
+				corev1.ResourceCPU:    resource.MustParse(cpu),
+				corev1.ResourceMemory: resource.MustParse(memory),
+			},
+			Conditions: []corev1.NodeCondition{{Type: corev1.NodeReady, Status: corev1.ConditionTrue}},
+		},
+	}
+}
+
+func testPod(namespace string, name string, node string, cpu string, memory string) corev1.Pod {
+	return corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+		Spec: corev1.PodSpec{
+			NodeName: node,
+			Containers: []corev1.Container{{
+				Name: "main",
+				Resources: corev1.ResourceRequirements{Requests: corev1.ResourceList{
+					corev1.ResourceCPU:    resource.MustParse(cpu),
+					corev1.ResourceMemory: resource.MustParse(memory),
+				}},
+			}},
+		},
+	}
+}
+
+func TestClusterCapacity(t *testing.T) {
+	cordoned := testNode("cordoned", "8", "32Gi")
+	cordoned.Spec.Unschedulable = true
+	master := testNode("master", "8", "32Gi")
+	master.Spec.Taints = []corev1.Taint{{Key: "node-role.kubernetes.io/master", Effect: corev1.TaintEffectNoSchedule}}
+	nodes := []corev1.Node{testNode("a", "4", "8Gi"), testNode("b", "2", "4Gi"), cordoned, master}
+
+	withInit := testPod("default", "with-init", "b", "100m", "128Mi")
+	withInit.Spec.InitContainers = []corev1.Container{{
+		Name:      "init",
+		Resources: corev1.ResourceRequirements{Requests: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("500m")}},
+	}}
+	pods := []corev1.Pod{
+		testPod("kube-system", "dns", "a", "1", "1Gi"),
+		testPod("astarte", "astarte-cassandra-0", "a", "1", "2Gi"),
+		withInit,
+		testPod("default", "on-cordoned", "cordoned", "1", "1Gi"),
+	}
+
+	capacity, err := newClusterCapacity(nodes, pods, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []nodeCapacity{
+		{Name: "a", AllocatableCPU: 4000, AllocatableMemory: 8 << 30, FreeCPU: 2000, FreeMemory: 5 << 30},
+		{Name: "b", AllocatableCPU: 2000, AllocatableMemory: 4 << 30, FreeCPU: 1500, FreeMemory: 4<<30 - 128<<20},
+	}
+	if !reflect.DeepEqual(capacity.Nodes, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, capacity.Nodes)
+	}
+	if summary := capacity.unschedulableNodesSummary(); summary != "cordoned is cordoned, master is tainted with node-role.kubernetes.io/master" {
+		t.Errorf("Unexpected unschedulable nodes: %s", summary)
+	}
+
+	// The pods of an instance being changed are not accounted
+	capacity, err = newClusterCapacity(nodes, pods, astarteInstancePods("astarte", "astarte"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if capacity.Nodes[0].FreeCPU != 3000 || capacity.Nodes[0].FreeMemory != 7<<30 {
+		t.Errorf("Unexpected capacity %+v", capacity.Nodes[0])
+	}
+}
+
+func TestPlacePods(t *testing.T) {
+	// Many tiny nodes sum up to a lot of resources, but cannot host a large pod
+	nodes := []corev1.Node{}
+	for i := 0; i < 8; i++ {
+		nodes = append(nodes, testNode(fmt.Sprintf("tiny-%d", i), "600m", "1Gi"))
+	}
+	capacity, err := newClusterCapacity(nodes, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reasons := capacity.placePods([]podRequest{
+		{Component: "cassandra", CPU: 1000, Memory: 512 << 20},
+		{Component: "rabbitmq", CPU: 300, Memory: 512 << 20},
+		{Component: "rabbitmq", CPU: 300, Memory: 512 << 20},
+	})
+	expected := []string{"1 of 1 cassandra pods (1000m CPU, 512Mi memory each) do not fit on any node, " +
+		"the closest fit is tiny-2 with 600m CPU and 1Gi memory free"}
+	if !reflect.DeepEqual(reasons, expected) {
+		t.Errorf("Expected %v, got %v", expected, reasons)
+	}
+
+	// Pods are spread, and packed until nodes are full
+	pods := []podRequest{}
+	for i := 0; i < 16; i++ {
+		pods = append(pods, podRequest{Component: "vernemq", CPU: 300, Memory: 256 << 20})
+	}
+	if reasons := capacity.placePods(pods); len(reasons) != 0 {
+		t.Errorf("Unexpected reasons %v", reasons)
+	}
+	pods = append(pods, podRequest{Component: "vernemq", CPU: 300, Memory: 256 << 20})
+	if reasons := capacity.placePods(pods); len(reasons) != 1 || !strings.HasPrefix(reasons[0], "1 of 17 vernemq pods") {
+		t.Errorf("Unexpected reasons %v", reasons)
+	}
+
+	if reasons := (&clusterCapacity{}).placePods(pods); !reflect.DeepEqual(reasons, []string{"the cluster has no schedulable nodes"}) {
+		t.Errorf("Unexpected reasons %v", reasons)
+	}
+}
+
+func TestProfilePodRequests(t *testing.T) {
+	profile := deployment.AstarteClusterProfile{Name: "test"}
+	profile.DefaultSpec.Cassandra.Deploy = false
+	profile.DefaultSpec.Rabbitmq.Replicas = 2
+	profile.DefaultSpec.Rabbitmq.Resources.Requests.CPU = "500m"
+	profile.DefaultSpec.Rabbitmq.Resources.Requests.Memory = "1Gi"
+	profile.DefaultSpec.Components.Resources.Requests.CPU = "1800m"
+	profile.DefaultSpec.Components.Resources.Requests.Memory = "1800M"
+	profile.DefaultSpec.Components.DataUpdaterPlant.Resources.Requests.CPU = "1"
+
+	pods, err := profilePodRequests(profile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := map[string]int{}
+	for _, pod := range pods {
+		counts[pod.Component]++
+		switch pod.Component {
+		case "rabbitmq":
+			if pod.CPU != 500 || pod.Memory != 1<<30 {
+				t.Errorf("Unexpected requests %+v", pod)
+			}
+		case "data-updater-plant":
+			if pod.CPU != 1000 || pod.Memory != 0 {
+				t.Errorf("Unexpected requests %+v", pod)
+			}
+		case "housekeeping-api":
+			// The other 9 Astarte components share components.resources
+			if pod.CPU != 200 || pod.Memory != 200*1000*1000 {
+				t.Errorf("Unexpected requests %+v", pod)
+			}
+		}
+	}
+	if counts["cassandra"] != 0 || counts["rabbitmq"] != 2 || counts["vernemq"] != 1 || len(pods) != 14 {
+		t.Errorf("Unexpected pods %v", counts)
+	}
+
+	// Builtin profiles are checked against the whole cluster, and against the size of each node
+	nodes := []corev1.Node{}
+	for i := 0; i < 20; i++ {
+		nodes = append(nodes, testNode(fmt.Sprintf("tiny-%d", i), "500m", "1Gi"))
+	}
+	capacity, err := newClusterCapacity(nodes, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, profile := range deployment.GetAllBuiltinAstarteClusterProfiles() {
+		if profile.Name != "basic" {
+			continue
+		}
+		reasons := capacity.profileIncompatibilityReasons(profile, semver.MustParse("0.10.2"))
+		if len(reasons) == 0 || !strings.Contains(strings.Join(reasons, "; "), "cassandra pods") {
+			t.Errorf("Expected cassandra not to fit, got %v", reasons)
+		}
+	}
+}
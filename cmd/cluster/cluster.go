@@ -54,8 +54,8 @@ manage the entire lifecycle of an Astarte instance, including its installation a
 
 // Set here all custom resources for Astarte
 var (
-	kubernetesClient              *kubernetes.Clientset
-	kubernetesAPIExtensionsClient *apiextensions.Clientset
+	kubernetesClient              kubernetes.Interface
+	kubernetesAPIExtensionsClient apiextensions.Interface
 	kubernetesDynamicClient       dynamic.Interface
 
 	astarteGroupResource = schema.GroupResource{
@@ -90,6 +90,17 @@ func init() {
 		"(optional) absolute path to the kubeconfig file")
 	viper.BindPFlag("kubeconfig", ClusterCmd.PersistentFlags().Lookup("kubeconfig"))
 
+	defaultProfilesDir := ""
+	if home, err := homedir.Dir(); err == nil {
+		defaultProfilesDir = filepath.Join(home, ".astartectl", "profiles")
+	}
+	ClusterCmd.PersistentFlags().String("profiles-dir", defaultProfilesDir,
+		"Directory holding Astarte Deployment Profiles as YAML files, in addition to the builtin ones")
+	ClusterCmd.MarkPersistentFlagDirname("profiles-dir")
+	ClusterCmd.PersistentFlags().StringSlice("profile-file", nil,
+		"Astarte Deployment Profile YAML file to load in addition to the builtin ones. Can be repeated.")
+	ClusterCmd.MarkPersistentFlagFilename("profile-file", "yaml", "yml")
+
 	ClusterCmd.AddCommand(InstancesCmd)
 }
 
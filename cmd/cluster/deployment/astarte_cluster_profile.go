@@ -52,35 +52,3 @@ type AstarteClusterProfile struct {
 	DefaultSpec        Astartev1alpha1DeploymentSpec     `yaml:"defaultSpec"`
 	CustomizableFields []AstarteProfileCustomizableField `yaml:"customizableFields"`
 }
-
-// GetProfilesForVersionAndRequirements gets all profiles compatible with given version and requirements
-func GetProfilesForVersionAndRequirements(version *semver.Version, requirements AstarteProfileRequirements) map[string]AstarteClusterProfile {
-	ret := map[string]AstarteClusterProfile{}
-	for _, v := range GetAllBuiltinAstarteClusterProfiles() {
-		if v.Compatibility.MinAstarteVersion != nil {
-			if version.LessThan(v.Compatibility.MinAstarteVersion) {
-				continue
-			}
-		}
-		if v.Compatibility.MaxAstarteVersion != nil {
-			if version.GreaterThan(v.Compatibility.MaxAstarteVersion) {
-				continue
-			}
-		}
-		if requirements.CPUAllocation < v.Requirements.CPUAllocation {
-			continue
-		}
-		if requirements.MemoryAllocation < v.Requirements.MemoryAllocation {
-			continue
-		}
-		if requirements.MinNodes < v.Requirements.MinNodes && v.Requirements.MinNodes > 0 {
-			continue
-		}
-		if requirements.MaxNodes > v.Requirements.MaxNodes && v.Requirements.MaxNodes > 0 {
-			continue
-		}
-		ret[v.Name] = v
-	}
-
-	return ret
-}
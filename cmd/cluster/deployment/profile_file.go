@@ -0,0 +1,307 @@
+// Copyright © 2019 Ispirata Srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deployment
+
+import (
+	"fmt"
+	"go/types"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Masterminds/semver/v3"
+	"gopkg.in/yaml.v2"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// customizableFieldTypes maps the type names used in profile files to the types of customizable fields
+var customizableFieldTypes = map[string]types.BasicKind{
+	"string": types.String,
+	"int":    types.Int,
+	"bool":   types.Bool,
+}
+
+// ProfileValidationError lists all the problems found in an Astarte Cluster Profile
+type ProfileValidationError struct {
+	Problems []string
+}
+
+func (e *ProfileValidationError) Error() string {
+	return strings.Join(e.Problems, "; ")
+}
+
+// LoadAstarteClusterProfile reads an Astarte Cluster Profile from a YAML file, and validates it.
+// Unknown fields are rejected.
+func LoadAstarteClusterProfile(file string) (AstarteClusterProfile, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return AstarteClusterProfile{}, err
+	}
+	profile := AstarteClusterProfile{}
+	if err := yaml.UnmarshalStrict(content, &profile); err != nil {
+		return AstarteClusterProfile{}, &ProfileValidationError{Problems: []string{err.Error()}}
+	}
+	if err := profile.Validate(); err != nil {
+		return AstarteClusterProfile{}, err
+	}
+	return profile, nil
+}
+
+// ListAstarteClusterProfileFiles returns the YAML files in dir, sorted by name. A missing dir holds no files.
+func ListAstarteClusterProfileFiles(dir string) ([]string, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	files := []string{}
+	for _, entry := range entries {
+		extension := filepath.Ext(entry.Name())
+		if !entry.IsDir() && (extension == ".yaml" || extension == ".yml") {
+			files = append(files, filepath.Join(dir, entry.Name()))
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// Validate checks that the profile is consistent, returning a ProfileValidationError listing all problems
+func (p AstarteClusterProfile) Validate() error {
+	problems := []string{}
+	if strings.TrimSpace(p.Name) == "" || strings.ContainsAny(p.Name, " \t\n") {
+		problems = append(problems, "name must be a non-empty string without whitespace")
+	}
+
+	if p.Requirements.CPUAllocation < 0 {
+		problems = append(problems, "requirements.cpuAllocation cannot be negative")
+	}
+	if p.Requirements.MemoryAllocation < 0 {
+		problems = append(problems, "requirements.memoryAllocation cannot be negative")
+	}
+	if p.Requirements.MinNodes < 0 || p.Requirements.MaxNodes < 0 {
+		problems = append(problems, "requirements.minNodes and requirements.maxNodes cannot be negative")
+	}
+	if p.Requirements.MinNodes > 0 && p.Requirements.MaxNodes > 0 && p.Requirements.MinNodes > p.Requirements.MaxNodes {
+		problems = append(problems, "requirements.minNodes is greater than requirements.maxNodes")
+	}
+	if p.Compatibility.MinAstarteVersion != nil && p.Compatibility.MaxAstarteVersion != nil &&
+		p.Compatibility.MinAstarteVersion.GreaterThan(p.Compatibility.MaxAstarteVersion) {
+		problems = append(problems, "compatibility.minAstarteVersion is greater than compatibility.maxAstarteVersion")
+	}
+
+	fields := map[string]bool{}
+	for i, field := range p.CustomizableFields {
+		prefix := fmt.Sprintf("customizableFields[%d]", i)
+		if field.Field == "" {
+			problems = append(problems, prefix+".field is required")
+		} else if fields[field.Field] {
+			problems = append(problems, fmt.Sprintf("%s.field %s is customizable more than once", prefix, field.Field))
+		}
+		fields[field.Field] = true
+		if field.Question == "" {
+			problems = append(problems, prefix+".question is required")
+		}
+		if field.Default == nil {
+			continue
+		}
+		defaultValue := fmt.Sprintf("%v", field.Default)
+		switch field.Type {
+		case types.Int:
+			if _, err := strconv.Atoi(defaultValue); err != nil {
+				problems = append(problems, fmt.Sprintf("%s.default %s is not an int", prefix, defaultValue))
+			}
+		case types.Bool:
+			if _, err := strconv.ParseBool(defaultValue); err != nil {
+				problems = append(problems, fmt.Sprintf("%s.default %s is not a bool", prefix, defaultValue))
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		return &ProfileValidationError{Problems: problems}
+	}
+	return nil
+}
+
+// IncompatibilityReasons explains why the profile cannot be deployed with version on a cluster providing
+// requirements. It returns nil when the profile can be deployed. When version is nil, it is not checked.
+func (p AstarteClusterProfile) IncompatibilityReasons(version *semver.Version, requirements AstarteProfileRequirements) []string {
+	var reasons []string
+	if version != nil && p.Compatibility.MinAstarteVersion != nil && version.LessThan(p.Compatibility.MinAstarteVersion) {
+		reasons = append(reasons, fmt.Sprintf("requires Astarte %s or later", p.Compatibility.MinAstarteVersion))
+	}
+	if version != nil && p.Compatibility.MaxAstarteVersion != nil && version.GreaterThan(p.Compatibility.MaxAstarteVersion) {
+		reasons = append(reasons, fmt.Sprintf("requires Astarte %s or earlier", p.Compatibility.MaxAstarteVersion))
+	}
+	if requirements.CPUAllocation < p.Requirements.CPUAllocation {
+		reasons = append(reasons, fmt.Sprintf("requires %dm of allocatable CPU, the cluster has %dm",
+			p.Requirements.CPUAllocation, requirements.CPUAllocation))
+	}
+	if requirements.MemoryAllocation < p.Requirements.MemoryAllocation {
+		reasons = append(reasons, fmt.Sprintf("requires %s of allocatable memory, the cluster has %s",
+			resource.NewQuantity(p.Requirements.MemoryAllocation, resource.BinarySI),
+			resource.NewQuantity(requirements.MemoryAllocation, resource.BinarySI)))
+	}
+	if requirements.MinNodes < p.Requirements.MinNodes && p.Requirements.MinNodes > 0 {
+		reasons = append(reasons, fmt.Sprintf("requires at least %d nodes, the cluster has %d",
+			p.Requirements.MinNodes, requirements.MinNodes))
+	}
+	if requirements.MaxNodes > p.Requirements.MaxNodes && p.Requirements.MaxNodes > 0 {
+		reasons = append(reasons, fmt.Sprintf("supports at most %d nodes, the cluster has %d",
+			p.Requirements.MaxNodes, requirements.MaxNodes))
+	}
+	return reasons
+}
+
+// UnmarshalYAML parses Astarte versions
+func (c *AstarteProfileCompatibility) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var raw struct {
+		MinAstarteVersion string `yaml:"minAstarteVersion,omitempty"`
+		MaxAstarteVersion string `yaml:"maxAstarteVersion,omitempty"`
+	}
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+
+	*c = AstarteProfileCompatibility{}
+	var err error
+	if raw.MinAstarteVersion != "" {
+		if c.MinAstarteVersion, err = semver.NewVersion(raw.MinAstarteVersion); err != nil {
+			return fmt.Errorf("invalid minAstarteVersion %s: %s", raw.MinAstarteVersion, err)
+		}
+	}
+	if raw.MaxAstarteVersion != "" {
+		if c.MaxAstarteVersion, err = semver.NewVersion(raw.MaxAstarteVersion); err != nil {
+			return fmt.Errorf("invalid maxAstarteVersion %s: %s", raw.MaxAstarteVersion, err)
+		}
+	}
+	return nil
+}
+
+// MarshalYAML renders Astarte versions as strings
+func (c AstarteProfileCompatibility) MarshalYAML() (interface{}, error) {
+	var raw struct {
+		MinAstarteVersion string `yaml:"minAstarteVersion,omitempty"`
+		MaxAstarteVersion string `yaml:"maxAstarteVersion,omitempty"`
+	}
+	if c.MinAstarteVersion != nil {
+		raw.MinAstarteVersion = c.MinAstarteVersion.String()
+	}
+	if c.MaxAstarteVersion != nil {
+		raw.MaxAstarteVersion = c.MaxAstarteVersion.String()
+	}
+	return raw, nil
+}
+
+// UnmarshalYAML accepts CPU and memory either as a number of millicores and bytes, or as Kubernetes quantities
+// such as "2" or "5Gi"
+func (r *AstarteProfileRequirements) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var raw struct {
+		CPUAllocation    interface{} `yaml:"cpuAllocation"`
+		MemoryAllocation interface{} `yaml:"memoryAllocation"`
+		MinNodes         int         `yaml:"minNodes,omitempty"`
+		MaxNodes         int         `yaml:"maxNodes,omitempty"`
+	}
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+
+	cpu, err := parseAllocation(raw.CPUAllocation, func(q resource.Quantity) int64 { return q.ScaledValue(resource.Milli) })
+	if err != nil {
+		return fmt.Errorf("invalid cpuAllocation: %s", err)
+	}
+	memory, err := parseAllocation(raw.MemoryAllocation, func(q resource.Quantity) int64 { return q.Value() })
+	if err != nil {
+		return fmt.Errorf("invalid memoryAllocation: %s", err)
+	}
+	*r = AstarteProfileRequirements{CPUAllocation: cpu, MemoryAllocation: memory, MinNodes: raw.MinNodes, MaxNodes: raw.MaxNodes}
+	return nil
+}
+
+func parseAllocation(value interface{}, quantityValue func(resource.Quantity) int64) (int64, error) {
+	switch v := value.(type) {
+	case nil:
+		return 0, nil
+	case int:
+		return int64(v), nil
+	case int64:
+		return v, nil
+	case uint64:
+		return 0, fmt.Errorf("%v is too large", v)
+	case string:
+		q, err := resource.ParseQuantity(v)
+		if err != nil {
+			return 0, err
+		}
+		return quantityValue(q), nil
+	}
+	return 0, fmt.Errorf("%v is neither an integer nor a quantity", value)
+}
+
+// UnmarshalYAML parses the field type from its name: string, int or bool. It defaults to string.
+func (f *AstarteProfileCustomizableField) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var raw struct {
+		Field      string      `yaml:"field"`
+		Question   string      `yaml:"question"`
+		Default    interface{} `yaml:"default"`
+		Type       string      `yaml:"type"`
+		AllowEmpty bool        `yaml:"allowEmpty,omitempty"`
+	}
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+	if raw.Type == "" {
+		raw.Type = "string"
+	}
+	fieldType, ok := customizableFieldTypes[raw.Type]
+	if !ok {
+		return fmt.Errorf("invalid type %s of customizable field %s, expected string, int or bool", raw.Type, raw.Field)
+	}
+
+	*f = AstarteProfileCustomizableField{
+		Field:      raw.Field,
+		Question:   raw.Question,
+		Default:    raw.Default,
+		Type:       fieldType,
+		AllowEmpty: raw.AllowEmpty,
+	}
+	return nil
+}
+
+// TypeName returns the name of the field type used in profile files
+func (f AstarteProfileCustomizableField) TypeName() string {
+	for name, fieldType := range customizableFieldTypes {
+		if fieldType == f.Type {
+			return name
+		}
+	}
+	return "string"
+}
+
+// MarshalYAML renders the field type by name
+func (f AstarteProfileCustomizableField) MarshalYAML() (interface{}, error) {
+	return struct {
+		Field      string      `yaml:"field"`
+		Question   string      `yaml:"question"`
+		Default    interface{} `yaml:"default,omitempty"`
+		Type       string      `yaml:"type"`
+		AllowEmpty bool        `yaml:"allowEmpty,omitempty"`
+	}{f.Field, f.Question, f.Default, f.TypeName(), f.AllowEmpty}, nil
+}
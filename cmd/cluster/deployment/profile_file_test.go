@@ -0,0 +1,118 @@
+package deployment
+
+import (
+	"go/types"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/Masterminds/semver/v3"
+	"gopkg.in/yaml.v2"
+)
+
+const testProfile = `name: edge
+description: Single node profile for edge gateways
+compatibility:
+  minAstarteVersion: 0.10.0
+  maxAstarteVersion: 0.10.99
+requirements:
+  cpuAllocation: "1.5"
+  memoryAllocation: 4Gi
+  maxNodes: 1
+defaultSpec:
+  version: 0.10.2
+  cassandra:
+    deploy: true
+customizableFields:
+- field: components.dataUpdaterPlant.replicas
+  question: How many Data Updater Plant replicas?
+  default: 1
+  type: int
+`
+
+func writeTestProfile(t *testing.T, dir string, name string, content string) string {
+	file := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestBuiltinProfilesAreValid(t *testing.T) {
+	for _, profile := range GetAllBuiltinAstarteClusterProfiles() {
+		if err := profile.Validate(); err != nil {
+			t.Errorf("%s: %v", profile.Name, err)
+		}
+	}
+}
+
+func TestLoadAstarteClusterProfile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "astartectl-profiles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	profile, err := LoadAstarteClusterProfile(writeTestProfile(t, dir, "edge.yaml", testProfile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedRequirements := AstarteProfileRequirements{CPUAllocation: 1500, MemoryAllocation: 4 * 1024 * 1024 * 1024, MaxNodes: 1}
+	if profile.Name != "edge" || profile.Requirements != expectedRequirements || !profile.DefaultSpec.Cassandra.Deploy ||
+		profile.Compatibility.MaxAstarteVersion.String() != "0.10.99" || profile.CustomizableFields[0].Type != types.Int {
+		t.Errorf("unexpected profile: %+v", profile)
+	}
+
+	// A marshaled profile can be loaded back
+	marshaled, err := yaml.Marshal(profile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloaded, err := LoadAstarteClusterProfile(writeTestProfile(t, dir, "reloaded.yaml", string(marshaled)))
+	if err != nil {
+		t.Fatalf("%v: %s", err, marshaled)
+	}
+	if !reflect.DeepEqual(reloaded, profile) {
+		t.Errorf("reloaded profile differs: %+v", reloaded)
+	}
+
+	if _, err := LoadAstarteClusterProfile(writeTestProfile(t, dir, "typo.yaml", testProfile+"requirement: {}\n")); err == nil {
+		t.Error("a profile with an unknown field was accepted")
+	}
+	_, err = LoadAstarteClusterProfile(writeTestProfile(t, dir, "invalid.yaml",
+		"name: invalid\nrequirements:\n  minNodes: 3\n  maxNodes: 1\ncustomizableFields:\n- field: api.ssl\n  type: bool\n  default: maybe\n"))
+	validationErr, ok := err.(*ProfileValidationError)
+	if !ok || len(validationErr.Problems) != 3 {
+		t.Errorf("unexpected validation error: %v", err)
+	}
+
+	files, err := ListAstarteClusterProfileFiles(dir)
+	if err != nil || len(files) != 4 || files[0] != filepath.Join(dir, "edge.yaml") {
+		t.Errorf("unexpected profile files: %v %v", files, err)
+	}
+	if files, err := ListAstarteClusterProfileFiles(filepath.Join(dir, "missing")); err != nil || len(files) != 0 {
+		t.Errorf("unexpected profile files in a missing directory: %v %v", files, err)
+	}
+}
+
+func TestIncompatibilityReasons(t *testing.T) {
+	profile := AstarteClusterProfile{
+		Name:         "test",
+		Requirements: AstarteProfileRequirements{CPUAllocation: 2000, MemoryAllocation: 1024, MinNodes: 2, MaxNodes: 3},
+	}
+	profile.Compatibility.MinAstarteVersion, _ = semver.NewVersion("0.11.0")
+
+	fits := AstarteProfileRequirements{CPUAllocation: 4000, MemoryAllocation: 2048, MinNodes: 2, MaxNodes: 2}
+	if reasons := profile.IncompatibilityReasons(semver.MustParse("0.11.1"), fits); reasons != nil {
+		t.Errorf("unexpected reasons: %v", reasons)
+	}
+	tooSmall := AstarteProfileRequirements{CPUAllocation: 1000, MemoryAllocation: 2048, MinNodes: 1, MaxNodes: 1}
+	if reasons := profile.IncompatibilityReasons(semver.MustParse("0.10.2"), tooSmall); len(reasons) != 3 {
+		t.Errorf("unexpected reasons: %v", reasons)
+	}
+	if reasons := profile.IncompatibilityReasons(nil, fits); reasons != nil {
+		t.Errorf("unexpected reasons without a version: %v", reasons)
+	}
+}
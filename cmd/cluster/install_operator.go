@@ -32,40 +32,56 @@ var installCmd = &cobra.Command{
 	Use:   "install-operator",
 	Short: "Install Astarte Operator in the current Kubernetes Cluster",
 	Long: `Install Astarte Operator in the current Kubernetes Cluster. This will adhere to the same current-context
-kubectl mentions. If no versions are specified, the last stable version is installed.`,
-	Example: `  astartectl cluster install-operator`,
-	RunE:    clusterInstallF,
+kubectl mentions. If no versions are specified, the last stable version is installed.
+
+Manifests are downloaded from GitHub, unless --manifests-dir or --from-bundle are given: on air-gapped clusters,
+create a bundle with astartectl cluster operator bundle and use --image-registry to pull images from a mirror.
+
+With --plan, the objects which would be created are printed together with their fields, and nothing is applied.`,
+	Example: `  astartectl cluster install-operator
+  astartectl cluster install-operator --plan
+  astartectl cluster install-operator --from-bundle astarte-operator-0.10.2.tar.gz --image-registry registry.local:5000`,
+	RunE: clusterInstallF,
 }
 
 func init() {
 	installCmd.PersistentFlags().String("version", "", "Version of Astarte Operator to install. If not specified, last stable version will be installed (recommended)")
 	installCmd.PersistentFlags().BoolP("non-interactive", "y", false, "Non-interactive mode. Will answer yes by default to all questions.")
+	addOperatorManifestsFlags(installCmd)
+	installCmd.PersistentFlags().Bool("plan", false, "Show the objects which would be created, without applying anything")
 
 	ClusterCmd.AddCommand(installCmd)
 }
 
 func clusterInstallF(command *cobra.Command, args []string) error {
-	_, err := getAstarteOperator()
-	if err == nil {
-		fmt.Println("Astarte Operator is already installed in your cluster.")
-		os.Exit(1)
-	}
-
-	version, err := command.Flags().GetString("version")
+	nonInteractive, err := command.Flags().GetBool("non-interactive")
 	if err != nil {
 		return err
 	}
-	nonInteractive, err := command.Flags().GetBool("non-interactive")
+	plan, err := command.Flags().GetBool("plan")
 	if err != nil {
 		return err
 	}
+	// The plan reports an existing Astarte Operator as a conflict
+	if _, err := getAstarteOperator(); err == nil && !plan {
+		fmt.Println("Astarte Operator is already installed in your cluster.")
+		os.Exit(1)
+	}
+	version, err := operatorVersionFromFlags(command)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
 
-	if version == "" {
-		version, err = getLastOperatorRelease()
+	if plan {
+		steps, err := planOperatorInstall(version)
 		if err != nil {
 			fmt.Println(err)
 			os.Exit(1)
 		}
+		fmt.Printf("Installing Astarte Operator version %s would apply the following changes:\n", version)
+		printOperatorPlan(os.Stdout, steps)
+		return nil
 	}
 
 	fmt.Printf("Will install Astarte Operator version %s in the Cluster.\n", version)
@@ -15,8 +15,11 @@
 package cluster
 
 import (
+	"errors"
 	"fmt"
 	"go/types"
+	"io"
+	"io/ioutil"
 	"os"
 	"strconv"
 	"strings"
@@ -36,9 +39,20 @@ var deployCmd = &cobra.Command{
 	Use:   "deploy",
 	Short: "Deploy an Astarte Instance in the current Kubernetes Cluster",
 	Long: `Deploy an Astarte Instance in the current Kubernetes Cluster. This will adhere to the same current-context
-kubectl mentions. If no versions are specified, the last stable version is deployed.`,
-	Example: `  astartectl cluster instances deploy`,
-	RunE:    clusterDeployF,
+kubectl mentions. If no versions are specified, the last stable version is deployed.
+
+The Astarte resource is built from the chosen profile, asking for any setting which was not given through flags.
+Values of the profile's customizable fields can be given with --answers, as a YAML file mapping each field
+to its value. Alternatively, --from-file deploys an Astarte resource from a YAML file, such as one printed by
+--dry-run: only --name and --namespace are taken into account in this case.
+
+In non-interactive mode, settings which were not given take their default value, and the command fails when
+there is none. --dry-run prints the resulting Astarte resource without deploying it.`,
+	Example: `  astartectl cluster instances deploy
+  astartectl cluster instances deploy --profile basic --api-host api.astarte.example.com \
+    --broker-host broker.astarte.example.com --answers answers.yaml -y --dry-run > astarte.yaml
+  astartectl cluster instances deploy --from-file astarte.yaml -y`,
+	RunE: clusterDeployF,
 }
 
 func init() {
@@ -58,72 +72,228 @@ func init() {
 	deployCmd.PersistentFlags().String("storage-class-name", "", "The Kubernetes Storage Class name for this Astarte deployment. If not specified, it will be left empty and the default Storage Class for your Cloud Provider will be used. Keep in mind that with some Cloud Providers, you always need to specify this.")
 	deployCmd.PersistentFlags().Bool("no-ssl", false, "Don't use SSL for the API and Broker endpoints. Strongly not recommended.")
 	deployCmd.PersistentFlags().BoolP("non-interactive", "y", false, "Non-interactive mode. Will answer yes by default to all questions.")
+	deployCmd.PersistentFlags().String("from-file", "", "Deploy the Astarte resource in this YAML file, rather than building it from a profile.")
+	deployCmd.MarkPersistentFlagFilename("from-file", "yaml", "yml")
+	deployCmd.PersistentFlags().String("answers", "", "YAML file holding the values of the profile's customizable fields.")
+	deployCmd.MarkPersistentFlagFilename("answers", "yaml", "yml")
+	deployCmd.PersistentFlags().Bool("dry-run", false, "Print the Astarte resource which would be deployed, without deploying it.")
 
 	InstancesCmd.AddCommand(deployCmd)
 }
 
 func clusterDeployF(command *cobra.Command, args []string) error {
-	nodes, allocatableCPU, allocatableMemory, err := getClusterAllocatableResources()
+	fromFile, err := command.Flags().GetString("from-file")
+	if err != nil {
+		return err
+	}
+	answersFile, err := command.Flags().GetString("answers")
+	if err != nil {
+		return err
+	}
+	if fromFile != "" && answersFile != "" {
+		return errors.New("--answers cannot be used together with --from-file")
+	}
+	dryRun, err := command.Flags().GetBool("dry-run")
+	if err != nil {
+		return err
+	}
+	nonInteractive, err := command.Flags().GetBool("non-interactive")
+	if err != nil {
+		return err
+	}
+
+	// The resource is all a dry run prints on stdout, so that it can be redirected to a file
+	messages := io.Writer(os.Stdout)
+	if dryRun {
+		messages = os.Stderr
+	}
+
+	var astarteDeploymentResource map[string]interface{}
+	if fromFile != "" {
+		astarteDeploymentResource, err = readAstarteResourceFile(fromFile)
+		if err != nil {
+			return err
+		}
+		metadata := astarteDeploymentResource["metadata"].(map[string]interface{})
+		for _, field := range []string{"name", "namespace"} {
+			value, err := command.Flags().GetString(field)
+			if err != nil {
+				return err
+			}
+			if value != "" {
+				metadata[field] = value
+			}
+			if s, _ := metadata[field].(string); s == "" {
+				return fmt.Errorf("%s has no metadata.%s, and --%s was not given", fromFile, field, field)
+			}
+		}
+	} else {
+		answers := map[string]interface{}{}
+		if answersFile != "" {
+			if answers, err = readDeploymentAnswers(answersFile); err != nil {
+				return err
+			}
+		}
+		astarteDeploymentResource = buildAstarteResourceFromProfile(command, answers, nonInteractive, messages)
+	}
+	metadata := astarteDeploymentResource["metadata"].(map[string]interface{})
+	resourceName := metadata["name"].(string)
+	resourceNamespace := metadata["namespace"].(string)
+
+	if dryRun {
+		marshaledResource, err := yaml.Marshal(astarteDeploymentResource)
+		if err != nil {
+			fmt.Fprintln(messages, "Could not build the YAML representation. Aborting.")
+			os.Exit(1)
+		}
+		fmt.Print(string(marshaledResource))
+		return nil
+	}
+
+	if !nonInteractive {
+		fmt.Println()
+		fmt.Println("Your Astarte instance is ready to be deployed!")
+		reviewConfiguration, _ := utils.AskForConfirmation("Do you wish to review the configuration before deployment?")
+		if reviewConfiguration {
+			marshaledResource, err := yaml.Marshal(astarteDeploymentResource)
+			if err != nil {
+				fmt.Println("Could not build the YAML representation. Aborting.")
+				os.Exit(1)
+			}
+			fmt.Println(string(marshaledResource))
+		}
+		goAhead, _ := utils.AskForConfirmation(fmt.Sprintf("Your Astarte instance \"%s\" will be deployed in namespace \"%s\". Do you want to continue?", resourceName, resourceNamespace))
+		if !goAhead {
+			fmt.Println("Aborting.")
+			os.Exit(0)
+		}
+	}
+
+	// Let's do it. Retrieve the namespace first and ensure it's there
+	namespaceList, err := kubernetesClient.CoreV1().Namespaces().List(metav1.ListOptions{})
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
+	namespaceFound := false
+	for _, ns := range namespaceList.Items {
+		if ns.Name == resourceNamespace {
+			namespaceFound = true
+			break
+		}
+	}
+
+	if !namespaceFound {
+		fmt.Printf("Namespace %s does not exist, creating it...\n", resourceNamespace)
+		nsSpec := &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: resourceNamespace}}
+		_, err := kubernetesClient.CoreV1().Namespaces().Create(nsSpec)
+		if err != nil {
+			fmt.Println("Could not create namespace!")
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+
+	_, err = kubernetesDynamicClient.Resource(astarteV1Alpha1).Namespace(resourceNamespace).Create(&unstructured.Unstructured{Object: astarteDeploymentResource},
+		metav1.CreateOptions{})
+	if err != nil {
+		fmt.Println("Error while deploying Astarte Resource.")
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	fmt.Println("Your Astarte instance has been successfully deployed. Please allow a few minutes for the Cluster to start. You can monitor the progress with astartectl cluster show.")
+	return nil
+}
+
+// buildAstarteResourceFromProfile builds the Astarte resource out of a profile compatible with the cluster, taking
+// settings from flags and answers, or prompting for them. Information, prompts and errors are printed on messages.
+func buildAstarteResourceFromProfile(command *cobra.Command, answers map[string]interface{}, nonInteractive bool,
+	messages io.Writer) map[string]interface{} {
+	capacity, err := getClusterCapacity(nil)
+	if err != nil {
+		fmt.Fprintln(messages, err)
+		os.Exit(1)
+	}
 
-	fmt.Printf("Cluster has %v nodes\n", nodes)
-	fmt.Printf("Allocatable CPU is %vm\n", allocatableCPU)
-	fmt.Printf("Allocatable Memory is %v\n", bytefmt.ByteSize(uint64(allocatableMemory)))
-	fmt.Println()
+	freeResources := capacity.requirements()
+	fmt.Fprintf(messages, "Cluster has %v schedulable nodes\n", len(capacity.Nodes))
+	if len(capacity.UnschedulableNodes) > 0 {
+		fmt.Fprintf(messages, "Nodes which cannot be scheduled on: %s\n", capacity.unschedulableNodesSummary())
+	}
+	fmt.Fprintf(messages, "Free CPU is %vm\n", freeResources.CPUAllocation)
+	fmt.Fprintf(messages, "Free Memory is %v\n", bytefmt.ByteSize(uint64(freeResources.MemoryAllocation)))
+	fmt.Fprintln(messages)
 
 	version, err := command.Flags().GetString("version")
 	if err != nil {
-		return err
+		fmt.Fprintln(messages, err)
+		os.Exit(1)
 	}
 	if version == "" {
-		latestAstarteVersion, _ := getLastAstarteRelease()
-		version, err = utils.PromptChoice("What Astarte version would you like to install?", latestAstarteVersion, false)
-		if err != nil {
-			fmt.Println(err)
-			os.Exit(1)
+		latestAstarteVersion, err := getLastAstarteRelease()
+		if nonInteractive {
+			if err != nil {
+				fmt.Fprintf(messages, "Could not retrieve the last Astarte version, please specify --version: %s\n", err)
+				os.Exit(1)
+			}
+			version = latestAstarteVersion
+		} else {
+			version, err = utils.PromptChoiceTo(messages, "What Astarte version would you like to install?", latestAstarteVersion, false)
+			if err != nil {
+				fmt.Fprintln(messages, err)
+				os.Exit(1)
+			}
 		}
 	}
 	astarteVersion, err := semver.NewVersion(version)
 	if err != nil {
-		fmt.Printf("%s is not a valid Astarte version", version)
+		fmt.Fprintf(messages, "%s is not a valid Astarte version\n", version)
 		os.Exit(1)
 	}
 
-	clusterRequirements := deployment.AstarteProfileRequirements{
-		CPUAllocation:    allocatableCPU,
-		MemoryAllocation: allocatableMemory,
-		MinNodes:         nodes,
-		MaxNodes:         nodes,
+	profiles, err := getAstarteClusterProfiles(command)
+	if err != nil {
+		fmt.Fprintln(messages, err)
+		os.Exit(1)
+	}
+	availableProfiles := map[string]deployment.AstarteClusterProfile{}
+	for _, profile := range profiles {
+		if len(capacity.profileIncompatibilityReasons(profile.AstarteClusterProfile, astarteVersion)) == 0 {
+			availableProfiles[profile.Name] = profile.AstarteClusterProfile
+		}
 	}
-	availableProfiles := deployment.GetProfilesForVersionAndRequirements(astarteVersion, clusterRequirements)
 
 	if len(availableProfiles) == 0 {
-		fmt.Println("Unfortunately, your cluster allocatable resources do not allow for any profile to be deployed.")
+		fmt.Fprintln(messages, "Unfortunately, the free resources of your cluster's nodes do not allow for any profile to be deployed.")
+		fmt.Fprintln(messages, "Run astartectl cluster profiles list to find out why.")
 		os.Exit(1)
 	}
 
-	fmt.Println("You can safely deploy the following Profiles on this cluster:")
-	for _, v := range availableProfiles {
-		fmt.Printf("%s: %s\n", v.Name, v.Description)
+	fmt.Fprintln(messages, "You can safely deploy the following Profiles on this cluster:")
+	for _, name := range sortedProfileNames(availableProfiles) {
+		fmt.Fprintf(messages, "%s: %s\n", name, availableProfiles[name].Description)
 	}
 
-	fmt.Println()
-	profile := getStringFlagFromPromptOrDie(command, "profile", "Which profile would you like to deploy?", "", false)
+	fmt.Fprintln(messages)
+	profile := getStringFlagFromPromptOrDie(command, messages, "profile", "Which profile would you like to deploy?", "", false)
 
-	astarteDeployment := availableProfiles[profile]
+	astarteDeployment, ok := availableProfiles[profile]
+	if !ok {
+		fmt.Fprintf(messages, "Profile %s cannot be deployed on this cluster. Run astartectl cluster profiles show %s to find out why.\n",
+			profile, profile)
+		os.Exit(1)
+	}
 
 	// Let's go
-	resourceName := getStringFlagFromPromptOrDie(command, "name", "Please enter the name for this Astarte instance:", "astarte", false)
-	resourceNamespace := getStringFlagFromPromptOrDie(command, "namespace", "Please enter the namespace where the Astarte instance will be deployed:", "astarte", false)
+	resourceName := getStringFlagFromPromptOrDie(command, messages, "name", "Please enter the name for this Astarte instance:", "astarte", false)
+	resourceNamespace := getStringFlagFromPromptOrDie(command, messages, "namespace", "Please enter the namespace where the Astarte instance will be deployed:", "astarte", false)
 	astarteDeployment.DefaultSpec.Version = astarteVersion.String()
-	astarteDeployment.DefaultSpec.API.Host = getStringFlagFromPromptOrDie(command, "api-host", "Please enter the API Host for this Deployment:", "", false)
-	astarteDeployment.DefaultSpec.Vernemq.Host = getStringFlagFromPromptOrDie(command, "broker-host", "Please enter the MQTT Broker Host for this Deployment:", "", false)
+	astarteDeployment.DefaultSpec.API.Host = getStringFlagFromPromptOrDie(command, messages, "api-host", "Please enter the API Host for this Deployment:", "", false)
+	astarteDeployment.DefaultSpec.Vernemq.Host = getStringFlagFromPromptOrDie(command, messages, "broker-host", "Please enter the MQTT Broker Host for this Deployment:", "", false)
 	storageClassName, err := command.Flags().GetString("storage-class-name")
 	if err != nil {
-		fmt.Println(err)
+		fmt.Fprintln(messages, err)
 		os.Exit(1)
 	}
 	if storageClassName != "" {
@@ -132,56 +302,37 @@ func clusterDeployF(command *cobra.Command, args []string) error {
 
 	// Ensure Storage and dependencies for all components.
 	if astarteDeployment.DefaultSpec.Cassandra.Deploy {
-		astarteDeployment.DefaultSpec.Cassandra.Storage.Size = getStringFlagFromPromptOrDie(command, "cassandra-volume-size", "Please enter the Cassandra Volume size for this Deployment:",
+		astarteDeployment.DefaultSpec.Cassandra.Storage.Size = getStringFlagFromPromptOrDie(command, messages, "cassandra-volume-size", "Please enter the Cassandra Volume size for this Deployment:",
 			astarteDeployment.DefaultSpec.Cassandra.Storage.Size, false)
 	} else {
 		// Ask for nodes
-		astarteDeployment.DefaultSpec.Cassandra.Nodes = getStringFlagFromPromptOrDie(command, "cassandra-nodes", "Please enter a comma separated list of Cassandra Nodes the cluster will connect to:",
+		astarteDeployment.DefaultSpec.Cassandra.Nodes = getStringFlagFromPromptOrDie(command, messages, "cassandra-nodes", "Please enter a comma separated list of Cassandra Nodes the cluster will connect to:",
 			astarteDeployment.DefaultSpec.Cassandra.Nodes, false)
 	}
 	if astarteDeployment.DefaultSpec.Rabbitmq.Deploy {
-		astarteDeployment.DefaultSpec.Rabbitmq.Storage.Size = getStringFlagFromPromptOrDie(command, "rabbitmq-volume-size", "Please enter the RabbitMQ Volume size for this Deployment:",
+		astarteDeployment.DefaultSpec.Rabbitmq.Storage.Size = getStringFlagFromPromptOrDie(command, messages, "rabbitmq-volume-size", "Please enter the RabbitMQ Volume size for this Deployment:",
 			astarteDeployment.DefaultSpec.Rabbitmq.Storage.Size, false)
 	}
 	if astarteDeployment.DefaultSpec.Vernemq.Deploy {
-		astarteDeployment.DefaultSpec.Vernemq.Storage.Size = getStringFlagFromPromptOrDie(command, "vernemq-volume-size", "Please enter the VerneMQ Volume size for this Deployment:",
+		astarteDeployment.DefaultSpec.Vernemq.Storage.Size = getStringFlagFromPromptOrDie(command, messages, "vernemq-volume-size", "Please enter the VerneMQ Volume size for this Deployment:",
 			astarteDeployment.DefaultSpec.Vernemq.Storage.Size, false)
 	}
 	if astarteDeployment.DefaultSpec.Cfssl.Deploy {
-		astarteDeployment.DefaultSpec.Cfssl.Storage.Size = getStringFlagFromPromptOrDie(command, "cfssl-volume-size", "Please enter the CFSSL Volume size for this Deployment:",
+		astarteDeployment.DefaultSpec.Cfssl.Storage.Size = getStringFlagFromPromptOrDie(command, messages, "cfssl-volume-size", "Please enter the CFSSL Volume size for this Deployment:",
 			astarteDeployment.DefaultSpec.Cfssl.Storage.Size, false)
-		cfsslDBDriver := getStringFlagFromPromptOrDie(command, "cfssl-db-driver", "Please enter the CFSSL DB Driver for this deployment.\nPlease note that leaving this empty will default to using SQLite, which is strongly discouraged in production.\nCFSSL DB Connection String:",
+		cfsslDBDriver := getStringFlagFromPromptOrDie(command, messages, "cfssl-db-driver", "Please enter the CFSSL DB Driver for this deployment.\nPlease note that leaving this empty will default to using SQLite, which is strongly discouraged in production.\nCFSSL DB Connection String:",
 			"", true)
 		if cfsslDBDriver != "" {
 			astarteDeployment.DefaultSpec.Cfssl.DbConfig.Driver = cfsslDBDriver
-			astarteDeployment.DefaultSpec.Cfssl.DbConfig.DataSource = getStringFlagFromPromptOrDie(command, "cfssl-db-datasource", "Please enter the CFSSL DB Datasource for this Deployment:",
+			astarteDeployment.DefaultSpec.Cfssl.DbConfig.DataSource = getStringFlagFromPromptOrDie(command, messages, "cfssl-db-datasource", "Please enter the CFSSL DB Datasource for this Deployment:",
 				"", false)
 		}
 	}
 
-	customFields := map[string]interface{}{}
-	// Now we go with the custom fields
-	for _, customizableField := range astarteDeployment.CustomizableFields {
-		stringValue := getFromPromptOrDie(command, customizableField.Question,
-			fmt.Sprintf("%v", customizableField.Default), customizableField.AllowEmpty)
-		switch customizableField.Type {
-		case types.Int:
-			i, err := strconv.Atoi(stringValue)
-			if err != nil {
-				fmt.Printf("%v is not a valid value for %v.\n", stringValue, customizableField.Field)
-				os.Exit(1)
-			}
-			customFields[customizableField.Field] = i
-		case types.Bool:
-			b, err := strconv.ParseBool(stringValue)
-			if err != nil {
-				fmt.Printf("%v is not a valid value for %v.\n", stringValue, customizableField.Field)
-				os.Exit(1)
-			}
-			customFields[customizableField.Field] = b
-		default:
-			customFields[customizableField.Field] = stringValue
-		}
+	customFields, err := getCustomFieldValues(command, messages, astarteDeployment.CustomizableFields, answers)
+	if err != nil {
+		fmt.Fprintln(messages, err)
+		os.Exit(1)
 	}
 
 	// Assemble the Astarte resource
@@ -197,12 +348,12 @@ func clusterDeployF(command *cobra.Command, args []string) error {
 
 	astarteDeploymentYaml, err := yaml.Marshal(astarteK8sDeployment)
 	if err != nil {
-		fmt.Println(err)
+		fmt.Fprintln(messages, err)
 		os.Exit(1)
 	}
 	astarteDeploymentResource, err := utils.UnmarshalYAMLToJSON(astarteDeploymentYaml)
 	if err != nil {
-		fmt.Println(err)
+		fmt.Fprintln(messages, err)
 		os.Exit(1)
 	}
 	// Go with the custom fields
@@ -212,77 +363,115 @@ func clusterDeployF(command *cobra.Command, args []string) error {
 			fieldTokens, customFieldValue)
 	}
 
-	//
-	fmt.Println()
-	fmt.Println("Your Astarte instance is ready to be deployed!")
-	reviewConfiguration, _ := utils.AskForConfirmation("Do you wish to review the configuration before deployment?")
-	if reviewConfiguration {
-		marshaledResource, err := yaml.Marshal(astarteDeploymentResource)
-		if err != nil {
-			fmt.Println("Could not build the YAML representation. Aborting.")
-			os.Exit(1)
-		}
-		fmt.Println(string(marshaledResource))
-	}
-	goAhead, _ := utils.AskForConfirmation(fmt.Sprintf("Your Astarte instance \"%s\" will be deployed in namespace \"%s\". Do you want to continue?", resourceName, resourceNamespace))
-	if !goAhead {
-		fmt.Println("Aborting.")
-		os.Exit(0)
-	}
+	return astarteDeploymentResource
+}
 
-	// Let's do it. Retrieve the namespace first and ensure it's there
-	namespaceList, err := kubernetesClient.CoreV1().Namespaces().List(metav1.ListOptions{})
-	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+// getCustomFieldValues returns the values of customizableFields, taken from answers or prompted for
+func getCustomFieldValues(command *cobra.Command, messages io.Writer, customizableFields []deployment.AstarteProfileCustomizableField,
+	answers map[string]interface{}) (map[string]interface{}, error) {
+	customizable := map[string]bool{}
+	for _, customizableField := range customizableFields {
+		customizable[customizableField.Field] = true
 	}
-	namespaceFound := false
-	for _, ns := range namespaceList.Items {
-		if ns.Name == resourceNamespace {
-			namespaceFound = true
-			break
+	for field := range answers {
+		if !customizable[field] {
+			return nil, fmt.Errorf("%s is not a customizable field of the profile", field)
 		}
 	}
 
-	if !namespaceFound {
-		fmt.Printf("Namespace %s does not exist, creating it...\n", resourceNamespace)
-		nsSpec := &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: resourceNamespace}}
-		_, err := kubernetesClient.CoreV1().Namespaces().Create(nsSpec)
-		if err != nil {
-			fmt.Println("Could not create namespace!")
-			fmt.Println(err)
-			os.Exit(1)
+	customFields := map[string]interface{}{}
+	for _, customizableField := range customizableFields {
+		var stringValue string
+		if answer, ok := answers[customizableField.Field]; ok && answer != nil {
+			stringValue = fmt.Sprintf("%v", answer)
+		} else {
+			stringValue = getFromPromptOrDie(command, messages, customizableField.Question,
+				fmt.Sprintf("%v", customizableField.Default), customizableField.AllowEmpty)
+		}
+		switch customizableField.Type {
+		case types.Int:
+			i, err := strconv.Atoi(stringValue)
+			if err != nil {
+				return nil, fmt.Errorf("%v is not a valid value for %v", stringValue, customizableField.Field)
+			}
+			customFields[customizableField.Field] = i
+		case types.Bool:
+			b, err := strconv.ParseBool(stringValue)
+			if err != nil {
+				return nil, fmt.Errorf("%v is not a valid value for %v", stringValue, customizableField.Field)
+			}
+			customFields[customizableField.Field] = b
+		default:
+			customFields[customizableField.Field] = stringValue
 		}
 	}
+	return customFields, nil
+}
 
-	_, err = kubernetesDynamicClient.Resource(astarteV1Alpha1).Namespace(resourceNamespace).Create(&unstructured.Unstructured{Object: astarteDeploymentResource},
-		metav1.CreateOptions{})
+// readDeploymentAnswers reads a YAML file mapping customizable fields to their values
+func readDeploymentAnswers(file string) (map[string]interface{}, error) {
+	content, err := ioutil.ReadFile(file)
 	if err != nil {
-		fmt.Println("Error while deploying Astarte Resource.")
-		fmt.Println(err)
-		os.Exit(1)
+		return nil, err
+	}
+	answers := map[string]interface{}{}
+	if err := yaml.Unmarshal(content, &answers); err != nil {
+		return nil, fmt.Errorf("Could not parse %s: %s", file, err)
 	}
+	return answers, nil
+}
 
-	fmt.Println("Your Astarte instance has been successfully deployed. Please allow a few minutes for the Cluster to start. You can monitor the progress with astartectl cluster show.")
-	return nil
+// readAstarteResourceFile reads an Astarte resource from a YAML file
+func readAstarteResourceFile(file string) (map[string]interface{}, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	resource, err := utils.UnmarshalYAMLToJSON(content)
+	if err != nil || resource == nil {
+		return nil, fmt.Errorf("%s is not a valid YAML file", file)
+	}
+	if resource["kind"] != "Astarte" || resource["apiVersion"] != astarteV1Alpha1.GroupVersion().String() {
+		return nil, fmt.Errorf("%s does not hold an Astarte resource of version %s", file, astarteV1Alpha1.GroupVersion())
+	}
+	if _, ok := resource["spec"].(map[string]interface{}); !ok {
+		return nil, fmt.Errorf("%s has no spec", file)
+	}
+	if _, ok := resource["metadata"].(map[string]interface{}); !ok {
+		resource["metadata"] = map[string]interface{}{}
+	}
+	return resource, nil
 }
 
-func getStringFlagFromPromptOrDie(command *cobra.Command, flagName string, question string, defaultValue string, allowEmpty bool) string {
+func getStringFlagFromPromptOrDie(command *cobra.Command, messages io.Writer, flagName string, question string, defaultValue string, allowEmpty bool) string {
 	ret, err := command.Flags().GetString(flagName)
 	if err != nil {
-		fmt.Println(err)
+		fmt.Fprintln(messages, err)
 		os.Exit(1)
 	}
 	if ret == "" {
-		ret = getFromPromptOrDie(command, question, defaultValue, allowEmpty)
+		if nonInteractive, _ := command.Flags().GetBool("non-interactive"); nonInteractive && defaultValue == "" && !allowEmpty {
+			fmt.Fprintf(messages, "--%s is required in non-interactive mode.\n", flagName)
+			os.Exit(1)
+		}
+		ret = getFromPromptOrDie(command, messages, question, defaultValue, allowEmpty)
 	}
 	return ret
 }
 
-func getFromPromptOrDie(command *cobra.Command, question string, defaultValue string, allowEmpty bool) string {
-	ret, err := utils.PromptChoice(question, defaultValue, allowEmpty)
+// getFromPromptOrDie prompts question on messages, or returns defaultValue in non-interactive mode
+func getFromPromptOrDie(command *cobra.Command, messages io.Writer, question string, defaultValue string, allowEmpty bool) string {
+	if nonInteractive, _ := command.Flags().GetBool("non-interactive"); nonInteractive {
+		if defaultValue == "" && !allowEmpty {
+			fmt.Fprintf(messages, "%s\nThere is no default answer, hence a value is required in non-interactive mode.\n", question)
+			os.Exit(1)
+		}
+		return defaultValue
+	}
+
+	ret, err := utils.PromptChoiceTo(messages, question, defaultValue, allowEmpty)
 	if err != nil {
-		fmt.Println(err)
+		fmt.Fprintln(messages, err)
 		os.Exit(1)
 	}
 	return ret
@@ -0,0 +1,114 @@
+package cluster
+
+import (
+	"bytes"
+	"go/types"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/astarte-platform/astartectl/cmd/cluster/deployment"
+)
+
+func TestReadAstarteResourceFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "astartectl-deploy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for name, test := range map[string]struct {
+		content string
+		valid   bool
+	}{
+		"astarte.yaml": {"apiVersion: api.astarte-platform.org/v1alpha1\nkind: Astarte\nmetadata:\n  name: astarte\nspec:\n  version: 0.10.2\n", true},
+		"no-spec.yaml": {"apiVersion: api.astarte-platform.org/v1alpha1\nkind: Astarte\n", false},
+		"other.yaml":   {"apiVersion: v1\nkind: ConfigMap\nspec: {}\n", false},
+	} {
+		file := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(file, []byte(test.content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		resource, err := readAstarteResourceFile(file)
+		if test.valid != (err == nil) {
+			t.Errorf("%s: unexpected error %v", name, err)
+			continue
+		}
+		if test.valid && resource["metadata"].(map[string]interface{})["name"] != "astarte" {
+			t.Errorf("%s: unexpected resource %v", name, resource)
+		}
+	}
+}
+
+func TestGetCustomFieldValues(t *testing.T) {
+	customizableFields := []deployment.AstarteProfileCustomizableField{
+		{Field: "components.dataUpdaterPlant.replicas", Type: types.Int, Default: 1},
+		{Field: "api.ssl", Type: types.Bool, Default: true},
+		{Field: "vernemq.sslListener", Type: types.String, AllowEmpty: true},
+	}
+	// Persistent flags are merged into Flags() when the command runs
+	deployCmd.LocalFlags()
+	deployCmd.Flags().Set("non-interactive", "true")
+	defer deployCmd.Flags().Set("non-interactive", "false")
+
+	values, err := getCustomFieldValues(deployCmd, ioutil.Discard, customizableFields, map[string]interface{}{
+		"components.dataUpdaterPlant.replicas": 3,
+		"vernemq.sslListener":                  "true",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{
+		"components.dataUpdaterPlant.replicas": 3,
+		"api.ssl":                              true,
+		"vernemq.sslListener":                  "true",
+	}
+	if !reflect.DeepEqual(values, expected) {
+		t.Errorf("unexpected values: %v", values)
+	}
+
+	if _, err := getCustomFieldValues(deployCmd, ioutil.Discard, customizableFields, map[string]interface{}{"api.host": "x"}); err == nil {
+		t.Error("an answer for a field which is not customizable was accepted")
+	}
+	if _, err := getCustomFieldValues(deployCmd, ioutil.Discard, customizableFields, map[string]interface{}{"api.ssl": "maybe"}); err == nil {
+		t.Error("an invalid boolean answer was accepted")
+	}
+}
+
+func TestPromptOnMessages(t *testing.T) {
+	// With --dry-run, prompts are printed on stderr rather than mixed with the resource printed on stdout
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	previousStdin, previousStdout := os.Stdin, os.Stdout
+	defer func() { os.Stdin, os.Stdout = previousStdin, previousStdout }()
+	os.Stdin = r
+	if _, err := w.WriteString("api.astarte.example.com\n"); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	stdout, err := ioutil.TempFile("", "astartectl-stdout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(stdout.Name())
+	defer stdout.Close()
+	os.Stdout = stdout
+
+	var messages bytes.Buffer
+	deployCmd.LocalFlags()
+	host := getStringFlagFromPromptOrDie(deployCmd, &messages, "api-host", "Please enter the API Host for this Deployment:", "", false)
+	if host != "api.astarte.example.com" {
+		t.Errorf("unexpected answer %s", host)
+	}
+	if messages.String() != "Please enter the API Host for this Deployment: " {
+		t.Errorf("unexpected messages %q", messages.String())
+	}
+	if printed, _ := ioutil.ReadFile(stdout.Name()); len(printed) != 0 {
+		t.Errorf("unexpected output on stdout %q", printed)
+	}
+}
@@ -0,0 +1,255 @@
+// Copyright © 2019 Ispirata Srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/astarte-platform/astartectl/client"
+	"github.com/astarte-platform/astartectl/cmd/config"
+	"github.com/astarte-platform/astartectl/utils"
+	"github.com/mitchellh/go-homedir"
+	"github.com/spf13/cobra"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var getCredentialsCmd = &cobra.Command{
+	Use:   "get-credentials <name>",
+	Short: "Write an astartectl context to access an Astarte Instance",
+	Long: `Write a context to access an Astarte Instance in the current Kubernetes Cluster into astartectl's
+configuration file, so that other astartectl commands can be used right away.
+
+The API URL is built from the API host and SSL settings of the Astarte resource, and the Housekeeping private
+key is read from the Secret created by Astarte Operator and saved in --keys-dir. When the context already
+exists, its URL, Housekeeping key and kubeconfig are updated, and its other settings are kept.
+
+With --create-realm, a realm is created with a freshly generated keypair, which is saved in --keys-dir and
+set as the realm of the context. Existing keys of a realm with the same name are never overwritten.`,
+	Example: `  astartectl cluster instances get-credentials astarte
+  astartectl cluster instances get-credentials astarte --context-name staging --use --create-realm test`,
+	Args: cobra.ExactArgs(1),
+	RunE: instanceGetCredentialsF,
+}
+
+func init() {
+	getCredentialsCmd.PersistentFlags().String("namespace", "", "Namespace of the Astarte resource. Defaults to astarte.")
+	getCredentialsCmd.PersistentFlags().String("context-name", "", "Name of the context to write. Defaults to the name of the instance.")
+	getCredentialsCmd.PersistentFlags().Bool("use", false, "Switch to the context once written")
+	getCredentialsCmd.PersistentFlags().String("keys-dir", "", "Directory to save private keys in. Defaults to ~/.astartectl/keys/<context>.")
+	getCredentialsCmd.MarkPersistentFlagDirname("keys-dir")
+	getCredentialsCmd.PersistentFlags().String("housekeeping-key-secret", "",
+		"Secret holding the Housekeeping private key. Defaults to <name>-housekeeping-private-key.")
+	getCredentialsCmd.PersistentFlags().String("create-realm", "", "Create a realm with this name and a new keypair, and set it in the context")
+
+	InstancesCmd.AddCommand(getCredentialsCmd)
+}
+
+func instanceGetCredentialsF(command *cobra.Command, args []string) error {
+	resourceName := args[0]
+	resourceNamespace, err := command.Flags().GetString("namespace")
+	if err != nil {
+		return err
+	}
+	if resourceNamespace == "" {
+		resourceNamespace = "astarte"
+	}
+	contextName, err := command.Flags().GetString("context-name")
+	if err != nil {
+		return err
+	}
+	if contextName == "" {
+		contextName = resourceName
+	}
+	use, err := command.Flags().GetBool("use")
+	if err != nil {
+		return err
+	}
+	keysDir, err := command.Flags().GetString("keys-dir")
+	if err != nil {
+		return err
+	}
+	if keysDir == "" {
+		home, err := homedir.Dir()
+		if err != nil {
+			return err
+		}
+		keysDir = filepath.Join(home, ".astartectl", "keys", contextName)
+	}
+	secretName, err := command.Flags().GetString("housekeeping-key-secret")
+	if err != nil {
+		return err
+	}
+	if secretName == "" {
+		secretName = resourceName + "-housekeeping-private-key"
+	}
+	realm, err := command.Flags().GetString("create-realm")
+	if err != nil {
+		return err
+	}
+	if realm != "" && !utils.IsValidAstarteRealmName(realm) {
+		return fmt.Errorf("%s is not a valid realm name", realm)
+	}
+
+	astarteObject, err := getAstarte(kubernetesDynamicClient.Resource(astarteV1Alpha1), resourceName, resourceNamespace)
+	if err != nil {
+		fmt.Printf("Could not find Astarte instance %s in namespace %s.\n", resourceName, resourceNamespace)
+		os.Exit(1)
+	}
+	apiURL, err := astarteAPIURL(*astarteObject)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	housekeepingKey, err := getHousekeepingPrivateKey(secretName, resourceNamespace)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	if err := os.MkdirAll(keysDir, 0700); err != nil {
+		return err
+	}
+	housekeepingKeyFile := filepath.Join(keysDir, "housekeeping_private.pem")
+	if err := ioutil.WriteFile(housekeepingKeyFile, housekeepingKey, 0600); err != nil {
+		return err
+	}
+
+	f, err := config.LoadFile()
+	if err != nil {
+		return err
+	}
+	context, exists := f.Contexts[contextName]
+	context.URL = apiURL
+	context.Housekeeping.Key = housekeepingKeyFile
+	f.Contexts[contextName] = context
+	if use || f.CurrentContext == "" {
+		f.CurrentContext = contextName
+	}
+	if err := f.Save(); err != nil {
+		return err
+	}
+	if exists {
+		fmt.Printf("Context %s updated in %s, with API URL %s.\n", contextName, f.Path(), apiURL)
+	} else {
+		fmt.Printf("Context %s created in %s, with API URL %s.\n", contextName, f.Path(), apiURL)
+	}
+
+	if realm == "" {
+		return nil
+	}
+	realmKeyFile, err := createRealmWithNewKeypair(apiURL, housekeepingKey, realm, keysDir)
+	if err != nil {
+		fmt.Printf("Could not create realm %s: %s\n", realm, err)
+		os.Exit(1)
+	}
+	context.Realm = config.RealmContext{Name: realm, Key: realmKeyFile}
+	f.Contexts[contextName] = context
+	if err := f.Save(); err != nil {
+		return err
+	}
+	fmt.Printf("Realm %s created, and set in context %s. Its private key is %s.\n", realm, contextName, realmKeyFile)
+	return nil
+}
+
+// getHousekeepingPrivateKey returns the PEM encoded Housekeeping private key held by secretName
+func getHousekeepingPrivateKey(secretName string, namespace string) ([]byte, error) {
+	secret, err := kubernetesClient.CoreV1().Secrets(namespace).Get(secretName, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("Could not read the Housekeeping private key: %s", err)
+	}
+	key, ok := secret.Data["private-key"]
+	if !ok || len(key) == 0 {
+		return nil, fmt.Errorf("Secret %s holds no private-key", secretName)
+	}
+	return key, nil
+}
+
+// createRealmWithNewKeypair creates realm in the Astarte instance at apiURL with a freshly generated keypair,
+// saved as <realm>_private.pem and <realm>_public.pem in keysDir. Existing key files are never overwritten.
+// Returns the path of the private key.
+func createRealmWithNewKeypair(apiURL string, housekeepingKey []byte, realm string, keysDir string) (string, error) {
+	if !utils.IsValidAstarteRealmName(realm) {
+		return "", fmt.Errorf("%s is not a valid realm name", realm)
+	}
+	key, err := rsa.GenerateKey(rand.Reader, 4096)
+	if err != nil {
+		return "", err
+	}
+	publicKeyBytes, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		return "", err
+	}
+	privateKeyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	publicKeyPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicKeyBytes})
+
+	// Save the keypair first: a realm whose private key got lost would be unusable
+	privateKeyFile := filepath.Join(keysDir, realm+"_private.pem")
+	publicKeyFile := filepath.Join(keysDir, realm+"_public.pem")
+	if err := writeNewFile(privateKeyFile, privateKeyPEM, 0600); err != nil {
+		return "", err
+	}
+	if err := writeNewFile(publicKeyFile, publicKeyPEM, 0644); err != nil {
+		os.Remove(privateKeyFile)
+		return "", err
+	}
+
+	astarteAPIClient, err := client.NewClient(apiURL, config.HTTPClient())
+	if err == nil {
+		var token string
+		token, err = utils.GenerateAstarteJWTFromPEMKey(housekeepingKey, utils.Housekeeping, []string{"POST::realms"}, 300)
+		if err == nil {
+			err = astarteAPIClient.Housekeeping.CreateRealm(realm, string(publicKeyPEM), token)
+		}
+	}
+	if err == nil {
+		return privateKeyFile, nil
+	}
+
+	// The keypair can be discarded only if Astarte refused the realm: otherwise, it might have been created
+	apiErr, ok := err.(*client.APIError)
+	if ok && apiErr.StatusCode >= 400 && apiErr.StatusCode < 500 {
+		os.Remove(privateKeyFile)
+		os.Remove(publicKeyFile)
+		return "", err
+	}
+	return "", fmt.Errorf("%s. The realm might have been created nonetheless, its private key is kept in %s", err, privateKeyFile)
+}
+
+// writeNewFile writes data to a new file at path, failing if it already exists
+func writeNewFile(path string, data []byte, perm os.FileMode) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if os.IsExist(err) {
+		return fmt.Errorf("%s already exists, and will not be overwritten", path)
+	} else if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(path)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(path)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package cluster
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/astarte-platform/astartectl/astartetest"
+	"github.com/astarte-platform/astartectl/cmd/config"
+	"github.com/spf13/viper"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestGetCredentials(t *testing.T) {
+	server, err := astartetest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "astartectl-credentials")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// An existing context is merged: its realm-management settings are kept
+	configFile := filepath.Join(dir, "config.yaml")
+	configContent := "current-context: other\ncontexts:\n  astarte:\n    url: https://old.example.com\n    realm-management:\n      url: https://rm.example.com\n"
+	if err := ioutil.WriteFile(configFile, []byte(configContent), 0600); err != nil {
+		t.Fatal(err)
+	}
+	viper.SetConfigFile(configFile)
+	defer viper.SetConfigFile("")
+
+	astarte := testAstarteResource("green")
+	unstructured.SetNestedField(astarte.Object, strings.TrimPrefix(server.URL(), "http://"), "spec", "api", "host")
+	unstructured.SetNestedField(astarte.Object, false, "spec", "api", "ssl")
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "astarte-housekeeping-private-key", Namespace: "astarte"},
+		Data:       map[string][]byte{"private-key": server.HousekeepingPrivateKey()},
+	}
+	previousClient, previousDynamicClient := kubernetesClient, kubernetesDynamicClient
+	defer func() {
+		kubernetesClient, kubernetesDynamicClient = previousClient, previousDynamicClient
+	}()
+	kubernetesClient = fake.NewSimpleClientset(secret)
+	kubernetesDynamicClient = dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), astarte)
+
+	keysDir := filepath.Join(dir, "keys")
+	getCredentialsCmd.LocalFlags()
+	getCredentialsCmd.Flags().Set("keys-dir", keysDir)
+	getCredentialsCmd.Flags().Set("create-realm", "test")
+	defer getCredentialsCmd.Flags().Set("keys-dir", "")
+	defer getCredentialsCmd.Flags().Set("create-realm", "")
+	if err := instanceGetCredentialsF(getCredentialsCmd, []string{"astarte"}); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := config.LoadFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.CurrentContext != "other" {
+		t.Errorf("The current context changed to %s", f.CurrentContext)
+	}
+	context := f.Contexts["astarte"]
+	expected := config.Context{
+		URL:             server.URL(),
+		Housekeeping:    config.HousekeepingContext{Key: filepath.Join(keysDir, "housekeeping_private.pem")},
+		RealmManagement: config.ServiceContext{URL: "https://rm.example.com"},
+		Realm:           config.RealmContext{Name: "test", Key: filepath.Join(keysDir, "test_private.pem")},
+	}
+	if context != expected {
+		t.Errorf("Expected context %+v, got %+v", expected, context)
+	}
+	if key, err := ioutil.ReadFile(context.Housekeeping.Key); err != nil || string(key) != string(server.HousekeepingPrivateKey()) {
+		t.Errorf("Unexpected Housekeeping key: %v", err)
+	}
+	if server.Realm("test") == nil {
+		t.Error("The realm was not created")
+	}
+	if info, err := os.Stat(context.Realm.Key); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("Unexpected realm key file: %v, %v", info, err)
+	}
+}
+
+func TestCreateRealmWithNewKeypair(t *testing.T) {
+	server, err := astartetest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	keysDir, err := ioutil.TempDir("", "astartectl-keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(keysDir)
+	keyFile := func(realm string) string {
+		return filepath.Join(keysDir, realm+"_private.pem")
+	}
+
+	if _, err := createRealmWithNewKeypair(server.URL(), server.HousekeepingPrivateKey(), "../test", keysDir); err == nil {
+		t.Error("An invalid realm name was accepted")
+	}
+
+	// Existing keys are never overwritten, and the realm is not created
+	if err := ioutil.WriteFile(keyFile("existing"), []byte("previous key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := createRealmWithNewKeypair(server.URL(), server.HousekeepingPrivateKey(), "existing", keysDir); err == nil {
+		t.Error("An existing private key was overwritten")
+	}
+	if key, err := ioutil.ReadFile(keyFile("existing")); err != nil || string(key) != "previous key" {
+		t.Errorf("The existing private key was not preserved: %q, %v", key, err)
+	}
+	if server.Realm("existing") != nil {
+		t.Error("The realm was created without saving its key")
+	}
+
+	// Keys are discarded when Astarte refuses the realm
+	server.AddRealm("taken")
+	if _, err := createRealmWithNewKeypair(server.URL(), server.HousekeepingPrivateKey(), "taken", keysDir); err == nil {
+		t.Error("An existing realm was created again")
+	}
+	if _, err := os.Stat(keyFile("taken")); !os.IsNotExist(err) {
+		t.Errorf("The key of a refused realm was kept: %v", err)
+	}
+
+	// Keys are kept when the outcome is unknown
+	server.Close()
+	if _, err := createRealmWithNewKeypair(server.URL(), server.HousekeepingPrivateKey(), "unknown", keysDir); err == nil {
+		t.Error("A realm was created in an unreachable instance")
+	}
+	if _, err := os.Stat(keyFile("unknown")); err != nil {
+		t.Errorf("The key of a realm which might have been created was discarded: %v", err)
+	}
+}
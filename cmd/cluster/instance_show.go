@@ -19,6 +19,7 @@ import (
 	"os"
 	"text/tabwriter"
 
+	"github.com/astarte-platform/astartectl/cmd/output"
 	"github.com/spf13/cobra"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 )
@@ -35,10 +36,17 @@ var instanceShowCmd = &cobra.Command{
 func init() {
 	instanceShowCmd.PersistentFlags().String("namespace", "astarte", "Namespace in which to look for the Astarte resource.")
 
+	output.AddFlag(instanceShowCmd)
+
 	InstancesCmd.AddCommand(instanceShowCmd)
 }
 
 func instanceShowF(command *cobra.Command, args []string) error {
+	outputFormat, err := output.FormatFromFlags(command)
+	if err != nil {
+		return err
+	}
+
 	astartes, err := listAstartes()
 	if err != nil || len(astartes) == 0 {
 		fmt.Println("No Managed Astarte installations found.")
@@ -70,6 +78,11 @@ func instanceShowF(command *cobra.Command, args []string) error {
 		os.Exit(1)
 	}
 
+	if !outputFormat.IsHumanReadable() {
+		// Scripts get the whole Astarte resource
+		return output.Print(os.Stdout, outputFormat, astarteObject.Object, nil)
+	}
+
 	astarteSpec := astarteObject.Object["spec"].(map[string]interface{})
 	operatorStatus, lastTransition, deploymentManager, deploymentProfile := getManagedAstarteResourceStatus(*astarteObject)
 
@@ -78,6 +91,9 @@ func instanceShowF(command *cobra.Command, args []string) error {
 	fmt.Fprintf(w, "Kubernetes Namespace:\t%v\n", resourceNamespace)
 	fmt.Fprintf(w, "Astarte Version:\t%v\n", astarteSpec["version"])
 	fmt.Fprintf(w, "Operator Status:\t%v\n", operatorStatus)
+	if health := getAstarteResourceHealth(*astarteObject); health != "" {
+		fmt.Fprintf(w, "Health:\t%v\n", health)
+	}
 	fmt.Fprintf(w, "Last Operator Transition:\t%v\n", lastTransition)
 	fmt.Fprintf(w, "Managed by astartectl:\t%v\n", deploymentManager == "astartectl")
 	fmt.Fprintf(w, "Deployment Profile:\t%v\n", deploymentProfile)
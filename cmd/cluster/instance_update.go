@@ -0,0 +1,421 @@
+// Copyright © 2019 Ispirata Srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/astarte-platform/astartectl/cmd/cluster/deployment"
+	"github.com/astarte-platform/astartectl/utils"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v2"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/jsonmergepatch"
+	"k8s.io/apimachinery/pkg/util/mergepatch"
+)
+
+var updateCmd = &cobra.Command{
+	Use:   "update <name>",
+	Short: "Update an Astarte Instance in the current Kubernetes Cluster",
+	Long: `Update the spec of an Astarte Instance in the current Kubernetes Cluster, for example to change the replicas
+or resources of its components, or its storage class.
+
+Changes are applied in this order:
+  --profile    applies the default spec of another profile. Version, hosts and storage of the instance are kept.
+  --from-file  merges a YAML file holding a partial spec, either at top level or under a spec key. A null value
+               removes a setting.
+  --set        sets a single value, with a dot separated path relative to the spec. The value is parsed as YAML,
+               and null removes the setting. Can be repeated.
+
+The changes are shown before being applied to the instance as a merge patch. Astarte Operator then reconciles
+the instance. The Astarte version cannot be changed: use astartectl cluster instances upgrade instead.`,
+	Example: `  astartectl cluster instances update astarte --set components.dataUpdaterPlant.replicas=3
+  astartectl cluster instances update astarte --set storageClassName=fast --from-file resources.yaml --dry-run
+  astartectl cluster instances update astarte --profile minimal-production`,
+	Args: cobra.ExactArgs(1),
+	RunE: clusterUpdateF,
+}
+
+func init() {
+	updateCmd.PersistentFlags().String("namespace", "", "Namespace of the Astarte resource. Defaults to astarte.")
+	updateCmd.PersistentFlags().StringArray("set", nil, "Set a value of the spec, as <path>=<value>. Can be repeated.")
+	updateCmd.PersistentFlags().String("from-file", "", "YAML file holding a partial spec to merge into the instance's spec.")
+	updateCmd.MarkPersistentFlagFilename("from-file", "yaml", "yml")
+	updateCmd.PersistentFlags().String("profile", "", "Apply the default spec of this Astarte Deployment Profile.")
+	updateCmd.PersistentFlags().Bool("dry-run", false, "Show the changes without applying them.")
+	updateCmd.PersistentFlags().BoolP("non-interactive", "y", false, "Non-interactive mode. Will answer yes by default to all questions.")
+
+	InstancesCmd.AddCommand(updateCmd)
+}
+
+func clusterUpdateF(command *cobra.Command, args []string) error {
+	resourceName := args[0]
+	resourceNamespace, err := command.Flags().GetString("namespace")
+	if err != nil {
+		return err
+	}
+	if resourceNamespace == "" {
+		resourceNamespace = "astarte"
+	}
+	setExpressions, err := command.Flags().GetStringArray("set")
+	if err != nil {
+		return err
+	}
+	fromFile, err := command.Flags().GetString("from-file")
+	if err != nil {
+		return err
+	}
+	profileName, err := command.Flags().GetString("profile")
+	if err != nil {
+		return err
+	}
+	if len(setExpressions) == 0 && fromFile == "" && profileName == "" {
+		return fmt.Errorf("Nothing to update: use --set, --from-file or --profile")
+	}
+	dryRun, err := command.Flags().GetBool("dry-run")
+	if err != nil {
+		return err
+	}
+	nonInteractive, err := command.Flags().GetBool("non-interactive")
+	if err != nil {
+		return err
+	}
+
+	astarteObject, err := getAstarte(kubernetesDynamicClient.Resource(astarteV1Alpha1), resourceName, resourceNamespace)
+	if err != nil {
+		fmt.Printf("Could not find resource %s in namespace %s: %s\n", resourceName, resourceNamespace, err)
+		os.Exit(1)
+	}
+	liveJSON, err := json.Marshal(astarteObject.Object)
+	if err != nil {
+		return err
+	}
+	desired := map[string]interface{}{}
+	if err := json.Unmarshal(liveJSON, &desired); err != nil {
+		return err
+	}
+	spec, ok := desired["spec"].(map[string]interface{})
+	if !ok {
+		fmt.Printf("Astarte resource %s has no spec.\n", resourceName)
+		os.Exit(1)
+	}
+
+	if profileName != "" {
+		if err := applyProfileToAstarteResource(command, desired, profileName); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+	if fromFile != "" {
+		partialSpec, err := readPartialSpecFile(fromFile)
+		if err != nil {
+			return err
+		}
+		mergeIntoMap(spec, partialSpec)
+	}
+	for _, expression := range setExpressions {
+		if err := applySetExpression(spec, expression); err != nil {
+			return err
+		}
+	}
+
+	liveSpec, _ := astarteObject.Object["spec"].(map[string]interface{})
+	if err := checkVersionUnchanged(liveSpec, spec); err != nil {
+		return err
+	}
+	changes := specChanges(liveSpec, spec)
+	if len(changes) == 0 {
+		fmt.Println("Nothing to update: the instance already matches the requested changes.")
+		return nil
+	}
+	fmt.Printf("The following changes will be applied to Astarte instance %s in namespace %s:\n", resourceName, resourceNamespace)
+	for _, change := range changes {
+		fmt.Println(change)
+	}
+	if dryRun {
+		return nil
+	}
+
+	patch, err := astarteResourceMergePatch(liveJSON, desired)
+	if err != nil {
+		fmt.Println("Could not compute the changes to the Astarte resource.")
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	if !nonInteractive {
+		confirmation, err := utils.AskForConfirmation("Do you want to continue?")
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		if !confirmation {
+			return nil
+		}
+	}
+
+	_, err = kubernetesDynamicClient.Resource(astarteV1Alpha1).Namespace(resourceNamespace).Patch(resourceName,
+		types.MergePatchType, patch, metav1.PatchOptions{})
+	if err != nil {
+		fmt.Println("Error while updating Astarte Resource.")
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	fmt.Println("Your Astarte instance has been successfully updated. Astarte Operator will now reconcile it, you can monitor the progress with astartectl cluster show.")
+	return nil
+}
+
+// applyProfileToAstarteResource merges the default spec of a profile into resource, keeping the version, hosts
+// and storage of the instance, and records the new profile in the resource's annotations
+func applyProfileToAstarteResource(command *cobra.Command, resource map[string]interface{}, profileName string) error {
+	profiles, err := getAstarteClusterProfiles(command)
+	if err != nil {
+		return err
+	}
+	var profile *sourcedProfile
+	for i := range profiles {
+		if profiles[i].Name == profileName {
+			profile = &profiles[i]
+		}
+	}
+	if profile == nil {
+		return fmt.Errorf("Profile %s not found", profileName)
+	}
+
+	spec := resource["spec"].(map[string]interface{})
+	version, _ := semver.NewVersion(fmt.Sprintf("%v", spec["version"]))
+	// The pods of the instance are replaced, hence their resources are available to the new profile
+	metadata := resource["metadata"].(map[string]interface{})
+	instancePods := astarteInstancePods(fmt.Sprintf("%v", metadata["name"]), fmt.Sprintf("%v", metadata["namespace"]))
+	if _, reasons := profileCompatibility(profile.AstarteClusterProfile, version, getClusterCapacityOrWarn(instancePods)); len(reasons) > 0 {
+		return fmt.Errorf("Profile %s cannot be applied to this instance: %s", profileName, strings.Join(reasons, "; "))
+	}
+
+	profileSpec, err := profileSpecDefaults(profile.AstarteClusterProfile)
+	if err != nil {
+		return err
+	}
+	mergeIntoMap(spec, profileSpec)
+
+	annotations, ok := metadata["annotations"].(map[string]interface{})
+	if !ok {
+		annotations = map[string]interface{}{}
+		metadata["annotations"] = annotations
+	}
+	annotations["astarte-platform.org/deployment-profile"] = profileName
+	return nil
+}
+
+// profileSpecDefaults returns the settings of the default spec of profile which can be applied to an existing
+// instance: version, hosts and storage are left out, as well as the settings the profile leaves empty
+func profileSpecDefaults(profile deployment.AstarteClusterProfile) (map[string]interface{}, error) {
+	profileSpecYAML, err := yaml.Marshal(profile.DefaultSpec)
+	if err != nil {
+		return nil, err
+	}
+	profileSpec, err := utils.UnmarshalYAMLToJSON(profileSpecYAML)
+	if err != nil {
+		return nil, err
+	}
+	delete(profileSpec, "version")
+	for _, component := range []string{"api", "vernemq"} {
+		if componentSpec, ok := profileSpec[component].(map[string]interface{}); ok {
+			delete(componentSpec, "host")
+		}
+	}
+	removeKeyRecursively(profileSpec, "storage")
+	pruneEmptyValues(profileSpec)
+	return profileSpec, nil
+}
+
+// astarteResourceMergePatch computes the merge patch turning the live Astarte resource into desired
+func astarteResourceMergePatch(liveJSON []byte, desired map[string]interface{}) ([]byte, error) {
+	desiredJSON, err := json.Marshal(desired)
+	if err != nil {
+		return nil, err
+	}
+	preconditions := []mergepatch.PreconditionFunc{mergepatch.RequireKeyUnchanged("apiVersion"),
+		mergepatch.RequireKeyUnchanged("kind"), mergepatch.RequireMetadataKeyUnchanged("name")}
+	return jsonmergepatch.CreateThreeWayJSONMergePatch(liveJSON, desiredJSON, liveJSON, preconditions...)
+}
+
+// checkVersionUnchanged returns an error if spec changes the Astarte version of liveSpec, as upgrades have their
+// own checks and migrations
+func checkVersionUnchanged(liveSpec map[string]interface{}, spec map[string]interface{}) error {
+	if !reflect.DeepEqual(liveSpec["version"], spec["version"]) {
+		return fmt.Errorf("The Astarte version cannot be changed from %v to %v with update: "+
+			"use astartectl cluster instances upgrade instead", liveSpec["version"], spec["version"])
+	}
+	return nil
+}
+
+// readPartialSpecFile reads a YAML file holding a partial spec, either at top level or under a spec key
+func readPartialSpecFile(file string) (map[string]interface{}, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	partialSpec, err := utils.UnmarshalYAMLToJSON(content)
+	if err != nil || partialSpec == nil {
+		return nil, fmt.Errorf("%s is not a valid YAML file", file)
+	}
+	if spec, ok := partialSpec["spec"].(map[string]interface{}); ok && len(partialSpec) == 1 {
+		return spec, nil
+	}
+	return partialSpec, nil
+}
+
+// applySetExpression applies a <path>=<value> expression to spec. The value is parsed as YAML, and null removes
+// the setting.
+func applySetExpression(spec map[string]interface{}, expression string) error {
+	tokens := strings.SplitN(expression, "=", 2)
+	path := strings.TrimPrefix(strings.TrimSpace(tokens[0]), "spec.")
+	if len(tokens) != 2 || path == "" {
+		return fmt.Errorf("Invalid --set expression %q, expected <path>=<value>", expression)
+	}
+	valueJSON, err := utils.UnmarshalYAMLToJSON([]byte("value: " + tokens[1]))
+	if err != nil {
+		return fmt.Errorf("Invalid value in --set expression %q: %s", expression, err)
+	}
+
+	// A partial spec holding only the value is merged, so that null removes the setting
+	fieldTokens := strings.Split(path, ".")
+	partialSpec := setInMapRecursively(map[string]interface{}{}, fieldTokens, valueJSON["value"])
+	for i, token := range fieldTokens[:len(fieldTokens)-1] {
+		parent := spec
+		for _, t := range fieldTokens[:i] {
+			parent = parent[t].(map[string]interface{})
+		}
+		if value, ok := parent[token]; ok {
+			if _, isMap := value.(map[string]interface{}); !isMap {
+				return fmt.Errorf("Cannot set %s: %s is not an object", path, strings.Join(fieldTokens[:i+1], "."))
+			}
+		} else {
+			break
+		}
+	}
+	mergeIntoMap(spec, partialSpec)
+	return nil
+}
+
+// mergeIntoMap merges src into dst with JSON merge patch semantics: objects are merged recursively, null
+// values remove keys, and any other value replaces the existing one
+func mergeIntoMap(dst map[string]interface{}, src map[string]interface{}) {
+	for key, value := range src {
+		if value == nil {
+			delete(dst, key)
+			continue
+		}
+		srcMap, srcIsMap := value.(map[string]interface{})
+		dstMap, dstIsMap := dst[key].(map[string]interface{})
+		if srcIsMap && dstIsMap {
+			mergeIntoMap(dstMap, srcMap)
+			continue
+		}
+		if srcIsMap {
+			dstMap = map[string]interface{}{}
+			mergeIntoMap(dstMap, srcMap)
+			dst[key] = dstMap
+			continue
+		}
+		dst[key] = value
+	}
+}
+
+func removeKeyRecursively(m map[string]interface{}, key string) {
+	delete(m, key)
+	for _, value := range m {
+		if child, ok := value.(map[string]interface{}); ok {
+			removeKeyRecursively(child, key)
+		}
+	}
+}
+
+// pruneEmptyValues removes empty strings, and the objects left empty by removing them
+func pruneEmptyValues(m map[string]interface{}) {
+	for key, value := range m {
+		switch v := value.(type) {
+		case string:
+			if v == "" {
+				delete(m, key)
+			}
+		case map[string]interface{}:
+			pruneEmptyValues(v)
+			if len(v) == 0 {
+				delete(m, key)
+			}
+		}
+	}
+}
+
+// specChanges describes the differences between two specs, one line per changed setting
+func specChanges(before map[string]interface{}, after map[string]interface{}) []string {
+	beforeValues := map[string]string{}
+	afterValues := map[string]string{}
+	flattenSpec("", before, beforeValues)
+	flattenSpec("", after, afterValues)
+
+	paths := []string{}
+	for path := range beforeValues {
+		paths = append(paths, path)
+	}
+	for path := range afterValues {
+		if _, ok := beforeValues[path]; !ok {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+
+	changes := []string{}
+	for _, path := range paths {
+		beforeValue, inBefore := beforeValues[path]
+		afterValue, inAfter := afterValues[path]
+		switch {
+		case !inBefore:
+			changes = append(changes, fmt.Sprintf("  + %s: %s", path, afterValue))
+		case !inAfter:
+			changes = append(changes, fmt.Sprintf("  - %s: %s", path, beforeValue))
+		case beforeValue != afterValue:
+			changes = append(changes, fmt.Sprintf("  ~ %s: %s -> %s", path, beforeValue, afterValue))
+		}
+	}
+	return changes
+}
+
+// flattenSpec maps the dot separated path of each value in spec to its JSON representation. Arrays are
+// considered values.
+func flattenSpec(prefix string, spec map[string]interface{}, values map[string]string) {
+	for key, value := range spec {
+		path := key
+		if prefix != "" {
+			path = prefix + "." + key
+		}
+		if child, ok := value.(map[string]interface{}); ok && len(child) > 0 {
+			flattenSpec(path, child, values)
+			continue
+		}
+		valueJSON, _ := json.Marshal(value)
+		values[path] = string(valueJSON)
+	}
+}
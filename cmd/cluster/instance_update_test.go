@@ -0,0 +1,148 @@
+package cluster
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func testSpec() map[string]interface{} {
+	return map[string]interface{}{
+		"version":          "0.10.2",
+		"storageClassName": "standard",
+		"components": map[string]interface{}{
+			"dataUpdaterPlant": map[string]interface{}{"replicas": float64(1)},
+		},
+	}
+}
+
+func TestApplySetExpression(t *testing.T) {
+	spec := testSpec()
+	for _, expression := range []string{
+		"components.dataUpdaterPlant.replicas=3",
+		"spec.api.ssl=false",
+		"storageClassName=null",
+		"vernemq.host=broker.example.com",
+	} {
+		if err := applySetExpression(spec, expression); err != nil {
+			t.Fatalf("%s: %s", expression, err)
+		}
+	}
+	expected := map[string]interface{}{
+		"version": "0.10.2",
+		"components": map[string]interface{}{
+			"dataUpdaterPlant": map[string]interface{}{"replicas": float64(3)},
+		},
+		"api":     map[string]interface{}{"ssl": false},
+		"vernemq": map[string]interface{}{"host": "broker.example.com"},
+	}
+	if !reflect.DeepEqual(spec, expected) {
+		t.Errorf("Unexpected spec %v", spec)
+	}
+
+	for _, expression := range []string{"replicas", "=3", "version.major=1"} {
+		if err := applySetExpression(testSpec(), expression); err == nil {
+			t.Errorf("%s: expected an error", expression)
+		}
+	}
+}
+
+func TestCheckVersionUnchanged(t *testing.T) {
+	spec := testSpec()
+	if err := applySetExpression(spec, "components.dataUpdaterPlant.replicas=3"); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkVersionUnchanged(testSpec(), spec); err != nil {
+		t.Error(err)
+	}
+
+	for _, partialSpec := range []map[string]interface{}{
+		{"version": "0.11.0"},
+		{"version": nil},
+	} {
+		spec := testSpec()
+		mergeIntoMap(spec, partialSpec)
+		if err := checkVersionUnchanged(testSpec(), spec); err == nil {
+			t.Errorf("%v: expected an error", partialSpec)
+		}
+	}
+	spec = testSpec()
+	if err := applySetExpression(spec, "version=0.11.0"); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkVersionUnchanged(testSpec(), spec); err == nil || !strings.Contains(err.Error(), "instances upgrade") {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestReadPartialSpecFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "astartectl-update")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for name, content := range map[string]string{
+		"top-level.yaml": "components:\n  dataUpdaterPlant:\n    replicas: 2\nstorageClassName: null\n",
+		"spec.yaml":      "spec:\n  components:\n    dataUpdaterPlant:\n      replicas: 2\n  storageClassName: null\n",
+	} {
+		file := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(file, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		partialSpec, err := readPartialSpecFile(file)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		spec := testSpec()
+		mergeIntoMap(spec, partialSpec)
+		expected := map[string]interface{}{
+			"version": "0.10.2",
+			"components": map[string]interface{}{
+				"dataUpdaterPlant": map[string]interface{}{"replicas": float64(2)},
+			},
+		}
+		if !reflect.DeepEqual(spec, expected) {
+			t.Errorf("%s: unexpected spec %v", name, spec)
+		}
+	}
+}
+
+func TestSpecChanges(t *testing.T) {
+	after := testSpec()
+	after["components"].(map[string]interface{})["dataUpdaterPlant"].(map[string]interface{})["replicas"] = 2
+	after["api"] = map[string]interface{}{"ssl": false}
+	delete(after, "storageClassName")
+
+	expected := []string{
+		`  + api.ssl: false`,
+		`  ~ components.dataUpdaterPlant.replicas: 1 -> 2`,
+		`  - storageClassName: "standard"`,
+	}
+	if changes := specChanges(testSpec(), after); !reflect.DeepEqual(changes, expected) {
+		t.Errorf("Unexpected changes %q", changes)
+	}
+	if changes := specChanges(testSpec(), testSpec()); len(changes) != 0 {
+		t.Errorf("Unexpected changes %q", changes)
+	}
+}
+
+func TestPruneEmptyValues(t *testing.T) {
+	spec := map[string]interface{}{
+		"api":        map[string]interface{}{"host": ""},
+		"components": map[string]interface{}{"resources": map[string]interface{}{"requests": map[string]interface{}{"cpu": ""}}, "replicas": float64(1)},
+		"version":    "",
+		"rbac":       true,
+	}
+	pruneEmptyValues(spec)
+	expected := map[string]interface{}{
+		"components": map[string]interface{}{"replicas": float64(1)},
+		"rbac":       true,
+	}
+	if !reflect.DeepEqual(spec, expected) {
+		t.Errorf("Unexpected spec %v", spec)
+	}
+}
@@ -0,0 +1,326 @@
+// Copyright © 2019 Ispirata Srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/astarte-platform/astartectl/cmd/cluster/deployment"
+	"github.com/astarte-platform/astartectl/utils"
+	"github.com/spf13/cobra"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+var instanceUpgradeCmd = &cobra.Command{
+	Use:   "upgrade <name>",
+	Short: "Upgrade an Astarte Instance in the current Kubernetes Cluster to a new Astarte version",
+	Long: `Upgrade an Astarte Instance in the current Kubernetes Cluster to a new Astarte version.
+
+The installed Astarte Operator must support the target version: if it does not, upgrade it first with
+astartectl cluster upgrade-operator. The Deployment Profile of the instance must support the target version
+too. If it does not, choose a profile which does with --profile: settings of the instance which still hold the
+defaults of the old profile are moved to the defaults of the new one, customized settings are kept.
+
+Once the resource is patched, the rollout is tracked until Astarte Operator reports the instance as green.`,
+	Example: `  astartectl cluster instances upgrade astarte --version 0.10.2`,
+	Args:    cobra.ExactArgs(1),
+	RunE:    instanceUpgradeF,
+}
+
+func init() {
+	instanceUpgradeCmd.PersistentFlags().String("namespace", "", "Namespace of the Astarte resource. Defaults to astarte.")
+	instanceUpgradeCmd.PersistentFlags().String("version", "", "Astarte version to upgrade to")
+	instanceUpgradeCmd.MarkPersistentFlagRequired("version")
+	instanceUpgradeCmd.PersistentFlags().String("profile", "", "Deployment Profile to move the instance to, when its current one does not support the target version")
+	instanceUpgradeCmd.PersistentFlags().Bool("wait", true, "Track the rollout until Astarte Operator reports the instance as green")
+	instanceUpgradeCmd.PersistentFlags().Duration("timeout", 30*time.Minute, "How long to track the rollout for")
+	instanceUpgradeCmd.PersistentFlags().BoolP("non-interactive", "y", false, "Non-interactive mode. Will answer yes by default to all questions.")
+
+	InstancesCmd.AddCommand(instanceUpgradeCmd)
+}
+
+func instanceUpgradeF(command *cobra.Command, args []string) error {
+	resourceName := args[0]
+	resourceNamespace, err := command.Flags().GetString("namespace")
+	if err != nil {
+		return err
+	}
+	if resourceNamespace == "" {
+		resourceNamespace = "astarte"
+	}
+	version, err := command.Flags().GetString("version")
+	if err != nil {
+		return err
+	}
+	targetVersion, err := semver.NewVersion(version)
+	if err != nil {
+		fmt.Printf("%s is not a valid Astarte version.\n", version)
+		os.Exit(1)
+	}
+	profileName, err := command.Flags().GetString("profile")
+	if err != nil {
+		return err
+	}
+	wait, err := command.Flags().GetBool("wait")
+	if err != nil {
+		return err
+	}
+	timeout, err := command.Flags().GetDuration("timeout")
+	if err != nil {
+		return err
+	}
+	nonInteractive, err := command.Flags().GetBool("non-interactive")
+	if err != nil {
+		return err
+	}
+
+	astarteObject, err := getAstarte(kubernetesDynamicClient.Resource(astarteV1Alpha1), resourceName, resourceNamespace)
+	if err != nil {
+		fmt.Printf("Could not find resource %s in namespace %s: %s\n", resourceName, resourceNamespace, err)
+		os.Exit(1)
+	}
+	liveJSON, err := json.Marshal(astarteObject.Object)
+	if err != nil {
+		return err
+	}
+	desired := map[string]interface{}{}
+	if err := json.Unmarshal(liveJSON, &desired); err != nil {
+		return err
+	}
+	spec, ok := desired["spec"].(map[string]interface{})
+	if !ok {
+		fmt.Printf("Astarte resource %s has no spec.\n", resourceName)
+		os.Exit(1)
+	}
+	currentVersion, err := semver.NewVersion(fmt.Sprintf("%v", spec["version"]))
+	if err != nil {
+		fmt.Printf("Astarte resource %s has an invalid version: %s\n", resourceName, err)
+		os.Exit(1)
+	}
+	if !targetVersion.GreaterThan(currentVersion) {
+		fmt.Printf("Astarte instance %s is running version %s, which is not older than %s.\n", resourceName, currentVersion, targetVersion)
+		return nil
+	}
+
+	// Astarte Operator must be able to manage the target version
+	astarteOperator, err := getAstarteOperator()
+	if err != nil {
+		fmt.Println("Astarte Operator is not installed in your cluster. You probably want to use astartectl cluster install-operator.")
+		os.Exit(1)
+	}
+	operatorVersion, err := getAstarteOperatorVersion(astarteOperator.Spec.Template.Spec.Containers[0].Image)
+	if err != nil {
+		fmt.Printf("Could not determine the version of Astarte Operator: %s\n", err)
+		os.Exit(1)
+	}
+	if err := checkOperatorSupportsAstarteVersion(operatorVersion, targetVersion); err != nil {
+		fmt.Println(err)
+		fmt.Println("Upgrade Astarte Operator first with astartectl cluster upgrade-operator.")
+		os.Exit(1)
+	}
+
+	// The Deployment Profile must support the target version, otherwise the instance is moved to another one
+	profiles, err := getAstarteClusterProfiles(command)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	_, _, _, currentProfileName := getManagedAstarteResourceStatus(*astarteObject)
+	currentProfile := findProfile(profiles, currentProfileName)
+	if currentProfile == nil {
+		fmt.Printf("WARNING: Deployment Profile %q of Astarte instance %s is unknown, its compatibility with %s is not checked.\n",
+			currentProfileName, resourceName, targetVersion)
+	}
+	// Staying on the current profile, either implicitly or explicitly
+	if (profileName == "" || profileName == currentProfileName) && currentProfile != nil {
+		if reasons := currentProfile.IncompatibilityReasons(targetVersion, currentProfile.Requirements); len(reasons) > 0 {
+			fmt.Printf("Deployment Profile %s of Astarte instance %s cannot be used with Astarte %s: %s.\n", currentProfileName,
+				resourceName, targetVersion, strings.Join(reasons, "; "))
+			fmt.Println("Choose a Deployment Profile supporting it with --profile. Run astartectl cluster profiles list to see them.")
+			os.Exit(1)
+		}
+	}
+	if profileName != "" && profileName != currentProfileName {
+		newProfile := findProfile(profiles, profileName)
+		if newProfile == nil {
+			fmt.Printf("Profile %s not found.\n", profileName)
+			os.Exit(1)
+		}
+		// The pods of the instance are replaced, hence their resources are available to the new profile
+		capacity := getClusterCapacityOrWarn(astarteInstancePods(resourceName, resourceNamespace))
+		if _, reasons := profileCompatibility(*newProfile, targetVersion, capacity); len(reasons) > 0 {
+			fmt.Printf("Profile %s cannot be used with Astarte %s on this cluster: %s.\n", profileName, targetVersion,
+				strings.Join(reasons, "; "))
+			os.Exit(1)
+		}
+		oldDefaults := map[string]interface{}{}
+		if currentProfile != nil {
+			if oldDefaults, err = profileSpecDefaults(*currentProfile); err != nil {
+				return err
+			}
+		}
+		newDefaults, err := profileSpecDefaults(*newProfile)
+		if err != nil {
+			return err
+		}
+		mergeIntoMap(spec, migratedProfileDefaults(spec, oldDefaults, newDefaults))
+		metadata := desired["metadata"].(map[string]interface{})
+		annotations, ok := metadata["annotations"].(map[string]interface{})
+		if !ok {
+			annotations = map[string]interface{}{}
+			metadata["annotations"] = annotations
+		}
+		annotations["astarte-platform.org/deployment-profile"] = profileName
+	}
+	spec["version"] = targetVersion.String()
+
+	liveSpec, _ := astarteObject.Object["spec"].(map[string]interface{})
+	fmt.Printf("Will upgrade Astarte instance %s in namespace %s from version %s to %s, with the following changes:\n",
+		resourceName, resourceNamespace, currentVersion, targetVersion)
+	for _, change := range specChanges(liveSpec, spec) {
+		fmt.Println(change)
+	}
+	if !nonInteractive {
+		confirmation, err := utils.AskForConfirmation("Do you want to continue?")
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		if !confirmation {
+			return nil
+		}
+	}
+
+	patch, err := astarteResourceMergePatch(liveJSON, desired)
+	if err != nil {
+		fmt.Println("Could not compute the changes to the Astarte resource.")
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	patchTime := time.Now()
+	_, err = kubernetesDynamicClient.Resource(astarteV1Alpha1).Namespace(resourceNamespace).Patch(resourceName,
+		types.MergePatchType, patch, metav1.PatchOptions{})
+	if err != nil {
+		fmt.Println("Error while upgrading Astarte Resource.")
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	if !wait {
+		fmt.Println("Astarte resource successfully upgraded. Astarte Operator will now roll out the new version, you can monitor the progress with astartectl cluster show.")
+		return nil
+	}
+	fmt.Println("Astarte resource successfully upgraded. Tracking the rollout...")
+	err = watchAstarteResource(resourceName, resourceNamespace, timeout, func(res *unstructured.Unstructured) bool {
+		return res != nil && isAstarteResourceUpgraded(*res, targetVersion, patchTime)
+	})
+	if err != nil {
+		fmt.Println(err)
+		fmt.Println("The rollout might still complete: check the state of your instance with astartectl cluster instances show.")
+		os.Exit(1)
+	}
+	fmt.Printf("Astarte instance %s successfully upgraded to version %s.\n", resourceName, targetVersion)
+	return nil
+}
+
+func findProfile(profiles []sourcedProfile, name string) *deployment.AstarteClusterProfile {
+	for _, profile := range profiles {
+		if profile.Name == name {
+			return &profile.AstarteClusterProfile
+		}
+	}
+	return nil
+}
+
+// getAstarteOperatorVersion returns the version of Astarte Operator from its image. Snapshots are reported as
+// their base version.
+func getAstarteOperatorVersion(image string) (*semver.Version, error) {
+	tag := imageTag(image)
+	if tag == "" {
+		return nil, fmt.Errorf("Image %s has no tag", image)
+	}
+	if isUnstableVersion(tag) {
+		baseVersion, err := getBaseVersionFromUnstable(tag)
+		if err != nil {
+			return nil, err
+		}
+		tag = baseVersion
+	}
+	return semver.NewVersion(tag)
+}
+
+// checkOperatorSupportsAstarteVersion returns an error unless Astarte Operator operatorVersion can manage Astarte
+// astarteVersion. An Astarte Operator manages the Astarte releases up to its own minor version.
+func checkOperatorSupportsAstarteVersion(operatorVersion *semver.Version, astarteVersion *semver.Version) error {
+	if astarteVersion.Major() > operatorVersion.Major() ||
+		(astarteVersion.Major() == operatorVersion.Major() && astarteVersion.Minor() > operatorVersion.Minor()) {
+		return fmt.Errorf("Astarte Operator %s does not support Astarte %s", operatorVersion, astarteVersion)
+	}
+	return nil
+}
+
+// migratedProfileDefaults returns the partial spec moving the settings of spec which hold the defaults of the
+// old profile to the defaults of the new one. Settings which were customized are left untouched.
+func migratedProfileDefaults(spec map[string]interface{}, oldDefaults map[string]interface{},
+	newDefaults map[string]interface{}) map[string]interface{} {
+	liveValues := map[string]string{}
+	oldValues := map[string]string{}
+	newValues := map[string]string{}
+	flattenSpec("", spec, liveValues)
+	flattenSpec("", oldDefaults, oldValues)
+	flattenSpec("", newDefaults, newValues)
+
+	migration := map[string]interface{}{}
+	for path, newValue := range newValues {
+		liveValue, isSet := liveValues[path]
+		if !isSet || liveValue == oldValues[path] {
+			var value interface{}
+			json.Unmarshal([]byte(newValue), &value)
+			setInMapRecursively(migration, strings.Split(path, "."), value)
+		}
+	}
+	for path, oldValue := range oldValues {
+		if _, ok := newValues[path]; !ok && liveValues[path] == oldValue {
+			setInMapRecursively(migration, strings.Split(path, "."), nil)
+		}
+	}
+	return migration
+}
+
+// isAstarteResourceUpgraded returns whether Astarte Operator reports res as healthy and running version. Operators
+// which do not report the version must have successfully reconciled res after since.
+func isAstarteResourceUpgraded(res unstructured.Unstructured, version *semver.Version, since time.Time) bool {
+	status, ok := res.Object["status"].(map[string]interface{})
+	if !ok {
+		return false
+	}
+	if reportedVersion, ok := status["astarteVersion"].(string); ok {
+		v, err := semver.NewVersion(reportedVersion)
+		if err != nil || !v.Equal(version) {
+			return false
+		}
+		return isAstarteResourceGreen(res)
+	}
+
+	_, lastTransition, _, _ := getManagedAstarteResourceStatus(res)
+	return isAstarteResourceGreen(res) && lastTransition.After(since)
+}
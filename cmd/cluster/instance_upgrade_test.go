@@ -0,0 +1,104 @@
+package cluster
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Masterminds/semver/v3"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestCheckOperatorSupportsAstarteVersion(t *testing.T) {
+	for _, test := range []struct {
+		operator  string
+		astarte   string
+		supported bool
+	}{
+		{"0.10.2", "0.10.0", true},
+		{"0.10.0", "0.10.3", true},
+		{"0.11.0", "0.10.3", true},
+		{"0.10.2", "0.11.0", false},
+		{"0.11.1", "1.0.0", false},
+	} {
+		err := checkOperatorSupportsAstarteVersion(semver.MustParse(test.operator), semver.MustParse(test.astarte))
+		if test.supported != (err == nil) {
+			t.Errorf("Operator %s, Astarte %s: unexpected error %v", test.operator, test.astarte, err)
+		}
+	}
+}
+
+func TestGetAstarteOperatorVersion(t *testing.T) {
+	for image, expected := range map[string]string{
+		"astarte/astarte-kubernetes-operator:0.10.2":           "0.10.2",
+		"registry:5000/astarte/astarte-operator:0.11-snapshot": "0.11.0",
+	} {
+		version, err := getAstarteOperatorVersion(image)
+		if err != nil || version.String() != expected {
+			t.Errorf("%s: unexpected version %v, %v", image, version, err)
+		}
+	}
+	for _, image := range []string{"astarte/astarte-kubernetes-operator", "astarte/astarte-kubernetes-operator:snapshot"} {
+		if _, err := getAstarteOperatorVersion(image); err == nil {
+			t.Errorf("%s: expected an error", image)
+		}
+	}
+}
+
+func TestMigratedProfileDefaults(t *testing.T) {
+	spec := map[string]interface{}{
+		"cassandra": map[string]interface{}{"maxHeapSize": "1024M", "heapNewSize": "384M"},
+		"rabbitmq":  map[string]interface{}{"replicas": float64(1)},
+	}
+	oldDefaults := map[string]interface{}{
+		"cassandra": map[string]interface{}{"maxHeapSize": "1024M", "heapNewSize": "256M"},
+		"rabbitmq":  map[string]interface{}{"replicas": float64(1)},
+	}
+	newDefaults := map[string]interface{}{
+		"cassandra": map[string]interface{}{"maxHeapSize": "2048M", "heapNewSize": "512M"},
+		"cfssl":     map[string]interface{}{"deploy": true},
+	}
+
+	// heapNewSize was customized, and is kept
+	expected := map[string]interface{}{
+		"cassandra": map[string]interface{}{"maxHeapSize": "2048M"},
+		"cfssl":     map[string]interface{}{"deploy": true},
+		"rabbitmq":  map[string]interface{}{"replicas": nil},
+	}
+	migration := migratedProfileDefaults(spec, oldDefaults, newDefaults)
+	if !reflect.DeepEqual(migration, expected) {
+		t.Errorf("Unexpected migration %v", migration)
+	}
+}
+
+func TestIsAstarteResourceUpgraded(t *testing.T) {
+	version := semver.MustParse("0.10.2")
+	since := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	resource := func(status map[string]interface{}) unstructured.Unstructured {
+		return unstructured.Unstructured{Object: map[string]interface{}{
+			"metadata": map[string]interface{}{"name": "astarte"},
+			"status":   status,
+		}}
+	}
+	runningCondition := func(transition string) map[string]interface{} {
+		return map[string]interface{}{"conditions": []interface{}{map[string]interface{}{
+			"type": "Running", "reason": "Successful", "lastTransitionTime": transition,
+		}}}
+	}
+
+	for name, test := range map[string]struct {
+		status   map[string]interface{}
+		upgraded bool
+	}{
+		"green":                {map[string]interface{}{"astarteVersion": "0.10.2", "health": "green"}, true},
+		"old version":          {map[string]interface{}{"astarteVersion": "0.10.1", "health": "green"}, false},
+		"yellow":               {map[string]interface{}{"astarteVersion": "0.10.2", "health": "yellow"}, false},
+		"reconciled":           {runningCondition("2020-01-01T12:05:00Z"), true},
+		"reconciled before":    {runningCondition("2020-01-01T11:55:00Z"), false},
+		"no status conditions": {map[string]interface{}{}, false},
+	} {
+		if upgraded := isAstarteResourceUpgraded(resource(test.status), version, since); upgraded != test.upgraded {
+			t.Errorf("%s: expected %v, got %v", name, test.upgraded, upgraded)
+		}
+	}
+}
@@ -0,0 +1,260 @@
+// Copyright © 2019 Ispirata Srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+var instanceWaitCmd = &cobra.Command{
+	Use:   "wait <name>",
+	Short: "Wait for an Astarte Instance in the current Kubernetes Cluster to reach a condition",
+	Long: `Wait for an Astarte Instance in the current Kubernetes Cluster to reach a condition, printing the state
+transitions reported by Astarte Operator. Supported conditions are:
+
+  green           Astarte Operator reports the instance as healthy, as shown in the Health column of
+                  astartectl cluster show
+  status=<value>  Astarte Operator reports the instance in state <value>, as shown in the Operator Status
+                  column of astartectl cluster show
+  deleted         The Astarte resource does not exist
+
+With --api-health, once the condition is met the command also waits until Astarte APIs answer their health
+checks on the instance's API host. The command fails if the timeout expires first.`,
+	Example: `  astartectl cluster instances wait astarte --for green --timeout 20m --api-health
+  astartectl cluster instances wait astarte --for status=Running`,
+	Args: cobra.ExactArgs(1),
+	RunE: instanceWaitF,
+}
+
+// astarteAPIServices are the Astarte APIs exposed on the API host
+var astarteAPIServices = []string{"appengine", "pairing", "realmmanagement", "housekeeping"}
+
+func init() {
+	instanceWaitCmd.PersistentFlags().String("namespace", "", "Namespace of the Astarte resource. Defaults to astarte.")
+	instanceWaitCmd.PersistentFlags().String("for", "green", "Condition to wait for: green, status=<value> or deleted")
+	instanceWaitCmd.PersistentFlags().Duration("timeout", 30*time.Minute, "How long to wait for")
+	instanceWaitCmd.PersistentFlags().Bool("api-health", false, "Also wait until Astarte APIs answer their health checks")
+
+	InstancesCmd.AddCommand(instanceWaitCmd)
+}
+
+func instanceWaitF(command *cobra.Command, args []string) error {
+	resourceName := args[0]
+	resourceNamespace, err := command.Flags().GetString("namespace")
+	if err != nil {
+		return err
+	}
+	if resourceNamespace == "" {
+		resourceNamespace = "astarte"
+	}
+	waitFor, err := command.Flags().GetString("for")
+	if err != nil {
+		return err
+	}
+	condition, err := parseWaitCondition(waitFor)
+	if err != nil {
+		return err
+	}
+	timeout, err := command.Flags().GetDuration("timeout")
+	if err != nil {
+		return err
+	}
+	apiHealth, err := command.Flags().GetBool("api-health")
+	if err != nil {
+		return err
+	}
+	if apiHealth && waitFor == "deleted" {
+		return fmt.Errorf("--api-health cannot be used when waiting for the instance to be deleted")
+	}
+
+	deadline := time.Now().Add(timeout)
+	if err := watchAstarteResource(resourceName, resourceNamespace, timeout, condition); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Printf("Astarte instance %s is %s.\n", resourceName, waitFor)
+	if !apiHealth {
+		return nil
+	}
+
+	astarteObject, err := getAstarte(kubernetesDynamicClient.Resource(astarteV1Alpha1), resourceName, resourceNamespace)
+	if err != nil {
+		fmt.Printf("Could not find resource %s in namespace %s: %s\n", resourceName, resourceNamespace, err)
+		os.Exit(1)
+	}
+	apiURL, err := astarteAPIURL(*astarteObject)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if err := waitForAstarteAPIHealth(apiURL, deadline); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Printf("Astarte APIs at %s are healthy.\n", apiURL)
+	return nil
+}
+
+// parseWaitCondition returns the condition described by --for. A nil resource means it does not exist.
+func parseWaitCondition(waitFor string) (func(*unstructured.Unstructured) bool, error) {
+	switch {
+	case waitFor == "green":
+		return func(res *unstructured.Unstructured) bool {
+			return res != nil && isAstarteResourceGreen(*res)
+		}, nil
+	case waitFor == "deleted":
+		return func(res *unstructured.Unstructured) bool {
+			return res == nil
+		}, nil
+	case strings.HasPrefix(waitFor, "status=") && waitFor != "status=":
+		status := strings.TrimPrefix(waitFor, "status=")
+		return func(res *unstructured.Unstructured) bool {
+			if res == nil {
+				return false
+			}
+			operatorStatus, _, _, _ := getManagedAstarteResourceStatus(*res)
+			return strings.EqualFold(operatorStatus, status)
+		}, nil
+	}
+	return nil, fmt.Errorf("Invalid condition %q: use green, status=<value> or deleted", waitFor)
+}
+
+// watchAstarteResource watches an Astarte resource, printing the state transitions reported by Astarte Operator,
+// until condition holds. condition gets nil when the resource does not exist.
+func watchAstarteResource(name string, namespace string, timeout time.Duration,
+	condition func(*unstructured.Unstructured) bool) error {
+	astarteCRD := kubernetesDynamicClient.Resource(astarteV1Alpha1).Namespace(namespace)
+	deadline := time.Now().Add(timeout)
+	lastStatus := ""
+	report := func(res *unstructured.Unstructured) bool {
+		status := "Not found"
+		if res != nil {
+			status, _, _, _ = getManagedAstarteResourceStatus(*res)
+			if health := getAstarteResourceHealth(*res); health != "" {
+				status += ", health " + health
+			}
+		}
+		if status != lastStatus {
+			fmt.Printf("%s: %s\n", time.Now().Format("15:04:05"), status)
+			lastStatus = status
+		}
+		return condition(res)
+	}
+
+	// Watches can be closed by the API server before the timeout expires: open them again until it does
+	for remaining := timeout; remaining > 0; remaining = time.Until(deadline) {
+		current, err := astarteCRD.Get(name, metav1.GetOptions{})
+		if errors.IsNotFound(err) {
+			current = nil
+		} else if err != nil {
+			return fmt.Errorf("Could not get the Astarte resource: %s", err)
+		}
+		if report(current) {
+			return nil
+		}
+
+		timeoutSeconds := int64(remaining.Seconds()) + 1
+		options := metav1.ListOptions{FieldSelector: "metadata.name=" + name, TimeoutSeconds: &timeoutSeconds}
+		if current != nil {
+			options.ResourceVersion = current.GetResourceVersion()
+		}
+		watcher, err := astarteCRD.Watch(options)
+		if err != nil {
+			return fmt.Errorf("Could not watch the Astarte resource: %s", err)
+		}
+		for event := range watcher.ResultChan() {
+			if event.Type == watch.Error {
+				// The watch is opened again from the current state
+				time.Sleep(time.Second)
+				break
+			}
+			res, ok := event.Object.(*unstructured.Unstructured)
+			if !ok {
+				continue
+			}
+			if event.Type == watch.Deleted {
+				res = nil
+			}
+			if report(res) {
+				watcher.Stop()
+				return nil
+			}
+		}
+		watcher.Stop()
+	}
+	return fmt.Errorf("Timed out after %s waiting for Astarte instance %s", timeout, name)
+}
+
+// isAstarteResourceGreen returns whether Astarte Operator reports res as healthy. Operators which do not report
+// the health of the instance report a successful reconciliation instead.
+func isAstarteResourceGreen(res unstructured.Unstructured) bool {
+	if health := getAstarteResourceHealth(res); health != "" {
+		return strings.EqualFold(health, "green")
+	}
+	condition := lastAstarteResourceCondition(res)
+	return condition != nil && condition["type"] == "Running" && condition["reason"] == "Successful"
+}
+
+// astarteAPIURL returns the base URL of the Astarte APIs of res
+func astarteAPIURL(res unstructured.Unstructured) (string, error) {
+	host, _, _ := unstructured.NestedString(res.Object, "spec", "api", "host")
+	if host == "" {
+		return "", fmt.Errorf("Astarte resource %s has no API host", res.GetName())
+	}
+	ssl, found, _ := unstructured.NestedBool(res.Object, "spec", "api", "ssl")
+	if found && !ssl {
+		return "http://" + host, nil
+	}
+	return "https://" + host, nil
+}
+
+// waitForAstarteAPIHealth polls the health checks of Astarte APIs at apiURL until all of them answer, or until
+// deadline
+func waitForAstarteAPIHealth(apiURL string, deadline time.Time) error {
+	httpClient := &http.Client{Timeout: 10 * time.Second}
+	pending := append([]string{}, astarteAPIServices...)
+	for {
+		stillPending := []string{}
+		for _, service := range pending {
+			response, err := httpClient.Get(fmt.Sprintf("%s/%s/health", apiURL, service))
+			if err == nil {
+				response.Body.Close()
+			}
+			if err != nil || response.StatusCode != http.StatusOK {
+				stillPending = append(stillPending, service)
+				continue
+			}
+			fmt.Printf("%s: %s is healthy\n", time.Now().Format("15:04:05"), service)
+		}
+		pending = stillPending
+		if len(pending) == 0 {
+			return nil
+		}
+		if time.Now().Add(5 * time.Second).After(deadline) {
+			return fmt.Errorf("Timed out waiting for the health checks of %s", strings.Join(pending, ", "))
+		}
+		time.Sleep(5 * time.Second)
+	}
+}
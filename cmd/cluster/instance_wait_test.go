@@ -0,0 +1,112 @@
+package cluster
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+)
+
+func testAstarteResource(health string) *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "api.astarte-platform.org/v1alpha1",
+		"kind":       "Astarte",
+		"metadata":   map[string]interface{}{"name": "astarte", "namespace": "astarte"},
+		"spec":       map[string]interface{}{"version": "0.10.2", "api": map[string]interface{}{"host": "api.example.com"}},
+		"status": map[string]interface{}{
+			"astarteVersion": "0.10.2",
+			"health":         health,
+			"conditions": []interface{}{
+				map[string]interface{}{"type": "Running", "reason": "Successful", "lastTransitionTime": "2020-01-01T00:00:00Z"},
+			},
+		},
+	}}
+}
+
+func TestWatchAstarteResource(t *testing.T) {
+	previousClient := kubernetesDynamicClient
+	defer func() { kubernetesDynamicClient = previousClient }()
+	green, _ := parseWaitCondition("green")
+	deleted, _ := parseWaitCondition("deleted")
+
+	// Conditions which already hold
+	kubernetesDynamicClient = dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), testAstarteResource("green"))
+	if err := watchAstarteResource("astarte", "astarte", time.Minute, green); err != nil {
+		t.Fatal(err)
+	}
+	if err := watchAstarteResource("other", "astarte", time.Minute, deleted); err != nil {
+		t.Fatal(err)
+	}
+
+	// A transition seen through the watch
+	client := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), testAstarteResource("yellow"))
+	kubernetesDynamicClient = client
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(50 * time.Millisecond):
+				client.Resource(astarteV1Alpha1).Namespace("astarte").Update(testAstarteResource("green"), metav1.UpdateOptions{})
+			}
+		}
+	}()
+	if err := watchAstarteResource("astarte", "astarte", time.Minute, green); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseWaitCondition(t *testing.T) {
+	for _, waitFor := range []string{"", "ready", "status="} {
+		if _, err := parseWaitCondition(waitFor); err == nil {
+			t.Errorf("%q: expected an error", waitFor)
+		}
+	}
+	// Statuses are the conditions reported by Astarte Operator, regardless of the health of the instance
+	condition, err := parseWaitCondition("status=running")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !condition(testAstarteResource("yellow")) || condition(nil) {
+		t.Error("Unexpected result of status=running")
+	}
+	if condition, _ := parseWaitCondition("status=yellow"); condition(testAstarteResource("yellow")) {
+		t.Error("Unexpected result of status=yellow")
+	}
+	green, _ := parseWaitCondition("green")
+	if !green(testAstarteResource("green")) || green(testAstarteResource("yellow")) {
+		t.Error("Unexpected result of green")
+	}
+}
+
+func TestWaitForAstarteAPIHealth(t *testing.T) {
+	healthy := map[string]bool{"/appengine/health": true, "/pairing/health": true, "/realmmanagement/health": true}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !healthy[r.URL.Path] {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	err := waitForAstarteAPIHealth(server.URL, time.Now().Add(time.Second))
+	if err == nil || !strings.Contains(err.Error(), "housekeeping") || strings.Contains(err.Error(), "pairing") {
+		t.Errorf("Unexpected error %v", err)
+	}
+	healthy["/housekeeping/health"] = true
+	if err := waitForAstarteAPIHealth(server.URL, time.Now().Add(time.Second)); err != nil {
+		t.Error(err)
+	}
+
+	apiURL, err := astarteAPIURL(*testAstarteResource("green"))
+	if err != nil || apiURL != "https://api.example.com" {
+		t.Errorf("Unexpected API URL %s, %v", apiURL, err)
+	}
+}
@@ -0,0 +1,139 @@
+// Copyright © 2019 Ispirata Srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+	appsv1 "k8s.io/api/apps/v1"
+)
+
+var operatorCmd = &cobra.Command{
+	Use:   "operator",
+	Short: "Manage Astarte Operator releases",
+	Long:  `Manage Astarte Operator releases, for example to install Astarte Operator on air-gapped clusters.`,
+	// Bundles are created without a Kubernetes cluster
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error { return nil },
+}
+
+var operatorBundleCmd = &cobra.Command{
+	Use:   "bundle",
+	Short: "Download an Astarte Operator release into a bundle",
+	Long: `Download the manifests of an Astarte Operator release into a bundle, to install or upgrade Astarte
+Operator without access to GitHub with astartectl cluster install-operator --from-bundle.
+
+The bundle records the version of the release and the images it needs, which should be mirrored to a registry
+reachable by the cluster. When --image-registry is given, installs from the bundle pull images from there by
+default.`,
+	Example: `  astartectl cluster operator bundle --version 0.10.2
+  astartectl cluster operator bundle --version 0.10.2 --image-registry registry.local:5000 --output-file operator.tar.gz`,
+	Args: cobra.NoArgs,
+	RunE: operatorBundleF,
+}
+
+func init() {
+	operatorBundleCmd.Flags().String("version", "", "Version of Astarte Operator to bundle. If not specified, the last stable version is bundled")
+	operatorBundleCmd.Flags().String("output-file", "", "Bundle file. Defaults to astarte-operator-<version>.tar.gz")
+	operatorBundleCmd.MarkFlagFilename("output-file", "tar.gz", "tgz")
+	operatorBundleCmd.Flags().String("image-registry", "", "Registry the images are mirrored to, used by default when installing from the bundle")
+
+	operatorCmd.AddCommand(operatorBundleCmd)
+	ClusterCmd.AddCommand(operatorCmd)
+}
+
+func operatorBundleF(command *cobra.Command, args []string) error {
+	version, err := command.Flags().GetString("version")
+	if err != nil {
+		return err
+	}
+	output, err := command.Flags().GetString("output-file")
+	if err != nil {
+		return err
+	}
+	imageRegistry, err := command.Flags().GetString("image-registry")
+	if err != nil {
+		return err
+	}
+
+	if version == "" {
+		version, err = getLastOperatorRelease()
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+	if output == "" {
+		output = fmt.Sprintf("astarte-operator-%s.tar.gz", version)
+	}
+
+	fmt.Printf("Downloading Astarte Operator %s...\n", version)
+	source := gitHubOperatorManifests{}
+	files := map[string]string{}
+	for _, file := range operatorManifestFiles {
+		content, err := source.Content(file, version)
+		if err != nil {
+			fmt.Printf("Could not download %s: %s\n", file, err)
+			os.Exit(1)
+		}
+		files[file] = content
+	}
+	metadata, err := newOperatorBundleMetadata(version, files, imageRegistry)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	f, err := os.OpenFile(output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if err := writeOperatorBundle(f, metadata, files); err != nil {
+		f.Close()
+		os.Remove(output)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	fmt.Printf("Astarte Operator %s bundled in %s. It needs the following images:\n", version, output)
+	for _, image := range metadata.Images {
+		fmt.Printf("  %s\n", image)
+	}
+	return nil
+}
+
+// newOperatorBundleMetadata describes a bundle holding files, the manifests of Astarte Operator version
+func newOperatorBundleMetadata(version string, files map[string]string, imageRegistry string) (operatorBundleMetadata, error) {
+	metadata := operatorBundleMetadata{
+		Version:       version,
+		CreatedAt:     time.Now().UTC().Truncate(time.Second),
+		ImageRegistry: imageRegistry,
+		Files:         operatorManifestFiles,
+	}
+	operator, err := decodeManifest(files["deploy/operator.yaml"])
+	if err != nil {
+		return metadata, fmt.Errorf("Invalid Astarte Operator manifest: %s", err)
+	}
+	deployment, ok := operator.(*appsv1.Deployment)
+	if !ok {
+		return metadata, fmt.Errorf("Invalid Astarte Operator manifest: it is not a Deployment")
+	}
+	metadata.Images = deploymentImages(deployment)
+	return metadata, nil
+}
@@ -0,0 +1,315 @@
+// Copyright © 2019 Ispirata Srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v2"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// operatorManifestFiles are the manifests of Astarte Operator needed to install and upgrade it, in the order
+// they are applied
+var operatorManifestFiles = []string{
+	"deploy/service_account.yaml",
+	"deploy/role.yaml",
+	"deploy/role_binding.yaml",
+	"deploy/crds/api_v1alpha1_astarte_crd.yaml",
+	"deploy/crds/api_v1alpha1_astarte_voyager_ingress_crd.yaml",
+	"deploy/operator.yaml",
+}
+
+const operatorBundleMetadataFile = "bundle.yaml"
+
+// operatorBundleMetadata describes the Astarte Operator release held by a bundle
+type operatorBundleMetadata struct {
+	Version   string    `yaml:"version"`
+	CreatedAt time.Time `yaml:"createdAt"`
+	Images    []string  `yaml:"images"`
+	// ImageRegistry is the registry images are pulled from, when they are mirrored
+	ImageRegistry string   `yaml:"imageRegistry,omitempty"`
+	Files         []string `yaml:"files"`
+}
+
+// operatorManifestSource provides the manifests of Astarte Operator releases
+type operatorManifestSource interface {
+	Content(path string, version string) (string, error)
+}
+
+// gitHubOperatorManifests fetches manifests from Astarte Operator's GitHub repository
+type gitHubOperatorManifests struct{}
+
+func (gitHubOperatorManifests) Content(path string, version string) (string, error) {
+	return getContentFromAstarteRepo("astarte-kubernetes-operator", path, version)
+}
+
+// localOperatorManifests provides the manifests of a single Astarte Operator release from a directory or a bundle
+type localOperatorManifests struct {
+	metadata operatorBundleMetadata
+	location string
+	read     func(path string) ([]byte, error)
+}
+
+// operatorVersionUnavailableError is returned by localOperatorManifests when asked for another version than the
+// one they hold
+type operatorVersionUnavailableError struct {
+	location         string
+	version          string
+	availableVersion string
+}
+
+func (e *operatorVersionUnavailableError) Error() string {
+	return fmt.Sprintf("%s holds Astarte Operator %s, not %s", e.location, e.availableVersion, e.version)
+}
+
+func (m localOperatorManifests) Content(path string, version string) (string, error) {
+	if version != m.metadata.Version {
+		return "", &operatorVersionUnavailableError{location: m.location, version: version, availableVersion: m.metadata.Version}
+	}
+	content, err := m.read(path)
+	if err != nil {
+		return "", fmt.Errorf("Could not read %s from %s: %s", path, m.location, err)
+	}
+	return string(content), nil
+}
+
+var (
+	// operatorManifests is where the manifests of Astarte Operator come from
+	operatorManifests operatorManifestSource = gitHubOperatorManifests{}
+	// operatorImageRegistry, when set, replaces the registry of Astarte Operator's images
+	operatorImageRegistry string
+)
+
+// addOperatorManifestsFlags adds the flags choosing where the manifests of Astarte Operator come from
+func addOperatorManifestsFlags(command *cobra.Command) {
+	command.PersistentFlags().String("manifests-dir", "", "Read Astarte Operator manifests from this directory rather than from GitHub")
+	command.MarkPersistentFlagDirname("manifests-dir")
+	command.PersistentFlags().String("from-bundle", "", "Read Astarte Operator manifests from a bundle created with astartectl cluster operator bundle")
+	command.MarkPersistentFlagFilename("from-bundle", "tar.gz", "tgz")
+	command.PersistentFlags().String("image-registry", "", "Pull Astarte Operator images from this registry, e.g. a private mirror")
+}
+
+// operatorVersionFromFlags sets up the source of Astarte Operator manifests from flags, and returns the version
+// of Astarte Operator to work with. When neither --version nor a local source are given, it is the last release.
+func operatorVersionFromFlags(command *cobra.Command) (string, error) {
+	version, err := command.Flags().GetString("version")
+	if err != nil {
+		return "", err
+	}
+	manifestsDir, err := command.Flags().GetString("manifests-dir")
+	if err != nil {
+		return "", err
+	}
+	bundleFile, err := command.Flags().GetString("from-bundle")
+	if err != nil {
+		return "", err
+	}
+	imageRegistry, err := command.Flags().GetString("image-registry")
+	if err != nil {
+		return "", err
+	}
+
+	var source *localOperatorManifests
+	switch {
+	case manifestsDir != "" && bundleFile != "":
+		return "", errors.New("--manifests-dir and --from-bundle cannot be used together")
+	case manifestsDir != "":
+		source, err = loadOperatorManifestsDir(manifestsDir, version)
+	case bundleFile != "":
+		source, err = loadOperatorBundle(bundleFile)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if source == nil {
+		operatorManifests = gitHubOperatorManifests{}
+		if version == "" {
+			version, err = getLastOperatorRelease()
+		}
+	} else {
+		if version != "" && version != source.metadata.Version {
+			return "", fmt.Errorf("%s holds Astarte Operator %s, not %s", source.location, source.metadata.Version, version)
+		}
+		operatorManifests = *source
+		version = source.metadata.Version
+		if imageRegistry == "" {
+			imageRegistry = source.metadata.ImageRegistry
+		}
+	}
+	operatorImageRegistry = imageRegistry
+	return version, err
+}
+
+// loadOperatorManifestsDir loads manifests from dir, which is either an extracted bundle or a checkout of Astarte
+// Operator's repository. In the latter case, version must be given.
+func loadOperatorManifestsDir(dir string, version string) (*localOperatorManifests, error) {
+	source := &localOperatorManifests{
+		location: dir,
+		read: func(path string) ([]byte, error) {
+			return ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(path)))
+		},
+	}
+	content, err := ioutil.ReadFile(filepath.Join(dir, operatorBundleMetadataFile))
+	switch {
+	case err == nil:
+		if err := yaml.Unmarshal(content, &source.metadata); err != nil || source.metadata.Version == "" {
+			return nil, fmt.Errorf("Invalid bundle metadata in %s", dir)
+		}
+	case os.IsNotExist(err):
+		if version == "" {
+			return nil, fmt.Errorf("%s has no bundle metadata: specify the version of its manifests with --version", dir)
+		}
+		source.metadata.Version = version
+	default:
+		return nil, err
+	}
+	return source, nil
+}
+
+// loadOperatorBundle loads a bundle created by astartectl cluster operator bundle in memory
+func loadOperatorBundle(file string) (*localOperatorManifests, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s is not a valid bundle: %s", file, err)
+	}
+	files := map[string][]byte{}
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("%s is not a valid bundle: %s", file, err)
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		content, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+		files[path.Clean(header.Name)] = content
+	}
+
+	source := &localOperatorManifests{
+		location: file,
+		read: func(path string) ([]byte, error) {
+			content, ok := files[path]
+			if !ok {
+				return nil, os.ErrNotExist
+			}
+			return content, nil
+		},
+	}
+	content, ok := files[operatorBundleMetadataFile]
+	if !ok {
+		return nil, fmt.Errorf("%s is not a valid bundle: %s is missing", file, operatorBundleMetadataFile)
+	}
+	if err := yaml.Unmarshal(content, &source.metadata); err != nil || source.metadata.Version == "" {
+		return nil, fmt.Errorf("%s is not a valid bundle: invalid %s", file, operatorBundleMetadataFile)
+	}
+	return source, nil
+}
+
+// writeOperatorBundle writes a bundle holding metadata and the manifests in files
+func writeOperatorBundle(w io.Writer, metadata operatorBundleMetadata, files map[string]string) error {
+	metadataContent, err := yaml.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	write := func(name string, content []byte) error {
+		header := &tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), ModTime: metadata.CreatedAt}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		_, err := tw.Write(content)
+		return err
+	}
+	if err := write(operatorBundleMetadataFile, metadataContent); err != nil {
+		return err
+	}
+	for _, name := range metadata.Files {
+		if err := write(name, []byte(files[name])); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// deploymentImages returns the images of the containers of deployment
+func deploymentImages(deployment *appsv1.Deployment) []string {
+	images := []string{}
+	for _, container := range append(deployment.Spec.Template.Spec.InitContainers, deployment.Spec.Template.Spec.Containers...) {
+		images = append(images, container.Image)
+	}
+	return images
+}
+
+// rewriteDeploymentImages moves the images of the containers of deployment to registry
+func rewriteDeploymentImages(deployment *appsv1.Deployment, registry string) {
+	rewrite := func(containers []corev1.Container) {
+		for i := range containers {
+			containers[i].Image = rewriteImageRegistry(containers[i].Image, registry)
+		}
+	}
+	rewrite(deployment.Spec.Template.Spec.InitContainers)
+	rewrite(deployment.Spec.Template.Spec.Containers)
+}
+
+// rewriteImageRegistry replaces the registry of image with registry, keeping its repository and tag. Images
+// without a registry come from Docker Hub.
+func rewriteImageRegistry(image string, registry string) string {
+	if registry == "" {
+		return image
+	}
+	tokens := strings.SplitN(image, "/", 2)
+	if len(tokens) == 2 && (strings.ContainsAny(tokens[0], ".:") || tokens[0] == "localhost") {
+		image = tokens[1]
+	}
+	return strings.TrimSuffix(registry, "/") + "/" + image
+}
+
+// imageTag returns the tag of image, or an empty string if it has none
+func imageTag(image string) string {
+	lastColon := strings.LastIndex(image, ":")
+	if lastColon < 0 || strings.Contains(image[lastColon:], "/") {
+		return ""
+	}
+	return image[lastColon+1:]
+}
@@ -0,0 +1,169 @@
+package cluster
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+)
+
+const testOperatorManifest = `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: astarte-operator
+  namespace: kube-system
+spec:
+  replicas: 1
+  selector:
+    matchLabels:
+      name: astarte-operator
+  template:
+    metadata:
+      labels:
+        name: astarte-operator
+    spec:
+      containers:
+        - name: astarte-operator
+          image: astarte/astarte-kubernetes-operator:0.10.2
+`
+
+func testOperatorManifestFiles() map[string]string {
+	files := map[string]string{}
+	for _, file := range operatorManifestFiles {
+		files[file] = "# " + file + "\n"
+	}
+	files["deploy/operator.yaml"] = testOperatorManifest
+	return files
+}
+
+func TestRewriteImageRegistry(t *testing.T) {
+	for _, test := range []struct {
+		image    string
+		registry string
+		expected string
+	}{
+		{"astarte/astarte-kubernetes-operator:0.10.2", "", "astarte/astarte-kubernetes-operator:0.10.2"},
+		{"astarte/astarte-kubernetes-operator:0.10.2", "registry.local:5000", "registry.local:5000/astarte/astarte-kubernetes-operator:0.10.2"},
+		{"quay.io/astarte/operator:0.10.2", "mirror.example.com/", "mirror.example.com/astarte/operator:0.10.2"},
+		{"localhost/operator", "mirror.example.com", "mirror.example.com/operator"},
+	} {
+		if image := rewriteImageRegistry(test.image, test.registry); image != test.expected {
+			t.Errorf("%s on %s: expected %s, got %s", test.image, test.registry, test.expected, image)
+		}
+	}
+
+	for image, tag := range map[string]string{
+		"astarte/astarte-kubernetes-operator:0.10.2":              "0.10.2",
+		"registry.local:5000/astarte/astarte-kubernetes-operator": "",
+		"registry.local:5000/astarte/operator:0.11-snapshot":      "0.11-snapshot",
+	} {
+		if imageTag(image) != tag {
+			t.Errorf("%s: expected tag %q, got %q", image, tag, imageTag(image))
+		}
+	}
+}
+
+func TestOperatorBundle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "astartectl-operator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func() {
+		operatorManifests = gitHubOperatorManifests{}
+		operatorImageRegistry = ""
+	}()
+
+	files := testOperatorManifestFiles()
+	metadata, err := newOperatorBundleMetadata("0.10.2", files, "registry.local:5000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(metadata.Images, []string{"astarte/astarte-kubernetes-operator:0.10.2"}) {
+		t.Errorf("Unexpected images %v", metadata.Images)
+	}
+	bundleFile := filepath.Join(dir, "bundle.tar.gz")
+	f, err := os.Create(bundleFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeOperatorBundle(f, metadata, files); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	source, err := loadOperatorBundle(bundleFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if source.metadata.Version != "0.10.2" || source.metadata.ImageRegistry != "registry.local:5000" {
+		t.Errorf("Unexpected metadata %v", source.metadata)
+	}
+	if content, err := source.Content("deploy/role.yaml", "0.10.2"); err != nil || content != files["deploy/role.yaml"] {
+		t.Errorf("Unexpected content %q, %v", content, err)
+	}
+	if _, err := source.Content("deploy/role.yaml", "0.10.1"); err == nil {
+		t.Error("Expected an error reading another version")
+	}
+
+	// Installing from the bundle uses its version and registry. Persistent flags are merged into Flags() when the
+	// command runs
+	installCmd.LocalFlags()
+	installCmd.Flags().Set("from-bundle", bundleFile)
+	defer installCmd.Flags().Set("from-bundle", "")
+	version, err := operatorVersionFromFlags(installCmd)
+	if err != nil || version != "0.10.2" {
+		t.Fatalf("Unexpected version %s, %v", version, err)
+	}
+	operator, err := decodeOperatorManifest("deploy/operator.yaml", version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if image := operator.(*appsv1.Deployment).Spec.Template.Spec.Containers[0].Image; image != "registry.local:5000/astarte/astarte-kubernetes-operator:0.10.2" {
+		t.Errorf("Unexpected image %s", image)
+	}
+
+	installCmd.Flags().Set("version", "0.10.1")
+	defer installCmd.Flags().Set("version", "")
+	if _, err := operatorVersionFromFlags(installCmd); err == nil {
+		t.Error("Expected an error installing another version from the bundle")
+	}
+}
+
+func TestOperatorManifestsDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "astartectl-operator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for file, content := range testOperatorManifestFiles() {
+		os.MkdirAll(filepath.Dir(filepath.Join(dir, file)), 0755)
+		if err := ioutil.WriteFile(filepath.Join(dir, file), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A checkout of the repository needs the version
+	if _, err := loadOperatorManifestsDir(dir, ""); err == nil {
+		t.Error("Expected an error without version")
+	}
+	source, err := loadOperatorManifestsDir(dir, "0.10.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content, err := source.Content("deploy/operator.yaml", "0.10.2"); err != nil || content != testOperatorManifest {
+		t.Errorf("Unexpected content %q, %v", content, err)
+	}
+
+	// An extracted bundle carries it
+	if err := ioutil.WriteFile(filepath.Join(dir, operatorBundleMetadataFile), []byte("version: 0.10.1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	source, err = loadOperatorManifestsDir(dir, "")
+	if err != nil || source.metadata.Version != "0.10.1" {
+		t.Errorf("Unexpected source %v, %v", source, err)
+	}
+}
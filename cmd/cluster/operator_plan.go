@@ -0,0 +1,378 @@
+// Copyright © 2019 Ispirata Srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	apiextensionsv1beta1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1beta1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// Actions of an operatorPlanStep
+const (
+	planCreate    = "create"
+	planUpdate    = "update"
+	planDelete    = "delete"
+	planUnchanged = "unchanged"
+	// planSkip marks objects left as they are: existing ones when installing, missing ones when uninstalling
+	planSkip = "skip"
+	// planConflict marks existing objects which make installing fail
+	planConflict = "conflict"
+)
+
+// operatorPlanStep is what installing, upgrading or uninstalling Astarte Operator would do to an object
+type operatorPlanStep struct {
+	Action    string
+	Kind      string
+	Name      string
+	Namespace string
+	Changes   []string
+}
+
+// operatorInstalledObjects are the objects deleted by uninstall-operator, in order
+var operatorInstalledObjects = []runtime.Object{
+	&appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "astarte-operator", Namespace: "kube-system"}},
+	&rbacv1.ClusterRoleBinding{ObjectMeta: metav1.ObjectMeta{Name: "astarte-operator"}},
+	&rbacv1.ClusterRole{ObjectMeta: metav1.ObjectMeta{Name: "astarte-operator"}},
+	&corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: "astarte-operator", Namespace: "kube-system"}},
+	&apiextensionsv1beta1.CustomResourceDefinition{ObjectMeta: metav1.ObjectMeta{Name: "astartes.api.astarte-platform.org"}},
+	&apiextensionsv1beta1.CustomResourceDefinition{ObjectMeta: metav1.ObjectMeta{Name: "astartevoyageringresses.api.astarte-platform.org"}},
+}
+
+// planOperatorInstall plans installing Astarte Operator version. Objects which already exist are left untouched,
+// except for the Deployment: installing fails if it exists.
+func planOperatorInstall(version string) ([]operatorPlanStep, error) {
+	steps := []operatorPlanStep{}
+	for _, manifest := range operatorManifestFiles {
+		desired, err := decodeOperatorManifest(manifest, version)
+		if err != nil {
+			return nil, fmt.Errorf("Could not read %s: %s", manifest, err)
+		}
+		step, live, err := newOperatorPlanStep(desired)
+		if err != nil {
+			return nil, err
+		}
+		if _, isDeployment := desired.(*appsv1.Deployment); live != nil && isDeployment {
+			step.Action = planConflict
+			step.Changes = []string{"  ! already exists, installing would fail"}
+		} else if live != nil {
+			step.Action = planSkip
+		} else {
+			step.Action = planCreate
+			step.Changes, err = objectChanges(nil, desired)
+		}
+		if err != nil {
+			return nil, err
+		}
+		steps = append(steps, step)
+	}
+	return steps, nil
+}
+
+// planOperatorUpgrade plans upgrading Astarte Operator to version
+func planOperatorUpgrade(version string) ([]operatorPlanStep, error) {
+	objects := []runtime.Object{}
+	for _, manifest := range operatorManifestFiles {
+		desired, err := decodeOperatorManifest(manifest, version)
+		if err != nil {
+			return nil, fmt.Errorf("Could not read %s: %s", manifest, err)
+		}
+		objects = append(objects, desired)
+	}
+	return planOperatorApply(objects)
+}
+
+// planOperatorApply plans applying objects to the cluster, creating the missing ones and updating the others
+func planOperatorApply(objects []runtime.Object) ([]operatorPlanStep, error) {
+	steps := []operatorPlanStep{}
+	for _, desired := range objects {
+		step, live, err := newOperatorPlanStep(desired)
+		if err != nil {
+			return nil, err
+		}
+		step.Changes, err = objectChanges(live, desired)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case live == nil:
+			step.Action = planCreate
+		case len(step.Changes) == 0:
+			step.Action = planUnchanged
+		default:
+			step.Action = planUpdate
+		}
+		steps = append(steps, step)
+	}
+	return steps, nil
+}
+
+// planOperatorUninstall plans uninstalling Astarte Operator
+func planOperatorUninstall() ([]operatorPlanStep, error) {
+	steps := []operatorPlanStep{}
+	for _, object := range operatorInstalledObjects {
+		step, live, err := newOperatorPlanStep(object)
+		if err != nil {
+			return nil, err
+		}
+		step.Action = planDelete
+		if live == nil {
+			step.Action = planSkip
+		}
+		steps = append(steps, step)
+	}
+	return steps, nil
+}
+
+// newOperatorPlanStep returns the step describing object, together with its live counterpart, which is nil
+// when it does not exist
+func newOperatorPlanStep(object runtime.Object) (operatorPlanStep, runtime.Object, error) {
+	var live runtime.Object
+	var step operatorPlanStep
+	var err error
+	switch o := object.(type) {
+	case *corev1.ServiceAccount:
+		step = operatorPlanStep{Kind: "ServiceAccount", Name: o.Name, Namespace: o.Namespace}
+		live, err = kubernetesClient.CoreV1().ServiceAccounts(o.Namespace).Get(o.Name, metav1.GetOptions{})
+	case *rbacv1.ClusterRole:
+		step = operatorPlanStep{Kind: "ClusterRole", Name: o.Name}
+		live, err = kubernetesClient.RbacV1().ClusterRoles().Get(o.Name, metav1.GetOptions{})
+	case *rbacv1.ClusterRoleBinding:
+		step = operatorPlanStep{Kind: "ClusterRoleBinding", Name: o.Name}
+		live, err = kubernetesClient.RbacV1().ClusterRoleBindings().Get(o.Name, metav1.GetOptions{})
+	case *apiextensionsv1beta1.CustomResourceDefinition:
+		step = operatorPlanStep{Kind: "CustomResourceDefinition", Name: o.Name}
+		live, err = kubernetesAPIExtensionsClient.ApiextensionsV1beta1().CustomResourceDefinitions().Get(o.Name, metav1.GetOptions{})
+	case *appsv1.Deployment:
+		step = operatorPlanStep{Kind: "Deployment", Name: o.Name, Namespace: o.Namespace}
+		live, err = kubernetesClient.AppsV1().Deployments(o.Namespace).Get(o.Name, metav1.GetOptions{})
+	default:
+		return step, nil, fmt.Errorf("Unexpected object %T in Astarte Operator manifests", object)
+	}
+	if errors.IsNotFound(err) {
+		return step, nil, nil
+	} else if err != nil {
+		return step, nil, fmt.Errorf("Could not get %s %s: %s", step.Kind, step.Name, err)
+	}
+	return step, live, nil
+}
+
+// serverDefaultedFields are the fields which the API server and controllers set on objects when their manifests
+// leave them unset. They are not reported as removed when only live objects have them.
+var serverDefaultedFields = map[string]bool{
+	// Metadata
+	"finalizers":                        true,
+	"ownerReferences":                   true,
+	"deployment.kubernetes.io/revision": true,
+	"kubectl.kubernetes.io/last-applied-configuration": true,
+	// ServiceAccounts
+	"secrets": true,
+	// Deployments and their pods
+	"progressDeadlineSeconds":       true,
+	"revisionHistoryLimit":          true,
+	"strategy":                      true,
+	"rollingUpdate":                 true,
+	"dnsPolicy":                     true,
+	"restartPolicy":                 true,
+	"schedulerName":                 true,
+	"securityContext":               true,
+	"serviceAccount":                true,
+	"terminationGracePeriodSeconds": true,
+	"terminationMessagePath":        true,
+	"terminationMessagePolicy":      true,
+	"imagePullPolicy":               true,
+	"protocol":                      true,
+	"defaultMode":                   true,
+	"apiVersion":                    true,
+	"timeoutSeconds":                true,
+	"periodSeconds":                 true,
+	"successThreshold":              true,
+	"failureThreshold":              true,
+	"scheme":                        true,
+	// CustomResourceDefinitions
+	"conversion":            true,
+	"preserveUnknownFields": true,
+	"listKind":              true,
+	"singular":              true,
+	"versions":              true,
+}
+
+// objectChanges describes the fields which applying desired would change in live, one line per field. Fields
+// desired leaves unset are reported as removed, unless the API server defaults them.
+func objectChanges(live runtime.Object, desired runtime.Object) ([]string, error) {
+	var liveObject map[string]interface{}
+	liveValues := map[string]interface{}{}
+	if live != nil {
+		var err error
+		if liveObject, err = objectToMap(live); err != nil {
+			return nil, err
+		}
+		flattenObject("", liveObject, liveValues)
+	}
+	desiredObject, err := objectToMap(desired)
+	if err != nil {
+		return nil, err
+	}
+	desiredValues := map[string]interface{}{}
+	flattenObject("", desiredObject, desiredValues)
+
+	changesByPath := map[string]string{}
+	for path, desiredValue := range desiredValues {
+		desiredJSON, _ := json.Marshal(desiredValue)
+		liveValue, ok := liveValues[path]
+		if !ok {
+			changesByPath[path] = fmt.Sprintf("  + %s: %s", path, desiredJSON)
+			continue
+		}
+		if liveJSON, _ := json.Marshal(liveValue); string(liveJSON) != string(desiredJSON) {
+			changesByPath[path] = fmt.Sprintf("  ~ %s: %s -> %s", path, liveJSON, desiredJSON)
+		}
+	}
+	if liveObject != nil {
+		removedFields("", liveObject, desiredObject, changesByPath)
+	}
+
+	paths := []string{}
+	for path := range changesByPath {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	changes := []string{}
+	for _, path := range paths {
+		changes = append(changes, changesByPath[path])
+	}
+	return changes, nil
+}
+
+// removedFields describes in changes the fields of live which desired leaves unset, except for the ones defaulted
+// by the API server. Array items beyond the length of the desired array are removed as a whole.
+func removedFields(prefix string, live interface{}, desired interface{}, changes map[string]string) {
+	switch l := live.(type) {
+	case map[string]interface{}:
+		d, ok := desired.(map[string]interface{})
+		if !ok {
+			return
+		}
+		for key, liveValue := range l {
+			path := key
+			if prefix != "" {
+				path = prefix + "." + key
+			}
+			if desiredValue, ok := d[key]; ok && desiredValue != nil {
+				removedFields(path, liveValue, desiredValue, changes)
+			} else if !serverDefaultedFields[key] {
+				reportRemovedField(path, liveValue, changes)
+			}
+		}
+	case []interface{}:
+		d, ok := desired.([]interface{})
+		if !ok {
+			return
+		}
+		for i, liveValue := range l {
+			path := fmt.Sprintf("%s[%d]", prefix, i)
+			if i < len(d) {
+				removedFields(path, liveValue, d[i], changes)
+			} else {
+				reportRemovedField(path, liveValue, changes)
+			}
+		}
+	}
+}
+
+func reportRemovedField(path string, value interface{}, changes map[string]string) {
+	// Unset values, empty objects and empty arrays are not reported
+	values := map[string]interface{}{}
+	flattenObject(path, value, values)
+	if len(values) == 0 {
+		return
+	}
+	valueJSON, _ := json.Marshal(value)
+	changes[path] = fmt.Sprintf("  - %s: %s", path, valueJSON)
+}
+
+// objectToMap returns object as a generic map, without the fields set by the API server
+func objectToMap(object runtime.Object) (map[string]interface{}, error) {
+	content, err := json.Marshal(object)
+	if err != nil {
+		return nil, err
+	}
+	ret := map[string]interface{}{}
+	if err := json.Unmarshal(content, &ret); err != nil {
+		return nil, err
+	}
+	// Live objects have no type metadata
+	delete(ret, "apiVersion")
+	delete(ret, "kind")
+	delete(ret, "status")
+	if metadata, ok := ret["metadata"].(map[string]interface{}); ok {
+		for _, field := range []string{"resourceVersion", "uid", "selfLink", "creationTimestamp", "generation", "managedFields"} {
+			delete(metadata, field)
+		}
+	}
+	return ret, nil
+}
+
+// flattenObject maps the path of each value in object to the value. Array items are indexed, and unset values,
+// empty objects and empty arrays are left out.
+func flattenObject(prefix string, object interface{}, values map[string]interface{}) {
+	switch o := object.(type) {
+	case map[string]interface{}:
+		for key, value := range o {
+			path := key
+			if prefix != "" {
+				path = prefix + "." + key
+			}
+			flattenObject(path, value, values)
+		}
+	case []interface{}:
+		for i, value := range o {
+			flattenObject(fmt.Sprintf("%s[%d]", prefix, i), value, values)
+		}
+	case nil:
+	default:
+		values[prefix] = o
+	}
+}
+
+// printOperatorPlan prints steps, and a summary of them
+func printOperatorPlan(w io.Writer, steps []operatorPlanStep) {
+	counts := map[string]int{}
+	for _, step := range steps {
+		name := step.Name
+		if step.Namespace != "" {
+			name = step.Namespace + "/" + step.Name
+		}
+		fmt.Fprintf(w, "%s %s %s\n", step.Action, step.Kind, name)
+		for _, change := range step.Changes {
+			fmt.Fprintln(w, change)
+		}
+		counts[step.Action]++
+	}
+	fmt.Fprintf(w, "\nPlan: %d to create, %d to update, %d to delete, %d unchanged, %d skipped. Nothing has been applied.\n",
+		counts[planCreate], counts[planUpdate], counts[planDelete], counts[planUnchanged], counts[planSkip])
+	if counts[planConflict] > 0 {
+		fmt.Fprintf(w, "%d objects conflict with the cluster: applying this plan would fail.\n", counts[planConflict])
+	}
+}
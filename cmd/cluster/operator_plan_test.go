@@ -0,0 +1,235 @@
+package cluster
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apiextensionsv1beta1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1beta1"
+	apiextensionsfake "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset/fake"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+var testPlanManifests = map[string]string{
+	"deploy/service_account.yaml": `apiVersion: v1
+kind: ServiceAccount
+metadata:
+  name: astarte-operator
+  namespace: kube-system
+`,
+	"deploy/role.yaml": `apiVersion: rbac.authorization.k8s.io/v1
+kind: ClusterRole
+metadata:
+  name: astarte-operator
+rules:
+  - apiGroups: ["api.astarte-platform.org"]
+    resources: ["*"]
+    verbs: ["*"]
+`,
+	"deploy/role_binding.yaml": `apiVersion: rbac.authorization.k8s.io/v1
+kind: ClusterRoleBinding
+metadata:
+  name: astarte-operator
+subjects:
+  - kind: ServiceAccount
+    name: astarte-operator
+    namespace: kube-system
+roleRef:
+  kind: ClusterRole
+  name: astarte-operator
+  apiGroup: rbac.authorization.k8s.io
+`,
+	"deploy/crds/api_v1alpha1_astarte_crd.yaml": `apiVersion: apiextensions.k8s.io/v1beta1
+kind: CustomResourceDefinition
+metadata:
+  name: astartes.api.astarte-platform.org
+spec:
+  group: api.astarte-platform.org
+  names:
+    kind: Astarte
+    plural: astartes
+  scope: Namespaced
+`,
+	"deploy/crds/api_v1alpha1_astarte_voyager_ingress_crd.yaml": `apiVersion: apiextensions.k8s.io/v1beta1
+kind: CustomResourceDefinition
+metadata:
+  name: astartevoyageringresses.api.astarte-platform.org
+spec:
+  group: api.astarte-platform.org
+  names:
+    kind: AstarteVoyagerIngress
+    plural: astartevoyageringresses
+  scope: Namespaced
+`,
+	"deploy/operator.yaml": testOperatorManifest,
+}
+
+// setupTestPlan serves testPlanManifests and objects from fake clientsets, and returns a function restoring them
+func setupTestPlan(objects ...runtime.Object) func() {
+	operatorManifests = localOperatorManifests{
+		metadata: operatorBundleMetadata{Version: "0.10.2"},
+		location: "test",
+		read: func(path string) ([]byte, error) {
+			return []byte(testPlanManifests[path]), nil
+		},
+	}
+	kubernetesObjects := []runtime.Object{}
+	apiExtensionsObjects := []runtime.Object{}
+	for _, object := range objects {
+		if _, ok := object.(*apiextensionsv1beta1.CustomResourceDefinition); ok {
+			apiExtensionsObjects = append(apiExtensionsObjects, object)
+		} else {
+			kubernetesObjects = append(kubernetesObjects, object)
+		}
+	}
+	oldClient, oldAPIExtensionsClient := kubernetesClient, kubernetesAPIExtensionsClient
+	kubernetesClient = fake.NewSimpleClientset(kubernetesObjects...)
+	kubernetesAPIExtensionsClient = apiextensionsfake.NewSimpleClientset(apiExtensionsObjects...)
+	return func() {
+		operatorManifests = gitHubOperatorManifests{}
+		kubernetesClient, kubernetesAPIExtensionsClient = oldClient, oldAPIExtensionsClient
+	}
+}
+
+func testPlanActions(steps []operatorPlanStep) []string {
+	actions := []string{}
+	for _, step := range steps {
+		actions = append(actions, step.Action+" "+step.Kind)
+	}
+	return actions
+}
+
+func TestPlanOperatorInstall(t *testing.T) {
+	defer setupTestPlan(&corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: "astarte-operator", Namespace: "kube-system"}})()
+
+	steps, err := planOperatorInstall("0.10.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"skip ServiceAccount", "create ClusterRole", "create ClusterRoleBinding",
+		"create CustomResourceDefinition", "create CustomResourceDefinition", "create Deployment"}
+	if actions := testPlanActions(steps); !reflect.DeepEqual(actions, expected) {
+		t.Errorf("Expected %v, got %v", expected, actions)
+	}
+	if len(steps[0].Changes) != 0 {
+		t.Errorf("Unexpected changes to an existing object: %v", steps[0].Changes)
+	}
+	image := `  + spec.template.spec.containers[0].image: "astarte/astarte-kubernetes-operator:0.10.2"`
+	if !containsString(steps[5].Changes, image) {
+		t.Errorf("Expected %s in %v", image, steps[5].Changes)
+	}
+
+	// Nothing is applied
+	if _, err := kubernetesClient.AppsV1().Deployments("kube-system").Get("astarte-operator", metav1.GetOptions{}); err == nil {
+		t.Error("The plan created the Deployment")
+	}
+
+	out := &bytes.Buffer{}
+	printOperatorPlan(out, steps)
+	if !strings.Contains(out.String(), "create Deployment kube-system/astarte-operator\n") ||
+		!strings.Contains(out.String(), "Plan: 5 to create, 0 to update, 0 to delete, 0 unchanged, 1 skipped.") ||
+		strings.Contains(out.String(), "conflict") {
+		t.Errorf("Unexpected plan:\n%s", out)
+	}
+
+	// Installing fails when Astarte Operator is already deployed
+	deployment, err := decodeManifest(testPlanManifests["deploy/operator.yaml"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer setupTestPlan(deployment)()
+	if steps, err = planOperatorInstall("0.10.2"); err != nil {
+		t.Fatal(err)
+	}
+	if steps[5].Action != planConflict {
+		t.Errorf("Expected a conflict on the Deployment, got %v", testPlanActions(steps))
+	}
+	out.Reset()
+	printOperatorPlan(out, steps)
+	if !strings.Contains(out.String(), "conflict Deployment kube-system/astarte-operator\n  ! already exists, installing would fail\n") ||
+		!strings.Contains(out.String(), "1 objects conflict with the cluster: applying this plan would fail.") {
+		t.Errorf("Unexpected plan:\n%s", out)
+	}
+}
+
+func TestPlanOperatorUpgrade(t *testing.T) {
+	live := map[string]runtime.Object{}
+	for _, manifest := range operatorManifestFiles {
+		object, err := decodeManifest(testPlanManifests[manifest])
+		if err != nil {
+			t.Fatal(err)
+		}
+		live[manifest] = object
+	}
+	// The live operator runs an older image and has fields set by the API server
+	deployment := live["deploy/operator.yaml"].(*appsv1.Deployment)
+	deployment.Spec.Template.Spec.Containers[0].Image = "astarte/astarte-kubernetes-operator:0.10.1"
+	deployment.Spec.Template.Spec.Containers[0].ImagePullPolicy = corev1.PullIfNotPresent
+	deployment.Spec.Template.Spec.Containers[0].TerminationMessagePath = "/dev/termination-log"
+	deployment.Spec.Template.Spec.DNSPolicy = corev1.DNSClusterFirst
+	deployment.ResourceVersion = "42"
+	// Settings which the new manifest drops
+	deployment.Spec.Template.Spec.Containers[0].Env = []corev1.EnvVar{{Name: "WATCH_NAMESPACE", Value: "astarte"}}
+	deployment.Spec.Template.Spec.Containers[0].Args = []string{"--zap-devel"}
+	deployment.Spec.Template.Spec.Containers = append(deployment.Spec.Template.Spec.Containers,
+		corev1.Container{Name: "proxy", Image: "proxy:1.0", TerminationMessagePolicy: corev1.TerminationMessageReadFile})
+	objects := []runtime.Object{}
+	for _, manifest := range operatorManifestFiles[:len(operatorManifestFiles)-2] {
+		objects = append(objects, live[manifest])
+	}
+	objects = append(objects, deployment)
+	defer setupTestPlan(objects...)()
+
+	steps, err := planOperatorUpgrade("0.10.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"unchanged ServiceAccount", "unchanged ClusterRole", "unchanged ClusterRoleBinding",
+		"unchanged CustomResourceDefinition", "create CustomResourceDefinition", "update Deployment"}
+	if actions := testPlanActions(steps); !reflect.DeepEqual(actions, expected) {
+		t.Errorf("Expected %v, got %v", expected, actions)
+	}
+	changes := []string{
+		`  - spec.template.spec.containers[0].args: ["--zap-devel"]`,
+		`  - spec.template.spec.containers[0].env: [{"name":"WATCH_NAMESPACE","value":"astarte"}]`,
+		`  ~ spec.template.spec.containers[0].image: "astarte/astarte-kubernetes-operator:0.10.1" -> "astarte/astarte-kubernetes-operator:0.10.2"`,
+		`  - spec.template.spec.containers[1]: {"image":"proxy:1.0","name":"proxy","resources":{},"terminationMessagePolicy":"File"}`,
+	}
+	if !reflect.DeepEqual(steps[5].Changes, changes) {
+		t.Errorf("Expected %v, got %v", changes, steps[5].Changes)
+	}
+}
+
+func TestPlanOperatorUninstall(t *testing.T) {
+	defer setupTestPlan(
+		&appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "astarte-operator", Namespace: "kube-system"}},
+		&apiextensionsv1beta1.CustomResourceDefinition{ObjectMeta: metav1.ObjectMeta{Name: "astartes.api.astarte-platform.org"}},
+	)()
+
+	steps, err := planOperatorUninstall()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"delete Deployment", "skip ClusterRoleBinding", "skip ClusterRole", "skip ServiceAccount",
+		"delete CustomResourceDefinition", "skip CustomResourceDefinition"}
+	if actions := testPlanActions(steps); !reflect.DeepEqual(actions, expected) {
+		t.Errorf("Expected %v, got %v", expected, actions)
+	}
+	if _, err := kubernetesClient.AppsV1().Deployments("kube-system").Get("astarte-operator", metav1.GetOptions{}); err != nil {
+		t.Errorf("The plan deleted the Deployment: %s", err)
+	}
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
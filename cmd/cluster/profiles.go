@@ -0,0 +1,379 @@
+// Copyright © 2019 Ispirata Srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/astarte-platform/astartectl/cmd/cluster/deployment"
+	"github.com/astarte-platform/astartectl/cmd/output"
+	"github.com/astarte-platform/astartectl/utils"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v2"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+var profilesCmd = &cobra.Command{
+	Use:   "profiles",
+	Short: "Inspect Astarte Deployment Profiles",
+	Long: `Inspect the Astarte Deployment Profiles which can be used to deploy Astarte instances.
+
+Besides the builtin profiles, profiles are loaded from the YAML files in --profiles-dir and from
+--profile-file. A profile loaded from a file replaces a builtin profile with the same name.`,
+	Aliases: []string{"profile"},
+}
+
+var profilesListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List Astarte Deployment Profiles",
+	Long: `List the available Astarte Deployment Profiles, together with their compatibility and requirements.
+
+Each profile is checked against the current cluster and, when --version is given, against that Astarte
+version, explaining why it cannot be deployed. The resources requested by the pods already running are
+subtracted from what each schedulable node can allocate, and the pods of the profile must fit on the nodes
+one by one: a cluster of many small nodes cannot host pods larger than any of them.`,
+	Example: `  astartectl cluster profiles list --version 0.10.2`,
+	Args:    cobra.NoArgs,
+	RunE:    profilesListF,
+}
+
+var profilesShowCmd = &cobra.Command{
+	Use:     "show <profile>",
+	Short:   "Show an Astarte Deployment Profile",
+	Example: `  astartectl cluster profiles show basic`,
+	Args:    cobra.ExactArgs(1),
+	RunE:    profilesShowF,
+}
+
+var profilesValidateCmd = &cobra.Command{
+	Use:   "validate [<file>...]",
+	Short: "Validate Astarte Deployment Profile files",
+	Long: `Validate Astarte Deployment Profile files, reporting all problems found in each of them.
+When no file is given, the profiles in --profiles-dir and --profile-file are validated.
+
+This command does not access the cluster.`,
+	Example: `  astartectl cluster profiles validate my-profile.yaml`,
+	RunE:    profilesValidateF,
+	// Validating files does not need a Kubernetes client
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error { return nil },
+}
+
+// sourcedProfile is an Astarte Cluster Profile together with where it was loaded from
+type sourcedProfile struct {
+	deployment.AstarteClusterProfile
+	Source string
+}
+
+const builtinProfileSource = "builtin"
+
+func init() {
+	profilesListCmd.Flags().String("version", "", "Check profiles against this Astarte version")
+	output.AddFlag(profilesListCmd)
+	profilesShowCmd.Flags().String("version", "", "Check the profile against this Astarte version")
+	output.AddFlag(profilesShowCmd)
+
+	profilesCmd.AddCommand(profilesListCmd, profilesShowCmd, profilesValidateCmd)
+	ClusterCmd.AddCommand(profilesCmd)
+}
+
+// profileFiles returns the profile files in --profiles-dir followed by the ones in --profile-file
+func profileFiles(command *cobra.Command) ([]string, error) {
+	profilesDir, err := command.Flags().GetString("profiles-dir")
+	if err != nil {
+		return nil, err
+	}
+	extraFiles, err := command.Flags().GetStringSlice("profile-file")
+	if err != nil {
+		return nil, err
+	}
+	files, err := deployment.ListAstarteClusterProfileFiles(profilesDir)
+	if err != nil {
+		return nil, err
+	}
+	return append(files, extraFiles...), nil
+}
+
+// getAstarteClusterProfiles returns the builtin profiles, replaced or extended by the ones in profile files
+func getAstarteClusterProfiles(command *cobra.Command) ([]sourcedProfile, error) {
+	profiles := []sourcedProfile{}
+	indexes := map[string]int{}
+	add := func(profile deployment.AstarteClusterProfile, source string) {
+		if i, ok := indexes[profile.Name]; ok {
+			profiles[i] = sourcedProfile{profile, source}
+			return
+		}
+		indexes[profile.Name] = len(profiles)
+		profiles = append(profiles, sourcedProfile{profile, source})
+	}
+
+	for _, profile := range deployment.GetAllBuiltinAstarteClusterProfiles() {
+		add(profile, builtinProfileSource)
+	}
+	files, err := profileFiles(command)
+	if err != nil {
+		return nil, err
+	}
+	loadedFrom := map[string]string{}
+	for _, file := range files {
+		profile, err := deployment.LoadAstarteClusterProfile(file)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid profile %s: %s", file, err)
+		}
+		if otherFile, ok := loadedFrom[profile.Name]; ok {
+			return nil, fmt.Errorf("Profile %s is defined both in %s and %s", profile.Name, otherFile, file)
+		}
+		loadedFrom[profile.Name] = file
+		add(profile, file)
+	}
+	return profiles, nil
+}
+
+// profileCompatibility returns whether profile can be deployed on the current cluster, and why not. It returns
+// "unknown" when the cluster's capacity could not be retrieved.
+func profileCompatibility(profile deployment.AstarteClusterProfile, version *semver.Version,
+	capacity *clusterCapacity) (string, []string) {
+	if capacity == nil {
+		// Only the version can be checked
+		if reasons := profile.IncompatibilityReasons(version, profile.Requirements); len(reasons) > 0 {
+			return "no", reasons
+		}
+		return "unknown", nil
+	}
+	reasons := capacity.profileIncompatibilityReasons(profile, version)
+	if len(reasons) > 0 {
+		return "no", reasons
+	}
+	return "yes", nil
+}
+
+// getClusterCapacityOrWarn returns the capacity of the current cluster, or nil after printing a warning when it
+// cannot be retrieved. Pods for which ignorePod returns true are considered gone.
+func getClusterCapacityOrWarn(ignorePod func(corev1.Pod) bool) *clusterCapacity {
+	capacity, err := getClusterCapacity(ignorePod)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not retrieve the cluster's resources, profiles are not checked against them: %s\n", err)
+		return nil
+	}
+	return capacity
+}
+
+func versionFromFlags(command *cobra.Command) (*semver.Version, error) {
+	version, err := command.Flags().GetString("version")
+	if err != nil || version == "" {
+		return nil, err
+	}
+	astarteVersion, err := semver.NewVersion(version)
+	if err != nil {
+		return nil, fmt.Errorf("%s is not a valid Astarte version", version)
+	}
+	return astarteVersion, nil
+}
+
+func profilesListF(command *cobra.Command, args []string) error {
+	outputFormat, err := output.FormatFromFlags(command)
+	if err != nil {
+		return err
+	}
+	version, err := versionFromFlags(command)
+	if err != nil {
+		return err
+	}
+	profiles, err := getAstarteClusterProfiles(command)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	capacity := getClusterCapacityOrWarn(nil)
+
+	t := output.NewTable("Name", "Source", "Astarte Versions", "CPU", "Memory", "Nodes", "Deployable", "Reasons")
+	t.AddWideColumns("Description")
+	data := []map[string]interface{}{}
+	for _, profile := range profiles {
+		deployable, reasons := profileCompatibility(profile.AstarteClusterProfile, version, capacity)
+		t.AppendRow(profile.Name, profile.Source, astarteVersionsRange(profile.Compatibility),
+			fmt.Sprintf("%dm", profile.Requirements.CPUAllocation), memoryQuantity(profile.Requirements.MemoryAllocation),
+			nodesRange(profile.Requirements), deployable, strings.Join(reasons, "; "), profile.Description)
+		data = append(data, map[string]interface{}{
+			"name":              profile.Name,
+			"source":            profile.Source,
+			"description":       profile.Description,
+			"astarte_versions":  astarteVersionsRange(profile.Compatibility),
+			"cpu_allocation":    profile.Requirements.CPUAllocation,
+			"memory_allocation": profile.Requirements.MemoryAllocation,
+			"nodes":             nodesRange(profile.Requirements),
+			"deployable":        deployable,
+			"reasons":           reasons,
+		})
+	}
+	return output.Print(os.Stdout, outputFormat, data, t)
+}
+
+func profilesShowF(command *cobra.Command, args []string) error {
+	outputFormat, err := output.FormatFromFlags(command)
+	if err != nil {
+		return err
+	}
+	version, err := versionFromFlags(command)
+	if err != nil {
+		return err
+	}
+	profiles, err := getAstarteClusterProfiles(command)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	var profile *sourcedProfile
+	for i := range profiles {
+		if profiles[i].Name == args[0] {
+			profile = &profiles[i]
+		}
+	}
+	if profile == nil {
+		fmt.Printf("Profile %s not found\n", args[0])
+		os.Exit(1)
+	}
+
+	// Structured outputs render the profile as it would be written in a profile file
+	profileYAML, err := yaml.Marshal(profile.AstarteClusterProfile)
+	if err != nil {
+		return err
+	}
+	profileData, err := utils.UnmarshalYAMLToJSON(profileYAML)
+	if err != nil {
+		return err
+	}
+	if !outputFormat.IsHumanReadable() {
+		return output.Print(os.Stdout, outputFormat, profileData, nil)
+	}
+
+	deployable, reasons := profileCompatibility(profile.AstarteClusterProfile, version, getClusterCapacityOrWarn(nil))
+	summary := map[string]interface{}{
+		"Name":             profile.Name,
+		"Source":           profile.Source,
+		"Description":      profile.Description,
+		"Astarte Versions": astarteVersionsRange(profile.Compatibility),
+		"CPU":              fmt.Sprintf("%dm", profile.Requirements.CPUAllocation),
+		"Memory":           memoryQuantity(profile.Requirements.MemoryAllocation),
+		"Nodes":            nodesRange(profile.Requirements),
+		"Deployable":       deployable,
+		"Reasons":          strings.Join(reasons, "\n"),
+	}
+	keys := []string{"Name", "Source", "Description", "Astarte Versions", "CPU", "Memory", "Nodes", "Deployable", "Reasons"}
+	if err := output.Print(os.Stdout, outputFormat, summary, output.NewKeyValueTable(keys, summary)); err != nil {
+		return err
+	}
+
+	if len(profile.CustomizableFields) > 0 {
+		fmt.Println()
+		fmt.Println("Customizable fields:")
+		t := output.NewTable("Field", "Type", "Default", "Allow Empty", "Question")
+		for _, field := range profile.CustomizableFields {
+			t.AppendRow(field.Field, field.TypeName(), field.Default, field.AllowEmpty, field.Question)
+		}
+		if err := output.Print(os.Stdout, outputFormat, profile.CustomizableFields, t); err != nil {
+			return err
+		}
+	}
+
+	defaultSpec, err := yaml.Marshal(profile.DefaultSpec)
+	if err != nil {
+		return err
+	}
+	fmt.Println()
+	fmt.Println("Default spec:")
+	fmt.Print(string(defaultSpec))
+	return nil
+}
+
+func profilesValidateF(command *cobra.Command, args []string) error {
+	files := args
+	if len(files) == 0 {
+		var err error
+		if files, err = profileFiles(command); err != nil {
+			return err
+		}
+		if len(files) == 0 {
+			fmt.Println("No profile files to validate")
+			return nil
+		}
+	}
+
+	invalid := 0
+	for _, file := range files {
+		profile, err := deployment.LoadAstarteClusterProfile(file)
+		if err == nil {
+			fmt.Printf("%s: profile %s is valid\n", file, profile.Name)
+			continue
+		}
+		invalid++
+		fmt.Printf("%s: invalid\n", file)
+		if validationErr, ok := err.(*deployment.ProfileValidationError); ok {
+			for _, problem := range validationErr.Problems {
+				fmt.Printf("  - %s\n", problem)
+			}
+		} else {
+			fmt.Printf("  - %s\n", err)
+		}
+	}
+	if invalid > 0 {
+		os.Exit(1)
+	}
+	return nil
+}
+
+func astarteVersionsRange(compatibility deployment.AstarteProfileCompatibility) string {
+	switch {
+	case compatibility.MinAstarteVersion != nil && compatibility.MaxAstarteVersion != nil:
+		return fmt.Sprintf("%s - %s", compatibility.MinAstarteVersion, compatibility.MaxAstarteVersion)
+	case compatibility.MinAstarteVersion != nil:
+		return fmt.Sprintf(">= %s", compatibility.MinAstarteVersion)
+	case compatibility.MaxAstarteVersion != nil:
+		return fmt.Sprintf("<= %s", compatibility.MaxAstarteVersion)
+	}
+	return "any"
+}
+
+func nodesRange(requirements deployment.AstarteProfileRequirements) string {
+	switch {
+	case requirements.MinNodes > 0 && requirements.MinNodes == requirements.MaxNodes:
+		return fmt.Sprintf("%d", requirements.MinNodes)
+	case requirements.MinNodes > 0 && requirements.MaxNodes > 0:
+		return fmt.Sprintf("%d - %d", requirements.MinNodes, requirements.MaxNodes)
+	case requirements.MinNodes > 0:
+		return fmt.Sprintf(">= %d", requirements.MinNodes)
+	case requirements.MaxNodes > 0:
+		return fmt.Sprintf("<= %d", requirements.MaxNodes)
+	}
+	return "any"
+}
+
+func memoryQuantity(bytes int64) string {
+	return resource.NewQuantity(bytes, resource.BinarySI).String()
+}
+
+// sortedProfileNames returns the names of profiles, sorted
+func sortedProfileNames(profiles map[string]deployment.AstarteClusterProfile) []string {
+	names := []string{}
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,344 @@
+// Copyright © 2019 Ispirata Srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/astarte-platform/astartectl/utils"
+	"github.com/spf13/cobra"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	apiextensionsv1beta1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1beta1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/yaml"
+)
+
+var rollbackOperatorCmd = &cobra.Command{
+	Use:   "rollback-operator",
+	Short: "Roll Astarte Operator back to the version it was upgraded from",
+	Long: `Roll Astarte Operator back to the version it ran before the last astartectl cluster upgrade-operator, for
+example when the upgrade failed halfway. This will adhere to the same current-context kubectl mentions.
+
+Before upgrading, upgrade-operator records the Service Account, Cluster Role, Cluster Role Binding, Custom
+Resource Definitions and Deployment of Astarte Operator in the astarte-operator-rollback ConfigMap in
+kube-system. This command restores them as they were recorded, and then deletes the record. Objects which did
+not exist before the upgrade are left in place.
+
+The objects which would be created or updated are printed together with the fields which would change in the
+cluster before asking for confirmation. With --plan, nothing is applied.`,
+	Example: `  astartectl cluster rollback-operator --plan
+  astartectl cluster rollback-operator -y`,
+	Args: cobra.NoArgs,
+	RunE: clusterRollbackOperatorF,
+}
+
+const (
+	operatorRollbackConfigMap = "astarte-operator-rollback"
+	// operatorRollbackObjectsKey lists the keys of the recorded objects, in the order they are restored
+	operatorRollbackObjectsKey = "objects"
+)
+
+// operatorRollback is the state of Astarte Operator recorded before an upgrade
+type operatorRollback struct {
+	Version       string
+	TargetVersion string
+	RecordedAt    time.Time
+	Completed     bool
+	Objects       []runtime.Object
+}
+
+func init() {
+	rollbackOperatorCmd.PersistentFlags().BoolP("non-interactive", "y", false, "Non-interactive mode. Will answer yes by default to all questions.")
+	rollbackOperatorCmd.PersistentFlags().Bool("plan", false, "Show the objects which would be created or updated, without applying anything")
+
+	ClusterCmd.AddCommand(rollbackOperatorCmd)
+}
+
+func clusterRollbackOperatorF(command *cobra.Command, args []string) error {
+	nonInteractive, err := command.Flags().GetBool("non-interactive")
+	if err != nil {
+		return err
+	}
+	plan, err := command.Flags().GetBool("plan")
+	if err != nil {
+		return err
+	}
+
+	rollback, err := loadOperatorRollback()
+	if errors.IsNotFound(err) {
+		fmt.Println("No Astarte Operator upgrade has been recorded in this cluster, there is nothing to roll back.")
+		os.Exit(1)
+	} else if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	steps, err := planOperatorApply(rollback.Objects)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if rollback.Completed {
+		fmt.Printf("Astarte Operator was upgraded from version %s to %s on %s.\n", rollback.Version, rollback.TargetVersion,
+			rollback.RecordedAt.Format(time.RFC3339))
+	} else {
+		fmt.Printf("Astarte Operator was being upgraded from version %s to %s on %s, and the upgrade did not complete.\n",
+			rollback.Version, rollback.TargetVersion, rollback.RecordedAt.Format(time.RFC3339))
+	}
+	fmt.Printf("Rolling back to version %s would apply the following changes:\n", rollback.Version)
+	printOperatorPlan(os.Stdout, steps)
+	if plan {
+		return nil
+	}
+
+	fmt.Println()
+	fmt.Printf("Will roll back Astarte Operator to version %s.\n", rollback.Version)
+	if !nonInteractive {
+		confirmation, err := utils.AskForConfirmation("Do you want to continue?")
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		if !confirmation {
+			return nil
+		}
+	}
+
+	for _, object := range rollback.Objects {
+		if err := restoreOperatorObject(object); err != nil {
+			fmt.Println("Error while restoring Astarte Operator. Your rollback might be incomplete, run this command again to resume it.")
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+	err = kubernetesClient.CoreV1().ConfigMaps("kube-system").Delete(operatorRollbackConfigMap, &metav1.DeleteOptions{})
+	if err != nil {
+		fmt.Println("WARNING: Could not delete the record of the upgrade.")
+		fmt.Println(err)
+	}
+
+	fmt.Printf("Astarte Operator rolled back to version %s. Waiting until it is ready...\n", rollback.Version)
+	ready, err := waitForAstarteOperatorReady()
+	if err != nil {
+		fmt.Println("Could not watch the Deployment state. However, the rollback might be complete. Check with astartectl cluster show in a while.")
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if !ready {
+		fmt.Println("Could not verify if Astarte Operator Deployment was successful. Please check the state of your cluster with astartectl cluster show.")
+		os.Exit(1)
+	}
+	fmt.Println("Astarte Operator deployment ready! Check the state of your cluster with astartectl cluster show.")
+	return nil
+}
+
+// recordOperatorRollback records the objects of the installed Astarte Operator, which runs version, before it is
+// upgraded to targetVersion. The record of a previous upgrade is replaced only once that upgrade has completed:
+// while the operator still runs the version it was upgraded from, the upgrade is being retried and the record,
+// which is returned, is kept. If the operator runs the target version of an incomplete upgrade, the record is
+// replaced only with force.
+func recordOperatorRollback(version string, targetVersion string, force bool) (*operatorRollback, error) {
+	configMaps := kubernetesClient.CoreV1().ConfigMaps("kube-system")
+	existing, err := configMaps.Get(operatorRollbackConfigMap, metav1.GetOptions{})
+	exists := err == nil
+	if err != nil && !errors.IsNotFound(err) {
+		return nil, err
+	}
+	if exists && existing.Annotations["astarte-platform.org/upgrade-completed"] != "true" && !force {
+		previousTargetVersion := existing.Annotations["astarte-platform.org/operator-target-version"]
+		if previousTargetVersion == version {
+			return nil, fmt.Errorf("The upgrade of Astarte Operator to version %s did not complete. Roll it back with astartectl "+
+				"cluster rollback-operator, or use --force to replace its record", previousTargetVersion)
+		}
+		// The annotations of a record might have been removed by hand
+		if existing.Annotations == nil {
+			existing.Annotations = map[string]string{}
+		}
+		existing.Annotations["astarte-platform.org/operator-target-version"] = targetVersion
+		if _, err := configMaps.Update(existing); err != nil {
+			return nil, err
+		}
+		return loadOperatorRollback()
+	}
+
+	configMap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      operatorRollbackConfigMap,
+			Namespace: "kube-system",
+			Annotations: map[string]string{
+				"astarte-platform.org/operator-version":        version,
+				"astarte-platform.org/operator-target-version": targetVersion,
+				"astarte-platform.org/recorded-at":             time.Now().UTC().Format(time.RFC3339),
+			},
+		},
+		Data: map[string]string{},
+	}
+
+	// Restore objects in the opposite order they are uninstalled in
+	keys := []string{}
+	for i := len(operatorInstalledObjects) - 1; i >= 0; i-- {
+		step, live, err := newOperatorPlanStep(operatorInstalledObjects[i])
+		if err != nil {
+			return nil, err
+		}
+		if live == nil {
+			continue
+		}
+		content, err := operatorObjectManifest(live)
+		if err != nil {
+			return nil, fmt.Errorf("Could not record %s %s: %s", step.Kind, step.Name, err)
+		}
+		key := fmt.Sprintf("%s.%s.yaml", strings.ToLower(step.Kind), step.Name)
+		configMap.Data[key] = string(content)
+		keys = append(keys, key)
+	}
+	configMap.Data[operatorRollbackObjectsKey] = strings.Join(keys, "\n")
+
+	if exists {
+		_, err = configMaps.Update(configMap)
+	} else {
+		_, err = configMaps.Create(configMap)
+	}
+	return nil, err
+}
+
+// completeOperatorRollback marks the recorded upgrade as completed, so that the next upgrade replaces its record
+func completeOperatorRollback() error {
+	configMaps := kubernetesClient.CoreV1().ConfigMaps("kube-system")
+	configMap, err := configMaps.Get(operatorRollbackConfigMap, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if configMap.Annotations == nil {
+		configMap.Annotations = map[string]string{}
+	}
+	configMap.Annotations["astarte-platform.org/upgrade-completed"] = "true"
+	_, err = configMaps.Update(configMap)
+	return err
+}
+
+// loadOperatorRollback loads the objects recorded by recordOperatorRollback
+func loadOperatorRollback() (*operatorRollback, error) {
+	configMap, err := kubernetesClient.CoreV1().ConfigMaps("kube-system").Get(operatorRollbackConfigMap, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	rollback := &operatorRollback{
+		Version:       configMap.Annotations["astarte-platform.org/operator-version"],
+		TargetVersion: configMap.Annotations["astarte-platform.org/operator-target-version"],
+		Completed:     configMap.Annotations["astarte-platform.org/upgrade-completed"] == "true",
+	}
+	rollback.RecordedAt, _ = time.Parse(time.RFC3339, configMap.Annotations["astarte-platform.org/recorded-at"])
+	for _, key := range strings.Fields(configMap.Data[operatorRollbackObjectsKey]) {
+		object, err := decodeManifest(configMap.Data[key])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid record of %s in %s: %s", key, operatorRollbackConfigMap, err)
+		}
+		rollback.Objects = append(rollback.Objects, object)
+	}
+	if len(rollback.Objects) == 0 {
+		return nil, fmt.Errorf("%s holds no objects to restore", operatorRollbackConfigMap)
+	}
+	return rollback, nil
+}
+
+// operatorObjectManifest returns a live object of Astarte Operator as a manifest which can be applied again
+func operatorObjectManifest(live runtime.Object) ([]byte, error) {
+	object, err := objectToMap(live)
+	if err != nil {
+		return nil, err
+	}
+	// Objects returned by typed clients have no type metadata
+	switch live.(type) {
+	case *corev1.ServiceAccount:
+		object["apiVersion"], object["kind"] = "v1", "ServiceAccount"
+	case *rbacv1.ClusterRole:
+		object["apiVersion"], object["kind"] = "rbac.authorization.k8s.io/v1", "ClusterRole"
+	case *rbacv1.ClusterRoleBinding:
+		object["apiVersion"], object["kind"] = "rbac.authorization.k8s.io/v1", "ClusterRoleBinding"
+	case *apiextensionsv1beta1.CustomResourceDefinition:
+		object["apiVersion"], object["kind"] = "apiextensions.k8s.io/v1beta1", "CustomResourceDefinition"
+	case *appsv1.Deployment:
+		object["apiVersion"], object["kind"] = "apps/v1", "Deployment"
+	default:
+		return nil, fmt.Errorf("Unexpected object %T", live)
+	}
+	return yaml.Marshal(object)
+}
+
+// restoreOperatorObject creates object, or replaces the live one with it
+func restoreOperatorObject(object runtime.Object) error {
+	_, live, err := newOperatorPlanStep(object)
+	if err != nil {
+		return err
+	}
+	if live != nil {
+		// Replacing an object requires its current resourceVersion
+		liveMeta, err := meta.Accessor(live)
+		if err != nil {
+			return err
+		}
+		objectMeta, err := meta.Accessor(object)
+		if err != nil {
+			return err
+		}
+		objectMeta.SetResourceVersion(liveMeta.GetResourceVersion())
+	}
+
+	switch o := object.(type) {
+	case *corev1.ServiceAccount:
+		if live == nil {
+			_, err = kubernetesClient.CoreV1().ServiceAccounts(o.Namespace).Create(o)
+		} else {
+			_, err = kubernetesClient.CoreV1().ServiceAccounts(o.Namespace).Update(o)
+		}
+	case *rbacv1.ClusterRole:
+		if live == nil {
+			_, err = kubernetesClient.RbacV1().ClusterRoles().Create(o)
+		} else {
+			_, err = kubernetesClient.RbacV1().ClusterRoles().Update(o)
+		}
+	case *rbacv1.ClusterRoleBinding:
+		if live == nil {
+			_, err = kubernetesClient.RbacV1().ClusterRoleBindings().Create(o)
+		} else {
+			_, err = kubernetesClient.RbacV1().ClusterRoleBindings().Update(o)
+		}
+	case *apiextensionsv1beta1.CustomResourceDefinition:
+		crds := kubernetesAPIExtensionsClient.ApiextensionsV1beta1().CustomResourceDefinitions()
+		if live == nil {
+			_, err = crds.Create(o)
+		} else {
+			_, err = crds.Update(o)
+		}
+	case *appsv1.Deployment:
+		if live == nil {
+			_, err = kubernetesClient.AppsV1().Deployments(o.Namespace).Create(o)
+		} else {
+			_, err = kubernetesClient.AppsV1().Deployments(o.Namespace).Update(o)
+		}
+	default:
+		err = fmt.Errorf("Unexpected object %T", object)
+	}
+	return err
+}
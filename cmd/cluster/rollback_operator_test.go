@@ -0,0 +1,143 @@
+package cluster
+
+import (
+	"reflect"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestOperatorRollback(t *testing.T) {
+	// Astarte Operator 0.10.1 was installed before the Voyager Ingress CRD existed
+	objects := []runtime.Object{}
+	for _, manifest := range operatorManifestFiles {
+		if manifest == "deploy/crds/api_v1alpha1_astarte_voyager_ingress_crd.yaml" {
+			continue
+		}
+		object, err := decodeManifest(testPlanManifests[manifest])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if deployment, ok := object.(*appsv1.Deployment); ok {
+			deployment.Spec.Template.Spec.Containers[0].Image = "astarte/astarte-kubernetes-operator:0.10.1"
+		}
+		objects = append(objects, object)
+	}
+	defer setupTestPlan(objects...)()
+
+	if previous, err := recordOperatorRollback("0.10.1", "0.10.2", false); err != nil || previous != nil {
+		t.Fatalf("Unexpected previous rollback %+v, %v", previous, err)
+	}
+
+	// Retrying an upgrade which failed before updating the Deployment keeps the record
+	previous, err := recordOperatorRollback("0.10.1", "0.10.3", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if previous == nil || previous.Version != "0.10.1" || previous.TargetVersion != "0.10.3" || previous.Completed {
+		t.Errorf("Unexpected previous rollback %+v", previous)
+	}
+	if _, err := recordOperatorRollback("0.10.1", "0.10.2", false); err != nil {
+		t.Fatal(err)
+	}
+
+	// The upgrade fails halfway, after updating the Deployment
+	deployment, err := getAstarteOperator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	deployment.Spec.Template.Spec.Containers[0].Image = "astarte/astarte-kubernetes-operator:0.10.2"
+	if _, err := kubernetesClient.AppsV1().Deployments("kube-system").Update(deployment); err != nil {
+		t.Fatal(err)
+	}
+
+	// Upgrading again from the target version of the incomplete upgrade requires force
+	if _, err := recordOperatorRollback("0.10.2", "0.11.0", false); err == nil {
+		t.Error("The record of an incomplete upgrade was replaced")
+	}
+
+	rollback, err := loadOperatorRollback()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rollback.Version != "0.10.1" || rollback.TargetVersion != "0.10.2" || rollback.RecordedAt.IsZero() || rollback.Completed {
+		t.Errorf("Unexpected rollback %+v", rollback)
+	}
+	steps, err := planOperatorApply(rollback.Objects)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"unchanged CustomResourceDefinition", "unchanged ServiceAccount", "unchanged ClusterRole",
+		"unchanged ClusterRoleBinding", "update Deployment"}
+	if actions := testPlanActions(steps); !reflect.DeepEqual(actions, expected) {
+		t.Errorf("Expected %v, got %v", expected, actions)
+	}
+	changes := []string{`  ~ spec.template.spec.containers[0].image: "astarte/astarte-kubernetes-operator:0.10.2" -> "astarte/astarte-kubernetes-operator:0.10.1"`}
+	if !reflect.DeepEqual(steps[4].Changes, changes) {
+		t.Errorf("Expected %v, got %v", changes, steps[4].Changes)
+	}
+
+	for _, object := range rollback.Objects {
+		if err := restoreOperatorObject(object); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deployment, err = getAstarteOperator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if image := deployment.Spec.Template.Spec.Containers[0].Image; image != "astarte/astarte-kubernetes-operator:0.10.1" {
+		t.Errorf("Unexpected image %s after the rollback", image)
+	}
+
+	// The record of a completed upgrade is replaced
+	if err := completeOperatorRollback(); err != nil {
+		t.Fatal(err)
+	}
+	if previous, err := recordOperatorRollback("0.10.1", "0.11.0", false); err != nil || previous != nil {
+		t.Errorf("Unexpected previous rollback %+v, %v", previous, err)
+	}
+	if rollback, err := loadOperatorRollback(); err != nil || rollback.TargetVersion != "0.11.0" || rollback.Completed {
+		t.Errorf("Unexpected rollback %+v, %v", rollback, err)
+	}
+
+	// So is the one of an incomplete upgrade, with force
+	if previous, err := recordOperatorRollback("0.11.0", "0.12.0", true); err != nil || previous != nil {
+		t.Errorf("Unexpected previous rollback %+v, %v", previous, err)
+	}
+	if rollback, err := loadOperatorRollback(); err != nil || rollback.Version != "0.11.0" || rollback.TargetVersion != "0.12.0" {
+		t.Errorf("Unexpected rollback %+v, %v", rollback, err)
+	}
+
+	// Records whose annotations were removed by hand are still updated
+	configMaps := kubernetesClient.CoreV1().ConfigMaps("kube-system")
+	stripAnnotations := func() {
+		configMap, err := configMaps.Get(operatorRollbackConfigMap, metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		configMap.Annotations = nil
+		if _, err := configMaps.Update(configMap); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stripAnnotations()
+	if previous, err := recordOperatorRollback("0.11.0", "0.12.0", false); err != nil || previous == nil {
+		t.Errorf("Unexpected previous rollback %+v, %v", previous, err)
+	}
+	stripAnnotations()
+	if err := completeOperatorRollback(); err != nil {
+		t.Fatal(err)
+	}
+	if rollback, err := loadOperatorRollback(); err != nil || !rollback.Completed {
+		t.Errorf("Unexpected rollback %+v, %v", rollback, err)
+	}
+
+	configMaps.Delete(operatorRollbackConfigMap, &metav1.DeleteOptions{})
+	if _, err := loadOperatorRollback(); !errors.IsNotFound(err) {
+		t.Errorf("Expected a not found error, got %v", err)
+	}
+}
@@ -19,7 +19,7 @@ import (
 	"os"
 	"strings"
 
-	"github.com/jedib0t/go-pretty/table"
+	"github.com/astarte-platform/astartectl/cmd/output"
 	"github.com/spf13/cobra"
 )
 
@@ -32,10 +32,17 @@ var showCmd = &cobra.Command{
 }
 
 func init() {
+	output.AddFlag(showCmd)
+
 	ClusterCmd.AddCommand(showCmd)
 }
 
 func clusterShowF(command *cobra.Command, args []string) error {
+	outputFormat, err := output.FormatFromFlags(command)
+	if err != nil {
+		return err
+	}
+
 	operator, err := getAstarteOperator()
 	if err != nil {
 		fmt.Println("Could not find an Astarte Operator Deployment on this Kubernetes Cluster.")
@@ -43,35 +50,48 @@ func clusterShowF(command *cobra.Command, args []string) error {
 		fmt.Println("To install Astarte Operator in this cluster, please run astartectl cluster install-operator.")
 		os.Exit(0)
 	}
-
-	fmt.Printf("This Cluster is running Astarte Operator version %s.\n\n",
-		strings.Split(operator.Spec.Template.Spec.Containers[0].Image, ":")[1])
+	operatorVersion := strings.Split(operator.Spec.Template.Spec.Containers[0].Image, ":")[1]
 
 	astartes, err := listAstartes()
-	if err != nil || len(astartes) == 0 {
-		fmt.Println("No Managed Astarte installations found. Maybe you want to deploy one with astartectl cluster instance deploy?")
-		return nil
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not list Managed Astarte installations: %s\n", err)
+		os.Exit(1)
+	}
+	if outputFormat.IsHumanReadable() {
+		fmt.Printf("This Cluster is running Astarte Operator version %s.\n\n", operatorVersion)
+		if len(astartes) == 0 {
+			fmt.Println("No Managed Astarte installations found. Maybe you want to deploy one with astartectl cluster instance deploy?")
+			return nil
+		}
+		fmt.Println("Managed Astarte Instances:")
 	}
 
-	fmt.Println("Managed Astarte Instances:")
-	t := table.NewWriter()
-	t.SetOutputMirror(os.Stdout)
-	t.SetStyle(table.StyleLight)
-	t.AppendHeader(table.Row{"Name", "Namespace", "Version", "Deployment Profile", "Operator Status", "Last Transition"})
-
+	t := output.NewTable("Name", "Namespace", "Version", "Deployment Profile", "Operator Status", "Health", "Last Transition")
+	instances := []map[string]interface{}{}
 	for _, v := range astartes {
 		for _, res := range v.Items {
 			operatorStatus, lastTransition, _, deploymentProfile := getManagedAstarteResourceStatus(res)
+			name := res.Object["metadata"].(map[string]interface{})["name"]
+			namespace := res.Object["metadata"].(map[string]interface{})["namespace"]
+			version := res.Object["spec"].(map[string]interface{})["version"]
+			health := getAstarteResourceHealth(res)
 
-			t.AppendRow(table.Row{res.Object["metadata"].(map[string]interface{})["name"],
-				res.Object["metadata"].(map[string]interface{})["namespace"],
-				res.Object["spec"].(map[string]interface{})["version"],
-				deploymentProfile, operatorStatus, lastTransition,
+			t.AppendRow(name, namespace, version, deploymentProfile, operatorStatus, health, lastTransition)
+			instances = append(instances, map[string]interface{}{
+				"name":              name,
+				"namespace":         namespace,
+				"version":           version,
+				"deploymentProfile": deploymentProfile,
+				"operatorStatus":    operatorStatus,
+				"health":            health,
+				"lastTransition":    lastTransition,
 			})
 		}
 	}
 
-	t.Render()
-
-	return nil
+	clusterStatus := map[string]interface{}{
+		"operatorVersion": operatorVersion,
+		"instances":       instances,
+	}
+	return output.Print(os.Stdout, outputFormat, clusterStatus, t)
 }
@@ -27,13 +27,17 @@ var uninstallCmd = &cobra.Command{
 	Use:   "uninstall-operator",
 	Short: "Uninstall Astarte Operator from the current Kubernetes Cluster",
 	Long: `Uninstall Astarte Operator from the current Kubernetes Cluster. This will adhere to the same current-context
-kubectl mentions. This command will refuse to run unless no Astarte instances are managed by this Cluster.`,
-	Example: `  astartectl cluster uninstall-operator`,
-	RunE:    clusterUninstallF,
+kubectl mentions. This command will refuse to run unless no Astarte instances are managed by this Cluster.
+
+With --plan, the objects which would be deleted are printed, and nothing is deleted.`,
+	Example: `  astartectl cluster uninstall-operator
+  astartectl cluster uninstall-operator --plan`,
+	RunE: clusterUninstallF,
 }
 
 func init() {
 	uninstallCmd.PersistentFlags().BoolP("non-interactive", "y", false, "Non-interactive mode. Will answer yes by default to all questions.")
+	uninstallCmd.PersistentFlags().Bool("plan", false, "Show the objects which would be deleted, without deleting anything")
 
 	ClusterCmd.AddCommand(uninstallCmd)
 }
@@ -56,6 +60,21 @@ func clusterUninstallF(command *cobra.Command, args []string) error {
 		return err
 	}
 
+	plan, err := command.Flags().GetBool("plan")
+	if err != nil {
+		return err
+	}
+	if plan {
+		steps, err := planOperatorUninstall()
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Println("Uninstalling Astarte Operator would apply the following changes:")
+		printOperatorPlan(os.Stdout, steps)
+		return nil
+	}
+
 	fmt.Println("Will uninstall Astarte Operator from the Cluster.")
 	if !nonInteractive {
 		confirmation, err := utils.AskForConfirmation("Do you want to continue?")
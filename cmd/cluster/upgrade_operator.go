@@ -15,6 +15,7 @@
 package cluster
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
 	"strings"
@@ -27,6 +28,7 @@ import (
 	rbacv1 "k8s.io/api/rbac/v1"
 	apiextensionsv1beta1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1beta1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/jsonmergepatch"
 	"k8s.io/apimachinery/pkg/util/mergepatch"
@@ -36,14 +38,32 @@ var upgradeOperatorCmd = &cobra.Command{
 	Use:   "upgrade-operator",
 	Short: "Upgrade Astarte Operator in the current Kubernetes Cluster",
 	Long: `Upgrade Astarte Operator in the current Kubernetes Cluster. This will adhere to the same current-context
-kubectl mentions. If no versions are specified, the last stable version is used as the upgrade target..`,
-	Example: `  astartectl cluster upgrade-operator`,
-	RunE:    clusterUpgradeOperatorF,
+kubectl mentions. If no versions are specified, the last stable version is used as the upgrade target.
+
+Manifests are downloaded from GitHub, unless --manifests-dir or --from-bundle are given: on air-gapped clusters,
+create a bundle with astartectl cluster operator bundle and use --image-registry to pull images from a mirror.
+
+With --plan, the objects which would be created or updated are printed together with the fields which would
+be added (+), changed (~) or removed (-) in the cluster, and nothing is applied. Fields defaulted by the API
+server are not reported as removed.
+
+Before upgrading, the installed objects are recorded in the astarte-operator-rollback ConfigMap in kube-system:
+should the upgrade fail or misbehave, astartectl cluster rollback-operator restores them. The record of an
+upgrade which did not complete is kept when the upgrade is retried, so that a rollback restores the version it
+started from. Should Astarte Operator already run the target version of that upgrade, upgrading again requires
+--force, which replaces the record.`,
+	Example: `  astartectl cluster upgrade-operator
+  astartectl cluster upgrade-operator --version 0.10.2 --plan
+  astartectl cluster upgrade-operator --from-bundle astarte-operator-0.10.2.tar.gz --image-registry registry.local:5000`,
+	RunE: clusterUpgradeOperatorF,
 }
 
 func init() {
 	upgradeOperatorCmd.PersistentFlags().String("version", "", "Version of Astarte Operator to upgrade to. If not specified, last stable version will be installed (recommended)")
 	upgradeOperatorCmd.PersistentFlags().BoolP("non-interactive", "y", false, "Non-interactive mode. Will answer yes by default to all questions.")
+	addOperatorManifestsFlags(upgradeOperatorCmd)
+	upgradeOperatorCmd.PersistentFlags().Bool("plan", false, "Show the objects which would be created or updated, without applying anything")
+	upgradeOperatorCmd.PersistentFlags().Bool("force", false, "Replace the rollback record of a previous upgrade which did not complete")
 
 	ClusterCmd.AddCommand(upgradeOperatorCmd)
 }
@@ -54,26 +74,27 @@ func clusterUpgradeOperatorF(command *cobra.Command, args []string) error {
 		fmt.Println("Astarte Operator is not installed in your cluster. You probably want to use astartectl cluster install-operator.")
 		os.Exit(1)
 	}
-	currentAstarteOperatorVersion, err := semver.NewVersion(strings.Split(currentAstarteOperator.Spec.Template.Spec.Containers[0].Image, ":")[1])
+	currentAstarteOperatorVersion, err := semver.NewVersion(imageTag(currentAstarteOperator.Spec.Template.Spec.Containers[0].Image))
 	if err != nil {
 		return err
 	}
 
-	version, err := command.Flags().GetString("version")
+	nonInteractive, err := command.Flags().GetBool("non-interactive")
 	if err != nil {
 		return err
 	}
-	nonInteractive, err := command.Flags().GetBool("non-interactive")
+	plan, err := command.Flags().GetBool("plan")
 	if err != nil {
 		return err
 	}
-
-	if version == "" {
-		version, err = getLastOperatorRelease()
-		if err != nil {
-			fmt.Println(err)
-			os.Exit(1)
-		}
+	force, err := command.Flags().GetBool("force")
+	if err != nil {
+		return err
+	}
+	version, err := operatorVersionFromFlags(command)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
 	}
 	upgradeVersion, err := semver.NewVersion(version)
 	if err != nil {
@@ -99,6 +120,16 @@ func clusterUpgradeOperatorF(command *cobra.Command, args []string) error {
 		}
 		fmt.Printf("Your cluster is currently running on an unstable snapshot - which, by the way, is a bad idea. I'm happy to reconcile you to something more stable, and I'm assuming you're upgrading from %s.\n", currentAstarteOperatorVersion)
 	}
+	if plan {
+		steps, err := planOperatorUpgrade(version)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Printf("Upgrading Astarte Operator to version %s would apply the following changes:\n", version)
+		printOperatorPlan(os.Stdout, steps)
+		return nil
+	}
 	fmt.Printf("Will upgrade Astarte Operator to version %s.\n", version)
 
 	if !nonInteractive {
@@ -112,6 +143,18 @@ func clusterUpgradeOperatorF(command *cobra.Command, args []string) error {
 		}
 	}
 
+	// Record what is being replaced, so that a failed upgrade can be rolled back with astartectl cluster rollback-operator
+	previousRollback, err := recordOperatorRollback(imageTag(currentAstarteOperator.Spec.Template.Spec.Containers[0].Image), version, force)
+	if err != nil {
+		fmt.Println("Could not record the current Astarte Operator for rollback. Aborting.")
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if previousRollback != nil {
+		fmt.Printf("Resuming the incomplete upgrade from version %s: rolling back will still restore version %s.\n",
+			previousRollback.Version, previousRollback.Version)
+	}
+
 	// This section for now it's basically the same as we just need to upgrade all the resources. Moving forward, should the
 	// Operator change drammatically, we'll need proper cleanups+upgrades depending on the Operator version.
 
@@ -162,15 +205,13 @@ func clusterUpgradeOperatorF(command *cobra.Command, args []string) error {
 	// This is where it gets tricky. For all supported CRDs, we need to either update or install them. When we update,
 	// we need to ensure that the resourceVersion is increased compared to the existing resource.
 
-	err = upgradeCRD("deploy/crds/api_v1alpha1_astarte_crd.yaml", version, currentAstarteOperatorVersion.Original())
-	if err != nil {
-		err = upgradeCRD("deploy/crds/api_v1alpha1_astarte_voyager_ingress_crd.yaml", version, currentAstarteOperatorVersion.Original())
+	crds := []struct{ name, path string }{
+		{"Astarte CRD", "deploy/crds/api_v1alpha1_astarte_crd.yaml"},
+		{"AstarteVoyagerIngress CRD", "deploy/crds/api_v1alpha1_astarte_voyager_ingress_crd.yaml"},
 	}
-	if err != nil {
-		if strings.Contains(err.Error(), "already exists") {
-			fmt.Println("WARNING: AstarteVoyagerIngress CRD already exists in the cluster.")
-		} else {
-			fmt.Println("Error while deploying AstarteVoyagerIngress CRD. Your deployment might be incomplete.")
+	for _, crd := range crds {
+		if err := upgradeCRD(crd.path, version, currentAstarteOperatorVersion.Original()); err != nil {
+			fmt.Printf("Error while upgrading %s. Your deployment might be incomplete.\n", crd.name)
 			fmt.Println(err)
 			os.Exit(1)
 		}
@@ -181,7 +222,7 @@ func clusterUpgradeOperatorF(command *cobra.Command, args []string) error {
 
 	// Astarte Operator Deployment
 	astarteOperator := unmarshalYAML("deploy/operator.yaml", version)
-	astarteOperatorDeployment, err := kubernetesClient.AppsV1().Deployments("kube-system").Update(astarteOperator.(*appsv1.Deployment))
+	_, err = kubernetesClient.AppsV1().Deployments("kube-system").Update(astarteOperator.(*appsv1.Deployment))
 	if err != nil {
 		fmt.Println("Error while deploying Astarte Operator Deployment. Your deployment might be incomplete.")
 		fmt.Println(err)
@@ -190,28 +231,19 @@ func clusterUpgradeOperatorF(command *cobra.Command, args []string) error {
 
 	fmt.Println("Astarte Operator successfully upgraded. Waiting until it is ready...")
 
-	var timeoutSeconds int64 = 60
-	watcher, err := kubernetesClient.AppsV1().Deployments("kube-system").Watch(metav1.ListOptions{TimeoutSeconds: &timeoutSeconds})
+	ready, err := waitForAstarteOperatorReady()
 	if err != nil {
 		fmt.Println("Could not watch the Deployment state. However, deployment might be complete. Check with astartectl cluster show in a while.")
 		fmt.Println(err)
 		os.Exit(1)
 	}
-	ch := watcher.ResultChan()
-	for {
-		event := <-ch
-		deployment, ok := event.Object.(*appsv1.Deployment)
-		if !ok {
-			break
-		}
-		if deployment.Name != astarteOperatorDeployment.GetObjectMeta().GetName() {
-			continue
-		}
-
-		if deployment.Status.ReadyReplicas >= 1 {
-			fmt.Println("Astarte Operator deployment ready! Check the state of your cluster with astartectl cluster show. Note that you might need to upgrade some of your Astarte instances depending on your Operator version.")
-			return nil
+	if ready {
+		if err := completeOperatorRollback(); err != nil {
+			fmt.Println("WARNING: Could not mark the upgrade as completed in its record. The next upgrade will require --force.")
+			fmt.Println(err)
 		}
+		fmt.Println("Astarte Operator deployment ready! Check the state of your cluster with astartectl cluster show. Note that you might need to upgrade some of your Astarte instances depending on your Operator version.")
+		return nil
 	}
 
 	fmt.Println("Could not verify if Astarte Operator Deployment was successful. Please check the state of your cluster with astartectl cluster show.")
@@ -233,15 +265,35 @@ func upgradeCRD(path, version, originalVersion string) error {
 		}
 	} else {
 		// Move to a 3-way JSON Merge patch
-		originalCRD := unmarshalYAML(path, originalVersion)
-		crdJSON, err := runtimeObjectToJSON(crd)
+		crdJSON, err := manifestObjectToJSON(crd)
+		if err != nil {
+			return err
+		}
 		currentCRDJSON, err := runtimeObjectToJSON(currentCRD)
-		originalCRDJSON, err := runtimeObjectToJSON(originalCRD)
+		if err != nil {
+			return err
+		}
+		originalCRDJSON := crdJSON
+		originalCRD, err := decodeOperatorManifest(path, originalVersion)
+		switch err.(type) {
+		case nil:
+			if originalCRDJSON, err = manifestObjectToJSON(originalCRD); err != nil {
+				return err
+			}
+		case *operatorVersionUnavailableError:
+			// Local manifests hold only the target version: using it as the original one updates the fields it
+			// sets, without removing the ones set by the API server or by users
+		default:
+			return fmt.Errorf("Could not get %s of Astarte Operator %s: %s", path, originalVersion, err)
+		}
 
 		preconditions := []mergepatch.PreconditionFunc{mergepatch.RequireKeyUnchanged("apiVersion"),
 			mergepatch.RequireKeyUnchanged("kind"), mergepatch.RequireMetadataKeyUnchanged("name")}
 		patch, err := jsonmergepatch.CreateThreeWayJSONMergePatch(originalCRDJSON, crdJSON, currentCRDJSON,
 			preconditions...)
+		if err != nil {
+			return err
+		}
 
 		_, err = kubernetesAPIExtensionsClient.ApiextensionsV1beta1().CustomResourceDefinitions().Patch(
 			crd.(*apiextensionsv1beta1.CustomResourceDefinition).Name, types.MergePatchType, patch)
@@ -253,3 +305,13 @@ func upgradeCRD(path, version, originalVersion string) error {
 	// All good.
 	return nil
 }
+
+// manifestObjectToJSON returns the JSON of an object decoded from a manifest, without the fields set by the API
+// server which the manifest leaves empty, so that merge patches computed from it do not clear them
+func manifestObjectToJSON(object runtime.Object) ([]byte, error) {
+	content, err := objectToMap(object)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(content)
+}
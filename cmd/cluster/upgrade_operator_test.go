@@ -0,0 +1,77 @@
+package cluster
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	apiextensionsv1beta1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+)
+
+// unreachableOperatorManifests fails to provide any version but the one of its local manifests, as GitHub would
+// when it cannot be reached
+type unreachableOperatorManifests struct {
+	localOperatorManifests
+}
+
+func (m unreachableOperatorManifests) Content(path string, version string) (string, error) {
+	if version != m.metadata.Version {
+		return "", errors.New("GitHub cannot be reached")
+	}
+	return m.localOperatorManifests.Content(path, version)
+}
+
+func TestUpgradeCRD(t *testing.T) {
+	const crdManifest = "deploy/crds/api_v1alpha1_astarte_crd.yaml"
+	object, err := decodeManifest(testPlanManifests[crdManifest])
+	if err != nil {
+		t.Fatal(err)
+	}
+	liveCRD := object.(*apiextensionsv1beta1.CustomResourceDefinition)
+	manifestScope := liveCRD.Spec.Scope
+	// Fields set by users and by the API server, and a setting which differs from the manifest
+	liveCRD.Labels = map[string]string{"owner": "someone"}
+	liveCRD.Annotations = map[string]string{"example.com/reviewed": "true"}
+	liveCRD.UID = "6f1c1f0e-3b1a-4c55-9d53-0b8b1c1b7d2e"
+	liveCRD.Status.AcceptedNames = apiextensionsv1beta1.CustomResourceDefinitionNames{Plural: "astartes", Kind: "Astarte"}
+	liveCRD.Spec.Scope = apiextensionsv1beta1.ClusterScoped
+	defer setupTestPlan(liveCRD)()
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(liveCRD)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unstructuredCRD := &unstructured.Unstructured{Object: content}
+	unstructuredCRD.SetAPIVersion("apiextensions.k8s.io/v1beta1")
+	unstructuredCRD.SetKind("CustomResourceDefinition")
+	previousDynamicClient := kubernetesDynamicClient
+	defer func() { kubernetesDynamicClient = previousDynamicClient }()
+	kubernetesDynamicClient = dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), unstructuredCRD)
+
+	// Local manifests do not hold the version being upgraded from: the CRD is updated without removing other fields
+	if err := upgradeCRD(crdManifest, "0.10.2", "0.10.1"); err != nil {
+		t.Fatal(err)
+	}
+	patched, err := kubernetesAPIExtensionsClient.ApiextensionsV1beta1().CustomResourceDefinitions().Get(liveCRD.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if patched.Labels["owner"] != "someone" || patched.Annotations["example.com/reviewed"] != "true" {
+		t.Errorf("unexpected metadata %v", patched.ObjectMeta)
+	}
+	if patched.UID != liveCRD.UID || patched.Status.AcceptedNames.Kind != "Astarte" {
+		t.Errorf("server set fields were removed: %v, %v", patched.UID, patched.Status)
+	}
+	if patched.Spec.Scope != manifestScope {
+		t.Errorf("the CRD was not upgraded, scope is %s", patched.Spec.Scope)
+	}
+
+	// Failing to get the original manifest does not silently turn the three-way merge into a two-way one
+	operatorManifests = unreachableOperatorManifests{operatorManifests.(localOperatorManifests)}
+	if err := upgradeCRD(crdManifest, "0.10.2", "0.10.1"); err == nil || !strings.Contains(err.Error(), "GitHub cannot be reached") {
+		t.Errorf("expected the manifest error, got %v", err)
+	}
+}
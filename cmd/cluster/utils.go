@@ -30,7 +30,6 @@ import (
 	"github.com/google/go-github/v28/github"
 	appsv1 "k8s.io/api/apps/v1"
 	apiextensions "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/install"
-	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
@@ -44,22 +43,37 @@ func init() {
 }
 
 func unmarshalYAML(res string, version string) runtime.Object {
-	content, err := getOperatorContent(res, version)
+	obj, err := decodeOperatorManifest(res, version)
 	if err != nil {
 		fmt.Println("Error while parsing Kubernetes Resources. Your deployment might be incomplete.")
 		fmt.Println(err)
 		os.Exit(1)
 	}
 
-	decode := scheme.Codecs.UniversalDeserializer().Decode
-	obj, _, err := decode([]byte(content), nil, nil)
+	return obj
+}
+
+func decodeOperatorManifest(res string, version string) (runtime.Object, error) {
+	content, err := getOperatorContent(res, version)
 	if err != nil {
-		fmt.Println("Error while parsing Kubernetes Resources. Your deployment might be incomplete.")
-		fmt.Println(err)
-		os.Exit(1)
+		return nil, err
 	}
 
-	return obj
+	obj, err := decodeManifest(content)
+	if err != nil {
+		return nil, err
+	}
+	if deployment, ok := obj.(*appsv1.Deployment); ok && operatorImageRegistry != "" {
+		rewriteDeploymentImages(deployment, operatorImageRegistry)
+	}
+
+	return obj, nil
+}
+
+func decodeManifest(content string) (runtime.Object, error) {
+	decode := scheme.Codecs.UniversalDeserializer().Decode
+	obj, _, err := decode([]byte(content), nil, nil)
+	return obj, err
 }
 
 func runtimeObjectToJSON(object runtime.Object) ([]byte, error) {
@@ -103,6 +117,27 @@ func getAstarteOperator() (*appsv1.Deployment, error) {
 	return kubernetesClient.AppsV1().Deployments("kube-system").Get("astarte-operator", metav1.GetOptions{})
 }
 
+// waitForAstarteOperatorReady waits up to a minute for the Astarte Operator Deployment to have a ready replica,
+// and returns whether it has
+func waitForAstarteOperatorReady() (bool, error) {
+	var timeoutSeconds int64 = 60
+	watcher, err := kubernetesClient.AppsV1().Deployments("kube-system").Watch(metav1.ListOptions{TimeoutSeconds: &timeoutSeconds})
+	if err != nil {
+		return false, err
+	}
+	defer watcher.Stop()
+	for event := range watcher.ResultChan() {
+		deployment, ok := event.Object.(*appsv1.Deployment)
+		if !ok {
+			break
+		}
+		if deployment.Name == "astarte-operator" && deployment.Status.ReadyReplicas >= 1 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
 func getLastOperatorRelease() (string, error) {
 	return getLastReleaseForAstarteRepo("astarte-kubernetes-operator")
 }
@@ -137,7 +172,7 @@ func getLastReleaseForAstarteRepo(repo string) (string, error) {
 }
 
 func getOperatorContent(path string, tag string) (string, error) {
-	return getContentFromAstarteRepo("astarte-kubernetes-operator", path, tag)
+	return operatorManifests.Content(path, tag)
 }
 
 func getContentFromAstarteRepo(repo string, path string, tag string) (string, error) {
@@ -148,46 +183,22 @@ func getContentFromAstarteRepo(repo string, path string, tag string) (string, er
 		path, &github.RepositoryContentGetOptions{Ref: "v" + tag})
 
 	if err != nil {
-		return "", nil
+		return "", err
 	}
 
 	return content.GetContent()
 }
 
-func getClusterAllocatableResources() (int, int64, int64, error) {
-	// List Nodes
-	list, err := kubernetesClient.CoreV1().Nodes().List(metav1.ListOptions{})
-	if err != nil {
-		return 0, 0, 0, nil
-	}
-
-	var allocatableCPU int64 = 0
-	var allocatableMemory int64 = 0
-	for _, node := range list.Items {
-		nodeAllocatableCPU := node.Status.Allocatable.Cpu().ScaledValue(resource.Milli)
-		if nodeAllocatableCPU <= 0 {
-			return 0, 0, 0, fmt.Errorf("Could not retrieve allocatable CPU for node %s", node.GetName())
-		}
-		allocatableCPU += nodeAllocatableCPU
-		// Get Int64 directly, as the value is always returned in bytes.
-		nodeAllocatableMemory, ok := node.Status.Allocatable.Memory().AsInt64()
-		if !ok {
-			return 0, 0, 0, fmt.Errorf("Could not retrieve allocatable Memory for node %s", node.GetName())
-		}
-		allocatableMemory += nodeAllocatableMemory
-	}
-
-	return len(list.Items), allocatableCPU, allocatableMemory, nil
-}
-
 func getManagedAstarteResourceStatus(res unstructured.Unstructured) (string, time.Time, string, string) {
 	var operatorStatus string = "Initializing"
 	var lastTransition time.Time
 	var deploymentManager string = ""
 	var deploymentProfile string = ""
-	if status, ok := res.Object["status"]; ok {
-		operatorStatus = status.(map[string]interface{})["conditions"].([]interface{})[0].(map[string]interface{})["type"].(string)
-		lastTransition, _ = dateparse.ParseAny(status.(map[string]interface{})["conditions"].([]interface{})[0].(map[string]interface{})["lastTransitionTime"].(string))
+	if condition := lastAstarteResourceCondition(res); condition != nil {
+		operatorStatus, _ = condition["type"].(string)
+		if transitionTime, ok := condition["lastTransitionTime"].(string); ok {
+			lastTransition, _ = dateparse.ParseAny(transitionTime)
+		}
 	}
 	if annotations, ok := res.Object["metadata"].(map[string]interface{})["annotations"]; ok {
 		if dM, ok := annotations.(map[string]interface{})["astarte-platform.org/deployment-manager"]; ok {
@@ -201,6 +212,27 @@ func getManagedAstarteResourceStatus(res unstructured.Unstructured) (string, tim
 	return operatorStatus, lastTransition, deploymentManager, deploymentProfile
 }
 
+// getAstarteResourceHealth returns the health of res reported by newer Astarte Operators, or an empty string if
+// it is not reported
+func getAstarteResourceHealth(res unstructured.Unstructured) string {
+	health, _, _ := unstructured.NestedString(res.Object, "status", "health")
+	return health
+}
+
+// lastAstarteResourceCondition returns the most recent status condition of res, or nil if there is none
+func lastAstarteResourceCondition(res unstructured.Unstructured) map[string]interface{} {
+	status, ok := res.Object["status"].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	conditions, ok := status["conditions"].([]interface{})
+	if !ok || len(conditions) == 0 {
+		return nil
+	}
+	condition, _ := conditions[0].(map[string]interface{})
+	return condition
+}
+
 func isUnstableVersion(version string) bool {
 	return strings.HasSuffix(version, "-snapshot") || version == "snapshot"
 }
@@ -0,0 +1,259 @@
+// Copyright © 2019 Ispirata Srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/astarte-platform/astartectl/client"
+	homedir "github.com/mitchellh/go-homedir"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v2"
+)
+
+// ConfigCmd represents the config command
+var ConfigCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Manage astartectl configuration",
+	Long: `Manage astartectl configuration file and its contexts.
+
+A context is a named set of settings (URLs, realm, keys, token commands) for an Astarte instance. The current
+context is used by all commands, and can be overridden for a single invocation with --context.`,
+}
+
+// ServiceContext represents the settings of a single Astarte API in a Context
+type ServiceContext struct {
+	URL string `yaml:"url,omitempty"`
+}
+
+// HousekeepingContext represents the settings of the Housekeeping API in a Context
+type HousekeepingContext struct {
+	URL string `yaml:"url,omitempty"`
+	Key string `yaml:"key,omitempty"`
+}
+
+// RealmContext represents the settings of the Realm in a Context
+type RealmContext struct {
+	Name string `yaml:"name,omitempty"`
+	Key  string `yaml:"key,omitempty"`
+}
+
+// Context represents a named configuration for an Astarte instance. Its keys mirror the ones of the flat
+// configuration, which it overrides when it is in use.
+type Context struct {
+	URL             string              `yaml:"url,omitempty"`
+	Housekeeping    HousekeepingContext `yaml:"housekeeping,omitempty"`
+	RealmManagement ServiceContext      `yaml:"realm-management,omitempty"`
+	Pairing         ServiceContext      `yaml:"pairing,omitempty"`
+	AppEngine       ServiceContext      `yaml:"appengine,omitempty"`
+	Realm           RealmContext        `yaml:"realm,omitempty"`
+	Token           string              `yaml:"token,omitempty"`
+	TokenCommand    string              `yaml:"token-command,omitempty"`
+}
+
+// File represents the content of astartectl's configuration file. Keys which are not related to contexts
+// are preserved as they are.
+type File struct {
+	CurrentContext string
+	Contexts       map[string]Context
+
+	path string
+	raw  map[string]interface{}
+}
+
+func init() {
+	ConfigCmd.AddCommand(
+		getContextsCmd,
+		useContextCmd,
+		setContextCmd,
+		deleteContextCmd,
+		viewCmd,
+	)
+}
+
+// FilePath returns the path of the configuration file in use. If no configuration file has been found,
+// it returns the path of the default one.
+func FilePath() (string, error) {
+	if configFile := viper.ConfigFileUsed(); configFile != "" {
+		return configFile, nil
+	}
+
+	home, err := homedir.Dir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".astartectl.yaml"), nil
+}
+
+// LoadFile loads the configuration file in use. A missing file is not an error, and results in an empty File.
+func LoadFile() (*File, error) {
+	path, err := FilePath()
+	if err != nil {
+		return nil, err
+	}
+
+	f := &File{path: path, raw: map[string]interface{}{}, Contexts: map[string]Context{}}
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return f, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := yaml.Unmarshal(content, &f.raw); err != nil {
+		return nil, fmt.Errorf("Could not parse %s: %s", path, err)
+	}
+	if currentContext, ok := f.raw["current-context"].(string); ok {
+		f.CurrentContext = currentContext
+	}
+	if contexts, ok := f.raw["contexts"]; ok {
+		// Go through YAML to map the generic representation into Contexts
+		contextsYAML, err := yaml.Marshal(contexts)
+		if err != nil {
+			return nil, err
+		}
+		if err := yaml.Unmarshal(contextsYAML, &f.Contexts); err != nil {
+			return nil, fmt.Errorf("Could not parse contexts in %s: %s", path, err)
+		}
+	}
+
+	return f, nil
+}
+
+// Save writes the configuration back to its file.
+func (f *File) Save() error {
+	if f.CurrentContext != "" {
+		f.raw["current-context"] = f.CurrentContext
+	} else {
+		delete(f.raw, "current-context")
+	}
+	if len(f.Contexts) > 0 {
+		f.raw["contexts"] = f.Contexts
+	} else {
+		delete(f.raw, "contexts")
+	}
+
+	content, err := yaml.Marshal(f.raw)
+	if err != nil {
+		return err
+	}
+	// The configuration might hold tokens, keep it private. WriteFile does not change the mode of existing files.
+	if err := os.Chmod(f.path, 0600); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return ioutil.WriteFile(f.path, content, 0600)
+}
+
+// Path returns the path of the configuration file
+func (f *File) Path() string {
+	return f.path
+}
+
+// ApplyContext loads the context named contextName from the configuration file, and merges its settings into
+// the configuration, overriding the flat ones. Flat credentials are dropped, so that a token in the flat
+// configuration cannot take precedence over the keys or token command of the context. Flags and environment
+// variables still take precedence.
+func ApplyContext(contextName string) error {
+	f, err := LoadFile()
+	if err != nil {
+		return err
+	}
+	context, ok := f.Contexts[contextName]
+	if !ok {
+		return fmt.Errorf("Context %s does not exist in %s", contextName, f.path)
+	}
+
+	contextYAML, err := yaml.Marshal(context)
+	if err != nil {
+		return err
+	}
+	contextMap := map[string]interface{}{}
+	if err := yaml.Unmarshal(contextYAML, &contextMap); err != nil {
+		return err
+	}
+
+	credentials := map[string]interface{}{
+		"token":         context.Token,
+		"token-command": context.TokenCommand,
+		"housekeeping":  map[string]interface{}{"key": context.Housekeeping.Key},
+		"realm":         map[string]interface{}{"key": context.Realm.Key},
+	}
+	if err := viper.MergeConfigMap(credentials); err != nil {
+		return err
+	}
+	return viper.MergeConfigMap(contextMap)
+}
+
+// CurrentContextName returns the name of the context in use for this invocation, or an empty string if none is.
+func CurrentContextName() string {
+	if contextName := viper.GetString("context"); contextName != "" {
+		return contextName
+	}
+	return viper.GetString("current-context")
+}
+
+// GetExplicitToken returns the token set explicitly for this invocation, either directly or through a token
+// command. Returns an empty string if no token is configured, in which case tokens should be generated
+// from private keys.
+func GetExplicitToken() (string, error) {
+	if token := viper.GetString("token"); token != "" {
+		return token, nil
+	}
+
+	tokenCommand := viper.GetString("token-command")
+	if tokenCommand == "" {
+		return "", nil
+	}
+
+	var c *exec.Cmd
+	if runtime.GOOS == "windows" {
+		c = exec.Command("cmd", "/C", tokenCommand)
+	} else {
+		c = exec.Command("sh", "-c", tokenCommand)
+	}
+	var stderr bytes.Buffer
+	c.Stderr = &stderr
+	out, err := c.Output()
+	if err != nil {
+		return "", fmt.Errorf("Token command failed: %s %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	token := strings.TrimSpace(string(out))
+	if token == "" {
+		return "", errors.New("Token command returned an empty token")
+	}
+	return token, nil
+}
+
+// HTTPClient returns the http.Client Astarte API clients should use. When --verbosity or --print-curl are set,
+// it traces calls on stderr. Otherwise it returns nil, so that clients use their default one.
+func HTTPClient() *http.Client {
+	verbosity := viper.GetInt("verbosity")
+	printCurl := viper.GetBool("print-curl")
+	if verbosity <= 0 && !printCurl {
+		return nil
+	}
+	return client.NewTracingHTTPClient(os.Stderr, verbosity, printCurl)
+}
@@ -0,0 +1,187 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+// setupConfigFile points viper to a configuration file in a temporary directory holding content, and returns
+// its path together with a function restoring the previous configuration
+func setupConfigFile(t *testing.T, content string) (string, func()) {
+	dir, err := ioutil.TempDir("", "astartectl-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	configFile := filepath.Join(dir, "config.yaml")
+	if content != "" {
+		if err := ioutil.WriteFile(configFile, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	viper.Reset()
+	viper.SetConfigFile(configFile)
+	return configFile, func() {
+		viper.Reset()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestLoadFileAndSave(t *testing.T) {
+	configFile, teardown := setupConfigFile(t, "")
+	defer teardown()
+
+	// A missing file results in an empty configuration
+	f, err := LoadFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.CurrentContext != "" || len(f.Contexts) != 0 || f.Path() != configFile {
+		t.Errorf("Unexpected configuration %+v", f)
+	}
+
+	if err := ioutil.WriteFile(configFile, []byte("url: https://flat.example.com\nverbosity: 2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err = LoadFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	staging := Context{
+		URL:          "https://staging.example.com",
+		Housekeeping: HousekeepingContext{Key: "/keys/housekeeping.pem"},
+		AppEngine:    ServiceContext{URL: "https://appengine.staging.example.com"},
+		Realm:        RealmContext{Name: "test", Key: "/keys/test.pem"},
+		TokenCommand: "echo token",
+	}
+	f.Contexts["staging"] = staging
+	f.CurrentContext = "staging"
+	if err := f.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The configuration might hold tokens
+	if info, err := os.Stat(configFile); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("Unexpected configuration file: %v, %v", info, err)
+	}
+	f, err = LoadFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.CurrentContext != "staging" || !reflect.DeepEqual(f.Contexts, map[string]Context{"staging": staging}) {
+		t.Errorf("Unexpected configuration %+v", f)
+	}
+	if f.raw["url"] != "https://flat.example.com" || f.raw["verbosity"] != 2 {
+		t.Errorf("Flat settings were not preserved: %v", f.raw)
+	}
+
+	if err := ioutil.WriteFile(configFile, []byte("contexts: [not, a, map]\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadFile(); err == nil {
+		t.Error("Invalid contexts were accepted")
+	}
+}
+
+func TestApplyContext(t *testing.T) {
+	configContent := `url: https://flat.example.com
+token: flat-token
+housekeeping:
+  key: /keys/flat-housekeeping.pem
+realm:
+  name: flat
+  key: /keys/flat.pem
+contexts:
+  staging:
+    url: https://staging.example.com
+    realm:
+      key: /keys/staging.pem
+    token-command: echo staging-token
+`
+	_, teardown := setupConfigFile(t, configContent)
+	defer teardown()
+	if err := viper.ReadInConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ApplyContext("production"); err == nil {
+		t.Error("A missing context was applied")
+	}
+	if err := ApplyContext("staging"); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		"url":              "https://staging.example.com",
+		"token":            "",
+		"token-command":    "echo staging-token",
+		"housekeeping.key": "",
+		"realm.name":       "flat",
+		"realm.key":        "/keys/staging.pem",
+	}
+	for key, value := range expected {
+		if viper.GetString(key) != value {
+			t.Errorf("Expected %s to be %q, got %q", key, value, viper.GetString(key))
+		}
+	}
+	if token, err := GetExplicitToken(); err != nil || token != "staging-token" {
+		t.Errorf("Unexpected token %q, %v", token, err)
+	}
+}
+
+func TestContextCommands(t *testing.T) {
+	_, teardown := setupConfigFile(t, "")
+	defer teardown()
+
+	setContextCmd.Flags().Set("url", "https://staging.example.com")
+	setContextCmd.Flags().Set("realm-name", "test")
+	setContextCmd.Flags().Set("realm-key", "/keys/test.pem")
+	if err := setContextF(setContextCmd, []string{"staging"}); err != nil {
+		t.Fatal(err)
+	}
+	// Only the given settings are changed when updating a context
+	setContextCmd.Flags().Set("url", "https://production.example.com")
+	setContextCmd.Flags().Lookup("realm-name").Changed = false
+	setContextCmd.Flags().Lookup("realm-key").Changed = false
+	if err := setContextF(setContextCmd, []string{"production"}); err != nil {
+		t.Fatal(err)
+	}
+	setContextCmd.Flags().Set("realm-name", "other")
+	setContextCmd.Flags().Lookup("url").Changed = false
+	if err := setContextF(setContextCmd, []string{"staging"}); err != nil {
+		t.Fatal(err)
+	}
+	setContextCmd.Flags().Lookup("realm-name").Changed = false
+
+	f, err := LoadFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]Context{
+		"staging":    {URL: "https://staging.example.com", Realm: RealmContext{Name: "other", Key: "/keys/test.pem"}},
+		"production": {URL: "https://production.example.com"},
+	}
+	if !reflect.DeepEqual(f.Contexts, expected) {
+		t.Errorf("Expected contexts %+v, got %+v", expected, f.Contexts)
+	}
+	// The first context becomes the current one
+	if f.CurrentContext != "staging" {
+		t.Errorf("Unexpected current context %s", f.CurrentContext)
+	}
+
+	if err := useContextF(useContextCmd, []string{"production"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := deleteContextF(deleteContextCmd, []string{"production"}); err != nil {
+		t.Fatal(err)
+	}
+	if f, err = LoadFile(); err != nil {
+		t.Fatal(err)
+	}
+	if f.CurrentContext != "" || len(f.Contexts) != 1 {
+		t.Errorf("Unexpected configuration after deleting the current context %+v", f)
+	}
+}
@@ -0,0 +1,265 @@
+// Copyright © 2019 Ispirata Srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+
+	"github.com/astarte-platform/astartectl/cmd/output"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v2"
+)
+
+var getContextsCmd = &cobra.Command{
+	Use:     "get-contexts",
+	Short:   "List contexts",
+	Long:    `List all contexts in the configuration file. The current context is marked with an asterisk.`,
+	Example: `  astartectl config get-contexts`,
+	RunE:    getContextsF,
+}
+
+var useContextCmd = &cobra.Command{
+	Use:     "use-context <context_name>",
+	Short:   "Set the current context",
+	Long:    `Set the current context in the configuration file.`,
+	Example: `  astartectl config use-context production`,
+	Args:    cobra.ExactArgs(1),
+	RunE:    useContextF,
+}
+
+var setContextCmd = &cobra.Command{
+	Use:   "set-context <context_name>",
+	Short: "Create or update a context",
+	Long: `Create or update a context in the configuration file.
+
+When updating an existing context, only the settings passed as flags are changed.`,
+	Example: `  astartectl config set-context staging --url https://api.staging.example.com --realm-name test --realm-key test_private.pem`,
+	Args:    cobra.ExactArgs(1),
+	RunE:    setContextF,
+}
+
+var deleteContextCmd = &cobra.Command{
+	Use:     "delete-context <context_name>",
+	Short:   "Delete a context",
+	Long:    `Delete a context from the configuration file.`,
+	Example: `  astartectl config delete-context staging`,
+	Args:    cobra.ExactArgs(1),
+	RunE:    deleteContextF,
+}
+
+var viewCmd = &cobra.Command{
+	Use:     "view",
+	Short:   "Show the configuration file",
+	Long:    `Show the content of the configuration file. Use --minify to show only the settings of the context in use.`,
+	Example: `  astartectl config view`,
+	RunE:    viewF,
+}
+
+func init() {
+	setContextCmd.Flags().String("url", "", "Base URL for the Astarte instance")
+	setContextCmd.Flags().String("housekeeping-url", "", "Housekeeping API base URL, if different from <url>/housekeeping")
+	setContextCmd.Flags().String("realm-management-url", "", "Realm Management API base URL, if different from <url>/realmmanagement")
+	setContextCmd.Flags().String("pairing-url", "", "Pairing API base URL, if different from <url>/pairing")
+	setContextCmd.Flags().String("appengine-url", "", "AppEngine API base URL, if different from <url>/appengine")
+	setContextCmd.Flags().String("housekeeping-key", "", "Path to the housekeeping private key")
+	setContextCmd.MarkFlagFilename("housekeeping-key")
+	setContextCmd.Flags().String("realm-name", "", "Name of the realm")
+	setContextCmd.Flags().String("realm-key", "", "Path to the realm private key")
+	setContextCmd.MarkFlagFilename("realm-key")
+	setContextCmd.Flags().String("token-command", "", "A shell command printing a token on its standard output, used instead of private keys")
+	setContextCmd.Flags().Bool("use", false, "When set, the context becomes the current context")
+
+	output.AddFlag(getContextsCmd)
+
+	viewCmd.Flags().Bool("minify", false, "When set, show only the context in use")
+}
+
+func getContextsF(command *cobra.Command, args []string) error {
+	outputFormat, err := output.FormatFromFlags(command)
+	if err != nil {
+		return err
+	}
+	f, err := LoadFile()
+	if err != nil {
+		return err
+	}
+	if len(f.Contexts) == 0 && outputFormat.IsHumanReadable() {
+		fmt.Printf("No contexts defined in %s. You can create one with astartectl config set-context.\n", f.Path())
+		return nil
+	}
+
+	contextNames := []string{}
+	for name := range f.Contexts {
+		contextNames = append(contextNames, name)
+	}
+	sort.Strings(contextNames)
+
+	currentContext := CurrentContextName()
+	t := output.NewTable("Current", "Name", "URL", "Realm").AddWideColumns("Token Command")
+	contexts := []map[string]interface{}{}
+	for _, name := range contextNames {
+		context := f.Contexts[name]
+		current := ""
+		if name == currentContext {
+			current = "*"
+		}
+		t.AppendRow(current, name, context.URL, context.Realm.Name, context.TokenCommand)
+		contexts = append(contexts, map[string]interface{}{
+			"name":    name,
+			"current": name == currentContext,
+			"url":     context.URL,
+			"realm":   context.Realm.Name,
+		})
+	}
+
+	return output.Print(os.Stdout, outputFormat, contexts, t)
+}
+
+func useContextF(command *cobra.Command, args []string) error {
+	contextName := args[0]
+	f, err := LoadFile()
+	if err != nil {
+		return err
+	}
+	if _, ok := f.Contexts[contextName]; !ok {
+		fmt.Printf("Context %s does not exist in %s.\n", contextName, f.Path())
+		os.Exit(1)
+	}
+
+	f.CurrentContext = contextName
+	if err := f.Save(); err != nil {
+		return err
+	}
+
+	fmt.Printf("Switched to context %s.\n", contextName)
+	return nil
+}
+
+func setContextF(command *cobra.Command, args []string) error {
+	contextName := args[0]
+	f, err := LoadFile()
+	if err != nil {
+		return err
+	}
+
+	context, exists := f.Contexts[contextName]
+	stringSettings := map[string]*string{
+		"url":                  &context.URL,
+		"housekeeping-url":     &context.Housekeeping.URL,
+		"realm-management-url": &context.RealmManagement.URL,
+		"pairing-url":          &context.Pairing.URL,
+		"appengine-url":        &context.AppEngine.URL,
+		"housekeeping-key":     &context.Housekeeping.Key,
+		"realm-name":           &context.Realm.Name,
+		"realm-key":            &context.Realm.Key,
+		"token-command":        &context.TokenCommand,
+	}
+	for flagName, setting := range stringSettings {
+		if !command.Flags().Changed(flagName) {
+			continue
+		}
+		if *setting, err = command.Flags().GetString(flagName); err != nil {
+			return err
+		}
+	}
+	f.Contexts[contextName] = context
+
+	use, err := command.Flags().GetBool("use")
+	if err != nil {
+		return err
+	}
+	if use || f.CurrentContext == "" {
+		f.CurrentContext = contextName
+	}
+
+	if err := f.Save(); err != nil {
+		return err
+	}
+
+	if exists {
+		fmt.Printf("Context %s updated.\n", contextName)
+	} else {
+		fmt.Printf("Context %s created.\n", contextName)
+	}
+	return nil
+}
+
+func deleteContextF(command *cobra.Command, args []string) error {
+	contextName := args[0]
+	f, err := LoadFile()
+	if err != nil {
+		return err
+	}
+	if _, ok := f.Contexts[contextName]; !ok {
+		fmt.Printf("Context %s does not exist in %s.\n", contextName, f.Path())
+		os.Exit(1)
+	}
+
+	delete(f.Contexts, contextName)
+	if f.CurrentContext == contextName {
+		fmt.Printf("WARNING: %s was the current context, no context is in use anymore.\n", contextName)
+		f.CurrentContext = ""
+	}
+	if err := f.Save(); err != nil {
+		return err
+	}
+
+	fmt.Printf("Context %s deleted.\n", contextName)
+	return nil
+}
+
+func viewF(command *cobra.Command, args []string) error {
+	minify, err := command.Flags().GetBool("minify")
+	if err != nil {
+		return err
+	}
+
+	if !minify {
+		path, err := FilePath()
+		if err != nil {
+			return err
+		}
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		fmt.Print(string(content))
+		return nil
+	}
+
+	f, err := LoadFile()
+	if err != nil {
+		return err
+	}
+	currentContext := CurrentContextName()
+	context, ok := f.Contexts[currentContext]
+	if !ok {
+		fmt.Println("No context is in use.")
+		os.Exit(1)
+	}
+	minified := map[string]interface{}{
+		"current-context": currentContext,
+		"contexts":        map[string]Context{currentContext: context},
+	}
+	content, err := yaml.Marshal(minified)
+	if err != nil {
+		return err
+	}
+	fmt.Print(string(content))
+	return nil
+}
@@ -16,8 +16,10 @@ package housekeeping
 
 import (
 	"errors"
+	"fmt"
 
 	"github.com/astarte-platform/astartectl/client"
+	"github.com/astarte-platform/astartectl/cmd/config"
 
 	"github.com/astarte-platform/astartectl/utils"
 	"github.com/spf13/cobra"
@@ -51,13 +53,13 @@ func housekeepingPersistentPreRunE(cmd *cobra.Command, args []string) error {
 	if housekeepingURLOverride != "" {
 		// Use explicit housekeeping-url
 		var err error
-		astarteAPIClient, err = client.NewClientWithIndividualURLs("", housekeepingURLOverride, "", "", nil)
+		astarteAPIClient, err = client.NewClientWithIndividualURLs("", housekeepingURLOverride, "", "", config.HTTPClient())
 		if err != nil {
 			return err
 		}
 	} else if astarteURL != "" {
 		var err error
-		astarteAPIClient, err = client.NewClient(astarteURL, nil)
+		astarteAPIClient, err = client.NewClient(astarteURL, config.HTTPClient())
 		if err != nil {
 			return err
 		}
@@ -66,14 +68,17 @@ func housekeepingPersistentPreRunE(cmd *cobra.Command, args []string) error {
 	}
 
 	housekeepingKey := viper.GetString("housekeeping.key")
-	explicitToken := viper.GetString("token")
+	explicitToken, err := config.GetExplicitToken()
+	if err != nil {
+		return err
+	}
 	if housekeepingKey == "" && explicitToken == "" {
 		return errors.New("housekeeping-key or token is required")
 	}
 
 	if explicitToken == "" {
 		var err error
-		housekeepingJwt, err = generateHousekeepingJWT(housekeepingKey)
+		housekeepingJwt, err = generateHousekeepingJWT(housekeepingKey, cmd, args)
 		if err != nil {
 			return err
 		}
@@ -84,6 +89,14 @@ func housekeepingPersistentPreRunE(cmd *cobra.Command, args []string) error {
 	return nil
 }
 
-func generateHousekeepingJWT(privateKey string) (jwtString string, err error) {
-	return utils.GenerateAstarteJWTFromKeyFile(privateKey, utils.Housekeeping, nil, 300)
+func generateHousekeepingJWT(privateKey string, cmd *cobra.Command, args []string) (jwtString string, err error) {
+	if !viper.GetBool("least-privilege-tokens") {
+		return utils.GenerateAstarteJWTFromKeyFile(privateKey, utils.Housekeeping, nil, 300)
+	}
+
+	claims := utils.ExpandAuthorizationClaims(cmd.Annotations, utils.Housekeeping, args)
+	if len(claims) == 0 {
+		return "", fmt.Errorf("%s does not declare the Housekeeping claims it needs, and cannot be used with least-privilege-tokens", cmd.CommandPath())
+	}
+	return utils.GenerateAstarteJWTFromKeyFile(privateKey, utils.Housekeeping, claims, utils.LeastPrivilegeTokenTTL)
 }
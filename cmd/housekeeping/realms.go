@@ -22,6 +22,8 @@ import (
 	"strconv"
 	"strings"
 
+	"github.com/astarte-platform/astartectl/cmd/output"
+	"github.com/astarte-platform/astartectl/utils"
 	"github.com/spf13/cobra"
 )
 
@@ -40,6 +42,9 @@ var realmsListCmd = &cobra.Command{
 	Example: `  astartectl housekeeping realms list`,
 	RunE:    realmsListF,
 	Aliases: []string{"ls"},
+	Annotations: map[string]string{
+		utils.AuthorizationClaimsAnnotation(utils.Housekeeping): "GET::realms",
+	},
 }
 
 var realmsShowCmd = &cobra.Command{
@@ -49,6 +54,9 @@ var realmsShowCmd = &cobra.Command{
 	Example: `  astartectl housekeeping realms show myrealm`,
 	Args:    cobra.ExactArgs(1),
 	RunE:    realmsShowF,
+	Annotations: map[string]string{
+		utils.AuthorizationClaimsAnnotation(utils.Housekeeping): "GET::realms/$1",
+	},
 }
 
 var realmsCreateCmd = &cobra.Command{
@@ -58,6 +66,9 @@ var realmsCreateCmd = &cobra.Command{
 	Example: `  astartectl housekeeping realms create myrealm -p /path/to/public_key`,
 	Args:    cobra.ExactArgs(1),
 	RunE:    realmsCreateF,
+	Annotations: map[string]string{
+		utils.AuthorizationClaimsAnnotation(utils.Housekeeping): "POST::realms",
+	},
 }
 
 func init() {
@@ -73,6 +84,9 @@ func init() {
 The format is <datacenter-name>:<replication-factor>,<other-datacenter-name>:<other-replication-factor>.
 You can also specify the flag multiple times instead of separating it with a comma.`)
 
+	output.AddFlag(realmsListCmd)
+	output.AddFlag(realmsShowCmd)
+
 	realmsCmd.AddCommand(
 		realmsListCmd,
 		realmsShowCmd,
@@ -81,18 +95,30 @@ You can also specify the flag multiple times instead of separating it with a com
 }
 
 func realmsListF(command *cobra.Command, args []string) error {
+	outputFormat, err := output.FormatFromFlags(command)
+	if err != nil {
+		return err
+	}
+
 	realms, err := astarteAPIClient.Housekeeping.ListRealms(housekeepingJwt)
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
 
-	fmt.Println(realms)
-	return nil
+	t := output.NewTable("Realm")
+	for _, realm := range realms {
+		t.AppendRow(realm)
+	}
+	return output.Print(os.Stdout, outputFormat, realms, t)
 }
 
 func realmsShowF(command *cobra.Command, args []string) error {
 	realm := args[0]
+	outputFormat, err := output.FormatFromFlags(command)
+	if err != nil {
+		return err
+	}
 
 	realmDetails, err := astarteAPIClient.Housekeeping.GetRealm(realm, housekeepingJwt)
 	if err != nil {
@@ -100,8 +126,16 @@ func realmsShowF(command *cobra.Command, args []string) error {
 		os.Exit(1)
 	}
 
-	fmt.Printf("%+v\n", realmDetails)
-	return nil
+	t := output.NewKeyValueTable(
+		[]string{"Name", "Replication Class", "Replication Factor", "Datacenter Replication Factors", "JWT Public Key"},
+		map[string]interface{}{
+			"Name":                           realmDetails.Name,
+			"Replication Class":              realmDetails.ReplicationClass,
+			"Replication Factor":             realmDetails.ReplicationFactor,
+			"Datacenter Replication Factors": realmDetails.DatacenterReplicationFactors,
+			"JWT Public Key":                 strings.TrimSpace(realmDetails.JwtPublicKeyPEM),
+		})
+	return output.Print(os.Stdout, outputFormat, realmDetails, t)
 }
 
 func realmsCreateF(command *cobra.Command, args []string) error {
@@ -0,0 +1,289 @@
+// Copyright © 2019 Ispirata Srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package output
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/jedib0t/go-pretty/table"
+	"github.com/spf13/cobra"
+	"k8s.io/client-go/util/jsonpath"
+	"sigs.k8s.io/yaml"
+)
+
+// Supported output types
+const (
+	// TableOutput renders a human readable table
+	TableOutput = "table"
+	// WideOutput renders a human readable table, including additional columns
+	WideOutput = "wide"
+	// JSONOutput renders indented JSON
+	JSONOutput = "json"
+	// YAMLOutput renders YAML
+	YAMLOutput = "yaml"
+	// CSVOutput renders the table as CSV, including additional columns
+	CSVOutput = "csv"
+	// NDJSONOutput renders one JSON document per line, one for each element if the output is a list
+	NDJSONOutput = "ndjson"
+	// JSONPathOutput renders the result of a JSONPath expression, passed as jsonpath=<expression>
+	JSONPathOutput = "jsonpath"
+	// GoTemplateOutput renders the result of a Go template, passed as go-template=<template>
+	GoTemplateOutput = "go-template"
+)
+
+// SupportedOutputTypes lists all output types, in the form they should be passed to --output
+var SupportedOutputTypes = []string{TableOutput, WideOutput, JSONOutput, YAMLOutput, CSVOutput, NDJSONOutput,
+	JSONPathOutput + "=<expression>", GoTemplateOutput + "=<template>"}
+
+// Format represents the output format requested for a command
+type Format struct {
+	Type     string
+	Template string
+}
+
+// ParseFormat parses an output format string, such as json or jsonpath={.items[*].name}
+func ParseFormat(formatString string) (Format, error) {
+	tokens := strings.SplitN(formatString, "=", 2)
+	switch tokens[0] {
+	case "", "default":
+		// default is kept for compatibility with previous versions
+		return Format{Type: TableOutput}, nil
+	case TableOutput, WideOutput, JSONOutput, YAMLOutput, CSVOutput, NDJSONOutput:
+		if len(tokens) > 1 {
+			return Format{}, fmt.Errorf("Output type %s does not accept any argument", tokens[0])
+		}
+		return Format{Type: tokens[0]}, nil
+	case JSONPathOutput, GoTemplateOutput:
+		if len(tokens) < 2 || tokens[1] == "" {
+			return Format{}, fmt.Errorf("Output type %s requires an expression, as in %s=<expression>", tokens[0], tokens[0])
+		}
+		return Format{Type: tokens[0], Template: tokens[1]}, nil
+	}
+
+	return Format{}, fmt.Errorf("%v is not a supported output type. Supported output types are %v", formatString, SupportedOutputTypes)
+}
+
+// AddFlag adds the --output flag to command, defaulting to table output
+func AddFlag(command *cobra.Command) {
+	AddFlagWithDefault(command, TableOutput)
+}
+
+// AddFlagWithDefault adds the --output flag to command, with a custom default output type
+func AddFlagWithDefault(command *cobra.Command, defaultType string) {
+	command.Flags().StringP("output", "o", defaultType,
+		fmt.Sprintf("The type of output (%s)", strings.Join(SupportedOutputTypes, ",")))
+}
+
+// FormatFromFlags returns the output Format requested through the --output flag of command
+func FormatFromFlags(command *cobra.Command) (Format, error) {
+	formatString, err := command.Flags().GetString("output")
+	if err != nil {
+		return Format{}, err
+	}
+	return ParseFormat(formatString)
+}
+
+// IsHumanReadable returns whether the Format is meant for humans rather than scripts. Commands showing a single
+// object usually render a custom representation in this case.
+func (f Format) IsHumanReadable() bool {
+	return f.Type == TableOutput || f.Type == WideOutput
+}
+
+// IsTabular returns whether the Format is rendered out of a Table
+func (f Format) IsTabular() bool {
+	return f.Type == TableOutput || f.Type == WideOutput || f.Type == CSVOutput
+}
+
+// Timestamp formats a timestamp for a Table cell, according to the Format
+func (f Format) Timestamp(timestamp time.Time) string {
+	if timestamp.IsZero() {
+		return ""
+	}
+	if f.Type == CSVOutput {
+		return timestamp.Format(time.RFC3339Nano)
+	}
+	return timestamp.String()
+}
+
+// Column is a column of a Table
+type Column struct {
+	Name string
+	// Wide columns are shown only in wide and csv outputs
+	Wide bool
+}
+
+// Table is the tabular representation of a command output
+type Table struct {
+	Columns []Column
+	Rows    [][]interface{}
+}
+
+// NewTable creates a Table with the given columns
+func NewTable(columns ...string) *Table {
+	t := &Table{}
+	for _, c := range columns {
+		t.Columns = append(t.Columns, Column{Name: c})
+	}
+	return t
+}
+
+// AddWideColumns adds columns which are shown only in wide and csv outputs
+func (t *Table) AddWideColumns(columns ...string) *Table {
+	for _, c := range columns {
+		t.Columns = append(t.Columns, Column{Name: c, Wide: true})
+	}
+	return t
+}
+
+// AppendRow appends a row to the Table. Values must be in the same order as columns, including wide ones.
+func (t *Table) AppendRow(values ...interface{}) {
+	t.Rows = append(t.Rows, values)
+}
+
+// NewKeyValueTable creates a two-columns table out of ordered keys and values, useful to render single objects
+func NewKeyValueTable(keys []string, values map[string]interface{}) *Table {
+	t := NewTable("Field", "Value")
+	for _, k := range keys {
+		t.AppendRow(k, values[k])
+	}
+	return t
+}
+
+// Print renders the output of a command to w. data is used for structured outputs (json, yaml, ndjson, jsonpath,
+// go-template), whereas t is used for tabular ones (table, wide, csv). If t is nil, tabular outputs fall back to YAML.
+func Print(w io.Writer, format Format, data interface{}, t *Table) error {
+	if format.IsTabular() && t == nil {
+		format = Format{Type: YAMLOutput}
+	}
+
+	switch format.Type {
+	case TableOutput, WideOutput, CSVOutput:
+		return printTable(w, format, t)
+	case JSONOutput:
+		respJSON, err := json.MarshalIndent(data, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(w, string(respJSON))
+		return err
+	case YAMLOutput:
+		respYAML, err := yaml.Marshal(data)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprint(w, string(respYAML))
+		return err
+	case NDJSONOutput:
+		generic, err := toGeneric(data)
+		if err != nil {
+			return err
+		}
+		items, ok := generic.([]interface{})
+		if !ok {
+			items = []interface{}{generic}
+		}
+		encoder := json.NewEncoder(w)
+		for _, item := range items {
+			if err := encoder.Encode(item); err != nil {
+				return err
+			}
+		}
+		return nil
+	case JSONPathOutput:
+		generic, err := toGeneric(data)
+		if err != nil {
+			return err
+		}
+		expression := format.Template
+		if !strings.Contains(expression, "{") {
+			expression = "{" + expression + "}"
+		}
+		j := jsonpath.New("output")
+		j.AllowMissingKeys(true)
+		if err := j.Parse(expression); err != nil {
+			return fmt.Errorf("Invalid JSONPath expression %s: %s", format.Template, err)
+		}
+		if err := j.Execute(w, generic); err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(w)
+		return err
+	case GoTemplateOutput:
+		generic, err := toGeneric(data)
+		if err != nil {
+			return err
+		}
+		tmpl, err := template.New("output").Parse(format.Template)
+		if err != nil {
+			return fmt.Errorf("Invalid Go template %s: %s", format.Template, err)
+		}
+		if err := tmpl.Execute(w, generic); err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(w)
+		return err
+	}
+
+	return fmt.Errorf("%v is not a supported output type", format.Type)
+}
+
+func printTable(w io.Writer, format Format, t *Table) error {
+	includeWide := format.Type != TableOutput
+	tw := table.NewWriter()
+	tw.SetOutputMirror(w)
+	tw.SetStyle(table.StyleLight)
+
+	header := table.Row{}
+	for _, c := range t.Columns {
+		if !c.Wide || includeWide {
+			header = append(header, c.Name)
+		}
+	}
+	tw.AppendHeader(header)
+	for _, r := range t.Rows {
+		row := table.Row{}
+		for i, v := range r {
+			if i < len(t.Columns) && t.Columns[i].Wide && !includeWide {
+				continue
+			}
+			row = append(row, v)
+		}
+		tw.AppendRow(row)
+	}
+
+	if format.Type == CSVOutput {
+		tw.RenderCSV()
+	} else {
+		tw.Render()
+	}
+	return nil
+}
+
+// toGeneric turns data in its generic JSON representation, so that JSON field names are honored by
+// JSONPath expressions and templates
+func toGeneric(data interface{}) (interface{}, error) {
+	dataJSON, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	var generic interface{}
+	err = json.Unmarshal(dataJSON, &generic)
+	return generic, err
+}
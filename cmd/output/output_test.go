@@ -0,0 +1,72 @@
+package output
+
+import (
+	"bytes"
+	"testing"
+)
+
+type testItem struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+func TestParseFormat(t *testing.T) {
+	valid := map[string]Format{
+		"":                      {Type: TableOutput},
+		"default":               {Type: TableOutput},
+		"wide":                  {Type: WideOutput},
+		"ndjson":                {Type: NDJSONOutput},
+		"jsonpath={.name}":      {Type: JSONPathOutput, Template: "{.name}"},
+		"go-template={{.name}}": {Type: GoTemplateOutput, Template: "{{.name}}"},
+	}
+	for formatString, expected := range valid {
+		format, err := ParseFormat(formatString)
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", formatString, err)
+		} else if format != expected {
+			t.Errorf("%s: expected %v, got %v", formatString, expected, format)
+		}
+	}
+
+	for _, formatString := range []string{"xml", "json=foo", "jsonpath", "go-template="} {
+		if _, err := ParseFormat(formatString); err == nil {
+			t.Errorf("%s: expected an error", formatString)
+		}
+	}
+}
+
+func TestPrint(t *testing.T) {
+	data := []testItem{{Name: "a", Count: 1}, {Name: "b", Count: 2}}
+	table := NewTable("Name").AddWideColumns("Count")
+	for _, item := range data {
+		table.AppendRow(item.Name, item.Count)
+	}
+
+	tests := map[string]string{
+		"ndjson":              "{\"count\":1,\"name\":\"a\"}\n{\"count\":2,\"name\":\"b\"}\n",
+		"jsonpath={[*].name}": "a b\n",
+		"go-template={{range .}}{{.name}}={{.count}};{{end}}": "a=1;b=2;\n",
+		"csv":  "Name,Count\na,1\nb,2\n",
+		"yaml": "- count: 1\n  name: a\n- count: 2\n  name: b\n",
+	}
+	for formatString, expected := range tests {
+		format, err := ParseFormat(formatString)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var b bytes.Buffer
+		if err := Print(&b, format, data, table); err != nil {
+			t.Errorf("%s: unexpected error %s", formatString, err)
+		} else if b.String() != expected {
+			t.Errorf("%s: expected %q, got %q", formatString, expected, b.String())
+		}
+	}
+
+	var b bytes.Buffer
+	if err := Print(&b, Format{Type: TableOutput}, data, table); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(b.Bytes(), []byte("Count")) {
+		t.Errorf("wide columns should not be shown in table output:\n%s", b.String())
+	}
+}
@@ -15,10 +15,18 @@
 package pairing
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 
+	"github.com/astarte-platform/astartectl/client"
+	"github.com/astarte-platform/astartectl/cmd/output"
+	"github.com/astarte-platform/astartectl/common"
 	"github.com/astarte-platform/astartectl/utils"
 	"github.com/spf13/cobra"
 )
@@ -29,15 +37,37 @@ var agentCmd = &cobra.Command{
 }
 
 var agentRegisterCmd = &cobra.Command{
-	Use:   "register <device_id>",
+	Use:   "register [<device_id>]",
 	Short: "Register a device",
 	Long: `Register a new device to your realm.
 
 This returns the credentials_secret that can be use to obtain device credentials.
-<device_id> must be a 128 bit base64 url-encoded UUID`,
-	Example: `  astartectl pairing agent register 2TBn-jNESuuHamE2Zo1anA`,
-	Args:    cobra.ExactArgs(1),
-	RunE:    agentRegisterF,
+<device_id> must be a 128 bit base64 url-encoded UUID
+
+With --from-file, all devices listed in a CSV file are registered concurrently. The file has a device_id
+and/or a serial_number column, or holds a device ID per line. With --namespace, device IDs are derived from
+serial numbers. All IDs are validated before registering any device.
+
+Credentials Secrets are written to --credentials-file rather than printed, optionally encrypted with
+--encrypt. Each device is appended to the file as soon as it is registered, and encrypted files are saved as
+a single message once the run completes. Devices already in --credentials-file
+are skipped, hence a batch which partially failed or was interrupted can be resumed by running the same
+command again.
+
+--introspection and --introspection-from declare the interfaces of the device before it connects for the
+first time, so that server owned data can be sent to it in the meantime. --introspection entries take
+precedence over interfaces read with --introspection-from.`,
+	Example: `  astartectl pairing agent register 2TBn-jNESuuHamE2Zo1anA
+  astartectl pairing agent register --from-file ids.csv --credentials-file secrets.csv
+  astartectl pairing agent register --from-file serials.txt --namespace 7d1e8b4c-2d7a-4d3f-9a41-6f3b0f1f3c2e \
+    --credentials-file secrets.json.asc --encrypt
+  astartectl pairing agent register 2TBn-jNESuuHamE2Zo1anA --introspection org.example.Config:1:0
+  astartectl pairing agent register 2TBn-jNESuuHamE2Zo1anA --introspection-from ./interfaces`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: agentRegisterF,
+	Annotations: map[string]string{
+		utils.AuthorizationClaimsAnnotation(utils.Pairing): "POST::agent/devices",
+	},
 }
 
 var agentUnregisterCmd = &cobra.Command{
@@ -49,11 +79,17 @@ All data belonging to the device will be kept as is in Astarte.`,
 	Example: `  astartectl pairing agent unregister 2TBn-jNESuuHamE2Zo1anA`,
 	Args:    cobra.ExactArgs(1),
 	RunE:    agentUnregisterF,
+	Annotations: map[string]string{
+		utils.AuthorizationClaimsAnnotation(utils.Pairing): "DELETE::agent/devices/$1",
+	},
 }
 
 func init() {
 	agentUnregisterCmd.PersistentFlags().BoolP("non-interactive", "y", false, "Non-interactive mode. Will answer yes by default to all questions.")
 
+	addIntrospectionFlags(agentRegisterCmd)
+	output.AddFlag(agentRegisterCmd)
+
 	PairingCmd.AddCommand(agentCmd)
 
 	agentCmd.AddCommand(
@@ -63,18 +99,47 @@ func init() {
 }
 
 func agentRegisterF(command *cobra.Command, args []string) error {
-	// TODO: add support for initial_introspection
+	initialIntrospection, err := initialIntrospectionFromFlags(command)
+	if err != nil {
+		return err
+	}
+	fromFile, err := command.Flags().GetString("from-file")
+	if err != nil {
+		return err
+	}
+	if fromFile != "" {
+		if len(args) > 0 {
+			return errors.New("<device_id> and --from-file are mutually exclusive")
+		}
+		return agentRegisterFromFileF(command, fromFile, initialIntrospection)
+	}
+	if len(args) == 0 {
+		return errors.New("Either <device_id> or --from-file is required")
+	}
+
 	deviceID := args[0]
 	if !utils.IsValidAstarteDeviceID(deviceID) {
 		return errors.New("Invalid device id")
 	}
+	outputFormat, err := output.FormatFromFlags(command)
+	if err != nil {
+		return err
+	}
 
-	credentialsSecret, err := astarteAPIClient.Pairing.RegisterDevice(realm, deviceID, pairingJwt)
+	credentialsSecret, err := astarteAPIClient.Pairing.RegisterDeviceWithInitialIntrospection(realm, deviceID,
+		initialIntrospection, pairingJwt)
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
 
+	if !outputFormat.IsHumanReadable() {
+		registration := map[string]string{"device_id": deviceID, "credentials_secret": credentialsSecret}
+		t := output.NewTable("Device ID", "Credentials Secret")
+		t.AppendRow(deviceID, credentialsSecret)
+		return output.Print(os.Stdout, outputFormat, registration, t)
+	}
+
 	// Print the Credentials Secret
 	fmt.Printf("Device %s successfully registered in Realm %s.\n", deviceID, realm)
 	fmt.Printf("The Device's Credentials Secret is \"%s\".\n", credentialsSecret)
@@ -85,6 +150,93 @@ func agentRegisterF(command *cobra.Command, args []string) error {
 	return nil
 }
 
+func addIntrospectionFlags(command *cobra.Command) {
+	command.Flags().StringSlice("introspection", nil,
+		"Initial introspection of the device, as a list of <interface_name>:<major>:<minor>")
+	command.Flags().String("introspection-from", "",
+		"Directory of interface JSON files making up the initial introspection of the device")
+	command.MarkFlagDirname("introspection-from")
+}
+
+// initialIntrospectionFromFlags builds the initial introspection from --introspection-from and --introspection.
+// It returns nil when neither is set.
+func initialIntrospectionFromFlags(command *cobra.Command) (map[string]client.DeviceInterfaceIntrospection, error) {
+	introspectionEntries, err := command.Flags().GetStringSlice("introspection")
+	if err != nil {
+		return nil, err
+	}
+	interfacesDir, err := command.Flags().GetString("introspection-from")
+	if err != nil {
+		return nil, err
+	}
+	if len(introspectionEntries) == 0 && interfacesDir == "" {
+		return nil, nil
+	}
+
+	introspection := map[string]client.DeviceInterfaceIntrospection{}
+	if interfacesDir != "" {
+		if introspection, _, err = readIntrospectionFromDir(interfacesDir); err != nil {
+			return nil, err
+		}
+	}
+	for _, entry := range introspectionEntries {
+		tokens := strings.Split(entry, ":")
+		if len(tokens) != 3 || tokens[0] == "" {
+			return nil, fmt.Errorf("Invalid introspection entry %q, expected <interface_name>:<major>:<minor>", entry)
+		}
+		major, majorErr := strconv.Atoi(tokens[1])
+		minor, minorErr := strconv.Atoi(tokens[2])
+		if majorErr != nil || minorErr != nil || major < 0 || minor < 0 || (major == 0 && minor == 0) {
+			return nil, fmt.Errorf("Invalid version in introspection entry %q", entry)
+		}
+		introspection[tokens[0]] = client.DeviceInterfaceIntrospection{Major: major, Minor: minor}
+	}
+	return introspection, nil
+}
+
+// readIntrospectionFromDir reads the name and version of all interface JSON files in dir and its subdirectories.
+// It returns them together with the file defining each interface.
+func readIntrospectionFromDir(dir string) (map[string]client.DeviceInterfaceIntrospection, map[string]string, error) {
+	introspection := map[string]client.DeviceInterfaceIntrospection{}
+	interfaceFiles := map[string]string{}
+	err := filepath.Walk(dir, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || filepath.Ext(file) != ".json" {
+			return nil
+		}
+
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		var astarteInterface common.AstarteInterface
+		if err := json.Unmarshal(content, &astarteInterface); err != nil {
+			return fmt.Errorf("Could not parse %s: %s", file, err)
+		}
+		if astarteInterface.Name == "" {
+			return fmt.Errorf("%s is not an Astarte interface", file)
+		}
+		if otherFile, ok := interfaceFiles[astarteInterface.Name]; ok {
+			return fmt.Errorf("Interface %s is defined both in %s and %s", astarteInterface.Name, otherFile, file)
+		}
+		interfaceFiles[astarteInterface.Name] = file
+		introspection[astarteInterface.Name] = client.DeviceInterfaceIntrospection{
+			Major: astarteInterface.MajorVersion,
+			Minor: astarteInterface.MinorVersion,
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(introspection) == 0 {
+		return nil, nil, fmt.Errorf("No interface found in %s", dir)
+	}
+	return introspection, interfaceFiles, nil
+}
+
 func agentUnregisterF(command *cobra.Command, args []string) error {
 	deviceID := args[0]
 	if !utils.IsValidAstarteDeviceID(deviceID) {
@@ -0,0 +1,237 @@
+// Copyright © 2019 Ispirata Srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pairing
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/astarte-platform/astartectl/utils"
+	"github.com/skip2/go-qrcode"
+	"github.com/spf13/cobra"
+)
+
+var agentProvisionCmd = &cobra.Command{
+	Use:   "provision <device_id>",
+	Short: "Register a device and create its provisioning bundle",
+	Long: `Register a new device to your realm, and create the configuration its Astarte Device SDK needs to
+connect: realm, device ID, Credentials Secret and Pairing URL.
+
+The configuration is printed, or written to --output-dir together with the interfaces of the device when
+--include-interfaces is set. Supported formats are:
+
+  qt      Astarte Device SDK Qt5 transport configuration (astarte.ini)
+  esp32   Astarte Device SDK ESP32 configuration (astarte_config.json)
+  go      Astarte Go SDK device configuration (astarte_device.json)
+  python  Astarte Device SDK Python configuration (astarte_device.json)
+
+--qr renders the configuration as a QR code in the terminal, to transfer it to devices with a camera.`,
+	Example: `  astartectl pairing agent provision 2TBn-jNESuuHamE2Zo1anA --format esp32 --qr
+  astartectl pairing agent provision 2TBn-jNESuuHamE2Zo1anA --format qt --introspection-from ./interfaces \
+    --include-interfaces --output-dir ./bundle`,
+	Args: cobra.ExactArgs(1),
+	RunE: agentProvisionF,
+	Annotations: map[string]string{
+		utils.AuthorizationClaimsAnnotation(utils.Pairing): "POST::agent/devices",
+	},
+}
+
+// provisioningConfig holds what a Device needs to connect to Astarte
+type provisioningConfig struct {
+	Realm             string
+	DeviceID          string
+	CredentialsSecret string
+	PairingURL        string
+}
+
+type provisioningFormat struct {
+	fileName string
+	render   func(provisioningConfig) ([]byte, error)
+}
+
+var provisioningFormats = map[string]provisioningFormat{
+	"qt":     {"astarte.ini", renderQtProvisioningConfig},
+	"esp32":  {"astarte_config.json", renderESP32ProvisioningConfig},
+	"go":     {"astarte_device.json", renderSDKProvisioningConfig},
+	"python": {"astarte_device.json", renderSDKProvisioningConfig},
+}
+
+func init() {
+	agentProvisionCmd.Flags().StringP("format", "f", "go", "Format of the configuration (qt, esp32, go, python)")
+	agentProvisionCmd.Flags().String("output-dir", "", "Directory where the bundle is written. When not set, the configuration is printed.")
+	agentProvisionCmd.MarkFlagDirname("output-dir")
+	agentProvisionCmd.Flags().Bool("include-interfaces", false, "Add the interfaces of --introspection-from to the bundle. Requires --output-dir.")
+	agentProvisionCmd.Flags().Bool("qr", false, "Render the configuration as a QR code in the terminal")
+	addIntrospectionFlags(agentProvisionCmd)
+
+	agentCmd.AddCommand(agentProvisionCmd)
+}
+
+func agentProvisionF(command *cobra.Command, args []string) error {
+	deviceID := args[0]
+	if !utils.IsValidAstarteDeviceID(deviceID) {
+		return errors.New("Invalid device id")
+	}
+	formatName, err := command.Flags().GetString("format")
+	if err != nil {
+		return err
+	}
+	format, ok := provisioningFormats[formatName]
+	if !ok {
+		formats := []string{}
+		for name := range provisioningFormats {
+			formats = append(formats, name)
+		}
+		sort.Strings(formats)
+		return fmt.Errorf("Unsupported format %q. Supported formats are %s", formatName, strings.Join(formats, ", "))
+	}
+	outputDir, err := command.Flags().GetString("output-dir")
+	if err != nil {
+		return err
+	}
+	includeInterfaces, err := command.Flags().GetBool("include-interfaces")
+	if err != nil {
+		return err
+	}
+	interfacesDir, err := command.Flags().GetString("introspection-from")
+	if err != nil {
+		return err
+	}
+	if includeInterfaces && (outputDir == "" || interfacesDir == "") {
+		return errors.New("--include-interfaces requires --output-dir and --introspection-from")
+	}
+	showQR, err := command.Flags().GetBool("qr")
+	if err != nil {
+		return err
+	}
+	initialIntrospection, err := initialIntrospectionFromFlags(command)
+	if err != nil {
+		return err
+	}
+
+	credentialsSecret, err := astarteAPIClient.Pairing.RegisterDeviceWithInitialIntrospection(realm, deviceID,
+		initialIntrospection, pairingJwt)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	config, err := format.render(provisioningConfig{
+		Realm:             realm,
+		DeviceID:          deviceID,
+		CredentialsSecret: credentialsSecret,
+		PairingURL:        astarteAPIClient.Pairing.URL(),
+	})
+	if err != nil {
+		return err
+	}
+
+	if outputDir == "" {
+		os.Stdout.Write(config)
+	} else {
+		// The device is registered at this point: make sure the user gets its Credentials Secret anyway
+		if err := writeProvisioningBundle(outputDir, format.fileName, config, includeInterfaces, interfacesDir); err != nil {
+			fmt.Fprintf(os.Stderr, "Could not write the bundle of device %s: %s\n", deviceID, err)
+			fmt.Fprintf(os.Stderr, "The Device's Credentials Secret is \"%s\".\n", credentialsSecret)
+			os.Exit(1)
+		}
+		fmt.Printf("Device %s successfully registered in Realm %s.\n", deviceID, realm)
+		fmt.Printf("Provisioning bundle written to %s.\n", outputDir)
+	}
+
+	if showQR {
+		qr, err := qrcode.New(string(config), qrcode.Medium)
+		if err != nil {
+			return err
+		}
+		fmt.Println()
+		fmt.Print(qr.ToSmallString(false))
+	}
+	return nil
+}
+
+func writeProvisioningBundle(outputDir string, fileName string, config []byte, includeInterfaces bool, interfacesDir string) error {
+	if err := os.MkdirAll(outputDir, 0700); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(outputDir, fileName), config, 0600); err != nil {
+		return err
+	}
+	if !includeInterfaces {
+		return nil
+	}
+
+	_, interfaceFiles, err := readIntrospectionFromDir(interfacesDir)
+	if err != nil {
+		return err
+	}
+	bundleInterfacesDir := filepath.Join(outputDir, "interfaces")
+	if err := os.MkdirAll(bundleInterfacesDir, 0700); err != nil {
+		return err
+	}
+	for interfaceName, interfaceFile := range interfaceFiles {
+		content, err := ioutil.ReadFile(interfaceFile)
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(filepath.Join(bundleInterfacesDir, interfaceName+".json"), content, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func renderQtProvisioningConfig(config provisioningConfig) ([]byte, error) {
+	var b bytes.Buffer
+	fmt.Fprintln(&b, "[AstarteTransport]")
+	fmt.Fprintf(&b, "realm=%s\n", config.Realm)
+	fmt.Fprintf(&b, "hwId=%s\n", config.DeviceID)
+	fmt.Fprintf(&b, "credentialsSecret=%s\n", config.CredentialsSecret)
+	fmt.Fprintf(&b, "pairingUrl=%s\n", config.PairingURL)
+	return b.Bytes(), nil
+}
+
+func renderESP32ProvisioningConfig(config provisioningConfig) ([]byte, error) {
+	return marshalProvisioningConfig(map[string]string{
+		"realm":              config.Realm,
+		"hwid":               config.DeviceID,
+		"credentials_secret": config.CredentialsSecret,
+		"pairing_url":        config.PairingURL,
+	})
+}
+
+func renderSDKProvisioningConfig(config provisioningConfig) ([]byte, error) {
+	return marshalProvisioningConfig(map[string]string{
+		"device_id":          config.DeviceID,
+		"realm":              config.Realm,
+		"credentials_secret": config.CredentialsSecret,
+		"pairing_base_url":   config.PairingURL,
+	})
+}
+
+func marshalProvisioningConfig(config map[string]string) ([]byte, error) {
+	content, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(content, '\n'), nil
+}
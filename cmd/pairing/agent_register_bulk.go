@@ -0,0 +1,646 @@
+// Copyright © 2019 Ispirata Srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pairing
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/astarte-platform/astartectl/client"
+	"github.com/astarte-platform/astartectl/cmd/output"
+	"github.com/astarte-platform/astartectl/utils"
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// credentialsPassphraseEnv holds the passphrase of encrypted credentials files, to avoid prompting for it
+const credentialsPassphraseEnv = "ASTARTECTL_CREDENTIALS_PASSPHRASE"
+
+// deviceCredentials is a record of a credentials file
+type deviceCredentials struct {
+	DeviceID          string `json:"device_id"`
+	SerialNumber      string `json:"serial_number,omitempty"`
+	CredentialsSecret string `json:"credentials_secret"`
+}
+
+// registrationResult is the outcome of registering a device of a bulk registration
+type registrationResult struct {
+	Row          int    `json:"row"`
+	DeviceID     string `json:"device_id"`
+	SerialNumber string `json:"serial_number,omitempty"`
+	Result       string `json:"result"`
+	Details      string `json:"details,omitempty"`
+}
+
+// Results of a bulk registration row
+const (
+	registrationRegistered = "registered"
+	registrationSkipped    = "skipped"
+	registrationInvalid    = "invalid"
+	registrationFailed     = "failed"
+)
+
+func init() {
+	agentRegisterCmd.Flags().String("from-file", "", "Register all devices listed in a CSV file, instead of a single device")
+	agentRegisterCmd.MarkFlagFilename("from-file")
+	agentRegisterCmd.Flags().String("namespace", "", "UUID namespace used to derive Device IDs from the serial numbers of --from-file")
+	agentRegisterCmd.Flags().Int("concurrency", 8, "Number of devices registered concurrently with --from-file")
+	agentRegisterCmd.Flags().String("credentials-file", "", "File where the Credentials Secrets of --from-file are written. Required with --from-file.")
+	agentRegisterCmd.MarkFlagFilename("credentials-file")
+	agentRegisterCmd.Flags().String("credentials-format", "", "Format of --credentials-file (csv, json). Defaults to its extension.")
+	agentRegisterCmd.Flags().Bool("encrypt", false, "Encrypt --credentials-file with a passphrase, as an armored OpenPGP message. "+
+		"The passphrase is read from "+credentialsPassphraseEnv+" or prompted.")
+}
+
+func agentRegisterFromFileF(command *cobra.Command, inputFile string,
+	initialIntrospection map[string]client.DeviceInterfaceIntrospection) error {
+	namespace, err := command.Flags().GetString("namespace")
+	if err != nil {
+		return err
+	}
+	concurrency, err := command.Flags().GetInt("concurrency")
+	if err != nil {
+		return err
+	}
+	if concurrency < 1 {
+		return errors.New("concurrency must be at least 1")
+	}
+	credentialsFile, err := command.Flags().GetString("credentials-file")
+	if err != nil {
+		return err
+	}
+	if credentialsFile == "" {
+		return errors.New("--credentials-file is required with --from-file")
+	}
+	credentialsFormat, err := command.Flags().GetString("credentials-format")
+	if err != nil {
+		return err
+	}
+	if credentialsFormat == "" {
+		extension := filepath.Ext(credentialsFile)
+		if extension == ".asc" || extension == ".gpg" {
+			extension = filepath.Ext(strings.TrimSuffix(credentialsFile, extension))
+		}
+		credentialsFormat = strings.TrimPrefix(strings.ToLower(extension), ".")
+	}
+	if credentialsFormat != "csv" && credentialsFormat != "json" {
+		return fmt.Errorf("Unsupported credentials file format %q. Supported formats are csv and json", credentialsFormat)
+	}
+	encrypt, err := command.Flags().GetBool("encrypt")
+	if err != nil {
+		return err
+	}
+	outputFormat, err := output.FormatFromFlags(command)
+	if err != nil {
+		return err
+	}
+
+	results, err := readDevicesToRegister(inputFile, namespace)
+	if err != nil {
+		return err
+	}
+	invalid := 0
+	for _, result := range results {
+		if result.Result == registrationInvalid {
+			invalid++
+		}
+	}
+	if invalid > 0 {
+		// Nothing is registered unless the whole file is valid
+		if err := printRegistrationResults(outputFormat, results); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "%d of %d rows are invalid, no device was registered\n", invalid, len(results))
+		os.Exit(1)
+	}
+
+	var passphrase []byte
+	if encrypt {
+		if passphrase, err = readCredentialsPassphrase(); err != nil {
+			return err
+		}
+	}
+
+	// Devices in an existing credentials file were registered by a previous run, which is resumed
+	credentials := []deviceCredentials{}
+	if _, err := os.Stat(credentialsFile); err == nil {
+		if credentials, err = readCredentialsFile(credentialsFile, credentialsFormat, passphrase); err != nil {
+			return err
+		}
+	}
+	registered := map[string]bool{}
+	for _, c := range credentials {
+		registered[c.DeviceID] = true
+	}
+	for i := range results {
+		if results[i].Result == "" && registered[results[i].DeviceID] {
+			results[i].Result = registrationSkipped
+			results[i].Details = "already in " + credentialsFile
+		}
+	}
+
+	saver := &credentialsSaver{
+		file:        credentialsFile,
+		format:      credentialsFormat,
+		passphrase:  passphrase,
+		credentials: credentials,
+		saved:       len(credentials),
+	}
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range indexes {
+				result := &results[index]
+				credentialsSecret, err := astarteAPIClient.Pairing.RegisterDeviceWithInitialIntrospection(realm, result.DeviceID,
+					initialIntrospection, pairingJwt)
+				if err != nil {
+					result.Result = registrationFailed
+					result.Details = err.Error()
+					continue
+				}
+				result.Result = registrationRegistered
+				// The secret is saved right away, so that it is not lost if the run is interrupted
+				err = saver.add(deviceCredentials{
+					DeviceID:          result.DeviceID,
+					SerialNumber:      result.SerialNumber,
+					CredentialsSecret: credentialsSecret,
+				})
+				if err != nil {
+					result.Details = fmt.Sprintf("could not write %s: %s", credentialsFile, err)
+				}
+			}
+		}()
+	}
+	for i := range results {
+		if saver.failed() {
+			// Secrets could not be saved: stop registering devices rather than risking to lose more of them
+			break
+		}
+		if results[i].Result == "" {
+			indexes <- i
+		}
+	}
+	close(indexes)
+	wg.Wait()
+	for i := range results {
+		if results[i].Result == "" {
+			results[i].Result = registrationFailed
+			results[i].Details = "not attempted, as " + credentialsFile + " could not be written"
+		}
+	}
+
+	// Retry saving secrets which could not be written while registering
+	if err := saver.flush(); err != nil {
+		fmt.Fprintf(os.Stderr, "Could not write %s: %s\n", credentialsFile, err)
+		os.Exit(1)
+	}
+	if err := saver.compact(); err != nil {
+		fmt.Fprintf(os.Stderr, "Could not write %s: %s\n", credentialsFile, err)
+		os.Exit(1)
+	}
+
+	if err := printRegistrationResults(outputFormat, results); err != nil {
+		return err
+	}
+	failed := 0
+	for _, result := range results {
+		if result.Result == registrationFailed {
+			failed++
+		}
+	}
+	if failed > 0 {
+		fmt.Fprintf(os.Stderr, "%d of %d devices could not be registered. Run the same command again to retry them.\n",
+			failed, len(results))
+		os.Exit(1)
+	}
+	return nil
+}
+
+// credentialsSaver writes the credentials file of a bulk registration whenever devices are registered.
+// Concurrent registrations are saved together by a single write, which appends them to the file.
+type credentialsSaver struct {
+	file       string
+	format     string
+	passphrase []byte
+
+	// mu guards credentials and err
+	mu          sync.Mutex
+	credentials []deviceCredentials
+	err         error
+	// writeMu serializes writes, and guards saved, the number of credentials in the file, and appended,
+	// whether encrypted credentials were appended to the file as separate messages
+	writeMu  sync.Mutex
+	saved    int
+	appended bool
+}
+
+// add records c, and returns once it has been written to the credentials file
+func (s *credentialsSaver) add(c deviceCredentials) error {
+	s.mu.Lock()
+	s.credentials = append(s.credentials, c)
+	s.mu.Unlock()
+	return s.flush()
+}
+
+// flush writes to the credentials file all credentials recorded so far, unless they have already been written
+func (s *credentialsSaver) flush() error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	s.mu.Lock()
+	credentials := append([]deviceCredentials{}, s.credentials...)
+	s.mu.Unlock()
+	if len(credentials) == s.saved {
+		return nil
+	}
+
+	var err error
+	if s.saved == 0 {
+		err = writeCredentialsFile(s.file, s.format, s.passphrase, credentials)
+	} else {
+		err = appendCredentialsFile(s.file, s.format, s.passphrase, credentials[s.saved:])
+		s.appended = s.appended || s.passphrase != nil
+	}
+	s.mu.Lock()
+	s.err = err
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	s.saved = len(credentials)
+	return nil
+}
+
+// compact rewrites an encrypted credentials file holding several messages as a single message
+func (s *credentialsSaver) compact() error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if !s.appended {
+		return nil
+	}
+
+	s.mu.Lock()
+	credentials := append([]deviceCredentials{}, s.credentials...)
+	s.mu.Unlock()
+	if err := writeCredentialsFile(s.file, s.format, s.passphrase, credentials); err != nil {
+		return err
+	}
+	s.saved = len(credentials)
+	s.appended = false
+	return nil
+}
+
+// failed returns whether the last write of the credentials file failed
+func (s *credentialsSaver) failed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err != nil
+}
+
+// readDevicesToRegister reads the devices listed in file. The file is either a CSV file with a device_id
+// and/or a serial_number column, or a plain list with a device ID per line. When namespace is set, device
+// IDs are derived from serial numbers, and a plain list holds serial numbers instead.
+func readDevicesToRegister(file string, namespace string) ([]registrationResult, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	reader := csv.NewReader(f)
+	reader.FieldsPerRecord = -1
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse %s: %s", file, err)
+	}
+
+	deviceIDColumn, serialNumberColumn := -1, -1
+	if len(records) > 0 {
+		for i, header := range records[0] {
+			switch strings.Replace(strings.ToLower(strings.TrimSpace(header)), " ", "_", -1) {
+			case "device_id":
+				deviceIDColumn = i
+			case "serial_number", "serial":
+				serialNumberColumn = i
+			}
+		}
+	}
+	firstRow := 1
+	if deviceIDColumn < 0 && serialNumberColumn < 0 {
+		// No header
+		firstRow = 0
+		if namespace != "" {
+			serialNumberColumn = 0
+		} else {
+			deviceIDColumn = 0
+		}
+	}
+
+	results := []registrationResult{}
+	rowsByDeviceID := map[string]int{}
+	for i := firstRow; i < len(records); i++ {
+		field := func(column int) string {
+			if column < 0 || column >= len(records[i]) {
+				return ""
+			}
+			return strings.TrimSpace(records[i][column])
+		}
+		result := registrationResult{Row: i + 1, DeviceID: field(deviceIDColumn), SerialNumber: field(serialNumberColumn)}
+		if result.DeviceID == "" && result.SerialNumber == "" {
+			continue
+		}
+
+		switch {
+		case result.DeviceID == "" && namespace == "":
+			result.Result = registrationInvalid
+			result.Details = "no device ID, and no --namespace to derive it from the serial number"
+		case result.DeviceID == "":
+			result.DeviceID, err = utils.GetNamespacedAstarteDeviceID(namespace, []byte(result.SerialNumber))
+			if err != nil {
+				return nil, fmt.Errorf("Invalid namespace: %s", err)
+			}
+		case !utils.IsValidAstarteDeviceID(result.DeviceID):
+			result.Result = registrationInvalid
+			result.Details = "not a valid Astarte Device ID"
+		}
+		if result.Result == "" {
+			if row, ok := rowsByDeviceID[result.DeviceID]; ok {
+				result.Result = registrationSkipped
+				result.Details = fmt.Sprintf("duplicate of row %d", row)
+			} else {
+				rowsByDeviceID[result.DeviceID] = result.Row
+			}
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+func printRegistrationResults(outputFormat output.Format, results []registrationResult) error {
+	t := output.NewTable("Row", "Device ID", "Serial Number", "Result", "Details")
+	for _, result := range results {
+		t.AppendRow(result.Row, result.DeviceID, result.SerialNumber, result.Result, result.Details)
+	}
+	return output.Print(os.Stdout, outputFormat, results, t)
+}
+
+func readCredentialsPassphrase() ([]byte, error) {
+	if passphrase := os.Getenv(credentialsPassphraseEnv); passphrase != "" {
+		return []byte(passphrase), nil
+	}
+	if !terminal.IsTerminal(int(os.Stdin.Fd())) {
+		return nil, fmt.Errorf("--encrypt needs a passphrase: set %s", credentialsPassphraseEnv)
+	}
+	fmt.Fprint(os.Stderr, "Credentials file passphrase: ")
+	passphrase, err := terminal.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+	if len(passphrase) == 0 {
+		return nil, errors.New("Empty passphrase")
+	}
+	return passphrase, nil
+}
+
+// readCredentialsFile reads the credentials in file. Encrypted files might hold several messages, as batches of
+// credentials are appended as separate messages until a run completes.
+func readCredentialsFile(file string, format string, passphrase []byte) ([]deviceCredentials, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if passphrase == nil {
+		return parseCredentials(f, format, file)
+	}
+
+	credentials := []deviceCredentials{}
+	// Messages are decoded from the same buffered reader, which armor.Decode would otherwise wrap and read past
+	r := bufio.NewReader(f)
+	for messages := 0; ; messages++ {
+		block, err := armor.Decode(r)
+		if err == io.EOF && messages > 0 {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s is not an encrypted credentials file: %s", file, err)
+		}
+		prompted := false
+		message, err := openpgp.ReadMessage(block.Body, nil, func(keys []openpgp.Key, symmetric bool) ([]byte, error) {
+			if prompted {
+				return nil, errors.New("wrong passphrase")
+			}
+			prompted = true
+			return passphrase, nil
+		}, nil)
+		if err != nil {
+			return nil, fmt.Errorf("Could not decrypt %s: %s", file, err)
+		}
+		batch, err := parseCredentials(message.UnverifiedBody, format, file)
+		if err != nil {
+			return nil, err
+		}
+		// The integrity of a message is checked once it has been read entirely
+		if _, err := io.Copy(ioutil.Discard, message.UnverifiedBody); err != nil {
+			return nil, fmt.Errorf("Could not decrypt %s: %s", file, err)
+		}
+		credentials = append(credentials, batch...)
+	}
+	return credentials, nil
+}
+
+// parseCredentials parses a credentials document in format, read from file
+func parseCredentials(r io.Reader, format string, file string) ([]deviceCredentials, error) {
+	credentials := []deviceCredentials{}
+	switch format {
+	case "json":
+		if err := json.NewDecoder(r).Decode(&credentials); err != nil {
+			return nil, fmt.Errorf("Could not parse %s: %s", file, err)
+		}
+	case "csv":
+		records, err := csv.NewReader(r).ReadAll()
+		if err != nil {
+			return nil, fmt.Errorf("Could not parse %s: %s", file, err)
+		}
+		for i, record := range records {
+			if i == 0 {
+				continue
+			}
+			if len(record) != 3 {
+				return nil, fmt.Errorf("Could not parse %s: unexpected record on line %d", file, i+1)
+			}
+			credentials = append(credentials, deviceCredentials{DeviceID: record[0], SerialNumber: record[1], CredentialsSecret: record[2]})
+		}
+	}
+	return credentials, nil
+}
+
+// writeCredentialsFile replaces file with credentials. The file is written to a temporary file first, so
+// that an interrupted write does not lose the secrets of a previous run.
+func writeCredentialsFile(file string, format string, passphrase []byte, credentials []deviceCredentials) error {
+	content, err := encodeCredentials(format, credentials)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(file), "."+filepath.Base(file))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if passphrase == nil {
+		_, err = tmp.Write(content)
+	} else {
+		err = encryptTo(tmp, passphrase, content)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
+
+// appendCredentialsFile adds credentials to file, which holds the credentials of previous writes. Plain files
+// are extended in place, while encrypted files get another message holding only credentials.
+func appendCredentialsFile(file string, format string, passphrase []byte, credentials []deviceCredentials) error {
+	f, err := os.OpenFile(file, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err == nil {
+		switch {
+		case passphrase != nil:
+			var content []byte
+			if content, err = encodeCredentials(format, credentials); err == nil {
+				if _, err = f.Seek(0, io.SeekEnd); err == nil {
+					// Armored messages do not end with a newline
+					if _, err = f.Write([]byte("\n")); err == nil {
+						err = encryptTo(f, passphrase, content)
+					}
+				}
+			}
+		case format == "csv":
+			var content bytes.Buffer
+			w := csv.NewWriter(&content)
+			for _, c := range credentials {
+				w.Write([]string{c.DeviceID, c.SerialNumber, c.CredentialsSecret})
+			}
+			w.Flush()
+			if err = w.Error(); err == nil {
+				_, err = f.WriteAt(content.Bytes(), info.Size())
+			}
+		case format == "json":
+			err = appendJSONCredentials(f, info.Size(), credentials)
+		}
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// appendJSONCredentials inserts credentials at the end of the JSON array held by f, which is size bytes long
+// and was written by encodeCredentials
+func appendJSONCredentials(f *os.File, size int64, credentials []deviceCredentials) error {
+	tail := make([]byte, 16)
+	if size < int64(len(tail)) {
+		tail = tail[:size]
+	}
+	if _, err := f.ReadAt(tail, size-int64(len(tail))); err != nil {
+		return err
+	}
+	// The array is not empty, as there are credentials in the file
+	lastRecordEnd := bytes.LastIndexByte(tail, '}')
+	if lastRecordEnd < 0 {
+		return errors.New("unexpected end of the credentials array")
+	}
+	offset := size - int64(len(tail)) + int64(lastRecordEnd) + 1
+
+	var content bytes.Buffer
+	for _, c := range credentials {
+		record, err := json.MarshalIndent(c, "  ", "  ")
+		if err != nil {
+			return err
+		}
+		content.WriteString(",\n  ")
+		content.Write(record)
+	}
+	content.WriteString("\n]\n")
+	if _, err := f.WriteAt(content.Bytes(), offset); err != nil {
+		return err
+	}
+	return f.Truncate(offset + int64(content.Len()))
+}
+
+// encodeCredentials returns credentials as a document in format
+func encodeCredentials(format string, credentials []deviceCredentials) ([]byte, error) {
+	var content bytes.Buffer
+	switch format {
+	case "json":
+		encoder := json.NewEncoder(&content)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(credentials); err != nil {
+			return nil, err
+		}
+	case "csv":
+		w := csv.NewWriter(&content)
+		w.Write([]string{"device_id", "serial_number", "credentials_secret"})
+		for _, c := range credentials {
+			w.Write([]string{c.DeviceID, c.SerialNumber, c.CredentialsSecret})
+		}
+		w.Flush()
+		if err := w.Error(); err != nil {
+			return nil, err
+		}
+	}
+	return content.Bytes(), nil
+}
+
+func encryptTo(w io.Writer, passphrase []byte, plaintext []byte) error {
+	armored, err := armor.Encode(w, "PGP MESSAGE", nil)
+	if err != nil {
+		return err
+	}
+	encrypted, err := openpgp.SymmetricallyEncrypt(armored, passphrase, nil, nil)
+	if err != nil {
+		return err
+	}
+	if _, err := encrypted.Write(plaintext); err != nil {
+		return err
+	}
+	if err := encrypted.Close(); err != nil {
+		return err
+	}
+	return armored.Close()
+}
@@ -16,8 +16,10 @@ package pairing
 
 import (
 	"errors"
+	"fmt"
 
 	"github.com/astarte-platform/astartectl/client"
+	"github.com/astarte-platform/astartectl/cmd/config"
 	"github.com/astarte-platform/astartectl/utils"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -52,13 +54,13 @@ func pairingPersistentPreRunE(cmd *cobra.Command, args []string) error {
 	if pairingURLOverride != "" {
 		// Use explicit pairing-url
 		var err error
-		astarteAPIClient, err = client.NewClientWithIndividualURLs("", "", pairingURLOverride, "", nil)
+		astarteAPIClient, err = client.NewClientWithIndividualURLs("", "", pairingURLOverride, "", config.HTTPClient())
 		if err != nil {
 			return err
 		}
 	} else if astarteURL != "" {
 		var err error
-		astarteAPIClient, err = client.NewClient(astarteURL, nil)
+		astarteAPIClient, err = client.NewClient(astarteURL, config.HTTPClient())
 		if err != nil {
 			return err
 		}
@@ -68,7 +70,10 @@ func pairingPersistentPreRunE(cmd *cobra.Command, args []string) error {
 
 	viper.BindPFlag("realm.key", cmd.Flags().Lookup("realm-key"))
 	pairingKey := viper.GetString("realm.key")
-	explicitToken := viper.GetString("token")
+	explicitToken, err := config.GetExplicitToken()
+	if err != nil {
+		return err
+	}
 	if pairingKey == "" && explicitToken == "" {
 		return errors.New("realm-key or token is required")
 	}
@@ -81,7 +86,7 @@ func pairingPersistentPreRunE(cmd *cobra.Command, args []string) error {
 
 	if explicitToken == "" {
 		var err error
-		pairingJwt, err = generatePairingJWT(pairingKey)
+		pairingJwt, err = generatePairingJWT(pairingKey, cmd, args)
 		if err != nil {
 			return err
 		}
@@ -92,6 +97,14 @@ func pairingPersistentPreRunE(cmd *cobra.Command, args []string) error {
 	return nil
 }
 
-func generatePairingJWT(privateKey string) (jwtString string, err error) {
-	return utils.GenerateAstarteJWTFromKeyFile(privateKey, utils.Pairing, nil, 300)
+func generatePairingJWT(privateKey string, cmd *cobra.Command, args []string) (jwtString string, err error) {
+	if !viper.GetBool("least-privilege-tokens") {
+		return utils.GenerateAstarteJWTFromKeyFile(privateKey, utils.Pairing, nil, 300)
+	}
+
+	claims := utils.ExpandAuthorizationClaims(cmd.Annotations, utils.Pairing, args)
+	if len(claims) == 0 {
+		return "", fmt.Errorf("%s does not declare the Pairing claims it needs, and cannot be used with least-privilege-tokens", cmd.CommandPath())
+	}
+	return utils.GenerateAstarteJWTFromKeyFile(privateKey, utils.Pairing, claims, utils.LeastPrivilegeTokenTTL)
 }
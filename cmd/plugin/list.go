@@ -0,0 +1,104 @@
+// Copyright © 2019 Ispirata Srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugin
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+
+	"github.com/astarte-platform/astartectl/cmd/output"
+	"github.com/spf13/cobra"
+)
+
+var pluginListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List plugins",
+	Long: `List all plugins found in PATH.
+
+Plugins which cannot be invoked are reported together with the reason: their name collides with
+a built-in command, they are shadowed by a plugin with the same name found earlier in PATH,
+or they are not executable.`,
+	Example: `  astartectl plugin list`,
+	RunE:    pluginListF,
+	Aliases: []string{"ls"},
+}
+
+func init() {
+	output.AddFlag(pluginListCmd)
+}
+
+func pluginListF(command *cobra.Command, args []string) error {
+	outputFormat, err := output.FormatFromFlags(command)
+	if err != nil {
+		return err
+	}
+
+	plugins := List()
+	if len(plugins) == 0 && outputFormat.IsHumanReadable() {
+		fmt.Printf("No plugins found in PATH. Plugins are executables named %s<name>.\n", Prefix)
+		return nil
+	}
+
+	t := output.NewTable("Command", "Path", "Status")
+	pluginsStatus := []map[string]string{}
+	firstPaths := map[string]string{}
+	for _, p := range plugins {
+		status := "ok"
+		if builtin := builtinCommand(command.Root(), p); builtin != "" {
+			status = fmt.Sprintf("shadowed by built-in command %s", builtin)
+		} else if firstPath, ok := firstPaths[p.Name]; ok {
+			status = fmt.Sprintf("shadowed by %s", firstPath)
+		} else if !isExecutable(p.Path) {
+			status = "not executable"
+		}
+		if _, ok := firstPaths[p.Name]; !ok {
+			firstPaths[p.Name] = p.Path
+		}
+
+		invocation := "astartectl " + strings.Join(p.CommandPath(), " ")
+		t.AppendRow(invocation, p.Path, status)
+		pluginsStatus = append(pluginsStatus, map[string]string{
+			"name":   p.Name,
+			"path":   p.Path,
+			"status": status,
+		})
+	}
+
+	return output.Print(os.Stdout, outputFormat, pluginsStatus, t)
+}
+
+// builtinCommand returns the name of the built-in command which takes precedence over the plugin, if any
+func builtinCommand(root *cobra.Command, p Plugin) string {
+	firstToken := p.CommandPath()[0]
+	for _, c := range root.Commands() {
+		if c.Name() == firstToken || c.HasAlias(firstToken) {
+			return c.Name()
+		}
+	}
+	return ""
+}
+
+func isExecutable(path string) bool {
+	info, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	if runtime.GOOS == "windows" {
+		return true
+	}
+	return info.Mode()&0111 != 0
+}
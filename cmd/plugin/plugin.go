@@ -0,0 +1,274 @@
+// Copyright © 2019 Ispirata Srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugin
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+
+	"github.com/astarte-platform/astartectl/cmd/config"
+	"github.com/astarte-platform/astartectl/utils"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// Prefix is the prefix of the name of plugin executables. astartectl-fleet-report is invoked as
+// astartectl fleet report.
+const Prefix = "astartectl-"
+
+// ClaimsSuffix is the suffix of the file, next to a plugin executable, declaring the authorization claims
+// the plugin needs. The claims of astartectl-fleet-report are declared in astartectl-fleet-report.claims.
+const ClaimsSuffix = ".claims"
+
+// tokenTTL is the lifetime, in seconds, of tokens minted for plugins. Plugins might perform several
+// calls, hence it is longer than the one of tokens minted for built-in commands.
+const tokenTTL = 300
+
+// PluginCmd represents the plugin command
+var PluginCmd = &cobra.Command{
+	Use:   "plugin",
+	Short: "Manage astartectl plugins",
+	Long: `Manage astartectl plugins.
+
+Any executable named astartectl-<name> found in PATH can be invoked as astartectl <name>. Dashes in
+the executable name map to subcommands: astartectl-fleet-report is invoked as astartectl fleet report.
+Built-in commands always take precedence over plugins.
+
+Plugins receive the settings of the current context through the following environment variables:
+  ASTARTECTL_URL          Base URL of the Astarte instance
+  ASTARTECTL_REALM_NAME   Name of the realm
+  ASTARTECTL_TOKEN        A freshly minted token, valid for 5 minutes and holding only the claims the plugin
+                          declares. It is generated from the realm key if available, otherwise from the
+                          housekeeping key. An explicit token or token command takes precedence.
+  ASTARTECTL_CONTEXT      Name of the context in use
+  ASTARTECTL_CONFIG       Path to the configuration file in use
+
+As these variables are honored by astartectl itself, plugins can invoke astartectl and share the same settings.
+
+Plugins receive a token only if they declare the claims they need in a file named after their executable with
+the .claims suffix, e.g. astartectl-fleet-report.claims. The file holds one claim per line, prefixed by the
+Astarte service it applies to, and can reference the plugin's positional arguments as $1, $2, ...:
+  # Lines starting with # are comments
+  appengine: GET::devices/$1
+  realm-management: GET::interfaces
+Plugins without a claims file, or with an empty one, receive no token.
+
+Global flags, such as --context, are honored when given before the plugin name. Anything after it is passed
+to the plugin.`,
+}
+
+// Plugin represents a plugin executable found in PATH
+type Plugin struct {
+	// Name is the name of the plugin, as invoked through astartectl (e.g. fleet-report)
+	Name string
+	Path string
+}
+
+// CommandPath returns the arguments used to invoke the plugin through astartectl
+func (p Plugin) CommandPath() []string {
+	return strings.Split(p.Name, "-")
+}
+
+func init() {
+	PluginCmd.AddCommand(pluginListCmd)
+}
+
+// List returns all plugins found in PATH, in the order in which they are looked up. Plugins with the
+// same name can appear several times if they are found in several directories: only the first one is invoked.
+func List() []Plugin {
+	plugins := []Plugin{}
+	seenDirs := map[string]bool{}
+	for _, dir := range filepath.SplitList(os.Getenv("PATH")) {
+		if dir == "" || seenDirs[dir] {
+			continue
+		}
+		seenDirs[dir] = true
+
+		entries, err := ioutil.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		names := []string{}
+		for _, entry := range entries {
+			if entry.IsDir() || !strings.HasPrefix(entry.Name(), Prefix) || strings.HasSuffix(entry.Name(), ClaimsSuffix) {
+				continue
+			}
+			names = append(names, entry.Name())
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			pluginName := strings.TrimPrefix(name, Prefix)
+			if runtime.GOOS == "windows" {
+				pluginName = strings.TrimSuffix(pluginName, filepath.Ext(pluginName))
+			}
+			if pluginName == "" {
+				continue
+			}
+			plugins = append(plugins, Plugin{Name: pluginName, Path: filepath.Join(dir, name)})
+		}
+	}
+
+	return plugins
+}
+
+// Find looks up the plugin handling args, preferring the longest match. It returns the path of the plugin
+// executable and the arguments to be passed to it.
+func Find(args []string) (string, []string, bool) {
+	commandPath := []string{}
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "-") {
+			break
+		}
+		commandPath = append(commandPath, arg)
+	}
+
+	for i := len(commandPath); i > 0; i-- {
+		pluginPath, err := exec.LookPath(Prefix + strings.Join(commandPath[:i], "-"))
+		if err == nil {
+			return pluginPath, args[i:], true
+		}
+	}
+
+	return "", nil, false
+}
+
+// Run executes the plugin at pluginPath, passing args and the settings of the current context. It returns once
+// the plugin exits, and the returned error can be an *exec.ExitError holding the plugin's exit code.
+func Run(pluginPath string, args []string) error {
+	environment, err := Environment(pluginPath, args)
+	if err != nil {
+		return err
+	}
+
+	c := exec.Command(pluginPath, args...)
+	c.Stdin = os.Stdin
+	c.Stdout = os.Stdout
+	c.Stderr = os.Stderr
+	c.Env = append(os.Environ(), environment...)
+	return c.Run()
+}
+
+// Environment returns the environment variables passing the settings of the current context to the plugin at
+// pluginPath, invoked with args
+func Environment(pluginPath string, args []string) ([]string, error) {
+	environment := []string{}
+	settings := map[string]string{
+		"ASTARTECTL_URL":        viper.GetString("url"),
+		"ASTARTECTL_REALM_NAME": viper.GetString("realm.name"),
+		"ASTARTECTL_CONTEXT":    config.CurrentContextName(),
+		"ASTARTECTL_CONFIG":     viper.ConfigFileUsed(),
+	}
+	for name, value := range settings {
+		if value != "" {
+			environment = append(environment, name+"="+value)
+		}
+	}
+
+	token, err := pluginToken(pluginPath, args)
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		environment = append(environment, "ASTARTECTL_TOKEN="+token)
+	}
+
+	sort.Strings(environment)
+	return environment, nil
+}
+
+// pluginToken returns the token passed to the plugin at pluginPath, invoked with args. Only plugins declaring the
+// claims they need receive one, which holds only those claims.
+func pluginToken(pluginPath string, args []string) (string, error) {
+	annotations, err := readClaimsFile(ClaimsPath(pluginPath))
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+
+	// Only positional arguments can be referenced by claims
+	positionalArgs := []string{}
+	for _, arg := range args {
+		if !strings.HasPrefix(arg, "-") {
+			positionalArgs = append(positionalArgs, arg)
+		}
+	}
+	realmClaims := map[utils.AstarteService][]string{}
+	for _, astarteService := range []utils.AstarteService{utils.AppEngine, utils.RealmManagement, utils.Pairing, utils.Channels} {
+		if claims := utils.ExpandAuthorizationClaims(annotations, astarteService, positionalArgs); len(claims) > 0 {
+			realmClaims[astarteService] = claims
+		}
+	}
+	housekeepingClaims := utils.ExpandAuthorizationClaims(annotations, utils.Housekeeping, positionalArgs)
+	if len(realmClaims) == 0 && len(housekeepingClaims) == 0 {
+		return "", nil
+	}
+
+	explicitToken, err := config.GetExplicitToken()
+	if err != nil || explicitToken != "" {
+		return explicitToken, err
+	}
+	if realmKey := viper.GetString("realm.key"); realmKey != "" && len(realmClaims) > 0 {
+		return utils.GenerateMultiServiceAstarteJWTWithClaimsFromKeyFile(realmKey, realmClaims, tokenTTL)
+	}
+	if housekeepingKey := viper.GetString("housekeeping.key"); housekeepingKey != "" && len(housekeepingClaims) > 0 {
+		return utils.GenerateAstarteJWTFromKeyFile(housekeepingKey, utils.Housekeeping, housekeepingClaims, tokenTTL)
+	}
+
+	return "", nil
+}
+
+// ClaimsPath returns the path of the file declaring the claims needed by the plugin at pluginPath
+func ClaimsPath(pluginPath string) string {
+	if runtime.GOOS == "windows" {
+		pluginPath = strings.TrimSuffix(pluginPath, filepath.Ext(pluginPath))
+	}
+	return pluginPath + ClaimsSuffix
+}
+
+// readClaimsFile reads the claims declared in a plugin claims file, returning them in the same form commands
+// declare them in their annotations
+func readClaimsFile(claimsPath string) (map[string]string, error) {
+	f, err := os.Open(claimsPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	annotations := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		tokens := strings.SplitN(text, ":", 2)
+		astarteService, err := utils.AstarteServiceFromString(strings.TrimSpace(tokens[0]))
+		if len(tokens) != 2 || err != nil || strings.TrimSpace(tokens[1]) == "" {
+			return nil, fmt.Errorf("%s:%d: expected <service>: <claim>, got %q", claimsPath, line, text)
+		}
+		key := utils.AuthorizationClaimsAnnotation(astarteService)
+		annotations[key] += strings.TrimSpace(tokens[1]) + "\n"
+	}
+	return annotations, scanner.Err()
+}
@@ -0,0 +1,133 @@
+package plugin
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/astarte-platform/astartectl/utils"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/spf13/viper"
+)
+
+func TestFind(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("plugin fixtures are shell scripts")
+	}
+
+	dir, err := ioutil.TempDir("", "astartectl-plugins")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"astartectl-fleet", "astartectl-fleet-report"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("#!/bin/sh\n"), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Claims files are not plugins
+	if err := ioutil.WriteFile(filepath.Join(dir, "astartectl-fleet-report.claims"), []byte("appengine: GET::devices\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", dir)
+
+	pluginPath, pluginArgs, found := Find([]string{"fleet", "report", "--all", "extra"})
+	if !found || pluginPath != filepath.Join(dir, "astartectl-fleet-report") ||
+		!reflect.DeepEqual(pluginArgs, []string{"--all", "extra"}) {
+		t.Errorf("unexpected lookup result: %v %v %v", pluginPath, pluginArgs, found)
+	}
+
+	pluginPath, pluginArgs, found = Find([]string{"fleet", "status"})
+	if !found || pluginPath != filepath.Join(dir, "astartectl-fleet") || !reflect.DeepEqual(pluginArgs, []string{"status"}) {
+		t.Errorf("unexpected lookup result: %v %v %v", pluginPath, pluginArgs, found)
+	}
+
+	if _, _, found := Find([]string{"provision"}); found {
+		t.Error("unexpected plugin found")
+	}
+
+	plugins := List()
+	if len(plugins) != 2 || plugins[1].Name != "fleet-report" ||
+		!reflect.DeepEqual(plugins[1].CommandPath(), []string{"fleet", "report"}) {
+		t.Errorf("unexpected plugins: %v", plugins)
+	}
+}
+
+func TestPluginToken(t *testing.T) {
+	dir, err := ioutil.TempDir("", "astartectl-plugins")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(dir, "realm.pem")
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	pluginPath := filepath.Join(dir, "astartectl-fleet-report")
+
+	viper.Set("realm.key", keyFile)
+	defer viper.Set("realm.key", "")
+
+	// Plugins have to declare their claims to receive a token
+	if environment, err := Environment(pluginPath, nil); err != nil || strings.Contains(strings.Join(environment, " "), "ASTARTECTL_TOKEN") {
+		t.Errorf("unexpected environment %v, %v", environment, err)
+	}
+
+	claims := "# Devices of a group\nappengine: GET::groups/$1/devices\nrealm-management: GET::interfaces\n"
+	if err := ioutil.WriteFile(ClaimsPath(pluginPath), []byte(claims), 0644); err != nil {
+		t.Fatal(err)
+	}
+	environment, err := Environment(pluginPath, []string{"--all", "north"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := ""
+	for _, variable := range environment {
+		if strings.HasPrefix(variable, "ASTARTECTL_TOKEN=") {
+			token = strings.TrimPrefix(variable, "ASTARTECTL_TOKEN=")
+		}
+	}
+	mapClaims := jwt.MapClaims{}
+	if _, _, err := new(jwt.Parser).ParseUnverified(token, mapClaims); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[utils.AstarteService][]string{
+		utils.AppEngine:       {"GET::groups/north/devices"},
+		utils.RealmManagement: {"GET::interfaces"},
+	}
+	if authorizationClaims := utils.GetAstarteJWTAuthorizationClaims(mapClaims); !reflect.DeepEqual(authorizationClaims, expected) {
+		t.Errorf("expected claims %v, got %v", expected, authorizationClaims)
+	}
+	if ttl := mapClaims["exp"].(float64) - mapClaims["iat"].(float64); ttl != tokenTTL {
+		t.Errorf("unexpected token lifetime %v", ttl)
+	}
+
+	// An empty claims file declares that no token is needed
+	if err := ioutil.WriteFile(ClaimsPath(pluginPath), []byte("# No Astarte APIs\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if environment, err := Environment(pluginPath, nil); err != nil || strings.Contains(strings.Join(environment, " "), "ASTARTECTL_TOKEN") {
+		t.Errorf("unexpected environment %v, %v", environment, err)
+	}
+
+	if err := ioutil.WriteFile(ClaimsPath(pluginPath), []byte("GET::devices\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Environment(pluginPath, nil); err == nil {
+		t.Error("expected an invalid claims file error")
+	}
+}
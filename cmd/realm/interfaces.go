@@ -21,7 +21,9 @@ import (
 	"os"
 	"strconv"
 
+	"github.com/astarte-platform/astartectl/cmd/output"
 	"github.com/astarte-platform/astartectl/common"
+	"github.com/astarte-platform/astartectl/utils"
 	"github.com/spf13/cobra"
 )
 
@@ -40,6 +42,9 @@ var interfacesListCmd = &cobra.Command{
 	Example: `  astartectl realm-management interfaces list`,
 	RunE:    interfacesListF,
 	Aliases: []string{"ls"},
+	Annotations: map[string]string{
+		utils.AuthorizationClaimsAnnotation(utils.RealmManagement): "GET::interfaces",
+	},
 }
 
 var interfacesVersionsCmd = &cobra.Command{
@@ -49,6 +54,9 @@ var interfacesVersionsCmd = &cobra.Command{
 	Example: `  astartectl realm-management interfaces versions com.my.Interface`,
 	Args:    cobra.ExactArgs(1),
 	RunE:    interfacesVersionsF,
+	Annotations: map[string]string{
+		utils.AuthorizationClaimsAnnotation(utils.RealmManagement): "GET::interfaces/$1",
+	},
 }
 
 var interfacesShowCmd = &cobra.Command{
@@ -58,6 +66,9 @@ var interfacesShowCmd = &cobra.Command{
 	Example: `  astartectl realm-management interfaces show com.my.Interface 0`,
 	Args:    cobra.ExactArgs(2),
 	RunE:    interfacesShowF,
+	Annotations: map[string]string{
+		utils.AuthorizationClaimsAnnotation(utils.RealmManagement): "GET::interfaces/$1/$2",
+	},
 }
 
 var interfacesInstallCmd = &cobra.Command{
@@ -68,6 +79,9 @@ var interfacesInstallCmd = &cobra.Command{
 	Example: `  astartectl realm-management interfaces install com.my.Interface.json`,
 	Args:    cobra.ExactArgs(1),
 	RunE:    interfacesInstallF,
+	Annotations: map[string]string{
+		utils.AuthorizationClaimsAnnotation(utils.RealmManagement): "POST::interfaces",
+	},
 }
 
 var interfacesDeleteCmd = &cobra.Command{
@@ -81,6 +95,9 @@ Non-draft interfaces should be removed manually or by your system administrator.
 	Args:    cobra.ExactArgs(1),
 	RunE:    interfacesDeleteF,
 	Aliases: []string{"del"},
+	Annotations: map[string]string{
+		utils.AuthorizationClaimsAnnotation(utils.RealmManagement): "DELETE::interfaces/$1/0",
+	},
 }
 
 var interfacesUpdateCmd = &cobra.Command{
@@ -93,11 +110,19 @@ The name and major version of the interface are read from the interface file.`,
 	Example: `  astartectl realm-management interfaces update com.my.Interface.json`,
 	Args:    cobra.ExactArgs(1),
 	RunE:    interfacesUpdateF,
+	Annotations: map[string]string{
+		utils.AuthorizationClaimsAnnotation(utils.RealmManagement): "PUT::interfaces/[^/]+/[0-9]+",
+	},
 }
 
 func init() {
 	RealmManagementCmd.AddCommand(interfacesCmd)
 
+	output.AddFlag(interfacesListCmd)
+	output.AddFlag(interfacesVersionsCmd)
+	// Interfaces are shown as JSON by default, as they are defined
+	output.AddFlagWithDefault(interfacesShowCmd, output.JSONOutput)
+
 	interfacesCmd.AddCommand(
 		interfacesListCmd,
 		interfacesVersionsCmd,
@@ -109,26 +134,42 @@ func init() {
 }
 
 func interfacesListF(command *cobra.Command, args []string) error {
+	outputFormat, err := output.FormatFromFlags(command)
+	if err != nil {
+		return err
+	}
+
 	realmInterfaces, err := astarteAPIClient.RealmManagement.ListInterfaces(realm, realmManagementJwt)
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
 
-	fmt.Println(realmInterfaces)
-	return nil
+	t := output.NewTable("Interface")
+	for _, realmInterface := range realmInterfaces {
+		t.AppendRow(realmInterface)
+	}
+	return output.Print(os.Stdout, outputFormat, realmInterfaces, t)
 }
 
 func interfacesVersionsF(command *cobra.Command, args []string) error {
 	interfaceName := args[0]
+	outputFormat, err := output.FormatFromFlags(command)
+	if err != nil {
+		return err
+	}
+
 	interfaceVersions, err := astarteAPIClient.RealmManagement.ListInterfaceMajorVersions(realm, interfaceName, realmManagementJwt)
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
 
-	fmt.Println(interfaceVersions)
-	return nil
+	t := output.NewTable("Major Version")
+	for _, interfaceVersion := range interfaceVersions {
+		t.AppendRow(interfaceVersion)
+	}
+	return output.Print(os.Stdout, outputFormat, interfaceVersions, t)
 }
 
 func interfacesShowF(command *cobra.Command, args []string) error {
@@ -138,6 +179,10 @@ func interfacesShowF(command *cobra.Command, args []string) error {
 	if err != nil {
 		return err
 	}
+	outputFormat, err := output.FormatFromFlags(command)
+	if err != nil {
+		return err
+	}
 
 	interfaceDefinition, err := astarteAPIClient.RealmManagement.GetInterface(realm, interfaceName, interfaceMajor, realmManagementJwt)
 	if err != nil {
@@ -145,9 +190,12 @@ func interfacesShowF(command *cobra.Command, args []string) error {
 		os.Exit(1)
 	}
 
-	respJSON, _ := json.MarshalIndent(interfaceDefinition, "", "  ")
-	fmt.Println(string(respJSON))
-	return nil
+	t := output.NewTable("Endpoint", "Type").AddWideColumns("Reliability", "Retention", "Expiry", "Allow Unset", "Description")
+	for _, mapping := range interfaceDefinition.Mappings {
+		t.AppendRow(mapping.Endpoint, mapping.Type, mapping.Reliability, mapping.Retention, mapping.Expiry,
+			mapping.AllowUnset, mapping.Description)
+	}
+	return output.Print(os.Stdout, outputFormat, interfaceDefinition, t)
 }
 
 func interfacesInstallF(command *cobra.Command, args []string) error {
@@ -16,8 +16,10 @@ package realm
 
 import (
 	"errors"
+	"fmt"
 
 	"github.com/astarte-platform/astartectl/client"
+	"github.com/astarte-platform/astartectl/cmd/config"
 
 	"github.com/astarte-platform/astartectl/utils"
 	"github.com/spf13/cobra"
@@ -53,13 +55,13 @@ func realmManagementPersistentPreRunE(cmd *cobra.Command, args []string) error {
 	if realmManagementURLOverride != "" {
 		// Use explicit realm-management-url
 		var err error
-		astarteAPIClient, err = client.NewClientWithIndividualURLs("", "", "", realmManagementURLOverride, nil)
+		astarteAPIClient, err = client.NewClientWithIndividualURLs("", "", "", realmManagementURLOverride, config.HTTPClient())
 		if err != nil {
 			return err
 		}
 	} else if astarteURL != "" {
 		var err error
-		astarteAPIClient, err = client.NewClient(astarteURL, nil)
+		astarteAPIClient, err = client.NewClient(astarteURL, config.HTTPClient())
 		if err != nil {
 			return err
 		}
@@ -69,7 +71,10 @@ func realmManagementPersistentPreRunE(cmd *cobra.Command, args []string) error {
 
 	viper.BindPFlag("realm.key", cmd.Flags().Lookup("realm-key"))
 	realmManagementKey := viper.GetString("realm.key")
-	explicitToken := viper.GetString("token")
+	explicitToken, err := config.GetExplicitToken()
+	if err != nil {
+		return err
+	}
 	if realmManagementKey == "" && explicitToken == "" {
 		return errors.New("either realm-key or token is required")
 	}
@@ -82,7 +87,7 @@ func realmManagementPersistentPreRunE(cmd *cobra.Command, args []string) error {
 
 	if explicitToken == "" {
 		var err error
-		realmManagementJwt, err = generateRealmManagementJWT(realmManagementKey)
+		realmManagementJwt, err = generateRealmManagementJWT(realmManagementKey, cmd, args)
 		if err != nil {
 			return err
 		}
@@ -93,6 +98,14 @@ func realmManagementPersistentPreRunE(cmd *cobra.Command, args []string) error {
 	return nil
 }
 
-func generateRealmManagementJWT(privateKey string) (jwtString string, err error) {
-	return utils.GenerateAstarteJWTFromKeyFile(privateKey, utils.RealmManagement, nil, 300)
+func generateRealmManagementJWT(privateKey string, cmd *cobra.Command, args []string) (jwtString string, err error) {
+	if !viper.GetBool("least-privilege-tokens") {
+		return utils.GenerateAstarteJWTFromKeyFile(privateKey, utils.RealmManagement, nil, 300)
+	}
+
+	claims := utils.ExpandAuthorizationClaims(cmd.Annotations, utils.RealmManagement, args)
+	if len(claims) == 0 {
+		return "", fmt.Errorf("%s does not declare the Realm Management claims it needs, and cannot be used with least-privilege-tokens", cmd.CommandPath())
+	}
+	return utils.GenerateAstarteJWTFromKeyFile(privateKey, utils.RealmManagement, claims, utils.LeastPrivilegeTokenTTL)
 }
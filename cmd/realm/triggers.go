@@ -20,6 +20,8 @@ import (
 	"io/ioutil"
 	"os"
 
+	"github.com/astarte-platform/astartectl/cmd/output"
+	"github.com/astarte-platform/astartectl/utils"
 	"github.com/spf13/cobra"
 )
 
@@ -38,6 +40,9 @@ var triggersListCmd = &cobra.Command{
 	Example: `  astartectl realm-management triggers list`,
 	RunE:    triggersListF,
 	Aliases: []string{"ls"},
+	Annotations: map[string]string{
+		utils.AuthorizationClaimsAnnotation(utils.RealmManagement): "GET::triggers",
+	},
 }
 
 var triggersShowCmd = &cobra.Command{
@@ -47,6 +52,9 @@ var triggersShowCmd = &cobra.Command{
 	Example: `  astartectl realm-management triggers show my_data_trigger`,
 	Args:    cobra.ExactArgs(1),
 	RunE:    triggersShowF,
+	Annotations: map[string]string{
+		utils.AuthorizationClaimsAnnotation(utils.RealmManagement): "GET::triggers/$1",
+	},
 }
 
 var triggersInstallCmd = &cobra.Command{
@@ -57,6 +65,9 @@ var triggersInstallCmd = &cobra.Command{
 	Example: `  astartectl realm-management triggers install my_data_trigger.json`,
 	Args:    cobra.ExactArgs(1),
 	RunE:    triggersInstallF,
+	Annotations: map[string]string{
+		utils.AuthorizationClaimsAnnotation(utils.RealmManagement): "POST::triggers",
+	},
 }
 
 var triggersDeleteCmd = &cobra.Command{
@@ -67,11 +78,18 @@ var triggersDeleteCmd = &cobra.Command{
 	Args:    cobra.ExactArgs(1),
 	RunE:    triggersDeleteF,
 	Aliases: []string{"del"},
+	Annotations: map[string]string{
+		utils.AuthorizationClaimsAnnotation(utils.RealmManagement): "DELETE::triggers/$1",
+	},
 }
 
 func init() {
 	RealmManagementCmd.AddCommand(triggersCmd)
 
+	output.AddFlag(triggersListCmd)
+	// Triggers are shown as JSON by default, as they are defined
+	output.AddFlagWithDefault(triggersShowCmd, output.JSONOutput)
+
 	triggersCmd.AddCommand(
 		triggersListCmd,
 		triggersShowCmd,
@@ -81,18 +99,30 @@ func init() {
 }
 
 func triggersListF(command *cobra.Command, args []string) error {
+	outputFormat, err := output.FormatFromFlags(command)
+	if err != nil {
+		return err
+	}
+
 	realmTriggers, err := astarteAPIClient.RealmManagement.ListTriggers(realm, realmManagementJwt)
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
 
-	fmt.Println(realmTriggers)
-	return nil
+	t := output.NewTable("Trigger")
+	for _, realmTrigger := range realmTriggers {
+		t.AppendRow(realmTrigger)
+	}
+	return output.Print(os.Stdout, outputFormat, realmTriggers, t)
 }
 
 func triggersShowF(command *cobra.Command, args []string) error {
 	triggerName := args[0]
+	outputFormat, err := output.FormatFromFlags(command)
+	if err != nil {
+		return err
+	}
 
 	triggerDefinition, err := astarteAPIClient.RealmManagement.GetTrigger(realm, triggerName, realmManagementJwt)
 	if err != nil {
@@ -100,9 +130,7 @@ func triggersShowF(command *cobra.Command, args []string) error {
 		os.Exit(1)
 	}
 
-	respJSON, _ := json.MarshalIndent(triggerDefinition, "", "  ")
-	fmt.Println(string(respJSON))
-	return nil
+	return output.Print(os.Stdout, outputFormat, triggerDefinition, nil)
 }
 
 func triggersInstallF(command *cobra.Command, args []string) error {
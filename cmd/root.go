@@ -16,18 +16,23 @@ package cmd
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
+	"os/exec"
 	"strings"
 
 	"github.com/astarte-platform/astartectl/cmd/appengine"
 	"github.com/astarte-platform/astartectl/cmd/cluster"
+	"github.com/astarte-platform/astartectl/cmd/config"
 	"github.com/astarte-platform/astartectl/cmd/housekeeping"
 	"github.com/astarte-platform/astartectl/cmd/pairing"
+	"github.com/astarte-platform/astartectl/cmd/plugin"
 	"github.com/astarte-platform/astartectl/cmd/realm"
 	"github.com/astarte-platform/astartectl/cmd/utils"
 
 	homedir "github.com/mitchellh/go-homedir"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 )
 
@@ -48,6 +53,11 @@ See below for usage details`,
 // Execute adds all child commands to the root command and sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the rootCmd.
 func Execute() {
+	// Commands which are not built in are looked up as plugins
+	if pluginPath, pluginArgs, found := findPlugin(os.Args[1:]); found {
+		executePlugin(pluginPath, pluginArgs)
+	}
+
 	if err := rootCmd.Execute(); err != nil {
 		fmt.Println(err)
 		os.Exit(1)
@@ -63,8 +73,19 @@ func init() {
 	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.astartectl.yaml)")
 	rootCmd.PersistentFlags().StringP("astarte-url", "u", "", "Base url for your Astarte deployment (e.g. https://api.astarte.example.com)")
 	rootCmd.PersistentFlags().StringP("token", "t", "", "Token for authenticating against Astarte APIs. When set, it takes precedence over any private key setting. Claims in the token have to match the permissions needed for the individual command.")
+	rootCmd.PersistentFlags().String("context", "", "The name of the configuration context to use. Defaults to the current context.")
+	rootCmd.PersistentFlags().Bool("least-privilege-tokens", false, `When generating tokens from a private key, mint short-lived tokens holding only the claims needed by the individual command,
+rather than all-access ones.`)
+	rootCmd.PersistentFlags().IntP("verbosity", "v", 0, `Trace calls to Astarte APIs on stderr. 1 logs method, URL, status and latency of each call, 6 adds headers,
+8 adds bodies truncated to 1 KiB and 9 logs them in full. Tokens and credentials secrets are always redacted. -v alone is the same as -v=1.`)
+	rootCmd.PersistentFlags().Lookup("verbosity").NoOptDefVal = "1"
+	rootCmd.PersistentFlags().Bool("print-curl", false, "Print each call to Astarte APIs on stderr as an equivalent curl command, referencing the token as $ASTARTE_TOKEN.")
 	viper.BindPFlag("url", rootCmd.PersistentFlags().Lookup("astarte-url"))
 	viper.BindPFlag("token", rootCmd.PersistentFlags().Lookup("token"))
+	viper.BindPFlag("context", rootCmd.PersistentFlags().Lookup("context"))
+	viper.BindPFlag("least-privilege-tokens", rootCmd.PersistentFlags().Lookup("least-privilege-tokens"))
+	viper.BindPFlag("verbosity", rootCmd.PersistentFlags().Lookup("verbosity"))
+	viper.BindPFlag("print-curl", rootCmd.PersistentFlags().Lookup("print-curl"))
 
 	rootCmd.AddCommand(housekeeping.HousekeepingCmd)
 	rootCmd.AddCommand(pairing.PairingCmd)
@@ -72,6 +93,43 @@ func init() {
 	rootCmd.AddCommand(utils.UtilsCmd)
 	rootCmd.AddCommand(appengine.AppEngineCmd)
 	rootCmd.AddCommand(cluster.ClusterCmd)
+	rootCmd.AddCommand(config.ConfigCmd)
+	rootCmd.AddCommand(plugin.PluginCmd)
+}
+
+// findPlugin looks up the plugin handling args, if they do not invoke a built-in command. Global flags given before
+// the plugin name are parsed, so that they apply to the plugin invocation.
+func findPlugin(args []string) (string, []string, bool) {
+	globalFlags := pflag.NewFlagSet(rootCmd.Name(), pflag.ContinueOnError)
+	globalFlags.SetInterspersed(false)
+	globalFlags.SetOutput(ioutil.Discard)
+	globalFlags.AddFlagSet(rootCmd.PersistentFlags())
+	if err := globalFlags.Parse(args); err != nil {
+		// Let cobra report the error
+		return "", nil, false
+	}
+
+	commandArgs := globalFlags.Args()
+	if len(commandArgs) == 0 {
+		return "", nil, false
+	}
+	if _, _, err := rootCmd.Find(commandArgs); err == nil {
+		return "", nil, false
+	}
+	return plugin.Find(commandArgs)
+}
+
+func executePlugin(pluginPath string, pluginArgs []string) {
+	// Plugins bypass cobra, hence configuration has to be loaded explicitly
+	initConfig()
+	if err := plugin.Run(pluginPath, pluginArgs); err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			os.Exit(exitErr.ExitCode())
+		}
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	os.Exit(0)
 }
 
 // initConfig reads in config file and ENV variables if set.
@@ -109,4 +167,12 @@ func initConfig() {
 		// If we explicitly provided a config, print a failure message
 		fmt.Printf("Cannot use %s for configuration: %s\n", viper.ConfigFileUsed(), err.Error())
 	}
+
+	// If a context is in use, its settings override the flat configuration.
+	if contextName := config.CurrentContextName(); contextName != "" {
+		if err := config.ApplyContext(contextName); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
 }
@@ -0,0 +1,1014 @@
+// Copyright © 2019 Ispirata Srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bufio"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/astarte-platform/astartectl/astartetest"
+	"github.com/astarte-platform/astartectl/client"
+	"github.com/astarte-platform/astartectl/common"
+	"github.com/astarte-platform/astartectl/utils"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+const testDeviceID = "2TBn-jNESuuHamE2Zo1anA"
+
+var testInterface = common.AstarteInterface{
+	Name:         "org.example.Temperature",
+	MajorVersion: 1,
+	Type:         common.DatastreamType,
+	Ownership:    common.DeviceOwnership,
+	Mappings:     []common.AstarteInterfaceMapping{{Endpoint: "/%{sensor}/value", Type: "double"}},
+}
+
+// setupCLITest starts an astartetest Server with a "test" realm, and points astartectl to it through a
+// configuration file holding the Housekeeping and realm keys
+func setupCLITest(t *testing.T) (*astartetest.Server, *astartetest.Realm, func()) {
+	server, err := astartetest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	realm := server.AddRealm("test")
+
+	dir, err := ioutil.TempDir("", "astartectl-test")
+	if err != nil {
+		server.Close()
+		t.Fatal(err)
+	}
+	housekeepingKey := filepath.Join(dir, "housekeeping.pem")
+	realmKey := filepath.Join(dir, "realm.pem")
+	configFile := filepath.Join(dir, "config.yaml")
+	config := fmt.Sprintf("url: %s\nhousekeeping:\n  key: %s\nrealm:\n  name: test\n  key: %s\n", server.URL(), housekeepingKey, realmKey)
+	for file, content := range map[string][]byte{
+		housekeepingKey: server.HousekeepingPrivateKey(),
+		realmKey:        realm.PrivateKey(),
+		configFile:      []byte(config),
+	} {
+		if err := ioutil.WriteFile(file, content, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	oldHome, oldConfig := os.Getenv("HOME"), os.Getenv("ASTARTECTL_CONFIG")
+	os.Setenv("HOME", dir)
+	os.Setenv("ASTARTECTL_CONFIG", configFile)
+
+	return server, realm, func() {
+		os.Setenv("HOME", oldHome)
+		os.Setenv("ASTARTECTL_CONFIG", oldConfig)
+		os.RemoveAll(dir)
+		server.Close()
+	}
+}
+
+// executeCommand runs astartectl with args and returns what it printed to stdout. Commands exit the
+// process on failure, hence only successful invocations can be tested.
+func executeCommand(t *testing.T, args ...string) string {
+	resetFlags(rootCmd)
+	rootCmd.SetArgs(args)
+
+	stdout := os.Stdout
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Stdout = w
+	outputChannel := make(chan string)
+	go func() {
+		out, _ := ioutil.ReadAll(r)
+		outputChannel <- string(out)
+	}()
+
+	err = rootCmd.Execute()
+	w.Close()
+	os.Stdout = stdout
+	out := <-outputChannel
+	if err != nil {
+		t.Fatalf("astartectl %s failed: %v", strings.Join(args, " "), err)
+	}
+	return out
+}
+
+// resetFlags restores all flags to their default values, as cobra keeps them across executions
+func resetFlags(command *cobra.Command) {
+	reset := func(f *pflag.Flag) {
+		if !f.Changed {
+			return
+		}
+		// Setting a slice appends to it, and its default is formatted as [a,b]
+		if sliceValue, ok := f.Value.(pflag.SliceValue); ok {
+			defaults := []string{}
+			if trimmed := strings.Trim(f.DefValue, "[]"); trimmed != "" {
+				defaults = strings.Split(trimmed, ",")
+			}
+			sliceValue.Replace(defaults)
+		} else {
+			f.Value.Set(f.DefValue)
+		}
+		f.Changed = false
+	}
+	command.Flags().VisitAll(reset)
+	command.PersistentFlags().VisitAll(reset)
+	for _, c := range command.Commands() {
+		resetFlags(c)
+	}
+}
+
+func TestHousekeepingCommands(t *testing.T) {
+	_, _, teardown := setupCLITest(t)
+	defer teardown()
+
+	var realms []string
+	if err := json.Unmarshal([]byte(executeCommand(t, "housekeeping", "realms", "list", "-o", "json")), &realms); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(realms, []string{"test"}) {
+		t.Errorf("unexpected realms: %v", realms)
+	}
+}
+
+func TestInspectJWTLeastPrivilege(t *testing.T) {
+	server, realm, teardown := setupCLITest(t)
+	defer teardown()
+
+	// Capture the token used to fetch the realm public key
+	serverURL, err := url.Parse(server.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := httputil.NewSingleHostReverseProxy(serverURL)
+	var housekeepingToken string
+	frontend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		housekeepingToken = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		proxy.ServeHTTP(w, r)
+	}))
+	defer frontend.Close()
+
+	out := executeCommand(t, "utils", "inspect-jwt", realm.Token(utils.AppEngine), "--realm-name", "test",
+		"--astarte-url", frontend.URL, "--least-privilege-tokens")
+	if !regexp.MustCompile(`Signature:\s+valid`).MatchString(out) {
+		t.Errorf("the signature was not verified: %s", out)
+	}
+	_, claims, err := utils.ParseAstarteJWT(housekeepingToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[utils.AstarteService][]string{utils.Housekeeping: {"GET::realms/test"}}
+	if authorizationClaims := utils.GetAstarteJWTAuthorizationClaims(claims); !reflect.DeepEqual(authorizationClaims, expected) {
+		t.Errorf("expected claims %v, got %v", expected, authorizationClaims)
+	}
+}
+
+func TestRealmManagementCommands(t *testing.T) {
+	_, realm, teardown := setupCLITest(t)
+	defer teardown()
+	realm.AddInterface(testInterface)
+	realm.AddTrigger(map[string]interface{}{"name": "connections"})
+
+	if out := executeCommand(t, "realm-management", "interfaces", "list"); !strings.Contains(out, testInterface.Name) {
+		t.Errorf("unexpected interfaces list output: %s", out)
+	}
+
+	var astarteInterface common.AstarteInterface
+	out := executeCommand(t, "realm-management", "interfaces", "show", testInterface.Name, "1", "-o", "json")
+	if err := json.Unmarshal([]byte(out), &astarteInterface); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(astarteInterface, testInterface) {
+		t.Errorf("unexpected interface: %+v", astarteInterface)
+	}
+
+	if out := executeCommand(t, "realm-management", "triggers", "list"); !strings.Contains(out, "connections") {
+		t.Errorf("unexpected triggers list output: %s", out)
+	}
+}
+
+func TestPairingCommands(t *testing.T) {
+	_, realm, teardown := setupCLITest(t)
+	defer teardown()
+
+	var registration map[string]string
+	if err := json.Unmarshal([]byte(executeCommand(t, "pairing", "agent", "register", testDeviceID, "-o", "json")), &registration); err != nil {
+		t.Fatal(err)
+	}
+	if registration["credentials_secret"] == "" || registration["credentials_secret"] != realm.Device(testDeviceID).CredentialsSecret() {
+		t.Errorf("unexpected registration: %v", registration)
+	}
+
+	executeCommand(t, "pairing", "agent", "unregister", testDeviceID, "-y")
+	if realm.Device(testDeviceID).CredentialsSecret() != "" {
+		t.Error("device was not unregistered")
+	}
+
+	dir, err := ioutil.TempDir("", "astartectl-interfaces")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	interfaceJSON, err := json.Marshal(testInterface)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "temperature.json"), interfaceJSON, 0600); err != nil {
+		t.Fatal(err)
+	}
+	executeCommand(t, "pairing", "agent", "register", "f0VMRgIBAQAAAAAAAAAAAA", "--introspection-from", dir,
+		"--introspection", "org.example.Config:0:3")
+	expected := map[string]client.DeviceInterfaceIntrospection{testInterface.Name: {Major: 1}, "org.example.Config": {Minor: 3}}
+	if introspection := realm.Device("f0VMRgIBAQAAAAAAAAAAAA").Details().Introspection; !reflect.DeepEqual(introspection, expected) {
+		t.Errorf("unexpected introspection: %v", introspection)
+	}
+}
+
+func TestAppEngineCommands(t *testing.T) {
+	_, realm, teardown := setupCLITest(t)
+	defer teardown()
+	realm.AddInterface(testInterface)
+	start := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	device := realm.AddDevice(testDeviceID).SetIntrospection(testInterface.Name, 1, 0).AddAlias("name", "thermostat")
+	for i := 0; i < 3; i++ {
+		device.AppendDatastream(testInterface.Name, "/indoor/value", float64(20+i), start.Add(time.Duration(i)*time.Minute))
+	}
+
+	if out := executeCommand(t, "appengine", "devices", "list"); !strings.Contains(out, testDeviceID) {
+		t.Errorf("unexpected devices list output: %s", out)
+	}
+	if out := executeCommand(t, "appengine", "devices", "show", "thermostat"); !strings.Contains(out, testDeviceID) {
+		t.Errorf("unexpected devices show output: %s", out)
+	}
+	if out := executeCommand(t, "appengine", "devices", "data-snapshot", testDeviceID); !strings.Contains(out, "/indoor/value") {
+		t.Errorf("unexpected data-snapshot output: %s", out)
+	}
+
+	var samples []map[string]interface{}
+	out := executeCommand(t, "appengine", "devices", "get-samples", testDeviceID, testInterface.Name, "/indoor/value", "-o", "json")
+	if err := json.Unmarshal([]byte(out), &samples); err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	if len(samples) != 3 || samples[0]["value"] != 22.0 {
+		t.Errorf("unexpected samples: %v", samples)
+	}
+
+	executeCommand(t, "appengine", "devices", "aliases", "add", testDeviceID, "serial=SN-42")
+	executeCommand(t, "appengine", "devices", "aliases", "remove", testDeviceID, "name")
+	if aliases := device.Details().Aliases; !reflect.DeepEqual(aliases, map[string]string{"serial": "SN-42"}) {
+		t.Errorf("unexpected aliases: %v", aliases)
+	}
+}
+
+func TestDevicesStatsCommand(t *testing.T) {
+	server, realm, teardown := setupCLITest(t)
+	defer teardown()
+	now := time.Now()
+	realm.AddDevice(testDeviceID).EditDetails(func(d *client.DeviceDetails) {
+		d.Connected = true
+		d.LastConnection = now.Add(-time.Hour)
+		d.TotalReceivedMessages = 10
+		d.TotalReceivedBytes = 4096
+	})
+	realm.AddDevice("f0VMRgIBAQAAAAAAAAAAAA").EditDetails(func(d *client.DeviceDetails) {
+		d.LastConnection = now.Add(-48 * time.Hour)
+		d.LastDisconnection = now.Add(-47 * time.Hour)
+		d.TotalReceivedMessages = 20
+		d.TotalReceivedBytes = 1024
+	})
+	realm.AddDevice("AAAAAAAAAAAAAAAAAAAAAA")
+
+	for _, disableDevicesStats := range []bool{false, true} {
+		server.DisableDevicesStats = disableDevicesStats
+		var stats map[string]interface{}
+		if err := json.Unmarshal([]byte(executeCommand(t, "appengine", "devices", "stats", "--top", "1", "-o", "json")), &stats); err != nil {
+			t.Fatal(err)
+		}
+		if stats["total_devices"] != 3.0 || stats["connected_devices"] != 1.0 || stats["never_connected_devices"] != 1.0 {
+			t.Errorf("unexpected stats: %v", stats)
+		}
+		histogram := stats["last_seen_histogram"].([]interface{})
+		if histogram[2].(map[string]interface{})["devices"] != 1.0 {
+			t.Errorf("unexpected last seen histogram: %v", histogram)
+		}
+		topByMessages := stats["top_by_messages"].([]interface{})
+		topByBytes := stats["top_by_bytes"].([]interface{})
+		if len(topByMessages) != 1 || topByMessages[0].(map[string]interface{})["device_id"] != "f0VMRgIBAQAAAAAAAAAAAA" ||
+			topByBytes[0].(map[string]interface{})["device_id"] != testDeviceID {
+			t.Errorf("unexpected top talkers: %v %v", topByMessages, topByBytes)
+		}
+	}
+
+	// Devices which cannot be retrieved are left out
+	serverURL, err := url.Parse(server.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := httputil.NewSingleHostReverseProxy(serverURL)
+	frontend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/devices/"+testDeviceID) {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		proxy.ServeHTTP(w, r)
+	}))
+	defer frontend.Close()
+	var stats map[string]interface{}
+	out := executeCommand(t, "appengine", "devices", "stats", "-o", "json", "--astarte-url", frontend.URL)
+	if err := json.Unmarshal([]byte(out), &stats); err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	if stats["total_devices"] != 3.0 || stats["failed_devices"] != 1.0 || stats["never_connected_devices"] != 1.0 {
+		t.Errorf("unexpected stats: %v", stats)
+	}
+
+	resetFlags(rootCmd)
+	rootCmd.SetArgs([]string{"appengine", "devices", "stats", "--top", "-1"})
+	rootCmd.SetOutput(ioutil.Discard)
+	defer rootCmd.SetOutput(nil)
+	if err := rootCmd.Execute(); err == nil || err.Error() != "top must not be negative" {
+		t.Errorf("expected a negative top error, got %v", err)
+	}
+}
+
+func TestAliasesImportExportCommands(t *testing.T) {
+	server, realm, teardown := setupCLITest(t)
+	defer teardown()
+	device := realm.AddDevice(testDeviceID).AddAlias("name", "thermostat").AddAlias("room", "kitchen")
+	other := realm.AddDevice("f0VMRgIBAQAAAAAAAAAAAA")
+
+	dir, err := ioutil.TempDir("", "astartectl-aliases")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	mapping := filepath.Join(dir, "aliases.csv")
+	csvContent := "device_id,tag,alias\n" +
+		testDeviceID + ",name,thermostat\n" +
+		testDeviceID + ",serial,SN-42\n" +
+		testDeviceID + ",room,\n" +
+		"f0VMRgIBAQAAAAAAAAAAAA,name,boiler\n"
+	if err := ioutil.WriteFile(mapping, []byte(csvContent), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var results []map[string]interface{}
+	out := executeCommand(t, "appengine", "devices", "aliases", "import", mapping, "--dry-run", "-o", "json")
+	if err := json.Unmarshal([]byte(out), &results); err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	if len(results) != 4 || results[1]["details"] != "dry run, would be added" {
+		t.Errorf("unexpected dry run results: %v", results)
+	}
+	if aliases := device.Details().Aliases; len(aliases) != 2 {
+		t.Errorf("dry run changed aliases: %v", aliases)
+	}
+
+	out = executeCommand(t, "appengine", "devices", "aliases", "import", mapping, "-o", "json")
+	if err := json.Unmarshal([]byte(out), &results); err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	for i, expected := range []string{"unchanged", "added", "removed", "added"} {
+		if results[i]["result"] != expected {
+			t.Errorf("unexpected result of row %d: %v", i+1, results[i])
+		}
+	}
+	if aliases := device.Details().Aliases; !reflect.DeepEqual(aliases, map[string]string{"name": "thermostat", "serial": "SN-42"}) {
+		t.Errorf("unexpected aliases: %v", aliases)
+	}
+	if aliases := other.Details().Aliases; !reflect.DeepEqual(aliases, map[string]string{"name": "boiler"}) {
+		t.Errorf("unexpected aliases: %v", aliases)
+	}
+
+	var exported []map[string]string
+	if err := json.Unmarshal([]byte(executeCommand(t, "appengine", "devices", "aliases", "export", "-o", "json")), &exported); err != nil {
+		t.Fatal(err)
+	}
+	if len(exported) != 3 || exported[0]["device_id"] != testDeviceID || exported[0]["tag"] != "name" {
+		t.Errorf("unexpected export: %v", exported)
+	}
+	// Aliases are not assigned when their owner cannot be looked up
+	serverURL, err := url.Parse(server.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := httputil.NewSingleHostReverseProxy(serverURL)
+	frontend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/devices-by-alias/heater") {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		proxy.ServeHTTP(w, r)
+	}))
+	defer frontend.Close()
+	if err := ioutil.WriteFile(mapping, []byte("device_id,tag,alias\n"+testDeviceID+",kind,heater\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	out, exitCode := runCommandProcess(t, "appengine", "devices", "aliases", "import", mapping, "-o", "json",
+		"--astarte-url", frontend.URL)
+	if exitCode != 1 || !strings.Contains(out, "could not check whether the alias is taken") {
+		t.Errorf("unexpected result with a failing lookup: %d, %s", exitCode, out)
+	}
+	if _, ok := device.Details().Aliases["kind"]; ok {
+		t.Errorf("alias assigned despite a failing lookup: %v", device.Details().Aliases)
+	}
+}
+
+func TestBulkRegistrationCommand(t *testing.T) {
+	_, realm, teardown := setupCLITest(t)
+	defer teardown()
+
+	dir, err := ioutil.TempDir("", "astartectl-registration")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	idsFile := filepath.Join(dir, "ids.csv")
+	credentialsFile := filepath.Join(dir, "secrets.csv")
+	if err := ioutil.WriteFile(idsFile, []byte("device_id\n"+testDeviceID+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	executeCommand(t, "pairing", "agent", "register", "--from-file", idsFile, "--credentials-file", credentialsFile)
+
+	// A second run resumes from the credentials file, skipping the devices it holds
+	if err := ioutil.WriteFile(idsFile, []byte("device_id\n"+testDeviceID+"\nf0VMRgIBAQAAAAAAAAAAAA\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	var results []map[string]interface{}
+	out := executeCommand(t, "pairing", "agent", "register", "--from-file", idsFile, "--credentials-file", credentialsFile, "-o", "json")
+	if err := json.Unmarshal([]byte(out), &results); err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	if len(results) != 2 || results[0]["result"] != "skipped" || results[1]["result"] != "registered" {
+		t.Errorf("unexpected results: %v", results)
+	}
+	credentials, err := ioutil.ReadFile(credentialsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := fmt.Sprintf("device_id,serial_number,credentials_secret\n%s,,%s\nf0VMRgIBAQAAAAAAAAAAAA,,%s\n", testDeviceID,
+		realm.Device(testDeviceID).CredentialsSecret(), realm.Device("f0VMRgIBAQAAAAAAAAAAAA").CredentialsSecret())
+	if string(credentials) != expected {
+		t.Errorf("unexpected credentials file: %s", credentials)
+	}
+
+	// Device IDs derived from serial numbers, with an encrypted credentials file
+	os.Setenv("ASTARTECTL_CREDENTIALS_PASSPHRASE", "correct horse battery staple")
+	defer os.Unsetenv("ASTARTECTL_CREDENTIALS_PASSPHRASE")
+	serialsFile := filepath.Join(dir, "serials.txt")
+	encryptedFile := filepath.Join(dir, "secrets.json.asc")
+	if err := ioutil.WriteFile(serialsFile, []byte("SN-1\nSN-2\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, expectedResult := range []string{"registered", "skipped"} {
+		out := executeCommand(t, "pairing", "agent", "register", "--from-file", serialsFile, "--namespace",
+			"7d1e8b4c-2d7a-4d3f-9a41-6f3b0f1f3c2e", "--credentials-file", encryptedFile, "--encrypt", "-o", "json")
+		if err := json.Unmarshal([]byte(out), &results); err != nil {
+			t.Fatalf("%v: %s", err, out)
+		}
+		if len(results) != 2 || results[0]["result"] != expectedResult || results[1]["serial_number"] != "SN-2" {
+			t.Errorf("unexpected results: %v", results)
+		}
+		if realm.Device(results[1]["device_id"].(string)).CredentialsSecret() == "" {
+			t.Errorf("device %v was not registered", results[1]["device_id"])
+		}
+	}
+	encrypted, err := ioutil.ReadFile(encryptedFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(encrypted), "-----BEGIN PGP MESSAGE-----") || strings.Contains(string(encrypted), "SN-1") {
+		t.Errorf("credentials file is not encrypted: %s", encrypted)
+	}
+}
+
+func TestInterruptedBulkRegistration(t *testing.T) {
+	server, realm, teardown := setupCLITest(t)
+	defer teardown()
+
+	dir, err := ioutil.TempDir("", "astartectl-registration")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	const secondDeviceID, thirdDeviceID = "f0VMRgIBAQAAAAAAAAAAAA", "AAAAAAAAAAAAAAAAAAAAAA"
+	idsFile := filepath.Join(dir, "ids.csv")
+	credentialsFile := filepath.Join(dir, "secrets.csv")
+	if err := ioutil.WriteFile(idsFile, []byte("device_id\n"+testDeviceID+"\n"+secondDeviceID+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Take a snapshot of the credentials file when the second registration is sent, as if the run was killed then
+	serverURL, err := url.Parse(server.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := httputil.NewSingleHostReverseProxy(serverURL)
+	var snapshot []byte
+	registrations := 0
+	frontend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/agent/devices") {
+			if registrations++; registrations == 2 {
+				snapshot, _ = ioutil.ReadFile(credentialsFile)
+			}
+		}
+		proxy.ServeHTTP(w, r)
+	}))
+	defer frontend.Close()
+	executeCommand(t, "pairing", "agent", "register", "--from-file", idsFile, "--credentials-file", credentialsFile,
+		"--concurrency", "1", "--astarte-url", frontend.URL)
+
+	expected := fmt.Sprintf("device_id,serial_number,credentials_secret\n%s,,%s\n", testDeviceID, realm.Device(testDeviceID).CredentialsSecret())
+	if string(snapshot) != expected {
+		t.Fatalf("the secret of the first device was not saved before registering the second one: %q", snapshot)
+	}
+
+	// Resuming from the interrupted run skips the devices it registered
+	if err := ioutil.WriteFile(credentialsFile, snapshot, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(idsFile, []byte("device_id\n"+testDeviceID+"\n"+thirdDeviceID+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	var results []map[string]interface{}
+	out := executeCommand(t, "pairing", "agent", "register", "--from-file", idsFile, "--credentials-file", credentialsFile, "-o", "json")
+	if err := json.Unmarshal([]byte(out), &results); err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	if len(results) != 2 || results[0]["result"] != "skipped" || results[1]["result"] != "registered" {
+		t.Errorf("unexpected results: %v", results)
+	}
+	credentials, err := ioutil.ReadFile(credentialsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(credentials) != expected+thirdDeviceID+",,"+realm.Device(thirdDeviceID).CredentialsSecret()+"\n" {
+		t.Errorf("unexpected credentials file: %s", credentials)
+	}
+}
+
+func TestAppendedCredentialsFiles(t *testing.T) {
+	server, realm, teardown := setupCLITest(t)
+	defer teardown()
+	const passphrase = "correct horse battery staple"
+	os.Setenv("ASTARTECTL_CREDENTIALS_PASSPHRASE", passphrase)
+	defer os.Unsetenv("ASTARTECTL_CREDENTIALS_PASSPHRASE")
+
+	dir, err := ioutil.TempDir("", "astartectl-registration")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	idsFile := filepath.Join(dir, "ids.csv")
+
+	// Take a snapshot of the credentials file when the last registration is sent, and fail it
+	serverURL, err := url.Parse(server.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := httputil.NewSingleHostReverseProxy(serverURL)
+	var failedDeviceID, credentialsFile string
+	var snapshot []byte
+	frontend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/agent/devices") {
+			body, _ := ioutil.ReadAll(r.Body)
+			r.Body = ioutil.NopCloser(strings.NewReader(string(body)))
+			if failedDeviceID != "" && strings.Contains(string(body), failedDeviceID) {
+				snapshot, _ = ioutil.ReadFile(credentialsFile)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+		}
+		proxy.ServeHTTP(w, r)
+	}))
+	defer frontend.Close()
+
+	testCases := []struct {
+		credentialsFile string
+		deviceIDs       []string
+	}{
+		{"secrets.json", []string{testDeviceID, "f0VMRgIBAQAAAAAAAAAAAA", "AAAAAAAAAAAAAAAAAAAAAA", "BBBBBBBBBBBBBBBBBBBBBA"}},
+		{"secrets.json.asc", []string{"CCCCCCCCCCCCCCCCCCCCCA", "DDDDDDDDDDDDDDDDDDDDDA", "EEEEEEEEEEEEEEEEEEEEEA", "FFFFFFFFFFFFFFFFFFFFFA"}},
+	}
+	for _, tc := range testCases {
+		credentialsFile = filepath.Join(dir, tc.credentialsFile)
+		encrypted := strings.HasSuffix(credentialsFile, ".asc")
+		args := []string{"pairing", "agent", "register", "--from-file", idsFile, "--credentials-file", credentialsFile,
+			"--concurrency", "1", "--astarte-url", frontend.URL}
+		if encrypted {
+			args = append(args, "--encrypt")
+		}
+		writeIDs := func(ids ...string) {
+			if err := ioutil.WriteFile(idsFile, []byte(strings.Join(ids, "\n")+"\n"), 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// readCredentials returns the credentials in the file and the number of messages it holds
+		readCredentials := func(content []byte) ([]map[string]string, int) {
+			if !encrypted {
+				var credentials []map[string]string
+				if err := json.Unmarshal(content, &credentials); err != nil {
+					t.Fatalf("%v: %s", err, content)
+				}
+				return credentials, 1
+			}
+			credentials := []map[string]string{}
+			r := bufio.NewReader(strings.NewReader(string(content)))
+			messages := 0
+			for ; ; messages++ {
+				block, err := armor.Decode(r)
+				if err == io.EOF {
+					break
+				} else if err != nil {
+					t.Fatal(err)
+				}
+				message, err := openpgp.ReadMessage(block.Body, nil, func([]openpgp.Key, bool) ([]byte, error) {
+					return []byte(passphrase), nil
+				}, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var batch []map[string]string
+				if err := json.NewDecoder(message.UnverifiedBody).Decode(&batch); err != nil {
+					t.Fatal(err)
+				}
+				credentials = append(credentials, batch...)
+			}
+			return credentials, messages
+		}
+
+		writeIDs(tc.deviceIDs[0])
+		executeCommand(t, args...)
+
+		// Each registration of the next run is appended to the file
+		writeIDs(tc.deviceIDs...)
+		failedDeviceID = tc.deviceIDs[3]
+		if _, exitCode := runCommandProcess(t, args...); exitCode != 1 {
+			t.Errorf("unexpected exit code %d", exitCode)
+		}
+		failedDeviceID = ""
+		credentials, messages := readCredentials(snapshot)
+		if len(credentials) != 3 || (encrypted && messages != 3) {
+			t.Errorf("unexpected credentials file when interrupted, with %d messages: %v", messages, credentials)
+		}
+
+		// Resuming from the interrupted run reads all its credentials, and an encrypted file is saved as a single message
+		if err := ioutil.WriteFile(credentialsFile, snapshot, 0600); err != nil {
+			t.Fatal(err)
+		}
+		executeCommand(t, args...)
+		content, err := ioutil.ReadFile(credentialsFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		credentials, messages = readCredentials(content)
+		if len(credentials) != len(tc.deviceIDs) || messages != 1 {
+			t.Fatalf("unexpected credentials file, with %d messages: %v", messages, credentials)
+		}
+		for i, c := range credentials {
+			if c["device_id"] != tc.deviceIDs[i] || c["credentials_secret"] != realm.Device(tc.deviceIDs[i]).CredentialsSecret() {
+				t.Errorf("unexpected credentials: %v", c)
+			}
+		}
+	}
+}
+
+func TestProvisionCommand(t *testing.T) {
+	server, realm, teardown := setupCLITest(t)
+	defer teardown()
+
+	var config map[string]string
+	out := executeCommand(t, "pairing", "agent", "provision", testDeviceID, "--format", "python")
+	if err := json.Unmarshal([]byte(out), &config); err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	expected := map[string]string{
+		"device_id":          testDeviceID,
+		"realm":              "test",
+		"credentials_secret": realm.Device(testDeviceID).CredentialsSecret(),
+		"pairing_base_url":   server.URL() + "/pairing",
+	}
+	if !reflect.DeepEqual(config, expected) {
+		t.Errorf("unexpected configuration: %v", config)
+	}
+
+	dir, err := ioutil.TempDir("", "astartectl-provision")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	interfacesDir := filepath.Join(dir, "interfaces")
+	bundleDir := filepath.Join(dir, "bundle")
+	interfaceJSON, err := json.Marshal(testInterface)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(interfacesDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(interfacesDir, "temperature.json"), interfaceJSON, 0600); err != nil {
+		t.Fatal(err)
+	}
+	out = executeCommand(t, "pairing", "agent", "provision", "f0VMRgIBAQAAAAAAAAAAAA", "--format", "qt", "--introspection-from",
+		interfacesDir, "--include-interfaces", "--output-dir", bundleDir, "--qr")
+	if !strings.Contains(out, "█") {
+		t.Errorf("no QR code in output: %s", out)
+	}
+	ini, err := ioutil.ReadFile(filepath.Join(bundleDir, "astarte.ini"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(ini), "credentialsSecret="+realm.Device("f0VMRgIBAQAAAAAAAAAAAA").CredentialsSecret()+"\n") {
+		t.Errorf("unexpected configuration: %s", ini)
+	}
+	if _, err := os.Stat(filepath.Join(bundleDir, "interfaces", testInterface.Name+".json")); err != nil {
+		t.Error(err)
+	}
+	if _, ok := realm.Device("f0VMRgIBAQAAAAAAAAAAAA").Details().Introspection[testInterface.Name]; !ok {
+		t.Error("the device was registered without its introspection")
+	}
+}
+
+func TestFindPlugin(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("plugin fixtures are shell scripts")
+	}
+	dir, err := ioutil.TempDir("", "astartectl-plugins")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "astartectl-fleet-report"), []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", dir)
+	defer resetFlags(rootCmd)
+
+	// Global flags before the plugin name apply to the plugin invocation, the following ones are passed to it
+	pluginPath, pluginArgs, found := findPlugin([]string{"--context", "staging", "-v", "fleet", "report", "--context", "other"})
+	if !found || pluginPath != filepath.Join(dir, "astartectl-fleet-report") || !reflect.DeepEqual(pluginArgs, []string{"--context", "other"}) {
+		t.Errorf("unexpected lookup result: %v %v %v", pluginPath, pluginArgs, found)
+	}
+	if context := viper.GetString("context"); context != "staging" {
+		t.Errorf("unexpected context %s", context)
+	}
+	if verbosity := viper.GetInt("verbosity"); verbosity != 1 {
+		t.Errorf("unexpected verbosity %d", verbosity)
+	}
+
+	for _, args := range [][]string{{"appengine", "devices", "list"}, {"--context", "staging"}, {"--unknown", "fleet", "report"}} {
+		if _, _, found := findPlugin(args); found {
+			t.Errorf("unexpected plugin found for %v", args)
+		}
+	}
+}
+
+// TestCommandProcess runs astartectl with the arguments following "--" when started by startCommandProcess. It is not
+// a test by itself: it allows testing commands which exit the process or never return.
+func TestCommandProcess(t *testing.T) {
+	if os.Getenv("ASTARTECTL_TEST_COMMAND_PROCESS") != "1" {
+		return
+	}
+	args := []string{}
+	for i, arg := range os.Args {
+		if arg == "--" {
+			args = os.Args[i+1:]
+			break
+		}
+	}
+	rootCmd.SetArgs(args)
+	if err := rootCmd.Execute(); err != nil {
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// startCommandProcess starts astartectl with args in a separate process, sharing the environment of the test. It
+// returns the process together with a channel receiving the lines it prints to stdout.
+func startCommandProcess(t *testing.T, args ...string) (*exec.Cmd, <-chan string) {
+	c := exec.Command(os.Args[0], append([]string{"-test.run=^TestCommandProcess$", "--"}, args...)...)
+	c.Env = append(os.Environ(), "ASTARTECTL_TEST_COMMAND_PROCESS=1")
+	stdout, err := c.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+	lines := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(stdout)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		close(lines)
+	}()
+	return c, lines
+}
+
+// runCommandProcess runs astartectl with args in a separate process, and returns what it printed to stdout
+// together with its exit code
+func runCommandProcess(t *testing.T, args ...string) (string, int) {
+	c, lines := startCommandProcess(t, args...)
+	out := ""
+	for line := range lines {
+		out += line + "\n"
+	}
+	if err := c.Wait(); err != nil {
+		exitErr, ok := err.(*exec.ExitError)
+		if !ok {
+			t.Fatal(err)
+		}
+		return out, exitErr.ExitCode()
+	}
+	return out, 0
+}
+
+func TestJWTCommands(t *testing.T) {
+	server, realm, teardown := setupCLITest(t)
+	defer teardown()
+	token, err := utils.GenerateAstarteJWTFromPEMKey(realm.PrivateKey(), utils.AppEngine, []string{"GET::devices/.*"}, 300)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	block, _ := pem.Decode(realm.PrivateKey())
+	privateKey, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKeyBytes, err := x509.MarshalPKIXPublicKey(&privateKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKeyFile := filepath.Join(os.Getenv("HOME"), "realm_public.pem")
+	if err := ioutil.WriteFile(publicKeyFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicKeyBytes}), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var inspection map[string]interface{}
+	out := executeCommand(t, "utils", "inspect-jwt", token, "--public-key", publicKeyFile, "-o", "json")
+	if err := json.Unmarshal([]byte(out), &inspection); err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	claims, _ := inspection["claims"].(map[string]interface{})
+	if inspection["signature"] != "valid" || !reflect.DeepEqual(claims["a_aea"], []interface{}{"GET::devices/.*"}) {
+		t.Errorf("unexpected inspection: %v", inspection)
+	}
+	// Tokens signed with another key are reported as invalid
+	otherToken, err := utils.GenerateAstarteJWTFromPEMKey(server.HousekeepingPrivateKey(), utils.AppEngine, nil, 300)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out, exitCode := runCommandProcess(t, "utils", "inspect-jwt", otherToken, "--public-key", publicKeyFile); exitCode != 1 ||
+		!regexp.MustCompile(`Signature:\s+INVALID`).MatchString(out) {
+		t.Errorf("unexpected inspection of a token signed with another key, exit code %d: %s", exitCode, out)
+	}
+
+	out = executeCommand(t, "utils", "jwt", "check", token, "appengine", "GET", "/v1/test/devices/"+testDeviceID)
+	if !regexp.MustCompile(`Result:\s+ALLOWED`).MatchString(out) || !strings.Contains(out, "GET::devices/.*") {
+		t.Errorf("unexpected check result: %s", out)
+	}
+	if out, exitCode := runCommandProcess(t, "utils", "jwt", "check", token, "appengine", "POST", "devices/"+testDeviceID); exitCode != 1 ||
+		!regexp.MustCompile(`Result:\s+DENIED`).MatchString(out) {
+		t.Errorf("unexpected check result, exit code %d: %s", exitCode, out)
+	}
+}
+
+func TestConfigCommands(t *testing.T) {
+	server, _, teardown := setupCLITest(t)
+	defer teardown()
+	housekeepingKey := filepath.Join(os.Getenv("HOME"), "housekeeping.pem")
+
+	executeCommand(t, "config", "set-context", "staging", "--url", server.URL(), "--housekeeping-key", housekeepingKey)
+	executeCommand(t, "config", "set-context", "broken", "--url", "http://127.0.0.1:1", "--housekeeping-key", housekeepingKey)
+
+	var contexts []map[string]interface{}
+	if err := json.Unmarshal([]byte(executeCommand(t, "config", "get-contexts", "-o", "json")), &contexts); err != nil {
+		t.Fatal(err)
+	}
+	expected := []map[string]interface{}{
+		{"name": "broken", "current": false, "url": "http://127.0.0.1:1", "realm": ""},
+		{"name": "staging", "current": true, "url": server.URL(), "realm": ""},
+	}
+	if !reflect.DeepEqual(contexts, expected) {
+		t.Errorf("expected contexts %v, got %v", expected, contexts)
+	}
+
+	// --context overrides the current context
+	executeCommand(t, "config", "use-context", "broken")
+	var realms []string
+	if err := json.Unmarshal([]byte(executeCommand(t, "--context", "staging", "housekeeping", "realms", "list", "-o", "json")), &realms); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(realms, []string{"test"}) {
+		t.Errorf("unexpected realms: %v", realms)
+	}
+	if out := executeCommand(t, "--context", "staging", "config", "view", "--minify"); !strings.Contains(out, "current-context: staging") ||
+		strings.Contains(out, "broken") {
+		t.Errorf("unexpected minified configuration: %s", out)
+	}
+
+	executeCommand(t, "config", "delete-context", "broken")
+	out := executeCommand(t, "config", "view")
+	if strings.Contains(out, "broken") || !strings.Contains(out, "staging") {
+		t.Errorf("unexpected configuration after deleting a context: %s", out)
+	}
+}
+
+func TestWatchStateCommand(t *testing.T) {
+	_, realm, teardown := setupCLITest(t)
+	defer teardown()
+	device := realm.AddDevice(testDeviceID).AddAlias("name", "thermostat")
+
+	c, lines := startCommandProcess(t, "appengine", "devices", "watch-state", "thermostat", "--interval", "50ms",
+		"--skip-properties", "-o", "ndjson", "--least-privilege-tokens")
+	defer c.Process.Kill()
+
+	// Wait for the first poll to record the initial state before changing it
+	time.Sleep(500 * time.Millisecond)
+	device.EditDetails(func(details *client.DeviceDetails) { details.Connected = true })
+
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				t.Fatal("watch-state exited")
+			}
+			var event map[string]interface{}
+			if err := json.Unmarshal([]byte(line), &event); err != nil {
+				t.Fatalf("%v: %s", err, line)
+			}
+			if event["device_id"] != testDeviceID || event["type"] != "connected" {
+				t.Fatalf("unexpected event: %v", event)
+			}
+			return
+		case <-timeout:
+			t.Fatal("no event was printed")
+		}
+	}
+}
+
+func TestWatchStateAllCommand(t *testing.T) {
+	_, realm, teardown := setupCLITest(t)
+	defer teardown()
+	realm.AddDevice(testDeviceID)
+
+	c, lines := startCommandProcess(t, "appengine", "devices", "watch-state", "--all", "--interval", "50ms",
+		"--skip-properties", "-o", "ndjson")
+	defer c.Process.Kill()
+
+	time.Sleep(500 * time.Millisecond)
+	const addedDeviceID = "fUCX6fkvRnOCR3EO6p-sVA"
+	realm.AddDevice(addedDeviceID)
+
+	select {
+	case line, ok := <-lines:
+		if !ok {
+			t.Fatal("watch-state exited")
+		}
+		var event map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &event); err != nil {
+			t.Fatalf("%v: %s", err, line)
+		}
+		if event["device_id"] != addedDeviceID || event["type"] != "device_added" {
+			t.Fatalf("unexpected event: %v", event)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("no event was printed")
+	}
+}
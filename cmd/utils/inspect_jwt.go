@@ -0,0 +1,273 @@
+// Copyright © 2019 Ispirata Srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/astarte-platform/astartectl/client"
+	"github.com/astarte-platform/astartectl/cmd/config"
+	"github.com/astarte-platform/astartectl/cmd/output"
+	"github.com/astarte-platform/astartectl/utils"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var inspectJwtCmd = &cobra.Command{
+	Use:   "inspect-jwt <token>",
+	Short: "Inspect a JWT",
+	Long: `Decode a JWT and print its header and claims in a human readable form.
+
+Astarte authorization claims are grouped by the Astarte API they grant access to.
+When --public-key is given, the signature of the token is verified against it. Alternatively,
+the realm public key can be fetched through Housekeeping by specifying --realm-name, together with
+a Housekeeping key (or token) and the Astarte URL.`,
+	Example: `  astartectl utils inspect-jwt eyJhbGciOiJSUzI1NiIsInR5cCI6IkpXVCJ9...
+  astartectl utils inspect-jwt eyJhbGciOiJSUzI1NiIsInR5cCI6IkpXVCJ9... -p myrealm_public.pem
+  astartectl utils inspect-jwt eyJhbGciOiJSUzI1NiIsInR5cCI6IkpXVCJ9... -r myrealm -k housekeeping_private.pem`,
+	Args: cobra.ExactArgs(1),
+	RunE: inspectJwtF,
+	// $1 is the realm given with --realm-name, not the token
+	Annotations: map[string]string{
+		utils.AuthorizationClaimsAnnotation(utils.Housekeeping): "GET::realms/$1",
+	},
+}
+
+func init() {
+	inspectJwtCmd.Flags().StringP("public-key", "p", "", "Path to the PEM encoded public key used to verify the token signature.")
+	inspectJwtCmd.MarkFlagFilename("public-key")
+	inspectJwtCmd.Flags().StringP("realm-name", "r", "",
+		"When set, the public key of this realm is fetched through Housekeeping and used to verify the token signature.")
+	inspectJwtCmd.Flags().StringP("housekeeping-key", "k", "",
+		"Path to housekeeping private key used to fetch the realm public key.")
+	inspectJwtCmd.MarkFlagFilename("housekeeping-key")
+	inspectJwtCmd.Flags().String("housekeeping-url", "",
+		"Housekeeping API base URL. Defaults to <astarte-url>/housekeeping.")
+	output.AddFlag(inspectJwtCmd)
+
+	UtilsCmd.AddCommand(inspectJwtCmd)
+}
+
+func inspectJwtF(command *cobra.Command, args []string) error {
+	tokenString := args[0]
+	publicKey, err := command.Flags().GetString("public-key")
+	if err != nil {
+		return err
+	}
+	realmName, err := command.Flags().GetString("realm-name")
+	if err != nil {
+		return err
+	}
+	if publicKey != "" && realmName != "" {
+		return errors.New("public-key and realm-name are mutually exclusive, you only have to specify one")
+	}
+	outputFormat, err := output.FormatFromFlags(command)
+	if err != nil {
+		return err
+	}
+
+	token, claims, err := utils.ParseAstarteJWT(tokenString)
+	if err != nil {
+		fmt.Printf("Could not decode the token: %s\n", err)
+		os.Exit(1)
+	}
+
+	signatureVerified := publicKey != "" || realmName != ""
+	var signatureErr error
+	if signatureVerified {
+		var publicKeyPEM []byte
+		if publicKey != "" {
+			publicKeyPEM, err = ioutil.ReadFile(publicKey)
+			if err != nil {
+				return err
+			}
+		} else {
+			publicKeyPEM, err = fetchRealmPublicKey(command, realmName)
+			if err != nil {
+				return err
+			}
+		}
+		signatureErr = utils.VerifyAstarteJWTSignature(tokenString, publicKeyPEM)
+	}
+
+	if !outputFormat.IsHumanReadable() {
+		signature := "not verified"
+		if signatureVerified && signatureErr != nil {
+			signature = "invalid"
+		} else if signatureVerified {
+			signature = "valid"
+		}
+		inspection := map[string]interface{}{
+			"header":    token.Header,
+			"claims":    claims,
+			"signature": signature,
+		}
+		t := output.NewTable("Claim", "Value")
+		claimNames := []string{}
+		for k := range claims {
+			claimNames = append(claimNames, k)
+		}
+		sort.Strings(claimNames)
+		for _, k := range claimNames {
+			if timeClaim, ok := utils.GetAstarteJWTTimeClaim(claims, k); ok && (k == "iat" || k == "exp" || k == "nbf") {
+				t.AppendRow(k, outputFormat.Timestamp(timeClaim))
+			} else {
+				t.AppendRow(k, claims[k])
+			}
+		}
+		if err := output.Print(os.Stdout, outputFormat, inspection, t); err != nil {
+			return err
+		}
+		if signatureErr != nil {
+			os.Exit(1)
+		}
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 4, ' ', 0)
+	fmt.Fprintf(w, "Algorithm:\t%v\n", token.Header["alg"])
+	if typ, ok := token.Header["typ"]; ok {
+		fmt.Fprintf(w, "Type:\t%v\n", typ)
+	}
+	if kid, ok := token.Header["kid"]; ok {
+		fmt.Fprintf(w, "Key ID:\t%v\n", kid)
+	}
+	if issuedAt, ok := utils.GetAstarteJWTTimeClaim(claims, "iat"); ok {
+		fmt.Fprintf(w, "Issued At:\t%v (%s ago)\n", issuedAt, time.Since(issuedAt).Round(time.Second))
+	}
+	if notBefore, ok := utils.GetAstarteJWTTimeClaim(claims, "nbf"); ok {
+		fmt.Fprintf(w, "Not Before:\t%v\n", notBefore)
+	}
+	if expiresAt, ok := utils.GetAstarteJWTTimeClaim(claims, "exp"); ok {
+		if time.Now().After(expiresAt) {
+			fmt.Fprintf(w, "Expires At:\t%v (expired %s ago)\n", expiresAt, time.Since(expiresAt).Round(time.Second))
+		} else {
+			fmt.Fprintf(w, "Expires At:\t%v (expires in %s)\n", expiresAt, time.Until(expiresAt).Round(time.Second))
+		}
+	} else {
+		fmt.Fprintf(w, "Expires At:\tnever\n")
+	}
+
+	authorizationClaims := utils.GetAstarteJWTAuthorizationClaims(claims)
+	if len(authorizationClaims) > 0 {
+		astarteServices := []utils.AstarteService{}
+		for astarteService := range authorizationClaims {
+			astarteServices = append(astarteServices, astarteService)
+		}
+		sort.Slice(astarteServices, func(i, j int) bool { return astarteServices[i] < astarteServices[j] })
+
+		fmt.Fprintf(w, "Authorization Claims:")
+		for _, astarteService := range astarteServices {
+			fmt.Fprintf(w, "\t%v (%v): %v\n", astarteService, astarteService.JwtClaim(),
+				strings.Join(authorizationClaims[astarteService], ", "))
+		}
+	} else {
+		fmt.Fprintf(w, "Authorization Claims:\tnone\n")
+	}
+
+	otherClaims := []string{}
+	for k := range claims {
+		if _, err := utils.AstarteServiceFromJwtClaim(k); err == nil {
+			continue
+		}
+		if k == "iat" || k == "exp" || k == "nbf" {
+			continue
+		}
+		otherClaims = append(otherClaims, k)
+	}
+	if len(otherClaims) > 0 {
+		sort.Strings(otherClaims)
+		fmt.Fprintf(w, "Other Claims:")
+		for _, k := range otherClaims {
+			fmt.Fprintf(w, "\t%v: %v\n", k, claims[k])
+		}
+	}
+
+	if !signatureVerified {
+		fmt.Fprintf(w, "Signature:\tnot verified\n")
+		w.Flush()
+		return nil
+	}
+
+	if signatureErr != nil {
+		fmt.Fprintf(w, "Signature:\tINVALID (%s)\n", signatureErr)
+		w.Flush()
+		os.Exit(1)
+	}
+	fmt.Fprintf(w, "Signature:\tvalid\n")
+	w.Flush()
+
+	return nil
+}
+
+func fetchRealmPublicKey(command *cobra.Command, realmName string) ([]byte, error) {
+	viper.BindPFlag("housekeeping.url", command.Flags().Lookup("housekeeping-url"))
+	viper.BindPFlag("housekeeping.key", command.Flags().Lookup("housekeeping-key"))
+
+	housekeepingURLOverride := viper.GetString("housekeeping.url")
+	astarteURL := viper.GetString("url")
+	var astarteAPIClient *client.Client
+	var err error
+	if housekeepingURLOverride != "" {
+		astarteAPIClient, err = client.NewClientWithIndividualURLs("", housekeepingURLOverride, "", "", config.HTTPClient())
+	} else if astarteURL != "" {
+		astarteAPIClient, err = client.NewClient(astarteURL, config.HTTPClient())
+	} else {
+		return nil, errors.New("Either astarte-url or housekeeping-url have to be specified to fetch the realm public key")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	housekeepingKey := viper.GetString("housekeeping.key")
+	housekeepingJwt, err := config.GetExplicitToken()
+	if err != nil {
+		return nil, err
+	}
+	if housekeepingJwt == "" {
+		if housekeepingKey == "" {
+			return nil, errors.New("housekeeping-key or token is required to fetch the realm public key")
+		}
+		housekeepingJwt, err = generateRealmPublicKeyJWT(housekeepingKey, command, realmName)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	realmDetails, err := astarteAPIClient.Housekeeping.GetRealm(realmName, housekeepingJwt)
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(realmDetails.JwtPublicKeyPEM), nil
+}
+
+// generateRealmPublicKeyJWT mints the Housekeeping token used to fetch the public key of realmName, holding only
+// the claims the command declares with least-privilege-tokens
+func generateRealmPublicKeyJWT(privateKey string, command *cobra.Command, realmName string) (string, error) {
+	if !viper.GetBool("least-privilege-tokens") {
+		return utils.GenerateAstarteJWTFromKeyFile(privateKey, utils.Housekeeping, nil, 300)
+	}
+
+	claims := utils.ExpandAuthorizationClaims(command.Annotations, utils.Housekeeping, []string{realmName})
+	return utils.GenerateAstarteJWTFromKeyFile(privateKey, utils.Housekeeping, claims, utils.LeastPrivilegeTokenTTL)
+}
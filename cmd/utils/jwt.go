@@ -0,0 +1,95 @@
+// Copyright © 2019 Ispirata Srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/astarte-platform/astartectl/utils"
+	"github.com/spf13/cobra"
+)
+
+var jwtCmd = &cobra.Command{
+	Use:   "jwt",
+	Short: "Various operations on JWTs",
+}
+
+var jwtCheckCmd = &cobra.Command{
+	Use:   "check <token> <type> <method> <path>",
+	Short: "Checks whether a JWT authorizes an API call",
+	Long: `Evaluates the authorization claims of a JWT for the given Astarte API against a concrete API call,
+the same way Astarte does, and prints which claim authorizes it.
+
+<type> is the Astarte API the call is directed to (housekeeping, realm-management, pairing, appengine, channels).
+<path> can be either the full API path (e.g. /v1/myrealm/devices/2TBn-jNESuuHamE2Zo1anA) or a path relative to the realm
+(e.g. devices/2TBn-jNESuuHamE2Zo1anA). For channels, <method> is either JOIN or WATCH.
+
+The token signature is not verified. Returns 0 if the call is authorized, 1 otherwise.`,
+	Example: `  astartectl utils jwt check eyJhbGciOiJSUzI1NiIsInR5cCI6IkpXVCJ9... appengine GET /v1/myrealm/devices/2TBn-jNESuuHamE2Zo1anA`,
+	Args:    cobra.ExactArgs(4),
+	RunE:    jwtCheckF,
+}
+
+func init() {
+	UtilsCmd.AddCommand(jwtCmd)
+
+	jwtCmd.AddCommand(
+		jwtCheckCmd,
+	)
+}
+
+func jwtCheckF(command *cobra.Command, args []string) error {
+	tokenString := args[0]
+	astarteService, err := utils.AstarteServiceFromString(args[1])
+	if err != nil {
+		return fmt.Errorf("Invalid type. Valid types are: %s", strings.Join(jwtTypes, ", "))
+	}
+	method := strings.ToUpper(args[2])
+	path := args[3]
+
+	_, claims, err := utils.ParseAstarteJWT(tokenString)
+	if err != nil {
+		fmt.Printf("Could not decode the token: %s\n", err)
+		os.Exit(1)
+	}
+	authorizationClaims := utils.GetAstarteJWTAuthorizationClaims(claims)[astarteService]
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 4, ' ', 0)
+	fmt.Fprintf(w, "Evaluated Call:\t%s %s (%s)\n", method, utils.NormalizeAstarteAuthorizationPath(astarteService, path), astarteService)
+	if len(authorizationClaims) == 0 {
+		fmt.Fprintf(w, "Result:\tDENIED (the token has no %s claim)\n", astarteService.JwtClaim())
+		w.Flush()
+		os.Exit(1)
+	}
+
+	matchingClaim, authorized, err := utils.FindAuthorizingAstarteClaim(astarteService, authorizationClaims, method, path)
+	if err != nil {
+		return err
+	}
+	if !authorized {
+		fmt.Fprintf(w, "Result:\tDENIED (no claim matches among %s)\n", strings.Join(authorizationClaims, ", "))
+		w.Flush()
+		os.Exit(1)
+	}
+
+	fmt.Fprintf(w, "Result:\tALLOWED\n")
+	fmt.Fprintf(w, "Matching Claim:\t%s\n", matchingClaim)
+	w.Flush()
+
+	return nil
+}
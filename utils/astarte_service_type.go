@@ -63,6 +63,17 @@ func (astarteService AstarteService) JwtClaim() string {
 	return astarteServiceToJwtClaim[astarteService]
 }
 
+// AstarteServiceFromJwtClaim returns the AstarteService associated to a JWT claim (e.g. a_rma)
+func AstarteServiceFromJwtClaim(jwtClaim string) (AstarteService, error) {
+	for astarteService, claim := range astarteServiceToJwtClaim {
+		if claim == jwtClaim {
+			return astarteService, nil
+		}
+	}
+
+	return Unknown, errors.New("Invalid claim")
+}
+
 // AstarteServiceFromString returns a valid AstarteService out of a string
 func AstarteServiceFromString(astarteServiceString string) (AstarteService, error) {
 	if value, exist := astarteServiceValidNames[astarteServiceString]; exist {
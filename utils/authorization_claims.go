@@ -0,0 +1,94 @@
+package utils
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// AstarteAuthorizationClaim represents a single Astarte authorization claim, in the form METHOD_REGEX::PATH_REGEX
+type AstarteAuthorizationClaim struct {
+	MethodRegex string
+	PathRegex   string
+
+	method *regexp.Regexp
+	path   *regexp.Regexp
+}
+
+// ParseAstarteAuthorizationClaim parses a METHOD_REGEX::PATH_REGEX string into an AstarteAuthorizationClaim.
+// Just like Astarte does, both regular expressions are anchored to the beginning and the end of the string.
+func ParseAstarteAuthorizationClaim(claim string) (AstarteAuthorizationClaim, error) {
+	tokens := strings.SplitN(claim, "::", 2)
+	if len(tokens) != 2 {
+		return AstarteAuthorizationClaim{}, fmt.Errorf("%s is not a valid authorization claim. Claims must be in the form METHOD_REGEX::PATH_REGEX", claim)
+	}
+
+	method, err := regexp.Compile("^" + tokens[0] + "$")
+	if err != nil {
+		return AstarteAuthorizationClaim{}, fmt.Errorf("Invalid method regex in claim %s: %s", claim, err)
+	}
+	path, err := regexp.Compile("^" + tokens[1] + "$")
+	if err != nil {
+		return AstarteAuthorizationClaim{}, fmt.Errorf("Invalid path regex in claim %s: %s", claim, err)
+	}
+
+	return AstarteAuthorizationClaim{MethodRegex: tokens[0], PathRegex: tokens[1], method: method, path: path}, nil
+}
+
+// String returns the claim in its METHOD_REGEX::PATH_REGEX representation
+func (c AstarteAuthorizationClaim) String() string {
+	return c.MethodRegex + "::" + c.PathRegex
+}
+
+// Authorizes returns whether the claim grants access to method on path. path must be already normalized,
+// see NormalizeAstarteAuthorizationPath.
+func (c AstarteAuthorizationClaim) Authorizes(method string, path string) bool {
+	if c.method == nil || c.path == nil {
+		return false
+	}
+	return c.method.MatchString(method) && c.path.MatchString(path)
+}
+
+// NormalizeAstarteAuthorizationPath turns an API path into the form Astarte matches authorization claims against.
+// Astarte strips the API version and, for all realm-scoped APIs, the realm name: as such, /v1/myrealm/devices/xyz
+// becomes devices/xyz for AppEngine, and /v1/realms/myrealm stays realms/myrealm for Housekeeping.
+// Paths which do not start with the API version are assumed to be already relative and are returned as they are,
+// without any leading slash.
+func NormalizeAstarteAuthorizationPath(astarteService AstarteService, path string) string {
+	path = strings.TrimPrefix(path, "/")
+	if !strings.HasPrefix(path, "v1/") {
+		return path
+	}
+
+	tokens := strings.Split(path, "/")
+	switch astarteService {
+	case Housekeeping:
+		tokens = tokens[1:]
+	default:
+		if len(tokens) < 2 {
+			return ""
+		}
+		tokens = tokens[2:]
+	}
+
+	return strings.Join(tokens, "/")
+}
+
+// FindAuthorizingAstarteClaim evaluates a list of authorization claims against a method and a path, the way Astarte
+// does, and returns the first claim authorizing the call. The second return value is false if no claim authorizes it.
+// path is normalized with NormalizeAstarteAuthorizationPath before being evaluated.
+func FindAuthorizingAstarteClaim(astarteService AstarteService, authorizationClaims []string, method string,
+	path string) (AstarteAuthorizationClaim, bool, error) {
+	normalizedPath := NormalizeAstarteAuthorizationPath(astarteService, path)
+	for _, claimString := range authorizationClaims {
+		claim, err := ParseAstarteAuthorizationClaim(claimString)
+		if err != nil {
+			return AstarteAuthorizationClaim{}, false, err
+		}
+		if claim.Authorizes(method, normalizedPath) {
+			return claim, true, nil
+		}
+	}
+
+	return AstarteAuthorizationClaim{}, false, nil
+}
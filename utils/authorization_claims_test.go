@@ -0,0 +1,65 @@
+package utils
+
+import (
+	"testing"
+)
+
+func TestNormalizeAstarteAuthorizationPath(t *testing.T) {
+	testCases := []struct {
+		service  AstarteService
+		path     string
+		expected string
+	}{
+		{AppEngine, "/v1/myrealm/devices/2TBn-jNESuuHamE2Zo1anA", "devices/2TBn-jNESuuHamE2Zo1anA"},
+		{RealmManagement, "v1/myrealm/interfaces", "interfaces"},
+		{Pairing, "/v1/myrealm/agent/devices", "agent/devices"},
+		{Housekeeping, "/v1/realms/myrealm", "realms/myrealm"},
+		{AppEngine, "devices", "devices"},
+		{AppEngine, "/devices", "devices"},
+	}
+
+	for _, tc := range testCases {
+		if p := NormalizeAstarteAuthorizationPath(tc.service, tc.path); p != tc.expected {
+			t.Errorf("Normalizing %s for %v: expected %s, got %s", tc.path, tc.service, tc.expected, p)
+		}
+	}
+}
+
+func TestFindAuthorizingAstarteClaim(t *testing.T) {
+	claims := []string{"GET::devices/.*", "POST::devices/[^/]+/interfaces/com\\.example\\.Commands/.*"}
+
+	testCases := []struct {
+		method        string
+		path          string
+		authorized    bool
+		matchingClaim string
+	}{
+		{"GET", "/v1/myrealm/devices/2TBn-jNESuuHamE2Zo1anA", true, claims[0]},
+		{"POST", "/v1/myrealm/devices/2TBn-jNESuuHamE2Zo1anA/interfaces/com.example.Commands/reboot", true, claims[1]},
+		{"POST", "/v1/myrealm/devices/2TBn-jNESuuHamE2Zo1anA/interfaces/com.example.Other/reboot", false, ""},
+		// Regexes are anchored, so partial matches must not authorize the call
+		{"GETX", "/v1/myrealm/devices/2TBn-jNESuuHamE2Zo1anA", false, ""},
+		{"GET", "/v1/myrealm/groups/devices/test", false, ""},
+	}
+
+	for _, tc := range testCases {
+		claim, authorized, err := FindAuthorizingAstarteClaim(AppEngine, claims, tc.method, tc.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if authorized != tc.authorized {
+			t.Errorf("%s %s: expected authorized to be %v", tc.method, tc.path, tc.authorized)
+		}
+		if authorized && claim.String() != tc.matchingClaim {
+			t.Errorf("%s %s: expected claim %s to match, got %s", tc.method, tc.path, tc.matchingClaim, claim)
+		}
+	}
+}
+
+func TestInvalidAstarteAuthorizationClaim(t *testing.T) {
+	for _, c := range []string{"GET", "GET::devices/(", "[::.*"} {
+		if _, err := ParseAstarteAuthorizationClaim(c); err == nil {
+			t.Errorf("Expected %s to be an invalid claim", c)
+		}
+	}
+}
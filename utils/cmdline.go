@@ -3,6 +3,7 @@ package utils
 import (
 	"bufio"
 	"fmt"
+	"io"
 	"os"
 	"strings"
 )
@@ -31,14 +32,19 @@ func AskForConfirmation(s string) (bool, error) {
 
 // PromptChoice gets input from the user
 func PromptChoice(question string, defaultValue string, allowEmpty bool) (string, error) {
+	return PromptChoiceTo(os.Stdout, question, defaultValue, allowEmpty)
+}
+
+// PromptChoiceTo gets input from the user, printing the question on w
+func PromptChoiceTo(w io.Writer, question string, defaultValue string, allowEmpty bool) (string, error) {
 	reader := bufio.NewReader(os.Stdin)
 
 	for {
-		fmt.Printf(question)
+		fmt.Fprint(w, question)
 		if defaultValue != "" {
-			fmt.Printf(" [%s]", defaultValue)
+			fmt.Fprintf(w, " [%s]", defaultValue)
 		}
-		fmt.Printf(" ")
+		fmt.Fprint(w, " ")
 
 		response, err := reader.ReadString('\n')
 		if err != nil {
@@ -0,0 +1,49 @@
+package utils
+
+import (
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// LeastPrivilegeTokenTTL is the lifetime, in seconds, of tokens minted with the claims declared by a command
+const LeastPrivilegeTokenTTL = 60
+
+// AuthorizationClaimsAnnotation returns the key of the command annotation in which a command declares the
+// authorization claims it needs for a given Astarte Service. The annotation value holds one claim per line, and
+// each claim can reference the command's positional arguments as $1, $2, ... or ${1}, ${2}, ...
+func AuthorizationClaimsAnnotation(astarteService AstarteService) string {
+	return "astarte-platform.org/authorization-claims-" + astarteService.String()
+}
+
+// ExpandAuthorizationClaims returns the authorization claims declared in annotations for astarteService, with
+// references to positional arguments expanded to their escaped, literal values. References to missing arguments
+// expand to a single path token regex. Returns an empty slice if no claims are declared for astarteService.
+func ExpandAuthorizationClaims(annotations map[string]string, astarteService AstarteService, args []string) []string {
+	declaredClaims, ok := annotations[AuthorizationClaimsAnnotation(astarteService)]
+	if !ok {
+		return []string{}
+	}
+
+	claims := []string{}
+	for _, claim := range strings.Split(declaredClaims, "\n") {
+		claim = strings.TrimSpace(claim)
+		if claim == "" {
+			continue
+		}
+		claims = append(claims, os.Expand(claim, func(name string) string {
+			index, err := strconv.Atoi(name)
+			if err != nil {
+				// Not a reference to an argument, leave it untouched
+				return "$" + name
+			}
+			if index < 1 || index > len(args) {
+				return "[^/]+"
+			}
+			return regexp.QuoteMeta(args[index-1])
+		}))
+	}
+
+	return claims
+}
@@ -0,0 +1,28 @@
+package utils
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestExpandAuthorizationClaims(t *testing.T) {
+	annotations := map[string]string{
+		AuthorizationClaimsAnnotation(AppEngine): "GET::devices/$1\nGET::devices/$1/interfaces/$2(${3})?",
+	}
+
+	claims := ExpandAuthorizationClaims(annotations, AppEngine, []string{"2TBn-jNESuuHamE2Zo1anA", "com.my.Interface"})
+	expected := []string{"GET::devices/2TBn-jNESuuHamE2Zo1anA", "GET::devices/2TBn-jNESuuHamE2Zo1anA/interfaces/com\\.my\\.Interface([^/]+)?"}
+	if !reflect.DeepEqual(claims, expected) {
+		t.Errorf("Expected %v, got %v", expected, claims)
+	}
+
+	if claims := ExpandAuthorizationClaims(annotations, RealmManagement, nil); len(claims) != 0 {
+		t.Errorf("Expected no claims for Realm Management, got %v", claims)
+	}
+
+	// Expanded claims must authorize the call they were declared for
+	claims = ExpandAuthorizationClaims(annotations, AppEngine, []string{"2TBn-jNESuuHamE2Zo1anA", "com.my.Interface", "/my/path"})
+	if _, ok, _ := FindAuthorizingAstarteClaim(AppEngine, claims, "GET", "/v1/test/devices/2TBn-jNESuuHamE2Zo1anA/interfaces/com.my.Interface/my/path"); !ok {
+		t.Errorf("Expected %v to authorize the call", claims)
+	}
+}
@@ -0,0 +1,11 @@
+package utils
+
+import "regexp"
+
+var realmNameRegexp = regexp.MustCompile(`^[a-z][a-z0-9]{0,47}$`)
+
+// IsValidAstarteRealmName returns whether name is a valid Astarte realm name: up to 48 lowercase letters and
+// digits, starting with a letter
+func IsValidAstarteRealmName(name string) bool {
+	return realmNameRegexp.MatchString(name)
+}
@@ -1,6 +1,8 @@
 package utils
 
 import (
+	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"time"
 
@@ -21,26 +23,58 @@ func GenerateAstarteJWTFromKeyFile(privateKeyFile string, astarteService Astarte
 // GenerateAstarteJWTFromPEMKey generates an Astarte Token for a specific API out of a Private Key PEM bytearray
 func GenerateAstarteJWTFromPEMKey(privateKeyPEM []byte, astarteService AstarteService,
 	authorizationClaims []string, ttlSeconds int64) (jwtString string, err error) {
-	key, err := jwt.ParseRSAPrivateKeyFromPEM(privateKeyPEM)
+	return generateAstarteJWT(privateKeyPEM, map[AstarteService][]string{astarteService: authorizationClaims}, ttlSeconds)
+}
+
+// GenerateMultiServiceAstarteJWTFromKeyFile generates an all-access Astarte Token valid for several APIs at once
+// out of a Private Key File
+func GenerateMultiServiceAstarteJWTFromKeyFile(privateKeyFile string, astarteServices []AstarteService,
+	ttlSeconds int64) (jwtString string, err error) {
+	keyPEM, err := ioutil.ReadFile(privateKeyFile)
 	if err != nil {
 		return "", err
 	}
 
-	accessClaimKey := astarteService.JwtClaim()
+	servicesClaims := map[AstarteService][]string{}
+	for _, astarteService := range astarteServices {
+		servicesClaims[astarteService] = nil
+	}
+	return generateAstarteJWT(keyPEM, servicesClaims, ttlSeconds)
+}
 
-	if len(authorizationClaims) == 0 {
-		switch astarteService {
-		case Channels:
-			authorizationClaims = []string{"JOIN::.*", "WATCH::.*"}
-		default:
-			authorizationClaims = []string{"^.*$::^.*$"}
-		}
+// GenerateMultiServiceAstarteJWTWithClaimsFromKeyFile generates an Astarte Token valid for several APIs at once, each
+// with its own authorization claims, out of a Private Key File
+func GenerateMultiServiceAstarteJWTWithClaimsFromKeyFile(privateKeyFile string, servicesClaims map[AstarteService][]string,
+	ttlSeconds int64) (jwtString string, err error) {
+	keyPEM, err := ioutil.ReadFile(privateKeyFile)
+	if err != nil {
+		return "", err
+	}
+
+	return generateAstarteJWT(keyPEM, servicesClaims, ttlSeconds)
+}
+
+func generateAstarteJWT(privateKeyPEM []byte, servicesClaims map[AstarteService][]string,
+	ttlSeconds int64) (jwtString string, err error) {
+	key, err := jwt.ParseRSAPrivateKeyFromPEM(privateKeyPEM)
+	if err != nil {
+		return "", err
 	}
 
 	now := time.Now().UTC().Unix()
 	mapClaims := jwt.MapClaims{
-		accessClaimKey: authorizationClaims,
-		"iat":          now,
+		"iat": now,
+	}
+	for astarteService, authorizationClaims := range servicesClaims {
+		if len(authorizationClaims) == 0 {
+			switch astarteService {
+			case Channels:
+				authorizationClaims = []string{"JOIN::.*", "WATCH::.*"}
+			default:
+				authorizationClaims = []string{"^.*$::^.*$"}
+			}
+		}
+		mapClaims[astarteService.JwtClaim()] = authorizationClaims
 	}
 	if ttlSeconds > 0 {
 		exp := now + ttlSeconds
@@ -56,3 +90,81 @@ func GenerateAstarteJWTFromPEMKey(privateKeyPEM []byte, astarteService AstarteSe
 
 	return tokenString, nil
 }
+
+// ParseAstarteJWT decodes an Astarte Token without verifying its signature. It returns the decoded
+// token, whose Header and Claims can be inspected, and its claims as a MapClaims.
+func ParseAstarteJWT(tokenString string) (*jwt.Token, jwt.MapClaims, error) {
+	claims := jwt.MapClaims{}
+	token, _, err := new(jwt.Parser).ParseUnverified(tokenString, claims)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return token, claims, nil
+}
+
+// VerifyAstarteJWTSignature verifies the signature of an Astarte Token against a PEM encoded public key.
+// Both RSA and ECDSA keys are supported. Claims such as expiry are not validated by this function.
+func VerifyAstarteJWTSignature(tokenString string, publicKeyPEM []byte) error {
+	parser := &jwt.Parser{SkipClaimsValidation: true}
+	_, err := parser.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		switch token.Method.(type) {
+		case *jwt.SigningMethodRSA:
+			return jwt.ParseRSAPublicKeyFromPEM(publicKeyPEM)
+		case *jwt.SigningMethodECDSA:
+			return jwt.ParseECPublicKeyFromPEM(publicKeyPEM)
+		}
+		return nil, fmt.Errorf("Unsupported signing method %v", token.Header["alg"])
+	})
+
+	return err
+}
+
+// GetAstarteJWTAuthorizationClaims returns all the authorization claims contained in the Token's claims,
+// grouped by the Astarte Service they refer to. Claims which do not map to any Astarte Service are ignored.
+func GetAstarteJWTAuthorizationClaims(claims jwt.MapClaims) map[AstarteService][]string {
+	ret := map[AstarteService][]string{}
+	for claimKey, claimValue := range claims {
+		astarteService, err := AstarteServiceFromJwtClaim(claimKey)
+		if err != nil {
+			continue
+		}
+
+		authorizationClaims := []string{}
+		switch v := claimValue.(type) {
+		case []interface{}:
+			for _, c := range v {
+				authorizationClaims = append(authorizationClaims, fmt.Sprintf("%v", c))
+			}
+		case []string:
+			authorizationClaims = append(authorizationClaims, v...)
+		case string:
+			authorizationClaims = append(authorizationClaims, v)
+		}
+		ret[astarteService] = authorizationClaims
+	}
+
+	return ret
+}
+
+// GetAstarteJWTTimeClaim returns a time-based claim (such as "iat" or "exp") of a Token as a time.Time.
+// The second return value is false if the claim is not present or is not a valid timestamp.
+func GetAstarteJWTTimeClaim(claims jwt.MapClaims, claim string) (time.Time, bool) {
+	var timestamp int64
+	switch v := claims[claim].(type) {
+	case float64:
+		timestamp = int64(v)
+	case int64:
+		timestamp = v
+	case json.Number:
+		var err error
+		timestamp, err = v.Int64()
+		if err != nil {
+			return time.Time{}, false
+		}
+	default:
+		return time.Time{}, false
+	}
+
+	return time.Unix(timestamp, 0), true
+}